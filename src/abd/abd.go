@@ -0,0 +1,275 @@
+package abd
+
+import (
+	"encoding/binary"
+	"gus-epaxos/src/abdproto"
+	"gus-epaxos/src/dlog"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/state"
+	"log"
+)
+
+// Classic multi-writer ABD, as a baseline for Gus. The replica a client
+// connects to runs its operations in two phases, each waiting for a
+// majority. In the first, it asks for the highest tag and value of the key.
+// In the second, a write stores its value under a tag above the highest, and
+// a read writes back the value it returns, so that no later read returns an
+// older one. Tags are ordered as in Gus, but are counters rather than clock
+// readings.
+
+const TRUE = uint8(1)
+const FALSE = uint8(0)
+
+type Replica struct {
+	*genericsmr.Replica // extends a generic Paxos replica
+	readChan            chan fastrpc.Serializable
+	ackReadChan         chan fastrpc.Serializable
+	writeChan           chan fastrpc.Serializable
+	ackWriteChan        chan fastrpc.Serializable
+	readRPC             uint8
+	ackReadRPC          uint8
+	writeRPC            uint8
+	ackWriteRPC         uint8
+	storage             map[state.Key]register
+	currentSeq          int32
+	bookkeeping         map[int32]*OpsBookkeeping // operations in progress, by seq
+}
+
+// register is the latest value of a key this replica stores
+type register struct {
+	tag   gusproto.Tag
+	value state.Value
+}
+
+type OpsBookkeeping struct {
+	proposal *genericsmr.Propose
+	key      state.Key
+	writing  bool // in the second phase?
+	acks     []bool
+	ackCount int
+	tag      gusproto.Tag // highest tag reported, then the tag written
+	value    state.Value  // with it
+}
+
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable)
+
+	go r.run()
+
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0,
+		make(map[state.Key]register),
+		0,
+		make(map[int32]*OpsBookkeeping)}
+
+	r.Durable = durable
+
+	r.readRPC = r.RegisterRPC(new(abdproto.Read), r.readChan)
+	r.ackReadRPC = r.RegisterRPC(new(abdproto.AckRead), r.ackReadChan)
+	r.writeRPC = r.RegisterRPC(new(abdproto.Write), r.writeChan)
+	r.ackWriteRPC = r.RegisterRPC(new(abdproto.AckWrite), r.ackWriteChan)
+
+	return r
+}
+
+// recordWrite logs a key/tag/value triple to the stable store
+func (r *Replica) recordWrite(key state.Key, tag gusproto.Tag, value state.Value) {
+	if !r.Durable {
+		return
+	}
+
+	var b [28]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(tag.Timestamp))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(tag.WriterID))
+	binary.LittleEndian.PutUint64(b[20:28], uint64(value))
+	r.StableStore.Write(b[:])
+}
+
+// sync with the stable store
+func (r *Replica) sync() {
+	if !r.Durable {
+		return
+	}
+
+	r.StableStore.Sync()
+}
+
+/* Main event processing loop */
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+
+	dlog.Println("Waiting for client connections")
+
+	go r.WaitForClientConnections()
+
+	for !r.Shutdown {
+
+		select {
+
+		case propose := <-r.ProposeChan:
+			//got a Propose from a client
+			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
+			r.handlePropose(propose)
+			break
+
+		case readS := <-r.readChan:
+			read := readS.(*abdproto.Read)
+			//got a Read message
+			dlog.Printf("Received Read from replica %d, for key %d\n", read.ReaderID, read.Key)
+			r.handleRead(read)
+			break
+
+		case ackReadS := <-r.ackReadChan:
+			ackRead := ackReadS.(*abdproto.AckRead)
+			//got a Read reply
+			dlog.Printf("Received AckRead from replica %d, for operation %d\n", ackRead.Sender, ackRead.Seq)
+			r.handleAckRead(ackRead)
+			break
+
+		case writeS := <-r.writeChan:
+			write := writeS.(*abdproto.Write)
+			//got a Write message
+			dlog.Printf("Received Write from replica %d, for key %d\n", write.WriterID, write.Command.K)
+			r.handleWrite(write)
+			break
+
+		case ackWriteS := <-r.ackWriteChan:
+			ackWrite := ackWriteS.(*abdproto.AckWrite)
+			//got a Write reply
+			dlog.Printf("Received AckWrite from replica %d, for operation %d\n", ackWrite.Sender, ackWrite.Seq)
+			r.handleAckWrite(ackWrite)
+			break
+		}
+	}
+}
+
+// handlePropose starts the first phase of a client operation
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	seq := r.currentSeq
+	r.currentSeq++
+	key := propose.Command.K
+	r.bookkeeping[seq] = &OpsBookkeeping{propose, key, false, make([]bool, r.N), 0, gusproto.Tag{0, 0}, state.NIL}
+
+	read := &abdproto.Read{seq, r.Id, key}
+	r.bcastAll(r.readRPC, read)
+	r.handleRead(read)
+}
+
+func (r *Replica) handleRead(read *abdproto.Read) {
+	reg := r.storage[read.Key]
+	ack := &abdproto.AckRead{read.Seq, read.ReaderID, r.Id, reg.tag, reg.value}
+	if read.ReaderID == r.Id {
+		r.handleAckRead(ack)
+		return
+	}
+	r.SendMsg(read.ReaderID, r.ackReadRPC, ack)
+}
+
+func (r *Replica) handleAckRead(ack *abdproto.AckRead) {
+	op := r.bookkeeping[ack.Seq]
+	if op == nil || op.writing || op.acks[ack.Sender] {
+		// we've moved on, these are delayed replies, so just ignore
+		return
+	}
+	op.acks[ack.Sender] = true
+	op.ackCount++
+	if ack.CurrentTag.GreaterThan(op.tag) {
+		op.tag = ack.CurrentTag
+		op.value = ack.Value
+	}
+	if op.ackCount > r.N>>1 {
+		r.startSecondPhase(ack.Seq, op)
+	}
+}
+
+// startSecondPhase stores the value of a write under a higher tag than any a
+// majority has, or writes back the value a read returns
+func (r *Replica) startSecondPhase(seq int32, op *OpsBookkeeping) {
+	op.writing = true
+	op.acks = make([]bool, r.N)
+	op.ackCount = 0
+
+	cmd := state.Command{state.PUT, op.key, op.value}
+	if op.proposal.Command.Op != state.GET {
+		op.tag = gusproto.Tag{op.tag.Timestamp + 1, r.Id}
+		op.value = op.proposal.Command.V
+		cmd = op.proposal.Command
+	}
+
+	write := &abdproto.Write{seq, r.Id, op.tag, cmd}
+	r.bcastAll(r.writeRPC, write)
+	r.handleWrite(write)
+}
+
+func (r *Replica) handleWrite(write *abdproto.Write) {
+	key := write.Command.K
+	if write.Tag.GreaterThan(r.storage[key].tag) {
+		r.storage[key] = register{write.Tag, write.Command.V}
+		r.recordWrite(key, write.Tag, write.Command.V)
+		r.sync()
+	}
+
+	ack := &abdproto.AckWrite{write.Seq, write.WriterID, r.Id}
+	if write.WriterID == r.Id {
+		r.handleAckWrite(ack)
+		return
+	}
+	r.SendMsg(write.WriterID, r.ackWriteRPC, ack)
+}
+
+func (r *Replica) handleAckWrite(ack *abdproto.AckWrite) {
+	op := r.bookkeeping[ack.Seq]
+	if op == nil || !op.writing || op.acks[ack.Sender] {
+		// we've moved on, these are delayed replies, so just ignore
+		return
+	}
+	op.acks[ack.Sender] = true
+	op.ackCount++
+	if op.ackCount <= r.N>>1 {
+		return
+	}
+
+	delete(r.bookkeeping, ack.Seq)
+	val := state.NIL
+	if op.proposal.Command.Op == state.GET {
+		val = op.value
+	}
+	propreply := &genericsmrproto.ProposeReplyTS{
+		TRUE,
+		op.proposal.CommandId,
+		val,
+		op.proposal.Timestamp}
+	r.ReplyProposeTS(propreply, op.proposal.Reply)
+}
+
+/**********************************************************************
+                    inter-replica communication
+***********************************************************************/
+
+func (r *Replica) bcastAll(whichRPC uint8, msg fastrpc.Serializable) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Bcast failed:", err)
+		}
+	}()
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q] {
+			continue
+		}
+		r.SendMsg(q, whichRPC, msg)
+	}
+}
@@ -0,0 +1,95 @@
+package abd
+
+import (
+	"bytes"
+	"gus-epaxos/src/abdproto"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+// testNet runs the ABD handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, true)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.readRPC:     new(abdproto.Read),
+		r.ackReadRPC:  new(abdproto.AckRead),
+		r.writeRPC:    new(abdproto.Write),
+		r.ackWriteRPC: new(abdproto.AckWrite),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *abdproto.Read:
+			r.handleRead(m)
+		case *abdproto.AckRead:
+			r.handleAckRead(m)
+		case *abdproto.Write:
+			r.handleWrite(m)
+		case *abdproto.AckWrite:
+			r.handleAckWrite(m)
+		}
+	}
+	return net
+}
+
+// propose hands an operation to a replica, and returns where its reply goes
+func (net *testNet) propose(id int, op state.Operation, key state.Key, val state.Value) *bytes.Buffer {
+	propose, reply := smrtest.Propose(int32(val), state.Command{op, key, val})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+func TestReadYourWrite(t *testing.T) {
+	net := newTestNet(t, 3)
+	net.Down[2] = true
+
+	// a majority is enough for both phases
+	reply := net.propose(0, state.PUT, 7, 70)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 70, TRUE, state.NIL)
+
+	reply = net.propose(1, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	net := newTestNet(t, 3)
+
+	// both writers see the same highest tag, and the replica id breaks the tie
+	reply1 := net.propose(0, state.PUT, 7, 10)
+	reply2 := net.propose(1, state.PUT, 7, 20)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply1, 10, TRUE, state.NIL)
+	smrtest.CheckReply(t, reply2, 20, TRUE, state.NIL)
+
+	for _, r := range net.replicas {
+		if reg := r.storage[7]; reg.value != 20 || reg.tag.WriterID != 1 {
+			t.Fatalf("replica %d stores %d with tag %+v", r.Id, reg.value, reg.tag)
+		}
+	}
+
+	// a read returns the value with the highest tag, and writes it back
+	net.replicas[2].storage[7] = register{}
+	net.Down[1] = true
+	reply := net.propose(2, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 20)
+	if net.replicas[2].storage[7].value != 20 {
+		t.Fatalf("replica 2 did not store the value it read")
+	}
+}
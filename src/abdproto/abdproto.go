@@ -0,0 +1,38 @@
+package abdproto
+
+import (
+	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/state"
+)
+
+// Multi-writer ABD. Both reads and writes query a majority for the highest
+// tag of the key with a Read, then store a tag and value at a majority with
+// a Write. Tags are ordered as in Gus.
+
+type Read struct {
+	Seq      int32
+	ReaderID int32
+	Key      state.Key
+}
+
+type AckRead struct {
+	Seq        int32
+	ReaderID   int32
+	Sender     int32
+	CurrentTag gusproto.Tag
+	Value      state.Value
+}
+
+// Write stores a new value, or writes back the value a read returns
+type Write struct {
+	Seq      int32
+	WriterID int32
+	Tag      gusproto.Tag
+	Command  state.Command
+}
+
+type AckWrite struct {
+	Seq      int32
+	WriterID int32
+	Sender   int32
+}
@@ -0,0 +1,299 @@
+package abdproto
+
+import (
+	"gus-epaxos/src/fastrpc"
+	"io"
+	"sync"
+)
+
+func (t *Read) New() fastrpc.Serializable {
+	return new(Read)
+}
+func (t *Read) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type ReadCache struct {
+	mu    sync.Mutex
+	cache []*Read
+}
+
+func NewReadCache() *ReadCache {
+	c := &ReadCache{}
+	c.cache = make([]*Read, 0)
+	return c
+}
+
+func (p *ReadCache) Get() *Read {
+	var t *Read
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Read{}
+	}
+	return t
+}
+func (p *ReadCache) Put(t *Read) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Read) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Seq
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.ReaderID
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *Read) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.ReaderID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	if err := t.Key.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *AckRead) New() fastrpc.Serializable {
+	return new(AckRead)
+}
+func (t *AckRead) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AckReadCache struct {
+	mu    sync.Mutex
+	cache []*AckRead
+}
+
+func NewAckReadCache() *AckReadCache {
+	c := &AckReadCache{}
+	c.cache = make([]*AckRead, 0)
+	return c
+}
+
+func (p *AckReadCache) Get() *AckRead {
+	var t *AckRead
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AckRead{}
+	}
+	return t
+}
+func (p *AckReadCache) Put(t *AckRead) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AckRead) Marshal(wire io.Writer) {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	tmp32 := t.Seq
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.ReaderID
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.Sender
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.CurrentTag.Marshal(wire)
+	t.Value.Marshal(wire)
+}
+
+func (t *AckRead) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.ReaderID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Sender = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	if err := t.CurrentTag.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Write) New() fastrpc.Serializable {
+	return new(Write)
+}
+func (t *Write) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type WriteCache struct {
+	mu    sync.Mutex
+	cache []*Write
+}
+
+func NewWriteCache() *WriteCache {
+	c := &WriteCache{}
+	c.cache = make([]*Write, 0)
+	return c
+}
+
+func (p *WriteCache) Get() *Write {
+	var t *Write
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Write{}
+	}
+	return t
+}
+func (p *WriteCache) Put(t *Write) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Write) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Seq
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Tag.Marshal(wire)
+	t.Command.Marshal(wire)
+}
+
+func (t *Write) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	if err := t.Tag.Unmarshal(wire); err != nil {
+		return err
+	}
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *AckWrite) New() fastrpc.Serializable {
+	return new(AckWrite)
+}
+func (t *AckWrite) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+type AckWriteCache struct {
+	mu    sync.Mutex
+	cache []*AckWrite
+}
+
+func NewAckWriteCache() *AckWriteCache {
+	c := &AckWriteCache{}
+	c.cache = make([]*AckWrite, 0)
+	return c
+}
+
+func (p *AckWriteCache) Get() *AckWrite {
+	var t *AckWrite
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AckWrite{}
+	}
+	return t
+}
+func (p *AckWriteCache) Put(t *AckWrite) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AckWrite) Marshal(wire io.Writer) {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	tmp32 := t.Seq
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.Sender
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *AckWrite) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	var bs []byte
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Sender = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	return nil
+}
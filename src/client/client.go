@@ -21,6 +21,7 @@ import (
 
 var leaderAddr *string = flag.String("laddr", "10.10.1.2", "Leader address. Defaults to 10.10.1.2")
 var leaderPort *int = flag.Int("lport", 7070, "Leader port.")
+var forwarded = flag.Bool("forwarded", false, "Send writes to the server too, which forwards them to the leader (Paxos), instead of connecting to the leader.")
 var serverCount *int = flag.Int("serverCount", 5, "number of servers in experiment")
 var serverAddr *string = flag.String("saddr", "", "Server address.")
 var serverPort *int = flag.Int("sport", 7070, "Server port.")
@@ -94,7 +95,7 @@ func main() {
 			make(map[int32]time.Time, *outstandingReqs),
 			make(map[int32]state.Operation, *outstandingReqs)}
 
-		if *serverID != 0 { // not already connected to leader
+		if *serverID != 0 && !*forwarded { // not already connected to leader
 			leader, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *leaderAddr, *leaderPort))
 			if err != nil {
 				log.Fatalf("Error connecting to replica %s:%d\n", *leaderAddr, *leaderPort)
@@ -183,7 +184,7 @@ func simulatedClientWriter(writer *bufio.Writer, lWriter *bufio.Writer, orInfo *
 		}
 
 		before := time.Now()
-		if (args.Command.Op == state.RMW || args.Command.Op == state.PUT) && serverID != 0 { // send RMWs to leader
+		if (args.Command.Op == state.RMW || args.Command.Op == state.PUT) && lWriter != nil { // send RMWs to leader
 			lWriter.WriteByte(genericsmrproto.PROPOSE)
 			args.Marshal(lWriter)
 			lWriter.Flush()
@@ -1,154 +1,379 @@
 package epaxos
 
 import (
-	//    "state"
+	"gus-epaxos/src/dlog"
 	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/genericsmr"
 	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/state"
+	"runtime"
 	"sort"
 	"time"
 )
 
-const (
-	WHITE int8 = iota
-	GRAY
-	BLACK
-)
+// The executor runs in its own goroutine and never reads InstanceSpace, which
+// belongs to the event loop. The event loop hands every committed instance
+// over as an execNode on Exec.committed (see notifyCommitted), and the
+// executor reports how far it has executed on Replica.executedChan.
+//
+// Committed instances that are not executed yet form the dependency graph.
+// When an instance commits, Tarjan's algorithm is run from it and from the
+// instances that were waiting for it. A run that reaches an instance that is
+// not committed yet stops, and its root waits for that instance in turn, so no
+// part of the graph is explored again until something it depends on commits.
+//
+// Only dependencies on conflicting commands are followed. The commands of an
+// instance that is not committed yet are known from its PreAccept: recovery
+// can only commit them or a NO-OP, so a dependency that does not conflict with
+// them does not have to wait for the commit either.
+//
+// Components are handed to a pool of workers, each of which owns the keys
+// hashed to it and a shard of the state. Conflicting commands are on the same
+// key, so they reach the same worker in dependency order, while commands on
+// other keys execute in parallel.
 
-type Exec struct {
-	r *Replica
+// How often the executor looks for dependencies that never commit
+const STALL_CHECK_PERIOD = COMMIT_GRACE_PERIOD / 10
+
+// execNode is the executor's copy of a committed instance
+type execNode struct {
+	replica   int32
+	instance  int32
+	cmds      []state.Command
+	seq       int32
+	deps      []int32
+	proposals []*genericsmr.Propose
+	committed bool // otherwise only cmds are known
+	index     int
+	lowlink   int
+	onStack   bool
 }
 
-type SCComponent struct {
-	nodes []*Instance
-	color int8
+// execBatch is the part of a component that falls on one worker's keys
+type execBatch struct {
+	cmds      []state.Command
+	proposals []*genericsmr.Propose // nil where no client waits for a reply
 }
 
-func (e *Exec) executeCommand(replica int32, instance int32) bool {
-	if e.r.InstanceSpace[replica][instance] == nil {
-		return false
-	}
-	inst := e.r.InstanceSpace[replica][instance]
-	if inst.Status == epaxosproto.EXECUTED {
-		return true
+type Exec struct {
+	r            *Replica
+	committed    chan *execNode
+	nodes        []map[int32]*execNode       // committed but not executed, per replica
+	proposed     []map[int32][]state.Command // commands of instances that are not committed yet
+	executedUpTo []int32                     // every instance up to this one has been executed
+	executed     []map[int32]bool            // executed instances above executedUpTo
+	reported     []int32                     // executedUpTo as last sent to the event loop
+	waiters      map[instanceId][]*execNode
+	waitingSince map[instanceId]time.Time
+	stack        []*execNode
+	index        int
+	workers      []chan *execBatch
+	shards       []*state.State
+}
+
+func newExec(r *Replica) *Exec {
+	e := &Exec{
+		r,
+		make(chan *execNode, genericsmr.CHAN_BUFFER_SIZE),
+		make([]map[int32]*execNode, r.N),
+		make([]map[int32][]state.Command, r.N),
+		make([]int32, r.N),
+		make([]map[int32]bool, r.N),
+		make([]int32, r.N),
+		make(map[instanceId][]*execNode),
+		make(map[instanceId]time.Time),
+		make([]*execNode, 0, 100),
+		0,
+		make([]chan *execBatch, runtime.GOMAXPROCS(0)),
+		make([]*state.State, runtime.GOMAXPROCS(0))}
+	for q := 0; q < r.N; q++ {
+		e.nodes[q] = make(map[int32]*execNode)
+		e.proposed[q] = make(map[int32][]state.Command)
+		e.executedUpTo[q] = -1
+		e.executed[q] = make(map[int32]bool)
+		e.reported[q] = -1
 	}
-	if inst.Status != epaxosproto.COMMITTED {
-		return false
+	for w := range e.workers {
+		e.workers[w] = make(chan *execBatch, genericsmr.CHAN_BUFFER_SIZE)
+		e.shards[w] = state.InitState()
 	}
+	return e
+}
 
-	if !e.findSCC(inst) {
-		return false
+func (e *Exec) run() {
+	for w := range e.workers {
+		go e.worker(w)
 	}
 
-	return true
-}
+	stallTicker := time.NewTicker(STALL_CHECK_PERIOD)
+	defer stallTicker.Stop()
 
-var stack []*Instance = make([]*Instance, 0, 100)
+	for !e.r.Shutdown {
+		select {
+		case node := <-e.committed:
+			e.add(node)
+			// take whatever else committed before reporting progress
+			for len(e.committed) > 0 {
+				e.add(<-e.committed)
+			}
+			e.reportExecuted()
 
-func (e *Exec) findSCC(root *Instance) bool {
-	index := 1
-	//find SCCs using Tarjan's algorithm
-	stack = stack[0:0]
-	return e.strongconnect(root, &index)
+		case <-stallTicker.C:
+			e.recoverStalled()
+		}
+	}
 }
 
-func (e *Exec) strongconnect(v *Instance, index *int) bool {
-	v.Index = *index
-	v.Lowlink = *index
-	*index = *index + 1
+func (e *Exec) isExecuted(replica int32, instance int32) bool {
+	return instance <= e.executedUpTo[replica] || e.executed[replica][instance]
+}
 
-	l := len(stack)
-	if l == cap(stack) {
-		newSlice := make([]*Instance, l, 2*l)
-		copy(newSlice, stack)
-		stack = newSlice
+// add adds a committed node to the graph, or records the commands of an
+// instance that is not committed yet, and executes every component that this
+// completes
+func (e *Exec) add(node *execNode) {
+	if e.isExecuted(node.replica, node.instance) || e.nodes[node.replica][node.instance] != nil {
+		// the event loop may hand an instance over more than once
+		return
 	}
-	stack = stack[0 : l+1]
-	stack[l] = v
 
-	for q := int32(0); q < int32(e.r.N); q++ {
-		inst := v.Deps[q]
-		for i := e.r.ExecedUpTo[q] + 1; i <= inst; i++ {
-			for e.r.InstanceSpace[q][i] == nil || e.r.InstanceSpace[q][i].Cmds == nil || v.Cmds == nil {
-				time.Sleep(1000 * 1000)
+	id := instanceId{node.replica, node.instance}
+	roots := e.waiters[id]
+	delete(e.waiters, id)
+
+	if node.committed {
+		delete(e.waitingSince, id)
+		delete(e.proposed[node.replica], node.instance)
+		e.nodes[node.replica][node.instance] = node
+		roots = append([]*execNode{node}, roots...)
+	} else {
+		e.proposed[node.replica][node.instance] = node.cmds
+	}
+
+	for _, root := range roots {
+		if e.nodes[root.replica][root.instance] != root {
+			// executed as part of an earlier root's component
+			continue
+		}
+		if blocker, ok := e.findSCC(root); !ok {
+			if _, waiting := e.waitingSince[blocker]; !waiting {
+				e.waitingSince[blocker] = time.Now()
 			}
-			/*        if !state.Conflict(v.Command, e.r.InstanceSpace[q][i].Command) {
-			          continue
-			          }
-			*/
-			if e.r.InstanceSpace[q][i].Status == epaxosproto.EXECUTED {
+			e.waiters[blocker] = append(e.waiters[blocker], root)
+		}
+	}
+}
+
+// findSCC runs Tarjan's algorithm from root, executing each strongly
+// connected component as soon as it is found. If the search reaches an
+// instance that is not committed yet, it returns that instance.
+func (e *Exec) findSCC(root *execNode) (instanceId, bool) {
+	e.index = 1
+	e.stack = e.stack[0:0]
+	blocker, ok := e.strongconnect(root)
+	if !ok {
+		// the components that were found have executed, the rest is retried
+		for _, w := range e.stack {
+			w.index = 0
+			w.onStack = false
+		}
+		e.stack = e.stack[0:0]
+	}
+	return blocker, ok
+}
+
+func (e *Exec) strongconnect(v *execNode) (instanceId, bool) {
+	v.index = e.index
+	v.lowlink = e.index
+	e.index++
+
+	l := len(e.stack)
+	e.stack = append(e.stack, v)
+	v.onStack = true
+
+	// a NO-OP conflicts with nothing, so it need not wait for its deps
+	for q := int32(0); q < int32(e.r.N) && len(v.cmds) > 0; q++ {
+		for i := e.executedUpTo[q] + 1; i <= v.deps[q]; i++ {
+			// components found deeper down may have moved executedUpTo past i
+			if e.isExecuted(q, i) {
 				continue
 			}
-			for e.r.InstanceSpace[q][i].Status != epaxosproto.COMMITTED {
-				time.Sleep(1000 * 1000)
-			}
-			w := e.r.InstanceSpace[q][i]
-
-			if w.Index == 0 {
-				//e.strongconnect(w, index)
-				if !e.strongconnect(w, index) {
-					for j := l; j < len(stack); j++ {
-						stack[j].Index = 0
-					}
-					stack = stack[0:l]
-					return false
+			w := e.nodes[q][i]
+			if w == nil {
+				if cmds, known := e.proposed[q][i]; known && !state.ConflictBatch(v.cmds, cmds) {
+					continue
 				}
-				if w.Lowlink < v.Lowlink {
-					v.Lowlink = w.Lowlink
+				return instanceId{q, i}, false
+			}
+			if !state.ConflictBatch(v.cmds, w.cmds) {
+				continue
+			}
+
+			if w.index == 0 {
+				if blocker, ok := e.strongconnect(w); !ok {
+					return blocker, false
 				}
-			} else { //if e.inStack(w)  //<- probably unnecessary condition, saves a linear search
-				if w.Index < v.Lowlink {
-					v.Lowlink = w.Index
+				if w.lowlink < v.lowlink {
+					v.lowlink = w.lowlink
 				}
+			} else if w.onStack && w.index < v.lowlink {
+				v.lowlink = w.index
 			}
 		}
 	}
 
-	if v.Lowlink == v.Index {
+	if v.lowlink == v.index {
 		//found SCC
-		list := stack[l:len(stack)]
+		list := e.stack[l:len(e.stack)]
 
 		//execute commands in the increasing order of the Seq field
 		sort.Sort(nodeArray(list))
 		for _, w := range list {
-			for w.Cmds == nil {
-				time.Sleep(1000 * 1000)
-			}
-			for idx := 0; idx < len(w.Cmds); idx++ {
-				val := w.Cmds[idx].Execute(e.r.State)
-				if e.r.Dreply && w.lb != nil && w.lb.clientProposals != nil {
-					e.r.ReplyProposeTS(
-						&genericsmrproto.ProposeReplyTS{
-							TRUE,
-							w.lb.clientProposals[idx].CommandId,
-							val,
-							w.lb.clientProposals[idx].Timestamp},
-						w.lb.clientProposals[idx].Reply)
-				}
+			e.execute(w)
+		}
+		e.stack = e.stack[0:l]
+	}
+	return instanceId{}, true
+}
+
+// execute hands the commands of w to the workers that own their keys, and
+// removes w from the graph
+func (e *Exec) execute(w *execNode) {
+	batches := make(map[int]*execBatch)
+	for idx := 0; idx < len(w.cmds); idx++ {
+		shard := e.shardOf(w.cmds[idx].K)
+		b := batches[shard]
+		if b == nil {
+			b = &execBatch{make([]state.Command, 0, len(w.cmds)), make([]*genericsmr.Propose, 0, len(w.cmds))}
+			batches[shard] = b
+		}
+		b.cmds = append(b.cmds, w.cmds[idx])
+		if e.r.Dreply && w.proposals != nil {
+			b.proposals = append(b.proposals, w.proposals[idx])
+		} else {
+			b.proposals = append(b.proposals, nil)
+		}
+	}
+	for shard, b := range batches {
+		e.workers[shard] <- b
+	}
+
+	w.onStack = false
+	delete(e.nodes[w.replica], w.instance)
+	e.executed[w.replica][w.instance] = true
+	for e.executed[w.replica][e.executedUpTo[w.replica]+1] {
+		delete(e.executed[w.replica], e.executedUpTo[w.replica]+1)
+		e.executedUpTo[w.replica]++
+	}
+}
+
+// read hands a GET served under a lease to the worker that owns its key,
+// behind the commands that were executed before it
+func (e *Exec) read(propose *genericsmr.Propose) {
+	e.workers[e.shardOf(propose.Command.K)] <- &execBatch{[]state.Command{propose.Command}, []*genericsmr.Propose{propose}}
+}
+
+func (e *Exec) shardOf(key state.Key) int {
+	return int(uint64(key) % uint64(len(e.workers)))
+}
+
+// worker executes the commands on its shard of the keys in the order they
+// are handed over
+func (e *Exec) worker(w int) {
+	for !e.r.Shutdown {
+		b := <-e.workers[w]
+		for idx := 0; idx < len(b.cmds); idx++ {
+			val := b.cmds[idx].Execute(e.shards[w])
+			if p := b.proposals[idx]; p != nil {
+				e.r.clientMutex.Lock()
+				e.r.ReplyProposeTS(
+					&genericsmrproto.ProposeReplyTS{
+						TRUE,
+						p.CommandId,
+						val,
+						p.Timestamp},
+					p.Reply)
+				e.r.clientMutex.Unlock()
 			}
-			w.Status = epaxosproto.EXECUTED
 		}
-		stack = stack[0:l]
 	}
-	return true
 }
 
-func (e *Exec) inStack(w *Instance) bool {
-	for _, u := range stack {
-		if w == u {
-			return true
+// reportExecuted tells the event loop how far execution has progressed
+func (e *Exec) reportExecuted() {
+	for q := int32(0); q < int32(e.r.N); q++ {
+		if e.executedUpTo[q] > e.reported[q] {
+			e.reported[q] = e.executedUpTo[q]
+			e.r.executedChan <- &instanceId{q, e.executedUpTo[q]}
+		}
+	}
+}
+
+// recoverStalled asks the event loop to recover the instances that execution
+// has been waiting on for longer than COMMIT_GRACE_PERIOD
+func (e *Exec) recoverStalled() {
+	now := time.Now()
+	for id, since := range e.waitingSince {
+		if len(e.waiters[id]) == 0 {
+			delete(e.waitingSince, id)
+			continue
+		}
+		if now.Sub(since) < COMMIT_GRACE_PERIOD {
+			continue
+		}
+		dlog.Printf("Execution stalled on instance %d.%d\n", id.replica, id.instance)
+		e.r.instancesToRecover <- &instanceId{id.replica, id.instance}
+		e.waitingSince[id] = now
+	}
+}
+
+// notifyCommitted hands a committed instance over to the executor, once its
+// commands are known
+func (r *Replica) notifyCommitted(replica int32, instance int32) {
+	inst := r.InstanceSpace[replica][instance]
+	if !r.Exec || inst == nil || inst.Status != epaxosproto.COMMITTED || inst.Cmds == nil {
+		return
+	}
+
+	var proposals []*genericsmr.Propose
+	if inst.lb != nil {
+		proposals = inst.lb.clientProposals
+	}
+	r.exec.committed <- &execNode{replica, instance, inst.Cmds, inst.Seq, copyDeps(inst.Deps), proposals, true, 0, 0, false}
+}
+
+// notifyProposed tells the executor the commands of an instance that is not
+// committed yet, so that execution need not wait for it on other keys
+func (r *Replica) notifyProposed(replica int32, instance int32, cmds []state.Command) {
+	if !r.Exec || cmds == nil {
+		return
+	}
+	r.exec.committed <- &execNode{replica, instance, cmds, 0, nil, nil, false, 0, 0, false}
+}
+
+// handleExecuted marks the instances that the executor is done with
+func (r *Replica) handleExecuted(executed *instanceId) {
+	q := executed.replica
+	for i := r.ExecedUpTo[q] + 1; i <= executed.instance; i++ {
+		if inst := r.InstanceSpace[q][i]; inst != nil {
+			inst.Status = epaxosproto.EXECUTED
 		}
 	}
-	return false
+	r.ExecedUpTo[q] = executed.instance
 }
 
-type nodeArray []*Instance
+type nodeArray []*execNode
 
 func (na nodeArray) Len() int {
 	return len(na)
 }
 
+// commands in a component run in Seq order, ties broken by replica id and
+// then by instance, so that every replica picks the same order
 func (na nodeArray) Less(i, j int) bool {
-	return na[i].Seq < na[j].Seq
+	return na[i].seq < na[j].seq ||
+		na[i].seq == na[j].seq && na[i].replica < na[j].replica ||
+		na[i].seq == na[j].seq && na[i].replica == na[j].replica && na[i].instance < na[j].instance
 }
 
 func (na nodeArray) Swap(i, j int) {
@@ -0,0 +1,170 @@
+package epaxos
+
+import (
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/state"
+)
+
+// The DepGraph RPC dumps the part of InstanceSpace that execution has not got
+// past, for the epaxosgraph tool. Its edges are the dependencies that the
+// executor follows: those on conflicting commands, and those on instances
+// whose commands this replica does not know. Components that have not
+// executed are waiting for the uncommitted instances they depend on.
+
+// DepGraph reports the instances that this replica has not executed, and how
+// they depend on each other
+func (r *Replica) DepGraph(args *epaxosproto.DepGraphArgs, reply *epaxosproto.DepGraphReply) error {
+	// InstanceSpace belongs to the event loop
+	done := make(chan *epaxosproto.DepGraphReply)
+	r.depGraphChan <- done
+	*reply = *<-done
+	return nil
+}
+
+// depGraph builds the reply to DepGraph
+func (r *Replica) depGraph() *epaxosproto.DepGraphReply {
+	g := &depGraph{r, &epaxosproto.DepGraphReply{copyDeps(r.ExecedUpTo), nil, nil, nil}, make(map[instanceId]int), nil, nil, nil, nil, 1}
+
+	for q := int32(0); q < int32(r.N); q++ {
+		for i := r.ExecedUpTo[q] + 1; i < r.crtInstance[q]; i++ {
+			if r.InstanceSpace[q][i] != nil {
+				g.node(q, i)
+			}
+		}
+	}
+
+	// dependencies add nodes as they go
+	for v := 0; v < len(g.reply.Instances); v++ {
+		g.edges = append(g.edges, g.dependencies(v))
+	}
+
+	g.lowlink = make([]int, len(g.reply.Instances))
+	g.index = make([]int, len(g.reply.Instances))
+	for v := range g.edges {
+		if g.committed(v) && g.index[v] == 0 {
+			g.strongconnect(v)
+		}
+	}
+	return g.reply
+}
+
+type depGraph struct {
+	r       *Replica
+	reply   *epaxosproto.DepGraphReply
+	nodes   map[instanceId]int // index into reply.Instances
+	edges   [][]int
+	index   []int
+	lowlink []int
+	stack   []int
+	next    int
+}
+
+func (g *depGraph) node(q int32, i int32) int {
+	if v, present := g.nodes[instanceId{q, i}]; present {
+		return v
+	}
+
+	gi := epaxosproto.GraphInstance{epaxosproto.InstanceRef{q, i}, epaxosproto.NONE, -1, -1, nil, nil}
+	if inst := g.r.InstanceSpace[q][i]; inst != nil {
+		gi.Status = inst.Status
+		gi.Ballot = inst.ballot
+		gi.Seq = inst.Seq
+		gi.Deps = copyDeps(inst.Deps)
+		if inst.Cmds != nil {
+			gi.Keys = make([]state.Key, len(inst.Cmds))
+			for c := range inst.Cmds {
+				gi.Keys[c] = inst.Cmds[c].K
+			}
+		}
+	}
+
+	v := len(g.reply.Instances)
+	g.nodes[instanceId{q, i}] = v
+	g.reply.Instances = append(g.reply.Instances, gi)
+	return v
+}
+
+// committed tells whether the executor has node v in its graph
+func (g *depGraph) committed(v int) bool {
+	ref := g.reply.Instances[v].InstanceRef
+	inst := g.r.InstanceSpace[ref.Replica][ref.Instance]
+	return inst != nil && inst.Status == epaxosproto.COMMITTED && inst.Cmds != nil
+}
+
+// dependencies adds the edges out of node v, as strongconnect in the
+// executor would follow them
+func (g *depGraph) dependencies(v int) []int {
+	if !g.committed(v) {
+		return nil
+	}
+	ref := g.reply.Instances[v].InstanceRef
+	inst := g.r.InstanceSpace[ref.Replica][ref.Instance]
+	if len(inst.Cmds) == 0 {
+		return nil
+	}
+
+	var out []int
+	for q := int32(0); q < int32(g.r.N); q++ {
+		for i := g.r.ExecedUpTo[q] + 1; i <= inst.Deps[q]; i++ {
+			dep := g.r.InstanceSpace[q][i]
+			if dep != nil && dep.Status == epaxosproto.EXECUTED {
+				continue
+			}
+			if dep != nil && dep.Cmds != nil && !state.ConflictBatch(inst.Cmds, dep.Cmds) {
+				continue
+			}
+			w := g.node(q, i)
+			out = append(out, w)
+			g.reply.Edges = append(g.reply.Edges, [2]epaxosproto.InstanceRef{ref, {q, i}})
+		}
+	}
+	return out
+}
+
+func (g *depGraph) strongconnect(v int) {
+	g.index[v] = g.next
+	g.lowlink[v] = g.next
+	g.next++
+	l := len(g.stack)
+	g.stack = append(g.stack, v)
+
+	for _, w := range g.edges[v] {
+		if !g.committed(w) {
+			continue
+		}
+		if g.index[w] == 0 {
+			g.strongconnect(w)
+			if g.lowlink[w] < g.lowlink[v] {
+				g.lowlink[v] = g.lowlink[w]
+			}
+		} else if g.onStack(w) && g.index[w] < g.lowlink[v] {
+			g.lowlink[v] = g.index[w]
+		}
+	}
+
+	if g.lowlink[v] != g.index[v] {
+		return
+	}
+	scc := epaxosproto.GraphSCC{}
+	waiting := make(map[int]bool)
+	for _, w := range g.stack[l:] {
+		scc.Members = append(scc.Members, g.reply.Instances[w].InstanceRef)
+		for _, dep := range g.edges[w] {
+			if !g.committed(dep) && !waiting[dep] {
+				waiting[dep] = true
+				scc.WaitingFor = append(scc.WaitingFor, g.reply.Instances[dep].InstanceRef)
+			}
+		}
+	}
+	g.stack = g.stack[:l]
+	g.reply.SCCs = append(g.reply.SCCs, scc)
+}
+
+func (g *depGraph) onStack(v int) bool {
+	for _, w := range g.stack {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package epaxos
+
+import (
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/state"
+	"time"
+)
+
+// Quorum read leases. The replicas in the lease quorum each hold a lease from
+// every replica, and serve GETs from their executor's state while it lasts.
+//
+// A replica that has granted a lease commits a write only once the holder has
+// acknowledged it in some round, or the lease has expired, so a holder always
+// knows of the writes that may have completed since its lease started. It
+// reads a key locally only once it has executed every instance on the key
+// that it knows of. Grants carry the grantor's crtInstance, so that a holder
+// whose lease lapsed also waits for the writes that committed in between.
+
+// How long a lease lasts, counted from the moment it was requested
+const LEASE_DURATION = 1 * time.Second
+
+// Grantors keep a lease for longer than its holder, to absorb clock drift
+const LEASE_GUARD = 100 * time.Millisecond
+
+// A lease is renewed when it is this close to expiring
+const LEASE_RENEW = LEASE_DURATION / 2
+
+// lease is the lease this replica holds, or is requesting, from every replica
+type lease struct {
+	epoch          int32 // grants for older requests are ignored
+	pending        bool  // waiting for grants
+	sentAt         time.Time
+	grants         []bool
+	pendingCatchUp []int32 // highest instance among the grants of this epoch
+	catchUp        []int32 // instances to execute before reading locally
+	expiry         time.Time
+}
+
+func newLease(n int) *lease {
+	return &lease{0, false, time.Time{}, make([]bool, n), newDeps(n, -1), newDeps(n, -1), time.Time{}}
+}
+
+// leaseQuorum is the replicas that hold read leases
+func (r *Replica) leaseQuorum() []int32 {
+	quorum := make([]int32, r.N/2+1)
+	for i := range quorum {
+		quorum[i] = int32(i)
+	}
+	return quorum
+}
+
+func (r *Replica) isLeaseHolder(q int32) bool {
+	return q <= int32(r.N/2)
+}
+
+// readLocally replies to a GET from the executor's state if this replica
+// holds a lease and has executed every instance on the key that it knows of
+func (r *Replica) readLocally(propose *genericsmr.Propose) bool {
+	if !r.leases || !r.Exec || !state.IsRead(&propose.Command) {
+		return false
+	}
+	l := r.lease
+	if !time.Now().Before(l.expiry) {
+		return false
+	}
+
+	key := propose.Command.K
+	for q := 0; q < r.N; q++ {
+		if r.ExecedUpTo[q] < l.catchUp[q] {
+			return false
+		}
+		if i, present := r.conflicts[q][key]; present && i > r.ExecedUpTo[q] {
+			return false
+		}
+	}
+	for id := range r.blind {
+		if r.InstanceSpace[id.replica][id.instance].Cmds == nil && id.instance > r.ExecedUpTo[id.replica] {
+			// it may write to the key
+			return false
+		}
+		delete(r.blind, id)
+	}
+
+	r.exec.read(propose)
+	return true
+}
+
+// renewLease asks every replica for a lease once the current one is close to
+// expiring
+func (r *Replica) renewLease() {
+	l := r.lease
+	now := time.Now()
+	if l.expiry.Sub(now) >= LEASE_RENEW {
+		return
+	}
+	if l.pending && now.Sub(l.sentAt) < LEASE_DURATION {
+		return
+	}
+
+	l.epoch++
+	l.pending = true
+	l.sentAt = now
+	l.grants = make([]bool, r.N)
+	l.pendingCatchUp = newDeps(r.N, -1)
+
+	request := &epaxosproto.LeaseRequest{r.Id, l.epoch}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q] {
+			continue
+		}
+		r.SendMsg(q, r.leaseRequestRPC, request)
+	}
+}
+
+func (r *Replica) handleLeaseRequest(request *epaxosproto.LeaseRequest) {
+	if !r.isLeaseHolder(request.Sender) {
+		return
+	}
+	r.granted[request.Sender] = time.Now().Add(LEASE_DURATION + LEASE_GUARD)
+	r.SendMsg(request.Sender, r.leaseGrantRPC, &epaxosproto.LeaseGrant{r.Id, request.Epoch, copyDeps(r.crtInstance)})
+}
+
+func (r *Replica) handleLeaseGrant(grant *epaxosproto.LeaseGrant) {
+	l := r.lease
+	if !l.pending || grant.Epoch != l.epoch || l.grants[grant.Sender] {
+		return
+	}
+
+	l.grants[grant.Sender] = true
+	for q := 0; q < r.N; q++ {
+		if grant.CrtInstance[q]-1 > l.pendingCatchUp[q] {
+			l.pendingCatchUp[q] = grant.CrtInstance[q] - 1
+		}
+	}
+	for q := 0; q < r.N; q++ {
+		if q != int(r.Id) && !l.grants[q] {
+			return
+		}
+	}
+
+	l.pending = false
+	if !time.Now().Before(l.expiry) {
+		// the lease lapsed, and writes may have committed without us since
+		l.catchUp = l.pendingCatchUp
+	}
+	l.expiry = l.sentAt.Add(LEASE_DURATION)
+}
+
+// ackLease records that an acceptor knows of the instance
+func (lb *LeaderBookkeeping) ackLease(acceptor int32, n int) {
+	if lb.leaseAcks == nil {
+		lb.leaseAcks = make([]bool, n)
+	}
+	lb.leaseAcks[acceptor] = true
+}
+
+// leasesAcked tells whether every replica holding a lease from this one has
+// acknowledged the instance, if it writes
+func (r *Replica) leasesAcked(inst *Instance) bool {
+	writes := false
+	for i := range inst.Cmds {
+		if !state.IsRead(&inst.Cmds[i]) {
+			writes = true
+			break
+		}
+	}
+	if !writes {
+		return true
+	}
+
+	now := time.Now()
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !now.Before(r.granted[q]) {
+			continue
+		}
+		if inst.lb.leaseAcks == nil || !inst.lb.leaseAcks[q] {
+			return false
+		}
+	}
+	return true
+}
+
+// sendToLeaseHolders sends a thrifty round to the lease holders that it left
+// out, since the commit has to wait for them
+func (r *Replica) sendToLeaseHolders(sentTo []bool, code uint8, msg fastrpc.Serializable) {
+	now := time.Now()
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || sentTo[q] || !r.Alive[q] || !now.Before(r.granted[q]) {
+			continue
+		}
+		r.SendMsg(q, code, msg)
+		sentTo[q] = true
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"log"
 	"math"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -19,14 +20,26 @@ import (
 const MAX_DEPTH_DEP = 10
 const TRUE = uint8(1)
 const FALSE = uint8(0)
-const DS = 5
-const ADAPT_TIME_SEC = 10
 
-const MAX_BATCH = 1
+// Ballots are (counter << BALLOT_ID_BITS) | replica id, so that ballots from
+// different replicas never collide. This bounds the number of replicas.
+const BALLOT_ID_BITS = 8
+const BALLOT_ID_MASK = (1 << BALLOT_ID_BITS) - 1
+
 const CLOCK = 1e6 * 0.01 // 0.01ms
 
 const COMMIT_GRACE_PERIOD = 10 * 1e9 //10 seconds
 
+// A command leader that is missing replies for this long takes the slow path
+// if it has a majority, and otherwise also asks the peers it left out
+const PHASE_TIMEOUT = 300 * time.Millisecond
+
+// A leader that is NACKed lets the leader with the higher ballot finish the
+// instance, and only takes it over if that has not happened after a random
+// backoff, which doubles with every NACK up to MAX_BACKOFF
+const MIN_BACKOFF = 100 * time.Millisecond
+const MAX_BACKOFF = 5 * time.Second
+
 const BF_K = 4
 const BF_M_N = 32.0
 
@@ -52,6 +65,8 @@ type Replica struct {
 	acceptReplyChan       chan fastrpc.Serializable
 	tryPreAcceptChan      chan fastrpc.Serializable
 	tryPreAcceptReplyChan chan fastrpc.Serializable
+	leaseRequestChan      chan fastrpc.Serializable
+	leaseGrantChan        chan fastrpc.Serializable
 	prepareRPC            uint8
 	prepareReplyRPC       uint8
 	preAcceptRPC          uint8
@@ -63,9 +78,11 @@ type Replica struct {
 	commitShortRPC        uint8
 	tryPreAcceptRPC       uint8
 	tryPreAcceptReplyRPC  uint8
+	leaseRequestRPC       uint8
+	leaseGrantRPC         uint8
 	InstanceSpace         [][]*Instance // the space of all instances (used and not yet used)
 	crtInstance           []int32       // highest active instance numbers that this replica knows about
-	CommittedUpTo         [DS]int32     // highest committed instance per replica that this replica knows about
+	CommittedUpTo         []int32       // highest committed instance per replica that this replica knows about
 	ExecedUpTo            []int32       // instance up to which all commands have been executed (including iteslf)
 	exec                  *Exec
 	conflicts             []map[state.Key]int32
@@ -75,17 +92,26 @@ type Replica struct {
 	latestCPInstance      int32
 	clientMutex           *sync.Mutex // for synchronizing when sending replies to clients from multiple go-routines
 	instancesToRecover    chan *instanceId
+	batcher               *genericsmr.Batcher // adaptive batching of client proposals
+	executedChan          chan *instanceId    // how far the executor got in each replica's instance space
+	deferred              map[uint64]uint64   // recoveries deferred for a conflicting instance, see updateDeferred
+	leases                bool                // serve reads locally under quorum read leases?
+	lease                 *lease              // the lease this replica holds from the others
+	granted               []time.Time         // expiry of the lease granted to each replica
+	blind                 map[instanceId]bool // instances acknowledged without knowing their commands
+	depGraphChan          chan chan *epaxosproto.DepGraphReply
+	pending               []*genericsmr.Propose // proposals the event loop put back, handled before ProposeChan
 }
 
 type Instance struct {
-	Cmds           []state.Command
-	ballot         int32
-	Status         int8
-	Seq            int32
-	Deps           [DS]int32
-	lb             *LeaderBookkeeping
-	Index, Lowlink int
-	bfilter        *bloomfilter.Bloomfilter
+	Cmds    []state.Command
+	ballot  int32 // the highest ballot this replica has taken part in
+	vballot int32 // the ballot at which Cmds, Seq and Deps were (pre-)accepted
+	Status  int8
+	Seq     int32
+	Deps    []int32
+	lb      *LeaderBookkeeping
+	bfilter *bloomfilter.Bloomfilter
 }
 
 type instanceId struct {
@@ -94,12 +120,13 @@ type instanceId struct {
 }
 
 type RecoveryInstance struct {
-	cmds            []state.Command
+	cmds            []state.Command // nil if no replica that replied knows them yet
 	status          int8
 	seq             int32
-	deps            [DS]int32
-	preAcceptCount  int
+	deps            []int32
+	preAcceptCount  int // replies that pre-accepted the command leader's attributes at its initial ballot
 	leaderResponded bool
+	vballot         int32
 }
 
 type LeaderBookkeeping struct {
@@ -110,16 +137,34 @@ type LeaderBookkeeping struct {
 	preAcceptOKs      int
 	acceptOKs         int
 	nacks             int
-	originalDeps      [DS]int32
+	originalDeps      []int32
 	committedDeps     []int32
 	recoveryInst      *RecoveryInstance
 	preparing         bool
 	tryingToPreAccept bool
 	possibleQuorum    []bool
 	tpaOKs            int
+	phaseStart        time.Time     // when the current PreAccept or Accept round was sent
+	sentTo            []bool        // the peers that the current round was sent to
+	backoff           time.Duration // how long the next NACK defers this leader for
+	deferUntil        time.Time     // zero unless deferring to a leader with a higher ballot
+	leaseAcks         []bool        // the acceptors that acknowledged the instance, see leasesAcked
+	waitingForLeases  bool          // committed but for lease holders that have not acknowledged it
+}
+
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, beacon bool, durable bool, leases bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, beacon, durable, leases, maxBatch, maxBatchDelay)
+
+	go r.run()
+
+	return r
 }
 
-func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, beacon bool, durable bool) *Replica {
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, beacon bool, durable bool, leases bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
+	if len(peerAddrList) > BALLOT_ID_MASK+1 {
+		log.Fatalf("EPaxos supports at most %d replicas\n", BALLOT_ID_MASK+1)
+	}
+
 	r := &Replica{
 		genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
@@ -133,10 +178,12 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE*2),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 		make([][]*Instance, len(peerAddrList)),
 		make([]int32, len(peerAddrList)),
-		[DS]int32{-1, -1, -1, -1, -1},
+		make([]int32, len(peerAddrList)),
 		make([]int32, len(peerAddrList)),
 		nil,
 		make([]map[state.Key]int32, len(peerAddrList)),
@@ -145,23 +192,34 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		0,
 		-1,
 		new(sync.Mutex),
-		make(chan *instanceId, genericsmr.CHAN_BUFFER_SIZE)}
+		make(chan *instanceId, genericsmr.CHAN_BUFFER_SIZE),
+		genericsmr.NewBatcher(maxBatch, maxBatchDelay),
+		make(chan *instanceId, genericsmr.CHAN_BUFFER_SIZE),
+		make(map[uint64]uint64),
+		leases,
+		newLease(len(peerAddrList)),
+		make([]time.Time, len(peerAddrList)),
+		make(map[instanceId]bool),
+		make(chan chan *epaxosproto.DepGraphReply),
+		nil}
 
-	r.Beacon = beacon
+	// thrifty rounds go to the closest peers, so they have to be measured
+	r.Beacon = beacon || thrifty
 	r.Durable = durable
 
 	for i := 0; i < r.N; i++ {
 		r.InstanceSpace[i] = make([]*Instance, 2*1024*1024)
 		r.crtInstance[i] = 0
 		r.ExecedUpTo[i] = -1
+		r.CommittedUpTo[i] = -1
 		r.conflicts[i] = make(map[state.Key]int32, HT_INIT_SIZE)
 	}
 
-	for bf_PT = 1; math.Pow(2, float64(bf_PT))/float64(MAX_BATCH) < BF_M_N; {
+	for bf_PT = 1; math.Pow(2, float64(bf_PT))/float64(r.batcher.MaxBatch) < BF_M_N; {
 		bf_PT++
 	}
 
-	r.exec = &Exec{r}
+	r.exec = newExec(r)
 
 	cpMarker = make([]state.Command, 0)
 
@@ -177,8 +235,8 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 	r.commitShortRPC = r.RegisterRPC(new(epaxosproto.CommitShort), r.commitShortChan)
 	r.tryPreAcceptRPC = r.RegisterRPC(new(epaxosproto.TryPreAccept), r.tryPreAcceptChan)
 	r.tryPreAcceptReplyRPC = r.RegisterRPC(new(epaxosproto.TryPreAcceptReply), r.tryPreAcceptReplyChan)
-
-	go r.run()
+	r.leaseRequestRPC = r.RegisterRPC(new(epaxosproto.LeaseRequest), r.leaseRequestChan)
+	r.leaseGrantRPC = r.RegisterRPC(new(epaxosproto.LeaseGrant), r.leaseGrantChan)
 
 	return r
 }
@@ -189,7 +247,7 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 		return
 	}
 
-	var b [9 + DS*4]byte
+	b := make([]byte, 9+4*len(inst.Deps))
 	binary.LittleEndian.PutUint32(b[0:4], uint32(inst.ballot))
 	b[4] = byte(inst.Status)
 	binary.LittleEndian.PutUint32(b[5:9], uint32(inst.Seq))
@@ -198,7 +256,7 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 		binary.LittleEndian.PutUint32(b[l:l+4], uint32(dep))
 		l += 4
 	}
-	r.StableStore.Write(b[:])
+	r.StableStore.Write(b)
 }
 
 // write a sequence of commands to stable storage
@@ -224,6 +282,14 @@ func (r *Replica) sync() {
 	r.StableStore.Sync()
 }
 
+/* RPC to be called by clients */
+
+// BatchStats reports the sizes of the batches proposed by this replica
+func (r *Replica) BatchStats(args *genericsmrproto.BatchStatsArgs, reply *genericsmrproto.BatchStatsReply) error {
+	r.batcher.Stats(reply)
+	return nil
+}
+
 /* Clock goroutine */
 
 var fastClockChan chan bool
@@ -242,26 +308,6 @@ func (r *Replica) slowClock() {
 	}
 }
 
-func (r *Replica) stopAdapting() {
-	time.Sleep(1000 * 1000 * 1000 * ADAPT_TIME_SEC)
-	r.Beacon = false
-	time.Sleep(1000 * 1000 * 1000)
-
-	for i := 0; i < r.N-1; i++ {
-		min := i
-		for j := i + 1; j < r.N-1; j++ {
-			if r.Ewma[r.PreferredPeerOrder[j]] < r.Ewma[r.PreferredPeerOrder[min]] {
-				min = j
-			}
-		}
-		aux := r.PreferredPeerOrder[i]
-		r.PreferredPeerOrder[i] = r.PreferredPeerOrder[min]
-		r.PreferredPeerOrder[min] = aux
-	}
-
-	log.Println(r.PreferredPeerOrder)
-}
-
 var conflicted, weird, slow, happy int
 
 /* ============= */
@@ -278,35 +324,31 @@ func (r *Replica) run() {
 	go r.WaitForClientConnections()
 
 	if r.Exec {
-		go r.executeCommands()
+		go r.exec.run()
 	}
 
 	if r.Id == 0 {
 		//init quorum read lease
-		quorum := make([]int32, r.N/2+1)
-		for i := 0; i <= r.N/2; i++ {
-			quorum[i] = int32(i)
-		}
-		r.UpdatePreferredPeerOrder(quorum)
+		r.UpdatePreferredPeerOrder(r.leaseQuorum())
 	}
 
 	slowClockChan = make(chan bool, 1)
 	fastClockChan = make(chan bool, 1)
 	go r.slowClock()
 
-	//Enabled when batching for 5ms
-	//if MAX_BATCH > 100 {
 	go r.fastClock()
-	//}
-
-	if r.Beacon {
-		go r.stopAdapting()
-	}
 
 	onOffProposeChan := r.ProposeChan
 
 	for !r.Shutdown {
 
+		// the event loop cannot wait on ProposeChan for the proposals it puts
+		// back
+		if len(r.pending) > 0 {
+			r.handlePropose(r.nextProposal())
+			continue
+		}
+
 		select {
 
 		case propose := <-onOffProposeChan:
@@ -319,8 +361,10 @@ func (r *Replica) run() {
 			break
 
 		case <-fastClockChan:
-			//activate new proposals channel
-			onOffProposeChan = r.ProposeChan
+			//activate new proposals channel once enough commands are queued for a batch
+			if r.batcher.Ready(r.queued()) {
+				onOffProposeChan = r.ProposeChan
+			}
 			break
 
 		case prepareS := <-r.prepareChan:
@@ -398,6 +442,16 @@ func (r *Replica) run() {
 			r.handleTryPreAcceptReply(tryPreAcceptReply)
 			break
 
+		case leaseRequestS := <-r.leaseRequestChan:
+			leaseRequest := leaseRequestS.(*epaxosproto.LeaseRequest)
+			r.handleLeaseRequest(leaseRequest)
+			break
+
+		case leaseGrantS := <-r.leaseGrantChan:
+			leaseGrant := leaseGrantS.(*epaxosproto.LeaseGrant)
+			r.handleLeaseGrant(leaseGrant)
+			break
+
 		case beacon := <-r.BeaconChan:
 			dlog.Printf("Received Beacon from replica %d with timestamp %d\n", beacon.Rid, beacon.Timestamp)
 			r.ReplyBeacon(beacon)
@@ -406,12 +460,17 @@ func (r *Replica) run() {
 		case <-slowClockChan:
 			if r.Beacon {
 				for q := int32(0); q < int32(r.N); q++ {
-					if q == r.Id {
+					if q == r.Id || !r.Alive[q] {
 						continue
 					}
 					r.SendBeacon(q)
 				}
+				r.RankPeers(r.fastQuorumSize() - 1)
 			}
+			if r.leases && r.isLeaseHolder(r.Id) {
+				r.renewLease()
+			}
+			r.checkLeaderTimeouts()
 			break
 		case <-r.OnClientConnect:
 			log.Printf("weird %d; conflicted %d; slow %d; happy %d\n", weird, conflicted, slow, happy)
@@ -419,83 +478,39 @@ func (r *Replica) run() {
 
 		case iid := <-r.instancesToRecover:
 			r.startRecoveryForInstance(iid.replica, iid.instance)
-		}
-	}
-}
 
-/***********************************
-   Command execution thread        *
-************************************/
+		case executed := <-r.executedChan:
+			r.handleExecuted(executed)
 
-func (r *Replica) executeCommands() {
-	//const SLEEP_TIME_NS = 1e6
-	problemInstance := make([]int32, r.N)
-	timeout := make([]uint64, r.N)
-	for q := 0; q < r.N; q++ {
-		problemInstance[q] = -1
-		timeout[q] = 0
-	}
-
-	for !r.Shutdown {
-		executed := false
-		for q := 0; q < r.N; q++ {
-			inst := int32(0)
-			for inst = r.ExecedUpTo[q] + 1; inst < r.crtInstance[q]; inst++ {
-				if r.InstanceSpace[q][inst] != nil && r.InstanceSpace[q][inst].Status == epaxosproto.EXECUTED {
-					if inst == r.ExecedUpTo[q]+1 {
-						r.ExecedUpTo[q] = inst
-					}
-					continue
-				}
-				if r.InstanceSpace[q][inst] == nil || r.InstanceSpace[q][inst].Status != epaxosproto.COMMITTED {
-					if inst == problemInstance[q] {
-						//timeout[q] += SLEEP_TIME_NS
-						timeout[q] += CLOCK
-						if timeout[q] >= COMMIT_GRACE_PERIOD {
-							r.instancesToRecover <- &instanceId{int32(q), inst}
-							timeout[q] = 0
-						}
-					} else {
-						problemInstance[q] = inst
-						timeout[q] = 0
-					}
-					if r.InstanceSpace[q][inst] == nil {
-						continue
-					}
-					break
-				}
-				if ok := r.exec.executeCommand(int32(q), inst); ok {
-					executed = true
-					if inst == r.ExecedUpTo[q]+1 {
-						r.ExecedUpTo[q] = inst
-					}
-				}
-			}
-		}
-		if !executed {
-			//time.Sleep(SLEEP_TIME_NS)
-			time.Sleep(CLOCK)
+		case done := <-r.depGraphChan:
+			done <- r.depGraph()
 		}
-		//log.Println(r.ExecedUpTo, " ", r.crtInstance)
 	}
 }
 
 /* Ballot helper functions */
 
+// fastQuorumSize counts the command leader. With F = N/2 tolerated failures,
+// it is F + floor((F+1)/2), which is a majority for up to five replicas.
+func (r *Replica) fastQuorumSize() int {
+	f := r.N / 2
+	return f + (f+1)/2
+}
+
 func (r *Replica) makeUniqueBallot(ballot int32) int32 {
-	return (ballot << 4) | r.Id
+	return (ballot << BALLOT_ID_BITS) | r.Id
 }
 
 func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
-	return r.makeUniqueBallot((ballot >> 4) + 1)
+	return r.makeUniqueBallot((ballot >> BALLOT_ID_BITS) + 1)
 }
 
 func isInitialBallot(ballot int32) bool {
-	return (ballot >> 4) == 0
+	return (ballot >> BALLOT_ID_BITS) == 0
 }
 
 func replicaIdFromBallot(ballot int32) int32 {
-	return ballot & 15
+	return ballot & BALLOT_ID_MASK
 }
 
 /**********************************************************************
@@ -547,7 +562,9 @@ func (r *Replica) bcastPrepare(replica int32, instance int32, ballot int32) {
 
 var pa epaxosproto.PreAccept
 
-func (r *Replica) bcastPreAccept(replica int32, instance int32, ballot int32, cmds []state.Command, seq int32, deps [DS]int32) {
+// bcastPreAccept returns the peers it sent to
+func (r *Replica) bcastPreAccept(replica int32, instance int32, ballot int32, cmds []state.Command, seq int32, deps []int32) []bool {
+	sentTo := make([]bool, r.N)
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("PreAccept bcast failed:", err)
@@ -564,7 +581,7 @@ func (r *Replica) bcastPreAccept(replica int32, instance int32, ballot int32, cm
 
 	n := r.N - 1
 	if r.Thrifty {
-		n = r.N / 2
+		n = r.fastQuorumSize() - 1
 	}
 
 	sent := 0
@@ -573,16 +590,19 @@ func (r *Replica) bcastPreAccept(replica int32, instance int32, ballot int32, cm
 			continue
 		}
 		r.SendMsg(r.PreferredPeerOrder[q], r.preAcceptRPC, args)
+		sentTo[r.PreferredPeerOrder[q]] = true
 		sent++
 		if sent >= n {
 			break
 		}
 	}
+	r.sendToLeaseHolders(sentTo, r.preAcceptRPC, args)
+	return sentTo
 }
 
 var tpa epaxosproto.TryPreAccept
 
-func (r *Replica) bcastTryPreAccept(replica int32, instance int32, ballot int32, cmds []state.Command, seq int32, deps [DS]int32) {
+func (r *Replica) bcastTryPreAccept(replica int32, instance int32, ballot int32, cmds []state.Command, seq int32, deps []int32) {
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("PreAccept bcast failed:", err)
@@ -595,7 +615,7 @@ func (r *Replica) bcastTryPreAccept(replica int32, instance int32, ballot int32,
 	tpa.Command = cmds
 	tpa.Seq = seq
 	tpa.Deps = deps
-	args := &pa
+	args := &tpa
 
 	for q := int32(0); q < int32(r.N); q++ {
 		if q == r.Id {
@@ -610,7 +630,9 @@ func (r *Replica) bcastTryPreAccept(replica int32, instance int32, ballot int32,
 
 var ea epaxosproto.Accept
 
-func (r *Replica) bcastAccept(replica int32, instance int32, ballot int32, count int32, seq int32, deps [DS]int32) {
+// bcastAccept returns the peers it sent to
+func (r *Replica) bcastAccept(replica int32, instance int32, ballot int32, count int32, seq int32, deps []int32) []bool {
+	sentTo := make([]bool, r.N)
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("Accept bcast failed:", err)
@@ -637,17 +659,20 @@ func (r *Replica) bcastAccept(replica int32, instance int32, ballot int32, count
 			continue
 		}
 		r.SendMsg(r.PreferredPeerOrder[q], r.acceptRPC, args)
+		sentTo[r.PreferredPeerOrder[q]] = true
 		sent++
 		if sent >= n {
 			break
 		}
 	}
+	r.sendToLeaseHolders(sentTo, r.acceptRPC, args)
+	return sentTo
 }
 
 var ec epaxosproto.Commit
 var ecs epaxosproto.CommitShort
 
-func (r *Replica) bcastCommit(replica int32, instance int32, cmds []state.Command, seq int32, deps [DS]int32) {
+func (r *Replica) bcastCommit(replica int32, instance int32, cmds []state.Command, seq int32, deps []int32) {
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("Commit bcast failed:", err)
@@ -673,7 +698,9 @@ func (r *Replica) bcastCommit(replica int32, instance int32, cmds []state.Comman
 		if !r.Alive[r.PreferredPeerOrder[q]] {
 			continue
 		}
-		if r.Thrifty && sent >= r.N/2 {
+		// replicas may have accepted a recovered instance without ever
+		// seeing its commands
+		if r.Thrifty && sent >= r.N/2 || replica != r.Id {
 			r.SendMsg(r.PreferredPeerOrder[q], r.commitRPC, args)
 		} else {
 			r.SendMsg(r.PreferredPeerOrder[q], r.commitShortRPC, argsShort)
@@ -719,8 +746,9 @@ func (r *Replica) updateConflicts(cmds []state.Command, replica int32, instance
 	}
 }
 
-func (r *Replica) updateAttributes(cmds []state.Command, seq int32, deps [DS]int32, replica int32, instance int32) (int32, [DS]int32, bool) {
+func (r *Replica) updateAttributes(cmds []state.Command, seq int32, deps []int32, replica int32, instance int32) (int32, []int32, bool) {
 	changed := false
+	deps = copyDeps(deps)
 	for q := 0; q < r.N; q++ {
 		if r.Id != replica && int32(q) == replica {
 			continue
@@ -750,8 +778,9 @@ func (r *Replica) updateAttributes(cmds []state.Command, seq int32, deps [DS]int
 	return seq, deps, changed
 }
 
-func (r *Replica) mergeAttributes(seq1 int32, deps1 [DS]int32, seq2 int32, deps2 [DS]int32) (int32, [DS]int32, bool) {
+func (r *Replica) mergeAttributes(seq1 int32, deps1 []int32, seq2 int32, deps2 []int32) (int32, []int32, bool) {
 	equal := true
+	deps1 = copyDeps(deps1)
 	if seq1 != seq2 {
 		equal = false
 		if seq2 > seq1 {
@@ -772,7 +801,10 @@ func (r *Replica) mergeAttributes(seq1 int32, deps1 [DS]int32, seq2 int32, deps2
 	return seq1, deps1, equal
 }
 
-func equal(deps1 *[DS]int32, deps2 *[DS]int32) bool {
+func equal(deps1 []int32, deps2 []int32) bool {
+	if len(deps1) != len(deps2) {
+		return false
+	}
 	for i := 0; i < len(deps1); i++ {
 		if deps1[i] != deps2[i] {
 			return false
@@ -781,8 +813,27 @@ func equal(deps1 *[DS]int32, deps2 *[DS]int32) bool {
 	return true
 }
 
+// newDeps returns dependencies on instance value of each of the n replicas
+func newDeps(n int, value int32) []int32 {
+	deps := make([]int32, n)
+	for q := range deps {
+		deps[q] = value
+	}
+	return deps
+}
+
+// copyDeps lets the caller modify deps without affecting the instance or
+// message they came from
+func copyDeps(deps []int32) []int32 {
+	c := make([]int32, len(deps))
+	copy(c, deps)
+	return c
+}
+
+// bfFromCommands builds the bloom filter of the keys in a batch. Single
+// commands are compared directly.
 func bfFromCommands(cmds []state.Command) *bloomfilter.Bloomfilter {
-	if cmds == nil {
+	if len(cmds) < 2 {
 		return nil
 	}
 
@@ -795,6 +846,21 @@ func bfFromCommands(cmds []state.Command) *bloomfilter.Bloomfilter {
 	return bf
 }
 
+// conflictBatch is state.ConflictBatch, using the bloom filter of inst to
+// skip the batches that have no key in common with cmds
+func conflictBatch(inst *Instance, cmds []state.Command) bool {
+	if inst.bfilter != nil {
+		shared := false
+		for i := 0; i < len(cmds) && !shared; i++ {
+			shared = inst.bfilter.CheckUint64(uint64(cmds[i].K))
+		}
+		if !shared {
+			return false
+		}
+	}
+	return state.ConflictBatch(inst.Cmds, cmds)
+}
+
 /**********************************************************************
 
                             PHASE 1
@@ -804,10 +870,25 @@ func bfFromCommands(cmds []state.Command) *bloomfilter.Bloomfilter {
 func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 	//TODO!! Handle client retries
 
-	batchSize := len(r.ProposeChan) + 1
-	if batchSize > MAX_BATCH {
-		batchSize = MAX_BATCH
+	batchSize := r.batcher.Size(r.queued() + 1)
+
+	cmds := make([]state.Command, 0, batchSize)
+	proposals := make([]*genericsmr.Propose, 0, batchSize)
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = r.nextProposal()
+		}
+		if r.readLocally(propose) {
+			continue
+		}
+		cmds = append(cmds, propose.Command)
+		proposals = append(proposals, propose)
+	}
+	r.batcher.Record(batchSize, r.queued())
+	if len(cmds) == 0 {
+		return
 	}
+	batchSize = len(cmds)
 
 	instNo := r.crtInstance[r.Id]
 	r.crtInstance[r.Id]++
@@ -815,50 +896,65 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 	dlog.Printf("Starting instance %d\n", instNo)
 	dlog.Printf("Batching %d\n", batchSize)
 
-	cmds := make([]state.Command, batchSize)
-	proposals := make([]*genericsmr.Propose, batchSize)
-	cmds[0] = propose.Command
-	proposals[0] = propose
-	for i := 1; i < batchSize; i++ {
-		prop := <-r.ProposeChan
-		cmds[i] = prop.Command
-		proposals[i] = prop
-	}
-
 	r.startPhase1(r.Id, instNo, 0, proposals, cmds, batchSize)
 }
 
+// queued counts the proposals waiting to be handled
+func (r *Replica) queued() int {
+	return len(r.pending) + len(r.ProposeChan)
+}
+
+// nextProposal takes the next waiting proposal, those put back first. There
+// must be one.
+func (r *Replica) nextProposal() *genericsmr.Propose {
+	if len(r.pending) > 0 {
+		prop := r.pending[0]
+		r.pending = r.pending[1:]
+		return prop
+	}
+	return <-r.ProposeChan
+}
+
+// startPhase1 pre-accepts cmds in an instance, which is one of ours unless
+// recovery restarts another replica's instance
 func (r *Replica) startPhase1(replica int32, instance int32, ballot int32, proposals []*genericsmr.Propose, cmds []state.Command, batchSize int) {
 	//init command attributes
 
 	seq := int32(0)
-	var deps [DS]int32
-	for q := 0; q < r.N; q++ {
-		deps[q] = -1
-	}
+	deps := newDeps(r.N, -1)
 
 	seq, deps, _ = r.updateAttributes(cmds, seq, deps, replica, instance)
 
-	r.InstanceSpace[r.Id][instance] = &Instance{
+	inst := &Instance{
 		cmds,
 		ballot,
+		ballot,
 		epaxosproto.PREACCEPTED,
 		seq,
 		deps,
-		&LeaderBookkeeping{proposals, 0, 0, true, 0, 0, 0, deps, []int32{-1, -1, -1, -1, -1}, nil, false, false, nil, 0}, 0, 0,
-		nil}
+		&LeaderBookkeeping{proposals, 0, 0, true, 0, 0, 0, copyDeps(deps), newDeps(r.N, -1), nil, false, false, nil, 0, time.Time{}, nil, 0, time.Time{}, nil, false},
+		bfFromCommands(cmds)}
+	if old := r.InstanceSpace[replica][instance]; old != nil && old.lb != nil {
+		inst.lb.backoff = old.lb.backoff
+	}
+	r.InstanceSpace[replica][instance] = inst
 
-	r.updateConflicts(cmds, r.Id, instance, seq)
+	r.updateConflicts(cmds, replica, instance, seq)
+	r.notifyProposed(replica, instance, cmds)
 
 	if seq >= r.maxSeq {
 		r.maxSeq = seq + 1
 	}
 
-	r.recordInstanceMetadata(r.InstanceSpace[r.Id][instance])
+	r.recordInstanceMetadata(inst)
 	r.recordCommands(cmds)
 	r.sync()
 
-	r.bcastPreAccept(r.Id, instance, ballot, cmds, seq, deps)
+	inst.lb.startRound(r.bcastPreAccept(replica, instance, ballot, cmds, seq, deps))
+
+	if replica != r.Id || !isInitialBallot(ballot) {
+		return
+	}
 
 	cpcounter += batchSize
 
@@ -878,12 +974,11 @@ func (r *Replica) startPhase1(replica int32, instance int32, ballot int32, propo
 		r.InstanceSpace[r.Id][instance] = &Instance{
 			cpMarker,
 			0,
+			0,
 			epaxosproto.PREACCEPTED,
 			r.maxSeq,
 			deps,
-			&LeaderBookkeeping{nil, 0, 0, true, 0, 0, 0, deps, nil, nil, false, false, nil, 0},
-			0,
-			0,
+			&LeaderBookkeeping{nil, 0, 0, true, 0, 0, 0, deps, nil, nil, false, false, nil, 0, time.Time{}, nil, 0, time.Time{}, nil, false},
 			nil}
 
 		r.latestCPReplica = r.Id
@@ -895,12 +990,12 @@ func (r *Replica) startPhase1(replica int32, instance int32, ballot int32, propo
 		r.recordInstanceMetadata(r.InstanceSpace[r.Id][instance])
 		r.sync()
 
-		r.bcastPreAccept(r.Id, instance, 0, cpMarker, r.maxSeq, deps)
+		r.InstanceSpace[r.Id][instance].lb.startRound(r.bcastPreAccept(r.Id, instance, 0, cpMarker, r.maxSeq, deps))
 	}
 }
 
 func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
-	inst := r.InstanceSpace[preAccept.LeaderId][preAccept.Instance]
+	inst := r.InstanceSpace[preAccept.Replica][preAccept.Instance]
 
 	if preAccept.Seq >= r.maxSeq {
 		r.maxSeq = preAccept.Seq + 1
@@ -909,9 +1004,10 @@ func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
 	if inst != nil && (inst.Status == epaxosproto.COMMITTED || inst.Status == epaxosproto.ACCEPTED) {
 		//reordered handling of commit/accept and pre-accept
 		if inst.Cmds == nil {
-			r.InstanceSpace[preAccept.LeaderId][preAccept.Instance].Cmds = preAccept.Command
+			r.InstanceSpace[preAccept.Replica][preAccept.Instance].Cmds = preAccept.Command
 			r.updateConflicts(preAccept.Command, preAccept.Replica, preAccept.Instance, preAccept.Seq)
-			//r.InstanceSpace[preAccept.LeaderId][preAccept.Instance].bfilter = bfFromCommands(preAccept.Command)
+			r.InstanceSpace[preAccept.Replica][preAccept.Instance].bfilter = bfFromCommands(preAccept.Command)
+			r.notifyCommitted(preAccept.Replica, preAccept.Instance)
 		}
 		r.recordCommands(preAccept.Command)
 		r.sync()
@@ -940,6 +1036,7 @@ func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
 		if preAccept.Ballot < inst.ballot {
 			r.replyPreAccept(preAccept.LeaderId,
 				&epaxosproto.PreAcceptReply{
+					r.Id,
 					preAccept.Replica,
 					preAccept.Instance,
 					FALSE,
@@ -950,23 +1047,27 @@ func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
 			return
 		} else {
 			inst.Cmds = preAccept.Command
+			inst.bfilter = bfFromCommands(preAccept.Command)
 			inst.Seq = seq
 			inst.Deps = deps
 			inst.ballot = preAccept.Ballot
+			inst.vballot = preAccept.Ballot
 			inst.Status = status
 		}
 	} else {
 		r.InstanceSpace[preAccept.Replica][preAccept.Instance] = &Instance{
 			preAccept.Command,
 			preAccept.Ballot,
+			preAccept.Ballot,
 			status,
 			seq,
 			deps,
-			nil, 0, 0,
-			nil}
+			nil,
+			bfFromCommands(preAccept.Command)}
 	}
 
 	r.updateConflicts(preAccept.Command, preAccept.Replica, preAccept.Instance, preAccept.Seq)
+	r.notifyProposed(preAccept.Replica, preAccept.Instance, preAccept.Command)
 
 	r.recordInstanceMetadata(r.InstanceSpace[preAccept.Replica][preAccept.Instance])
 	r.recordCommands(preAccept.Command)
@@ -985,6 +1086,7 @@ func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
 	if changed || uncommittedDeps || preAccept.Replica != preAccept.LeaderId || !isInitialBallot(preAccept.Ballot) {
 		r.replyPreAccept(preAccept.LeaderId,
 			&epaxosproto.PreAcceptReply{
+				r.Id,
 				preAccept.Replica,
 				preAccept.Instance,
 				TRUE,
@@ -993,7 +1095,7 @@ func (r *Replica) handlePreAccept(preAccept *epaxosproto.PreAccept) {
 				deps,
 				r.CommittedUpTo})
 	} else {
-		pok := &epaxosproto.PreAcceptOK{preAccept.Instance}
+		pok := &epaxosproto.PreAcceptOK{r.Id, preAccept.Instance}
 		r.SendMsg(preAccept.LeaderId, r.preAcceptOKRPC, pok)
 	}
 
@@ -1009,31 +1111,26 @@ func (r *Replica) handlePreAcceptReply(pareply *epaxosproto.PreAcceptReply) {
 		return
 	}
 
-	if inst.ballot != pareply.Ballot {
+	if pareply.OK == FALSE {
+		// NACKs carry the ballot that the acceptor has moved on to
+		r.handleNack(pareply.Replica, pareply.Instance, pareply.Ballot)
 		return
 	}
 
-	if pareply.OK == FALSE {
-		// TODO: there is probably another active leader
-		inst.lb.nacks++
-		if pareply.Ballot > inst.lb.maxRecvBallot {
-			inst.lb.maxRecvBallot = pareply.Ballot
-		}
-		if inst.lb.nacks >= r.N/2 {
-			// TODO
-		}
+	if inst.ballot != pareply.Ballot {
 		return
 	}
 
 	inst.lb.preAcceptOKs++
+	inst.lb.ackLease(pareply.AcceptorId, r.N)
 
 	var equal bool
 	inst.Seq, inst.Deps, equal = r.mergeAttributes(inst.Seq, inst.Deps, pareply.Seq, pareply.Deps)
-	if (r.N <= 3 && !r.Thrifty) || inst.lb.preAcceptOKs > 1 {
-		inst.lb.allEqual = inst.lb.allEqual && equal
-		if !equal {
-			conflicted++
-		}
+	// recovery only looks for the leader's own attributes, so the fast
+	// path needs every reply to agree with them
+	inst.lb.allEqual = inst.lb.allEqual && equal
+	if !equal {
+		conflicted++
 	}
 
 	allCommitted := true
@@ -1050,37 +1147,25 @@ func (r *Replica) handlePreAcceptReply(pareply *epaxosproto.PreAcceptReply) {
 	}
 
 	//can we commit on the fast path?
-	if inst.lb.preAcceptOKs >= r.N/2 && inst.lb.allEqual && allCommitted && isInitialBallot(inst.ballot) {
+	fastPossible := inst.lb.allEqual && isInitialBallot(inst.ballot)
+	if inst.lb.preAcceptOKs >= r.fastQuorumSize()-1 && fastPossible && allCommitted {
+		if !r.leasesAcked(inst) {
+			inst.lb.waitingForLeases = true
+			return
+		}
 		happy++
 		dlog.Printf("Fast path for instance %d.%d\n", pareply.Replica, pareply.Instance)
-		r.InstanceSpace[pareply.Replica][pareply.Instance].Status = epaxosproto.COMMITTED
-		r.updateCommitted(pareply.Replica)
-		if inst.lb.clientProposals != nil && !r.Dreply {
-			// give clients the all clear
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ReplyProposeTS(
-					&genericsmrproto.ProposeReplyTS{
-						TRUE,
-						inst.lb.clientProposals[i].CommandId,
-						state.NIL,
-						inst.lb.clientProposals[i].Timestamp},
-					inst.lb.clientProposals[i].Reply)
-			}
-		}
-
-		r.recordInstanceMetadata(inst)
-		r.sync() //is this necessary here?
-
-		r.bcastCommit(pareply.Replica, pareply.Instance, inst.Cmds, inst.Seq, inst.Deps)
-	} else if inst.lb.preAcceptOKs >= r.N/2 {
+		r.commitInstance(pareply.Replica, pareply.Instance, inst)
+	} else if inst.lb.preAcceptOKs >= r.N/2 && (!fastPossible || inst.lb.preAcceptOKs >= r.fastQuorumSize()-1) {
+		// the fast path is out of reach, otherwise we wait for the fast
+		// quorum until PHASE_TIMEOUT
 		if !allCommitted {
 			weird++
 		}
 		slow++
 		inst.Status = epaxosproto.ACCEPTED
-		r.bcastAccept(pareply.Replica, pareply.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps)
+		inst.lb.startRound(r.bcastAccept(pareply.Replica, pareply.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps))
 	}
-	//TODO: take the slow path if messages are slow to arrive
 }
 
 func (r *Replica) handlePreAcceptOK(pareply *epaxosproto.PreAcceptOK) {
@@ -1097,6 +1182,7 @@ func (r *Replica) handlePreAcceptOK(pareply *epaxosproto.PreAcceptOK) {
 	}
 
 	inst.lb.preAcceptOKs++
+	inst.lb.ackLease(pareply.AcceptorId, r.N)
 
 	allCommitted := true
 	for q := 0; q < r.N; q++ {
@@ -1112,36 +1198,24 @@ func (r *Replica) handlePreAcceptOK(pareply *epaxosproto.PreAcceptOK) {
 	}
 
 	//can we commit on the fast path?
-	if inst.lb.preAcceptOKs >= r.N/2 && inst.lb.allEqual && allCommitted && isInitialBallot(inst.ballot) {
-		happy++
-		r.InstanceSpace[r.Id][pareply.Instance].Status = epaxosproto.COMMITTED
-		r.updateCommitted(r.Id)
-		if inst.lb.clientProposals != nil && !r.Dreply {
-			// give clients the all clear
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ReplyProposeTS(
-					&genericsmrproto.ProposeReplyTS{
-						TRUE,
-						inst.lb.clientProposals[i].CommandId,
-						state.NIL,
-						inst.lb.clientProposals[i].Timestamp},
-					inst.lb.clientProposals[i].Reply)
-			}
+	fastPossible := inst.lb.allEqual && isInitialBallot(inst.ballot)
+	if inst.lb.preAcceptOKs >= r.fastQuorumSize()-1 && fastPossible && allCommitted {
+		if !r.leasesAcked(inst) {
+			inst.lb.waitingForLeases = true
+			return
 		}
-
-		r.recordInstanceMetadata(inst)
-		r.sync() //is this necessary here?
-
-		r.bcastCommit(r.Id, pareply.Instance, inst.Cmds, inst.Seq, inst.Deps)
-	} else if inst.lb.preAcceptOKs >= r.N/2 {
+		happy++
+		r.commitInstance(r.Id, pareply.Instance, inst)
+	} else if inst.lb.preAcceptOKs >= r.N/2 && (!fastPossible || inst.lb.preAcceptOKs >= r.fastQuorumSize()-1) {
+		// the fast path is out of reach, otherwise we wait for the fast
+		// quorum until PHASE_TIMEOUT
 		if !allCommitted {
 			weird++
 		}
 		slow++
 		inst.Status = epaxosproto.ACCEPTED
-		r.bcastAccept(r.Id, pareply.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps)
+		inst.lb.startRound(r.bcastAccept(r.Id, pareply.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps))
 	}
-	//TODO: take the slow path if messages are slow to arrive
 }
 
 /**********************************************************************
@@ -1151,7 +1225,7 @@ func (r *Replica) handlePreAcceptOK(pareply *epaxosproto.PreAcceptOK) {
 ***********************************************************************/
 
 func (r *Replica) handleAccept(accept *epaxosproto.Accept) {
-	inst := r.InstanceSpace[accept.LeaderId][accept.Instance]
+	inst := r.InstanceSpace[accept.Replica][accept.Instance]
 
 	if accept.Seq >= r.maxSeq {
 		r.maxSeq = accept.Seq + 1
@@ -1161,26 +1235,41 @@ func (r *Replica) handleAccept(accept *epaxosproto.Accept) {
 		return
 	}
 
-	if accept.Instance >= r.crtInstance[accept.LeaderId] {
-		r.crtInstance[accept.LeaderId] = accept.Instance + 1
+	if accept.Instance >= r.crtInstance[accept.Replica] {
+		r.crtInstance[accept.Replica] = accept.Instance + 1
 	}
 
 	if inst != nil {
 		if accept.Ballot < inst.ballot {
-			r.replyAccept(accept.LeaderId, &epaxosproto.AcceptReply{accept.Replica, accept.Instance, FALSE, inst.ballot})
+			r.replyAccept(accept.LeaderId, &epaxosproto.AcceptReply{r.Id, accept.Replica, accept.Instance, FALSE, inst.ballot})
 			return
 		}
+		inst.ballot = accept.Ballot
+		inst.vballot = accept.Ballot
 		inst.Status = epaxosproto.ACCEPTED
 		inst.Seq = accept.Seq
 		inst.Deps = accept.Deps
+		if accept.Count == 0 {
+			// a NO-OP, whatever was pre-accepted before
+			inst.Cmds = []state.Command{}
+			inst.bfilter = nil
+		} else if len(inst.Cmds) == 0 {
+			inst.Cmds = nil
+		}
 	} else {
-		r.InstanceSpace[accept.LeaderId][accept.Instance] = &Instance{
-			nil,
+		// the commands arrive with the PreAccept, unless there are none
+		var cmds []state.Command
+		if accept.Count == 0 {
+			cmds = []state.Command{}
+		}
+		r.InstanceSpace[accept.Replica][accept.Instance] = &Instance{
+			cmds,
+			accept.Ballot,
 			accept.Ballot,
 			epaxosproto.ACCEPTED,
 			accept.Seq,
 			accept.Deps,
-			nil, 0, 0, nil}
+			nil, nil}
 
 		if accept.Count == 0 {
 			//checkpoint
@@ -1193,11 +1282,16 @@ func (r *Replica) handleAccept(accept *epaxosproto.Accept) {
 		}
 	}
 
+	if r.InstanceSpace[accept.Replica][accept.Instance].Cmds == nil {
+		r.blind[instanceId{accept.Replica, accept.Instance}] = true
+	}
+
 	r.recordInstanceMetadata(r.InstanceSpace[accept.Replica][accept.Instance])
 	r.sync()
 
 	r.replyAccept(accept.LeaderId,
 		&epaxosproto.AcceptReply{
+			r.Id,
 			accept.Replica,
 			accept.Instance,
 			TRUE,
@@ -1212,44 +1306,24 @@ func (r *Replica) handleAcceptReply(areply *epaxosproto.AcceptReply) {
 		return
 	}
 
-	if inst.ballot != areply.Ballot {
+	if areply.OK == FALSE {
+		r.handleNack(areply.Replica, areply.Instance, areply.Ballot)
 		return
 	}
 
-	if areply.OK == FALSE {
-		// TODO: there is probably another active leader
-		inst.lb.nacks++
-		if areply.Ballot > inst.lb.maxRecvBallot {
-			inst.lb.maxRecvBallot = areply.Ballot
-		}
-		if inst.lb.nacks >= r.N/2 {
-			// TODO
-		}
+	if inst.ballot != areply.Ballot {
 		return
 	}
 
 	inst.lb.acceptOKs++
+	inst.lb.ackLease(areply.AcceptorId, r.N)
 
 	if inst.lb.acceptOKs+1 > r.N/2 {
-		r.InstanceSpace[areply.Replica][areply.Instance].Status = epaxosproto.COMMITTED
-		r.updateCommitted(areply.Replica)
-		if inst.lb.clientProposals != nil && !r.Dreply {
-			// give clients the all clear
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ReplyProposeTS(
-					&genericsmrproto.ProposeReplyTS{
-						TRUE,
-						inst.lb.clientProposals[i].CommandId,
-						state.NIL,
-						inst.lb.clientProposals[i].Timestamp},
-					inst.lb.clientProposals[i].Reply)
-			}
+		if !r.leasesAcked(inst) {
+			inst.lb.waitingForLeases = true
+			return
 		}
-
-		r.recordInstanceMetadata(inst)
-		r.sync() //is this necessary here?
-
-		r.bcastCommit(areply.Replica, areply.Instance, inst.Cmds, inst.Seq, inst.Deps)
+		r.commitInstance(areply.Replica, areply.Instance, inst)
 	}
 }
 
@@ -1271,28 +1345,26 @@ func (r *Replica) handleCommit(commit *epaxosproto.Commit) {
 	}
 
 	if inst != nil {
-		if inst.lb != nil && inst.lb.clientProposals != nil && len(commit.Command) == 0 {
-			//someone committed a NO-OP, but we have proposals for this instance
-			//try in a different instance
-			for _, p := range inst.lb.clientProposals {
-				r.ProposeChan <- p
-			}
-			inst.lb = nil
-		}
+		committed := inst.Status >= epaxosproto.COMMITTED
+		inst.Cmds = commit.Command
+		inst.bfilter = bfFromCommands(commit.Command)
 		inst.Seq = commit.Seq
 		inst.Deps = commit.Deps
 		inst.Status = epaxosproto.COMMITTED
+		if !committed {
+			// another replica finished an instance that we lead
+			r.answerProposals(inst)
+		}
 	} else {
 		r.InstanceSpace[commit.Replica][int(commit.Instance)] = &Instance{
 			commit.Command,
 			0,
+			0,
 			epaxosproto.COMMITTED,
 			commit.Seq,
 			commit.Deps,
 			nil,
-			0,
-			0,
-			nil}
+			bfFromCommands(commit.Command)}
 		r.updateConflicts(commit.Command, commit.Replica, commit.Instance, commit.Seq)
 
 		if len(commit.Command) == 0 {
@@ -1306,6 +1378,7 @@ func (r *Replica) handleCommit(commit *epaxosproto.Commit) {
 		}
 	}
 	r.updateCommitted(commit.Replica)
+	r.notifyCommitted(commit.Replica, commit.Instance)
 
 	r.recordInstanceMetadata(r.InstanceSpace[commit.Replica][commit.Instance])
 	r.recordCommands(commit.Command)
@@ -1319,24 +1392,30 @@ func (r *Replica) handleCommitShort(commit *epaxosproto.CommitShort) {
 	}
 
 	if inst != nil {
-		if inst.lb != nil && inst.lb.clientProposals != nil {
-			//try command in a different instance
-			for _, p := range inst.lb.clientProposals {
-				r.ProposeChan <- p
-			}
-			inst.lb = nil
+		committed := inst.Status >= epaxosproto.COMMITTED
+		if commit.Count == 0 {
+			inst.Cmds = []state.Command{}
 		}
 		inst.Seq = commit.Seq
 		inst.Deps = commit.Deps
 		inst.Status = epaxosproto.COMMITTED
+		if !committed {
+			r.answerProposals(inst)
+		}
 	} else {
+		// the commands of a short commit arrive with the PreAccept, unless there are none
+		var cmds []state.Command
+		if commit.Count == 0 {
+			cmds = []state.Command{}
+		}
 		r.InstanceSpace[commit.Replica][commit.Instance] = &Instance{
-			nil,
+			cmds,
+			0,
 			0,
 			epaxosproto.COMMITTED,
 			commit.Seq,
 			commit.Deps,
-			nil, 0, 0, nil}
+			nil, nil}
 
 		if commit.Count == 0 {
 			//checkpoint
@@ -1348,11 +1427,199 @@ func (r *Replica) handleCommitShort(commit *epaxosproto.CommitShort) {
 			r.clearHashtables()
 		}
 	}
+	if r.InstanceSpace[commit.Replica][commit.Instance].Cmds == nil {
+		r.blind[instanceId{commit.Replica, commit.Instance}] = true
+	}
 	r.updateCommitted(commit.Replica)
+	r.notifyCommitted(commit.Replica, commit.Instance)
 
 	r.recordInstanceMetadata(r.InstanceSpace[commit.Replica][commit.Instance])
 }
 
+// commitInstance commits an instance that this replica leads, and lets the
+// other replicas know
+func (r *Replica) commitInstance(replica int32, instance int32, inst *Instance) {
+	inst.Status = epaxosproto.COMMITTED
+	inst.lb.waitingForLeases = false
+	r.updateCommitted(replica)
+	r.answerProposals(inst)
+	r.notifyCommitted(replica, instance)
+
+	r.recordInstanceMetadata(inst)
+	r.sync() //is this necessary here?
+
+	r.bcastCommit(replica, instance, inst.Cmds, inst.Seq, inst.Deps)
+}
+
+// answerProposals deals with the clients waiting on an instance that this
+// replica leads, once it is committed. If a NO-OP took the instance, their
+// commands are put back, to be tried in a different instance. The event loop
+// is the only reader of ProposeChan, so it must not block on it.
+func (r *Replica) answerProposals(inst *Instance) {
+	if inst.lb == nil || inst.lb.clientProposals == nil {
+		return
+	}
+	if len(inst.Cmds) == 0 {
+		r.pending = append(r.pending, inst.lb.clientProposals...)
+		inst.lb.clientProposals = nil
+		return
+	}
+	if !r.Dreply {
+		// give clients the all clear
+		for i := 0; i < len(inst.lb.clientProposals); i++ {
+			r.ReplyProposeTS(
+				&genericsmrproto.ProposeReplyTS{
+					TRUE,
+					inst.lb.clientProposals[i].CommandId,
+					state.NIL,
+					inst.lb.clientProposals[i].Timestamp},
+				inst.lb.clientProposals[i].Reply)
+		}
+	}
+}
+
+/**********************************************************************
+
+                      COMPETING LEADERS
+
+***********************************************************************/
+
+// handleNack defers to the leader whose ballot an acceptor has promised
+// instead of ours. Adopting its ballot makes us ignore the replies we are
+// still owed; if it does not commit the instance before the backoff is over,
+// checkLeaderTimeouts takes the instance over with a higher ballot.
+func (r *Replica) handleNack(replica int32, instance int32, ballot int32) {
+	inst := r.InstanceSpace[replica][instance]
+	lb := inst.lb
+	lb.nacks++
+	if ballot <= inst.ballot {
+		return
+	}
+	inst.ballot = ballot
+	r.deferInstance(lb)
+	dlog.Printf("Deferring to ballot %d in instance %d.%d\n", ballot, replica, instance)
+}
+
+// deferInstance stops leading an instance until the backoff is over
+func (r *Replica) deferInstance(lb *LeaderBookkeeping) {
+	lb.preparing = false
+	lb.tryingToPreAccept = false
+
+	if lb.backoff == 0 {
+		lb.backoff = MIN_BACKOFF
+	} else if lb.backoff < MAX_BACKOFF {
+		lb.backoff *= 2
+		if lb.backoff > MAX_BACKOFF {
+			lb.backoff = MAX_BACKOFF
+		}
+	}
+	lb.deferUntil = time.Now().Add(lb.backoff + time.Duration(rand.Int63n(int64(lb.backoff))))
+}
+
+// ownsBallot tells whether this replica leads an instance of replica at ballot
+func (r *Replica) ownsBallot(replica int32, ballot int32) bool {
+	if isInitialBallot(ballot) {
+		return replica == r.Id
+	}
+	return replicaIdFromBallot(ballot) == r.Id
+}
+
+// checkLeaderTimeouts moves on the instances that this replica leads and
+// that are waiting for replies, or for another leader, for too long
+func (r *Replica) checkLeaderTimeouts() {
+	now := time.Now()
+	for q := int32(0); q < int32(r.N); q++ {
+		for i := r.CommittedUpTo[q] + 1; i < r.crtInstance[q]; i++ {
+			inst := r.InstanceSpace[q][i]
+			if inst == nil || inst.lb == nil || inst.Status >= epaxosproto.COMMITTED {
+				continue
+			}
+			lb := inst.lb
+
+			if !lb.deferUntil.IsZero() {
+				if now.Before(lb.deferUntil) {
+					continue
+				}
+				// the other leader did not get through either
+				dlog.Printf("Taking over instance %d.%d\n", q, i)
+				r.startRecoveryForInstance(q, i)
+				continue
+			}
+
+			if !r.ownsBallot(q, inst.ballot) {
+				// another replica started recovering the instance since
+				r.deferInstance(lb)
+				continue
+			}
+
+			if lb.waitingForLeases {
+				if r.leasesAcked(inst) {
+					// the holders that did not acknowledge the instance lost their leases
+					r.commitInstance(q, i, inst)
+				} else if now.Sub(lb.phaseStart) >= PHASE_TIMEOUT {
+					r.widenRound(q, i, inst)
+				}
+				continue
+			}
+
+			if lb.phaseStart.IsZero() || now.Sub(lb.phaseStart) < PHASE_TIMEOUT {
+				continue
+			}
+
+			if lb.preparing || lb.tryingToPreAccept {
+				// not enough replies to go on, try again with a higher ballot
+				r.deferInstance(lb)
+				continue
+			}
+
+			if inst.Status != epaxosproto.ACCEPTED && lb.preAcceptOKs >= r.N/2 {
+				// the rest of the fast quorum is late
+				slow++
+				inst.Status = epaxosproto.ACCEPTED
+				lb.acceptOKs = 0
+				lb.startRound(r.bcastAccept(q, i, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps))
+				continue
+			}
+			r.widenRound(q, i, inst)
+		}
+	}
+}
+
+// widenRound sends the current PreAccept or Accept round of an instance to
+// the live peers that the broadcast left out
+func (r *Replica) widenRound(replica int32, instance int32, inst *Instance) {
+	lb := inst.lb
+	if lb.sentTo == nil {
+		lb.sentTo = make([]bool, r.N)
+	}
+
+	var msg fastrpc.Serializable
+	var rpc uint8
+	if inst.Status == epaxosproto.ACCEPTED {
+		msg = &epaxosproto.Accept{r.Id, replica, instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps}
+		rpc = r.acceptRPC
+	} else {
+		msg = &epaxosproto.PreAccept{r.Id, replica, instance, inst.ballot, inst.Cmds, inst.Seq, inst.Deps}
+		rpc = r.preAcceptRPC
+	}
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || lb.sentTo[q] || !r.Alive[q] {
+			continue
+		}
+		r.SendMsg(q, rpc, msg)
+		lb.sentTo[q] = true
+	}
+	lb.phaseStart = time.Now()
+}
+
+// startRound records that a PreAccept or Accept round was sent to sentTo
+func (lb *LeaderBookkeeping) startRound(sentTo []bool) {
+	lb.phaseStart = time.Now()
+	lb.sentTo = sentTo
+	lb.waitingForLeases = false
+}
+
 /**********************************************************************
 
                       RECOVERY ACTIONS
@@ -1360,51 +1627,68 @@ func (r *Replica) handleCommitShort(commit *epaxosproto.CommitShort) {
 ***********************************************************************/
 
 func (r *Replica) startRecoveryForInstance(replica int32, instance int32) {
-	var nildeps [DS]int32
+	nildeps := make([]int32, r.N)
 
 	if r.InstanceSpace[replica][instance] == nil {
-		r.InstanceSpace[replica][instance] = &Instance{nil, 0, epaxosproto.NONE, 0, nildeps, nil, 0, 0, nil}
+		r.InstanceSpace[replica][instance] = &Instance{nil, 0, -1, epaxosproto.NONE, 0, nildeps, nil, nil}
+	}
+	if instance >= r.crtInstance[replica] {
+		// so that checkLeaderTimeouts keeps track of the recovery
+		r.crtInstance[replica] = instance + 1
 	}
 
 	inst := r.InstanceSpace[replica][instance]
-	if inst.lb == nil {
-		inst.lb = &LeaderBookkeeping{nil, -1, 0, false, 0, 0, 0, nildeps, nil, nil, true, false, nil, 0}
-
-	} else {
-		inst.lb = &LeaderBookkeeping{inst.lb.clientProposals, -1, 0, false, 0, 0, 0, nildeps, nil, nil, true, false, nil, 0}
+	if inst.Status >= epaxosproto.COMMITTED && inst.Cmds != nil {
+		return
 	}
 
-	if inst.Status == epaxosproto.ACCEPTED {
-		inst.lb.recoveryInst = &RecoveryInstance{inst.Cmds, inst.Status, inst.Seq, inst.Deps, 0, false}
-		inst.lb.maxRecvBallot = inst.ballot
-	} else if inst.Status >= epaxosproto.PREACCEPTED {
-		inst.lb.recoveryInst = &RecoveryInstance{inst.Cmds, inst.Status, inst.Seq, inst.Deps, 1, (r.Id == replica)}
+	var proposals []*genericsmr.Propose
+	var backoff time.Duration
+	if inst.lb != nil {
+		proposals = inst.lb.clientProposals
+		backoff = inst.lb.backoff
 	}
+	inst.lb = &LeaderBookkeeping{proposals, -1, 0, false, 0, 0, 0, nildeps, nil, nil, true, false, nil, 0, time.Now(), nil, backoff, time.Time{}, nil, false}
 
 	//compute larger ballot
 	inst.ballot = r.makeBallotLargerThan(inst.ballot)
 
+	// what this replica knows counts like any other reply to the Prepare
+	r.updateRecoveryInstance(inst.lb, &epaxosproto.PrepareReply{
+		r.Id,
+		replica,
+		instance,
+		TRUE,
+		inst.ballot,
+		inst.vballot,
+		inst.Status,
+		inst.Cmds,
+		inst.Seq,
+		inst.Deps})
+
 	r.bcastPrepare(replica, instance, inst.ballot)
 }
 
 func (r *Replica) handlePrepare(prepare *epaxosproto.Prepare) {
 	inst := r.InstanceSpace[prepare.Replica][prepare.Instance]
 	var preply *epaxosproto.PrepareReply
-	var nildeps [DS]int32
+	nildeps := make([]int32, r.N)
 
 	if inst == nil {
 		r.InstanceSpace[prepare.Replica][prepare.Instance] = &Instance{
 			nil,
 			prepare.Ballot,
+			-1,
 			epaxosproto.NONE,
 			0,
 			nildeps,
-			nil, 0, 0, nil}
+			nil, nil}
 		preply = &epaxosproto.PrepareReply{
 			r.Id,
 			prepare.Replica,
 			prepare.Instance,
 			TRUE,
+			prepare.Ballot,
 			-1,
 			epaxosproto.NONE,
 			nil,
@@ -1412,17 +1696,20 @@ func (r *Replica) handlePrepare(prepare *epaxosproto.Prepare) {
 			nildeps}
 	} else {
 		ok := TRUE
-		if prepare.Ballot < inst.ballot {
+		if prepare.Ballot < inst.ballot && inst.Status < epaxosproto.COMMITTED {
 			ok = FALSE
-		} else {
+		} else if prepare.Ballot > inst.ballot {
 			inst.ballot = prepare.Ballot
 		}
+		// the ballot of what we (pre-)accepted, not the one we promised, tells
+		// the new leader which of the accepted values may have been chosen
 		preply = &epaxosproto.PrepareReply{
 			r.Id,
 			prepare.Replica,
 			prepare.Instance,
 			ok,
 			inst.ballot,
+			inst.vballot,
 			inst.Status,
 			inst.Cmds,
 			inst.Seq,
@@ -1435,128 +1722,219 @@ func (r *Replica) handlePrepare(prepare *epaxosproto.Prepare) {
 func (r *Replica) handlePrepareReply(preply *epaxosproto.PrepareReply) {
 	inst := r.InstanceSpace[preply.Replica][preply.Instance]
 
-	if inst.lb == nil || !inst.lb.preparing {
+	if inst.lb == nil || !inst.lb.preparing || inst.Status >= epaxosproto.COMMITTED && inst.Cmds != nil {
 		// we've moved on -- these are delayed replies, so just ignore
-		// TODO: should replies for non-current ballots be ignored?
-		return
-	}
-
-	if preply.OK == FALSE {
-		// TODO: there is probably another active leader, back off and retry later
-		inst.lb.nacks++
 		return
 	}
 
-	//Got an ACK (preply.OK == TRUE)
-
-	inst.lb.prepareOKs++
-
-	if preply.Status == epaxosproto.COMMITTED || preply.Status == epaxosproto.EXECUTED {
+	if (preply.Status == epaxosproto.COMMITTED || preply.Status == epaxosproto.EXECUTED) && preply.Command != nil {
+		inst.lb.preparing = false
 		r.InstanceSpace[preply.Replica][preply.Instance] = &Instance{
 			preply.Command,
 			inst.ballot,
+			inst.ballot,
 			epaxosproto.COMMITTED,
 			preply.Seq,
 			preply.Deps,
-			nil, 0, 0, nil}
-		r.bcastCommit(preply.Replica, preply.Instance, inst.Cmds, preply.Seq, preply.Deps)
-		//TODO: check if we should send notifications to clients
+			inst.lb, bfFromCommands(preply.Command)}
+		r.updateConflicts(preply.Command, preply.Replica, preply.Instance, preply.Seq)
+		r.updateCommitted(preply.Replica)
+		r.answerProposals(r.InstanceSpace[preply.Replica][preply.Instance])
+		r.notifyCommitted(preply.Replica, preply.Instance)
+
+		r.recordInstanceMetadata(r.InstanceSpace[preply.Replica][preply.Instance])
+		r.recordCommands(preply.Command)
+		r.sync()
+
+		r.bcastCommit(preply.Replica, preply.Instance, preply.Command, preply.Seq, preply.Deps)
 		return
 	}
 
-	if preply.Status == epaxosproto.ACCEPTED {
-		if inst.lb.recoveryInst == nil || inst.lb.maxRecvBallot < preply.Ballot {
-			inst.lb.recoveryInst = &RecoveryInstance{preply.Command, preply.Status, preply.Seq, preply.Deps, 0, false}
-			inst.lb.maxRecvBallot = preply.Ballot
-		}
+	if preply.OK == FALSE {
+		r.handleNack(preply.Replica, preply.Instance, preply.Ballot)
+		return
 	}
 
-	if (preply.Status == epaxosproto.PREACCEPTED || preply.Status == epaxosproto.PREACCEPTED_EQ) &&
-		(inst.lb.recoveryInst == nil || inst.lb.recoveryInst.status < epaxosproto.ACCEPTED) {
-		if inst.lb.recoveryInst == nil {
-			inst.lb.recoveryInst = &RecoveryInstance{preply.Command, preply.Status, preply.Seq, preply.Deps, 1, false}
-		} else if preply.Seq == inst.Seq && equal(&preply.Deps, &inst.Deps) {
-			inst.lb.recoveryInst.preAcceptCount++
-		} else if preply.Status == epaxosproto.PREACCEPTED_EQ {
-			// If we get different ordering attributes from pre-acceptors, we must go with the ones
-			// that agreed with the initial command leader (in case we do not use Thrifty).
-			// This is safe if we use thrifty, although we can also safely start phase 1 in that case.
-			inst.lb.recoveryInst = &RecoveryInstance{preply.Command, preply.Status, preply.Seq, preply.Deps, 1, false}
-		}
-		if preply.AcceptorId == preply.Replica {
-			//if the reply is from the initial command leader, then it's safe to restart phase 1
-			inst.lb.recoveryInst.leaderResponded = true
-			return
-		}
+	if preply.Ballot != inst.ballot {
+		// a reply to an earlier Prepare of ours
+		return
 	}
 
+	inst.lb.prepareOKs++
+	r.updateRecoveryInstance(inst.lb, preply)
+
 	if inst.lb.prepareOKs < r.N/2 {
 		return
 	}
 
 	//Received Prepare replies from a majority
+	r.finishPrepare(preply.Replica, preply.Instance)
+}
 
-	ir := inst.lb.recoveryInst
-
-	if ir != nil {
-		//at least one replica has (pre-)accepted this instance
-		if ir.status == epaxosproto.ACCEPTED ||
-			(!ir.leaderResponded && ir.preAcceptCount >= r.N/2 && (r.Thrifty || ir.status == epaxosproto.PREACCEPTED_EQ)) {
-			//safe to go to Accept phase
-			inst.Cmds = ir.cmds
-			inst.Seq = ir.seq
-			inst.Deps = ir.deps
-			inst.Status = epaxosproto.ACCEPTED
-			inst.lb.preparing = false
-			r.bcastAccept(preply.Replica, preply.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps)
-		} else if !ir.leaderResponded && ir.preAcceptCount >= (r.N/2+1)/2 {
-			//send TryPreAccepts
-			//but first try to pre-accept on the local replica
-			inst.lb.preAcceptOKs = 0
-			inst.lb.nacks = 0
-			inst.lb.possibleQuorum = make([]bool, r.N)
-			for q := 0; q < r.N; q++ {
-				inst.lb.possibleQuorum[q] = true
+// updateRecoveryInstance folds a reply to our Prepare into what recovery
+// knows about the instance. Accepted attributes take precedence over
+// pre-accepted ones, and among them those accepted at the highest ballot.
+// Among pre-accepted attributes, only the command leader's own, pre-accepted
+// at its initial ballot by other replicas, can have committed on the fast path.
+func (r *Replica) updateRecoveryInstance(lb *LeaderBookkeeping, preply *epaxosproto.PrepareReply) {
+	status := preply.Status
+	vballot := preply.VBallot
+	if status >= epaxosproto.COMMITTED {
+		// committed, but the commands did not reach the acceptor
+		status = epaxosproto.ACCEPTED
+		vballot = math.MaxInt32
+	}
+
+	ir := lb.recoveryInst
+	switch status {
+	case epaxosproto.ACCEPTED:
+		if ir == nil || ir.status < epaxosproto.ACCEPTED || ir.vballot < vballot {
+			cmds := preply.Command
+			if cmds == nil && ir != nil && len(ir.cmds) > 0 {
+				cmds = ir.cmds
 			}
-			if conf, q, i := r.findPreAcceptConflicts(ir.cmds, preply.Replica, preply.Instance, ir.seq, ir.deps); conf {
-				if r.InstanceSpace[q][i].Status >= epaxosproto.COMMITTED {
-					//start Phase1 in the initial leader's instance
-					r.startPhase1(preply.Replica, preply.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
-					return
-				} else {
-					inst.lb.nacks = 1
-					inst.lb.possibleQuorum[r.Id] = false
-				}
-			} else {
-				inst.Cmds = ir.cmds
-				inst.Seq = ir.seq
-				inst.Deps = ir.deps
-				inst.Status = epaxosproto.PREACCEPTED
-				inst.lb.preAcceptOKs = 1
-			}
-			inst.lb.preparing = false
-			inst.lb.tryingToPreAccept = true
-			r.bcastTryPreAccept(preply.Replica, preply.Instance, inst.ballot, inst.Cmds, inst.Seq, inst.Deps)
-		} else {
-			//start Phase1 in the initial leader's instance
-			inst.lb.preparing = false
-			r.startPhase1(preply.Replica, preply.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+			lb.recoveryInst = &RecoveryInstance{cmds, epaxosproto.ACCEPTED, preply.Seq, preply.Deps, 0, false, vballot}
 		}
-	} else {
+
+	case epaxosproto.PREACCEPTED, epaxosproto.PREACCEPTED_EQ:
+		identical := status == epaxosproto.PREACCEPTED_EQ && isInitialBallot(vballot) && preply.AcceptorId != preply.Replica
+		if ir == nil {
+			lb.recoveryInst = &RecoveryInstance{preply.Command, status, preply.Seq, preply.Deps, 0, false, vballot}
+		} else if ir.status < epaxosproto.ACCEPTED && identical && ir.preAcceptCount == 0 {
+			lb.recoveryInst = &RecoveryInstance{preply.Command, status, preply.Seq, preply.Deps, 0, ir.leaderResponded, vballot}
+		}
+		ir = lb.recoveryInst
+		if identical && ir.status < epaxosproto.ACCEPTED {
+			ir.preAcceptCount++
+		}
+		if preply.AcceptorId == preply.Replica {
+			ir.leaderResponded = true
+		}
+	}
+
+	if ir = lb.recoveryInst; ir != nil && ir.cmds == nil && len(preply.Command) > 0 {
+		// an instance only ever holds its leader's commands or a NO-OP
+		ir.cmds = preply.Command
+	}
+}
+
+// finishPrepare decides how to go on with a recovered instance once a
+// majority has answered the Prepare
+func (r *Replica) finishPrepare(replica int32, instance int32) {
+	inst := r.InstanceSpace[replica][instance]
+	ir := inst.lb.recoveryInst
+
+	switch {
+	case ir == nil:
 		//try to finalize instance by proposing NO-OP
-		var noop_deps [DS]int32
+		noop_deps := make([]int32, r.N)
 		// commands that depended on this instance must look at all previous instances
-		noop_deps[preply.Replica] = preply.Instance - 1
+		noop_deps[replica] = instance - 1
 		inst.lb.preparing = false
-		r.InstanceSpace[preply.Replica][preply.Instance] = &Instance{
-			nil,
+		r.InstanceSpace[replica][instance] = &Instance{
+			[]state.Command{},
+			inst.ballot,
 			inst.ballot,
 			epaxosproto.ACCEPTED,
 			0,
 			noop_deps,
-			inst.lb, 0, 0, nil}
-		r.bcastAccept(preply.Replica, preply.Instance, inst.ballot, 0, 0, noop_deps)
+			inst.lb, nil}
+		inst.lb.startRound(r.bcastAccept(replica, instance, inst.ballot, 0, 0, noop_deps))
+
+	case ir.status == epaxosproto.ACCEPTED:
+		if ir.cmds == nil {
+			// none of the replicas that answered so far has the commands
+			return
+		}
+		if inst.Status >= epaxosproto.COMMITTED {
+			// the commands were all we were missing
+			inst.Cmds = ir.cmds
+			inst.bfilter = bfFromCommands(ir.cmds)
+			inst.lb.preparing = false
+			r.updateConflicts(inst.Cmds, replica, instance, inst.Seq)
+			r.notifyCommitted(replica, instance)
+			return
+		}
+		r.acceptRecovered(replica, instance, inst)
+
+	case ir.leaderResponded:
+		// the command leader has not committed the instance, and it no longer
+		// can at its initial ballot
+		inst.lb.preparing = false
+		r.startPhase1(replica, instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+
+	case ir.preAcceptCount >= r.N/2:
+		//safe to go to Accept phase
+		r.acceptRecovered(replica, instance, inst)
+
+	case ir.preAcceptCount >= (r.N/2+1)/2:
+		// the instance may have committed on the fast path. It did if the
+		// remaining replicas can still pre-accept the same attributes.
+		r.startTryPreAccept(replica, instance, inst)
+
+	default:
+		// too few replicas pre-accepted the leader's attributes for the fast path
+		inst.lb.preparing = false
+		r.startPhase1(replica, instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+	}
+}
+
+// acceptRecovered runs the Accept phase for the attributes that recovery
+// settled on
+func (r *Replica) acceptRecovered(replica int32, instance int32, inst *Instance) {
+	ir := inst.lb.recoveryInst
+	inst.Cmds = ir.cmds
+	inst.bfilter = bfFromCommands(ir.cmds)
+	inst.Seq = ir.seq
+	inst.Deps = ir.deps
+	inst.vballot = inst.ballot
+	inst.Status = epaxosproto.ACCEPTED
+	inst.lb.preparing = false
+	inst.lb.tryingToPreAccept = false
+	inst.lb.acceptOKs = 0
+	r.updateConflicts(inst.Cmds, replica, instance, inst.Seq)
+
+	r.recordInstanceMetadata(inst)
+	r.recordCommands(inst.Cmds)
+	r.sync()
+
+	inst.lb.startRound(r.bcastAccept(replica, instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps))
+}
+
+func (r *Replica) startTryPreAccept(replica int32, instance int32, inst *Instance) {
+	ir := inst.lb.recoveryInst
+	inst.lb.preparing = false
+	inst.lb.preAcceptOKs = 0
+	inst.lb.nacks = 0
+	inst.lb.tpaOKs = 0
+	inst.lb.possibleQuorum = make([]bool, r.N)
+	for q := 0; q < r.N; q++ {
+		inst.lb.possibleQuorum[q] = true
 	}
+
+	//but first try to pre-accept on the local replica
+	if conf, q, i := r.findPreAcceptConflicts(ir.cmds, replica, instance, ir.seq, ir.deps); conf {
+		if r.InstanceSpace[q][i].Status >= epaxosproto.COMMITTED {
+			//start Phase1 in the initial leader's instance
+			r.startPhase1(replica, instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+			return
+		}
+		inst.lb.nacks = 1
+		inst.lb.possibleQuorum[r.Id] = false
+	} else {
+		inst.Cmds = ir.cmds
+		inst.bfilter = bfFromCommands(ir.cmds)
+		inst.Seq = ir.seq
+		inst.Deps = ir.deps
+		inst.vballot = inst.ballot
+		inst.Status = epaxosproto.PREACCEPTED
+		inst.lb.preAcceptOKs = 1
+		r.updateConflicts(inst.Cmds, replica, instance, inst.Seq)
+	}
+
+	inst.lb.tryingToPreAccept = true
+	inst.lb.phaseStart = time.Now()
+	r.bcastTryPreAccept(replica, instance, inst.ballot, ir.cmds, ir.seq, ir.deps)
 }
 
 func (r *Replica) handleTryPreAccept(tpa *epaxosproto.TryPreAccept) {
@@ -1572,6 +1950,7 @@ func (r *Replica) handleTryPreAccept(tpa *epaxosproto.TryPreAccept) {
 			tpa.Replica,
 			tpa.Instance,
 			inst.Status})
+		return
 	}
 	if conflict, confRep, confInst := r.findPreAcceptConflicts(tpa.Command, tpa.Replica, tpa.Instance, tpa.Seq, tpa.Deps); conflict {
 		// there is a conflict, can't pre-accept
@@ -1580,36 +1959,48 @@ func (r *Replica) handleTryPreAccept(tpa *epaxosproto.TryPreAccept) {
 			tpa.Replica,
 			tpa.Instance,
 			FALSE,
-			inst.ballot,
+			tpa.Ballot,
 			confRep,
 			confInst,
 			r.InstanceSpace[confRep][confInst].Status})
+		return
+	}
+
+	// can pre-accept
+	if tpa.Instance >= r.crtInstance[tpa.Replica] {
+		r.crtInstance[tpa.Replica] = tpa.Instance + 1
+	}
+	if inst != nil {
+		inst.Cmds = tpa.Command
+		inst.bfilter = bfFromCommands(tpa.Command)
+		inst.Deps = tpa.Deps
+		inst.Seq = tpa.Seq
+		inst.Status = epaxosproto.PREACCEPTED
+		inst.ballot = tpa.Ballot
+		inst.vballot = tpa.Ballot
 	} else {
-		// can pre-accept
-		if tpa.Instance >= r.crtInstance[tpa.Replica] {
-			r.crtInstance[tpa.Replica] = tpa.Instance + 1
-		}
-		if inst != nil {
-			inst.Cmds = tpa.Command
-			inst.Deps = tpa.Deps
-			inst.Seq = tpa.Seq
-			inst.Status = epaxosproto.PREACCEPTED
-			inst.ballot = tpa.Ballot
-		} else {
-			r.InstanceSpace[tpa.Replica][tpa.Instance] = &Instance{
-				tpa.Command,
-				tpa.Ballot,
-				epaxosproto.PREACCEPTED,
-				tpa.Seq,
-				tpa.Deps,
-				nil, 0, 0,
-				nil}
-		}
-		r.replyTryPreAccept(tpa.LeaderId, &epaxosproto.TryPreAcceptReply{r.Id, tpa.Replica, tpa.Instance, TRUE, inst.ballot, 0, 0, 0})
+		inst = &Instance{
+			tpa.Command,
+			tpa.Ballot,
+			tpa.Ballot,
+			epaxosproto.PREACCEPTED,
+			tpa.Seq,
+			tpa.Deps,
+			nil,
+			bfFromCommands(tpa.Command)}
+		r.InstanceSpace[tpa.Replica][tpa.Instance] = inst
 	}
+	r.updateConflicts(tpa.Command, tpa.Replica, tpa.Instance, tpa.Seq)
+	r.notifyProposed(tpa.Replica, tpa.Instance, tpa.Command)
+
+	r.recordInstanceMetadata(inst)
+	r.recordCommands(tpa.Command)
+	r.sync()
+
+	r.replyTryPreAccept(tpa.LeaderId, &epaxosproto.TryPreAcceptReply{r.Id, tpa.Replica, tpa.Instance, TRUE, inst.ballot, 0, 0, 0})
 }
 
-func (r *Replica) findPreAcceptConflicts(cmds []state.Command, replica int32, instance int32, seq int32, deps [DS]int32) (bool, int32, int32) {
+func (r *Replica) findPreAcceptConflicts(cmds []state.Command, replica int32, instance int32, seq int32, deps []int32) (bool, int32, int32) {
 	inst := r.InstanceSpace[replica][instance]
 	if inst != nil && len(inst.Cmds) > 0 {
 		if inst.Status >= epaxosproto.ACCEPTED {
@@ -1617,13 +2008,13 @@ func (r *Replica) findPreAcceptConflicts(cmds []state.Command, replica int32, in
 			// we consider this a conflict because we shouldn't regress to PRE-ACCEPTED
 			return true, replica, instance
 		}
-		if inst.Seq == tpa.Seq && equal(&inst.Deps, &tpa.Deps) {
+		if inst.Seq == seq && equal(inst.Deps, deps) {
 			// already PRE-ACCEPTED, no point looking for conflicts again
 			return false, replica, instance
 		}
 	}
 	for q := int32(0); q < int32(r.N); q++ {
-		for i := r.ExecedUpTo[q]; i < r.crtInstance[q]; i++ {
+		for i := r.ExecedUpTo[q] + 1; i < r.crtInstance[q]; i++ {
 			if replica == q && instance == i {
 				// no point checking past instance in replica's row, since replica would have
 				// set the dependencies correctly for anything started after instance
@@ -1641,7 +2032,7 @@ func (r *Replica) findPreAcceptConflicts(cmds []state.Command, replica int32, in
 				// instance q.i depends on instance replica.instance, it is not a conflict
 				continue
 			}
-			if state.ConflictBatch(inst.Cmds, cmds) {
+			if conflictBatch(inst, cmds) {
 				if i > deps[q] ||
 					(i < deps[q] && inst.Seq >= seq && (q != replica || inst.Status > epaxosproto.PREACCEPTED_EQ)) {
 					// this is a conflict
@@ -1655,83 +2046,94 @@ func (r *Replica) findPreAcceptConflicts(cmds []state.Command, replica int32, in
 
 func (r *Replica) handleTryPreAcceptReply(tpar *epaxosproto.TryPreAcceptReply) {
 	inst := r.InstanceSpace[tpar.Replica][tpar.Instance]
-	if inst == nil || inst.lb == nil || !inst.lb.tryingToPreAccept || inst.lb.recoveryInst == nil {
+	if inst == nil || inst.lb == nil || !inst.lb.tryingToPreAccept || inst.lb.recoveryInst == nil || inst.Status >= epaxosproto.COMMITTED {
+		return
+	}
+
+	if tpar.Ballot > inst.ballot {
+		r.handleNack(tpar.Replica, tpar.Instance, tpar.Ballot)
+		return
+	}
+	if tpar.Ballot != inst.ballot {
+		// a reply to an earlier TryPreAccept of ours
 		return
 	}
 
 	ir := inst.lb.recoveryInst
+	inst.lb.tpaOKs++
 
 	if tpar.OK == TRUE {
 		inst.lb.preAcceptOKs++
-		inst.lb.tpaOKs++
+		inst.lb.ackLease(tpar.AcceptorId, r.N)
 		if inst.lb.preAcceptOKs >= r.N/2 {
 			//it's safe to start Accept phase
-			inst.Cmds = ir.cmds
-			inst.Seq = ir.seq
-			inst.Deps = ir.deps
-			inst.Status = epaxosproto.ACCEPTED
-			inst.lb.tryingToPreAccept = false
-			inst.lb.acceptOKs = 0
-			r.bcastAccept(tpar.Replica, tpar.Instance, inst.ballot, int32(len(inst.Cmds)), inst.Seq, inst.Deps)
-			return
+			r.acceptRecovered(tpar.Replica, tpar.Instance, inst)
 		}
-	} else {
-		inst.lb.nacks++
-		if tpar.Ballot > inst.ballot {
-			//TODO: retry with higher ballot
-			return
-		}
-		inst.lb.tpaOKs++
-		if tpar.ConflictReplica == tpar.Replica && tpar.ConflictInstance == tpar.Instance {
-			//TODO: re-run prepare
-			inst.lb.tryingToPreAccept = false
-			return
-		}
-		inst.lb.possibleQuorum[tpar.AcceptorId] = false
-		inst.lb.possibleQuorum[tpar.ConflictReplica] = false
-		notInQuorum := 0
-		for q := 0; q < r.N; q++ {
-			if !inst.lb.possibleQuorum[tpar.AcceptorId] {
-				notInQuorum++
-			}
+		return
+	}
+
+	inst.lb.nacks++
+	if tpar.ConflictReplica == tpar.Replica && tpar.ConflictInstance == tpar.Instance {
+		// the acceptor has accepted or committed the instance since it
+		// answered our Prepare, which has to be run again
+		inst.lb.tryingToPreAccept = false
+		r.startRecoveryForInstance(tpar.Replica, tpar.Instance)
+		return
+	}
+	if tpar.ConflictStatus >= epaxosproto.COMMITTED {
+		// a committed command that neither depends on the instance nor is one
+		// of its dependencies: the instance cannot have committed on the fast path
+		inst.lb.tryingToPreAccept = false
+		r.startPhase1(tpar.Replica, tpar.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+		return
+	}
+
+	inst.lb.possibleQuorum[tpar.AcceptorId] = false
+	inst.lb.possibleQuorum[tpar.ConflictReplica] = false
+	notInQuorum := 0
+	for q := 0; q < r.N; q++ {
+		if !inst.lb.possibleQuorum[q] {
+			notInQuorum++
 		}
-		if tpar.ConflictStatus >= epaxosproto.COMMITTED || notInQuorum > r.N/2 {
-			//abandon recovery, restart from phase 1
-			inst.lb.tryingToPreAccept = false
-			r.startPhase1(tpar.Replica, tpar.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
-		}
-		if notInQuorum == r.N/2 {
-			//this is to prevent defer cycles
-			if present, dq, _ := deferredByInstance(tpar.Replica, tpar.Instance); present {
-				if inst.lb.possibleQuorum[dq] {
-					//an instance whose leader must have been in this instance's quorum has been deferred for this instance => contradiction
-					//abandon recovery, restart from phase 1
-					inst.lb.tryingToPreAccept = false
-					r.startPhase1(tpar.Replica, tpar.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
-				}
+	}
+	if notInQuorum > r.N-r.fastQuorumSize() {
+		// too few replicas are left to have made up a fast quorum
+		inst.lb.tryingToPreAccept = false
+		r.startPhase1(tpar.Replica, tpar.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+		return
+	}
+	if notInQuorum == r.N-r.fastQuorumSize() {
+		//this is to prevent defer cycles
+		if present, dq, _ := r.deferredByInstance(tpar.Replica, tpar.Instance); present {
+			if inst.lb.possibleQuorum[dq] {
+				//an instance whose leader must have been in this instance's quorum has been deferred for this instance => contradiction
+				//abandon recovery, restart from phase 1
+				inst.lb.tryingToPreAccept = false
+				r.startPhase1(tpar.Replica, tpar.Instance, inst.ballot, inst.lb.clientProposals, ir.cmds, len(ir.cmds))
+				return
 			}
 		}
-		if inst.lb.tpaOKs >= r.N/2 {
-			//defer recovery and update deferred information
-			updateDeferred(tpar.Replica, tpar.Instance, tpar.ConflictReplica, tpar.ConflictInstance)
-			inst.lb.tryingToPreAccept = false
-		}
+	}
+	if inst.lb.tpaOKs >= r.N/2 {
+		// wait for the conflicting instance to commit, then recover again
+		r.updateDeferred(tpar.Replica, tpar.Instance, tpar.ConflictReplica, tpar.ConflictInstance)
+		r.deferInstance(inst.lb)
 	}
 }
 
-//helper functions and structures to prevent defer cycles while recovering
+//helper functions to prevent defer cycles while recovering
 
-var deferMap map[uint64]uint64 = make(map[uint64]uint64)
-
-func updateDeferred(dr int32, di int32, r int32, i int32) {
+// updateDeferred records that the recovery of instance dr.di waits for
+// instance q.i to commit
+func (r *Replica) updateDeferred(dr int32, di int32, q int32, i int32) {
 	daux := (uint64(dr) << 32) | uint64(di)
-	aux := (uint64(r) << 32) | uint64(i)
-	deferMap[aux] = daux
+	aux := (uint64(q) << 32) | uint64(i)
+	r.deferred[aux] = daux
 }
 
-func deferredByInstance(q int32, i int32) (bool, int32, int32) {
+func (r *Replica) deferredByInstance(q int32, i int32) (bool, int32, int32) {
 	aux := (uint64(q) << 32) | uint64(i)
-	daux, present := deferMap[aux]
+	daux, present := r.deferred[aux]
 	if !present {
 		return false, 0, 0
 	}
@@ -3,77 +3,425 @@ package epaxos
 import (
 	"fmt"
 	"gus-epaxos/src/epaxosproto"
-	"gus-epaxos/src/genericsmr"
 	"gus-epaxos/src/state"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
-func initReplica() *Replica {
-	peers := make([]string, 3)
-	r := &Replica{genericsmr.NewReplica(0, peers, false, false, false),
-		make(chan *Propose, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.Prepare, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.PreAccept, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.PreAccept, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.Accept, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.Commit, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.PrepareReply, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.PreAcceptReply, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.PreAcceptOK, CHAN_BUFFER_SIZE),
-		make(chan *epaxosproto.AcceptReply, CHAN_BUFFER_SIZE),
-		make([][]*Instance, 3),
-		make([]int32, 3),
-		false,
-		0,
-		make([]int32, 3),
-		nil}
+// testGraph builds committed instances for the executor. Every command of an
+// instance carries the instance in its value, so that the order in which the
+// workers receive commands can be traced back to instances.
+type testGraph struct {
+	n     int
+	nodes []*execNode
+	byId  map[instanceId]*execNode
+}
+
+func newTestGraph(n int) *testGraph {
+	return &testGraph{n, nil, make(map[instanceId]*execNode)}
+}
+
+func cmdValue(q int32, i int32) state.Value {
+	return state.Value(int64(q)<<32 | int64(i))
+}
+
+func cmdInstance(v state.Value) instanceId {
+	return instanceId{int32(v >> 32), int32(v)}
+}
+
+// add adds a committed instance that writes each of keys
+func (g *testGraph) add(q int32, i int32, seq int32, deps []int32, keys ...state.Key) *execNode {
+	cmds := make([]state.Command, len(keys))
+	for c, k := range keys {
+		cmds[c] = state.Command{state.PUT, k, cmdValue(q, i)}
+	}
+	return g.addCmds(q, i, seq, deps, cmds)
+}
+
+func (g *testGraph) addCmds(q int32, i int32, seq int32, deps []int32, cmds []state.Command) *execNode {
+	node := &execNode{q, i, cmds, seq, copyDeps(deps), nil, true, 0, 0, false}
+	g.nodes = append(g.nodes, node)
+	g.byId[instanceId{q, i}] = node
+	return node
+}
+
+// copyNode gives every run of the executor nodes of its own, since it keeps
+// Tarjan's state in them
+func copyNode(node *execNode) *execNode {
+	return &execNode{node.replica, node.instance, node.cmds, node.seq, copyDeps(node.deps), nil, node.committed, 0, 0, false}
+}
+
+// edges is what the executor follows out of v: the instances it depends on
+// that conflict with it
+func (g *testGraph) edges(v *execNode) []*execNode {
+	var out []*execNode
+	for q := int32(0); q < int32(g.n); q++ {
+		for i := int32(0); i <= v.deps[q]; i++ {
+			if w := g.byId[instanceId{q, i}]; w != nil && w != v && state.ConflictBatch(v.cmds, w.cmds) {
+				out = append(out, w)
+			}
+		}
+	}
+	return out
+}
+
+// reach maps every instance to the instances it transitively depends on
+func (g *testGraph) reach() map[*execNode]map[*execNode]bool {
+	reach := make(map[*execNode]map[*execNode]bool)
+	for _, v := range g.nodes {
+		seen := map[*execNode]bool{}
+		todo := []*execNode{v}
+		for len(todo) > 0 {
+			u := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			for _, w := range g.edges(u) {
+				if !seen[w] {
+					seen[w] = true
+					todo = append(todo, w)
+				}
+			}
+		}
+		reach[v] = seen
+	}
+	return reach
+}
 
-	for i := 0; i < r.N; i++ {
-		r.InstanceSpace[i] = make([]*Instance, 1024*1024)
-		r.crtInstance[i] = 0
-		r.ExecedUpTo[i] = -1
+// before tells whether a has to execute before b
+func before(reach map[*execNode]map[*execNode]bool, a *execNode, b *execNode) bool {
+	if reach[b][a] && !reach[a][b] {
+		return true
+	}
+	if reach[b][a] && reach[a][b] {
+		// same component
+		return nodeArray{a, b}.Less(0, 1)
 	}
+	return false
+}
 
-	r.exec = &Exec{r}
+// execRun feeds instances to a fresh executor and records the order in which
+// they execute, per key
+type execRun struct {
+	t     *testing.T
+	g     *testGraph
+	e     *Exec
+	reach map[*execNode]map[*execNode]bool
+	added map[instanceId]bool
+	order map[state.Key][]instanceId
+}
 
-	return r
+func (g *testGraph) newRun(t *testing.T, r *Replica) *execRun {
+	return &execRun{t, g, newExec(r), g.reach(), make(map[instanceId]bool), make(map[state.Key][]instanceId)}
 }
 
-func (r *Replica) MakeInstance(q, i int, seq int32, deps [3]int32) {
-	command := &state.Command{state.PUT, state.Key(q), state.Value(i)}
-	r.InstanceSpace[q][i] = &Instance{command, 0, epaxosproto.COMMITTED, seq, deps, nil, 0, 0}
+// commit hands an instance over, and checks what executes because of it
+func (run *execRun) commit(node *execNode) {
+	run.added[instanceId{node.replica, node.instance}] = true
+	run.e.add(copyNode(node))
+	run.drain()
 }
 
-func TestExec(t *testing.T) {
+// propose tells the executor the commands of an instance before it commits
+func (run *execRun) propose(node *execNode) {
+	run.e.add(&execNode{node.replica, node.instance, node.cmds, 0, nil, nil, false, 0, 0, false})
+	run.drain()
+}
 
-	r := initReplica()
+func (run *execRun) drain() {
+	for _, w := range run.e.workers {
+		for len(w) > 0 {
+			b := <-w
+			for _, cmd := range b.cmds {
+				id := cmdInstance(cmd.V)
+				keyOrder := run.order[cmd.K]
+				if len(keyOrder) == 0 || keyOrder[len(keyOrder)-1] != id {
+					run.order[cmd.K] = append(keyOrder, id)
+				}
+				run.checkDepsCommitted(run.g.byId[id])
+			}
+		}
+	}
+}
 
-	r.MakeInstance(0, 0, 2, [3]int32{0, 0, 0})
-	r.MakeInstance(1, 0, 1, [3]int32{0, 0, 0})
-	r.MakeInstance(2, 0, 0, [3]int32{0, 0, 0})
+// checkDepsCommitted fails if v executed before everything it depends on
+// had committed
+func (run *execRun) checkDepsCommitted(v *execNode) {
+	for w := range run.reach[v] {
+		if !run.added[instanceId{w.replica, w.instance}] {
+			run.t.Fatalf("%d.%d executed before %d.%d, which it depends on, committed",
+				v.replica, v.instance, w.replica, w.instance)
+		}
+	}
+}
 
-	r.MakeInstance(0, 1, 0, [3]int32{0, 1, 0})
-	r.MakeInstance(1, 1, 2, [3]int32{0, 0, 1})
-	r.MakeInstance(2, 1, 0, [3]int32{1, 0, 0})
+// check fails unless every instance executed once, and every pair of
+// conflicting instances executed in dependency order
+func (run *execRun) check() {
+	executed := make(map[instanceId]int)
+	for k, ids := range run.order {
+		for x, idx := range ids {
+			executed[idx]++
+			a := run.g.byId[idx]
+			for _, idy := range ids[x+1:] {
+				b := run.g.byId[idy]
+				if state.ConflictBatch(a.cmds, b.cmds) && before(run.reach, b, a) {
+					run.t.Fatalf("key %d: %d.%d executed before %d.%d", k, a.replica, a.instance, b.replica, b.instance)
+				}
+			}
+		}
+	}
+	for _, v := range run.g.nodes {
+		keys := make(map[state.Key]bool)
+		for _, cmd := range v.cmds {
+			keys[cmd.K] = true
+		}
+		if executed[instanceId{v.replica, v.instance}] != len(keys) {
+			run.t.Fatalf("%d.%d executed on %d keys, want %d", v.replica, v.instance, executed[instanceId{v.replica, v.instance}], len(keys))
+		}
+	}
+}
 
-	r.MakeInstance(0, 2, 0, [3]int32{1, 1, 1})
-	r.MakeInstance(1, 2, 0, [3]int32{1, 1, 2})
-	r.MakeInstance(2, 2, 0, [3]int32{2, 1, 1})
+// checkSameOrder fails unless every pair of conflicting instances executed in
+// the same order as in another run
+func (run *execRun) checkSameOrder(other map[state.Key][]instanceId) {
+	for k, ids := range run.order {
+		pos := make(map[instanceId]int)
+		for p, id := range other[k] {
+			pos[id] = p
+		}
+		for x, idx := range ids {
+			for _, idy := range ids[x+1:] {
+				if pos[idx] > pos[idy] && state.ConflictBatch(run.g.byId[idx].cmds, run.g.byId[idy].cmds) {
+					run.t.Fatalf("key %d: %d.%d executed before %d.%d, and after it in another order of commits",
+						k, idx.replica, idx.instance, idy.replica, idy.instance)
+				}
+			}
+		}
+	}
+}
 
-	r.MakeInstance(0, 3, 0, [3]int32{2, 2, 2})
-	r.MakeInstance(1, 3, 0, [3]int32{0, 0, 0})
-	r.MakeInstance(2, 3, 0, [3]int32{0, 0, 0})
+// randomGraph simulates n replicas proposing commands on a few keys at once,
+// and builds the instances with the attributes they commit with. Each
+// PreAccept reaches the replicas of its quorum at a random point, so that
+// concurrent commands see each other at some replicas and not at others.
+func randomGraph(rnd *rand.Rand, n int, instances int, keys int) *testGraph {
+	type proposal struct {
+		q, i    int32
+		cmds    []state.Command
+		seq     int32
+		deps    []int32
+		pending []int // quorum members that have not pre-accepted it yet
+	}
+	seen := make([]map[*proposal]int32, n) // the seq each replica pre-accepted with
+	for m := range seen {
+		seen[m] = make(map[*proposal]int32)
+	}
+	preAccept := func(m int, p *proposal) {
+		for other, seq := range seen[m] {
+			if !state.ConflictBatch(p.cmds, other.cmds) {
+				continue
+			}
+			if other.i > p.deps[other.q] {
+				p.deps[other.q] = other.i
+			}
+			if seq >= p.seq {
+				p.seq = seq + 1
+			}
+		}
+		seen[m][p] = p.seq
+	}
 
-	r.MakeInstance(0, 4, 1, [3]int32{3, 5, 0})
-	r.MakeInstance(1, 4, 2, [3]int32{0, 0, 0})
-	r.MakeInstance(2, 4, 3, [3]int32{0, 0, 0})
+	g := newTestGraph(n)
+	crt := make([]int32, n)
+	var inFlight []*proposal
+	for started := 0; started < instances || len(inFlight) > 0; {
+		if started < instances && (len(inFlight) == 0 || rnd.Intn(3) == 0) {
+			q := rnd.Intn(n)
+			cmds := make([]state.Command, 1+rnd.Intn(2))
+			for c := range cmds {
+				op := state.PUT
+				if rnd.Intn(4) == 0 {
+					op = state.GET
+				}
+				cmds[c] = state.Command{op, state.Key(rnd.Intn(keys)), cmdValue(int32(q), crt[q])}
+			}
+			p := &proposal{int32(q), crt[q], cmds, 0, newDeps(n, -1), nil}
+			crt[q]++
+			started++
+			preAccept(q, p)
+			for _, m := range rnd.Perm(n) {
+				if m != q && len(p.pending) < n/2 {
+					p.pending = append(p.pending, m)
+				}
+			}
+			inFlight = append(inFlight, p)
+			continue
+		}
 
-	r.MakeInstance(0, 5, 4, [3]int32{4, 5, 5})
-	r.MakeInstance(1, 5, 5, [3]int32{5, 5, 5})
-	r.MakeInstance(2, 5, 6, [3]int32{5, 0, 5})
+		x := rnd.Intn(len(inFlight))
+		p := inFlight[x]
+		if len(p.pending) > 0 {
+			preAccept(p.pending[0], p)
+			p.pending = p.pending[1:]
+			continue
+		}
+		inFlight = append(inFlight[:x], inFlight[x+1:]...)
+		g.addCmds(p.q, p.i, p.seq, p.deps, p.cmds)
+	}
+	return g
+}
 
-	r.exec.executeCommand(0, 5)
-	r.exec.executeCommand(0, 5)
+func TestExecRunsComponentInSeqOrder(t *testing.T) {
+	r := initReplica(t)
+	g := newTestGraph(3)
 
-	fmt.Println("Test ended\n")
+	// 0.0 -> 1.0 -> 2.0 -> 0.0, with 1.0 and 2.0 tied on seq
+	g.add(0, 0, 3, []int32{-1, 0, -1}, 1)
+	g.add(1, 0, 2, []int32{-1, -1, 0}, 1)
+	g.add(2, 0, 2, []int32{0, -1, -1}, 1)
+	// 0.1 depends on the component
+	g.add(0, 1, 0, []int32{0, 0, 0}, 1)
+
+	run := g.newRun(t, r)
+	for _, node := range g.nodes {
+		run.commit(node)
+	}
+	run.check()
+	want := []instanceId{{1, 0}, {2, 0}, {0, 0}, {0, 1}}
+	if got := run.order[1]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("executed %v, want %v", got, want)
+	}
+}
+
+func TestExecWaitsForDeps(t *testing.T) {
+	r := initReplica(t)
+	g := newTestGraph(3)
+
+	a := g.add(0, 0, 0, []int32{-1, -1, -1}, 1)
+	b := g.add(1, 0, 1, []int32{0, -1, 0}, 1)
+	c := g.add(2, 0, 1, []int32{-1, 0, -1}, 1)
+	// 2.1 depends on 1.0 and 2.0, but does not conflict with them
+	d := g.add(2, 1, 0, []int32{-1, 0, 0}, 2)
+
+	run := g.newRun(t, r)
+	run.commit(b)
+	if len(run.order[1]) != 0 {
+		t.Fatalf("executed %v before 0.0 and 2.0 committed", run.order[1])
+	}
+	run.commit(c)
+	run.commit(d)
+	if len(run.order[1]) != 0 {
+		t.Fatalf("executed %v before 0.0 committed", run.order[1])
+	}
+	if !reflect.DeepEqual(run.order[2], []instanceId{{2, 1}}) {
+		t.Fatalf("2.1 waited for instances on other keys, executed %v", run.order[2])
+	}
+	run.commit(a)
+	run.check()
+}
+
+func TestExecSkipsProposedOnOtherKeys(t *testing.T) {
+	r := initReplica(t)
+	g := newTestGraph(3)
+
+	a := g.add(0, 0, 0, []int32{-1, -1, -1}, 1)
+	b := g.add(1, 0, 1, []int32{0, -1, -1}, 2)
+
+	run := g.newRun(t, r)
+	run.propose(a)
+	run.commit(b)
+	if !reflect.DeepEqual(run.order[2], []instanceId{{1, 0}}) {
+		t.Fatalf("1.0 waited for 0.0, which is on another key")
+	}
+	run.commit(a)
+	run.check()
+}
+
+func TestExecRandomGraphs(t *testing.T) {
+	for _, n := range []int{3, 5} {
+		r := newTestNet(t, n).replicas[0]
+		for seed := int64(0); seed < 50; seed++ {
+			t.Run(fmt.Sprintf("n%d-seed%d", n, seed), func(t *testing.T) {
+				rnd := rand.New(rand.NewSource(seed))
+				g := randomGraph(rnd, n, 40, 4)
+
+				// replicas learn of commits in different orders, and must
+				// execute the same
+				var first map[state.Key][]instanceId
+				for attempt := 0; attempt < 3; attempt++ {
+					run := g.newRun(t, r)
+					for _, x := range rnd.Perm(len(g.nodes)) {
+						node := g.nodes[x]
+						if rnd.Intn(3) == 0 {
+							run.propose(node)
+						}
+						run.commit(node)
+					}
+					run.check()
+					if first == nil {
+						first = run.order
+					} else {
+						run.checkSameOrder(first)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateAttributes(t *testing.T) {
+	r := initReplica(t)
+
+	// 1.0 writes key 1 with seq 4, 2.0 writes key 2 with seq 7
+	r.setInstance(1, 0, epaxosproto.PREACCEPTED, 1, newDeps(3, -1))
+	r.InstanceSpace[1][0].Seq = 4
+	r.updateConflicts(r.InstanceSpace[1][0].Cmds, 1, 0, 4)
+	r.setInstance(2, 0, epaxosproto.PREACCEPTED, 2, newDeps(3, -1))
+	r.InstanceSpace[2][0].Seq = 7
+	r.updateConflicts(r.InstanceSpace[2][0].Cmds, 2, 0, 7)
+
+	cmds := []state.Command{{state.PUT, 1, 0}}
+	deps := newDeps(3, -1)
+	seq, newDeps, changed := r.updateAttributes(cmds, 0, deps, 0, 0)
+	if seq != 5 || !reflect.DeepEqual(newDeps, []int32{-1, 0, -1}) || !changed {
+		t.Fatalf("got seq %d deps %v changed %v, want seq 5 deps [-1 0 -1] changed", seq, newDeps, changed)
+	}
+	if !reflect.DeepEqual(deps, []int32{-1, -1, -1}) {
+		t.Fatalf("updateAttributes changed its argument to %v", deps)
+	}
+
+	// attributes that already cover the conflicts stay as they are
+	seq, newDeps, changed = r.updateAttributes(cmds, 5, []int32{-1, 0, -1}, 0, 0)
+	if seq != 5 || !reflect.DeepEqual(newDeps, []int32{-1, 0, -1}) || changed {
+		t.Fatalf("got seq %d deps %v changed %v, want them unchanged", seq, newDeps, changed)
+	}
+
+	// a replica leaves the command leader's own instances to the leader
+	seq, newDeps, _ = r.updateAttributes([]state.Command{{state.PUT, 2, 0}}, 0, newDeps, 2, 1)
+	if newDeps[2] != -1 {
+		t.Fatalf("got deps %v on the leader's own instances", newDeps)
+	}
+	// but the seq still follows every command on the key
+	if seq != 8 {
+		t.Fatalf("got seq %d, want 8", seq)
+	}
+}
+
+func TestMergeAttributes(t *testing.T) {
+	r := initReplica(t)
+
+	deps1 := []int32{3, 1, 5}
+	seq, deps, equal := r.mergeAttributes(2, deps1, 4, []int32{7, 2, 4})
+	// the leader's own column is its own to decide
+	if seq != 4 || !reflect.DeepEqual(deps, []int32{3, 2, 5}) || equal {
+		t.Fatalf("got seq %d deps %v equal %v, want seq 4 deps [3 2 5] not equal", seq, deps, equal)
+	}
+	if !reflect.DeepEqual(deps1, []int32{3, 1, 5}) {
+		t.Fatalf("mergeAttributes changed its argument to %v", deps1)
+	}
+
+	seq, deps, equal = r.mergeAttributes(2, deps1, 2, []int32{9, 1, 5})
+	if seq != 2 || !reflect.DeepEqual(deps, deps1) || !equal {
+		t.Fatalf("got seq %d deps %v equal %v, want the attributes equal", seq, deps, equal)
+	}
 }
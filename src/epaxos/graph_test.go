@@ -0,0 +1,67 @@
+package epaxos
+
+import (
+	"bytes"
+	"encoding/gob"
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/state"
+	"reflect"
+	"testing"
+)
+
+func (r *Replica) setInstance(q int32, i int32, status int8, key state.Key, deps []int32) {
+	cmds := []state.Command{{state.PUT, key, state.Value(i)}}
+	r.InstanceSpace[q][i] = &Instance{cmds, 0, 0, status, 0, deps, nil, nil}
+	if i >= r.crtInstance[q] {
+		r.crtInstance[q] = i + 1
+	}
+}
+
+func TestDepGraph(t *testing.T) {
+	r := newTestNet(t, 3).replicas[0]
+
+	// 0.0 and 1.0 depend on each other, and 1.0 on 2.0, which is pre-accepted
+	r.setInstance(0, 0, epaxosproto.COMMITTED, 1, []int32{-1, 0, -1})
+	r.setInstance(1, 0, epaxosproto.COMMITTED, 1, []int32{0, -1, 0})
+	r.setInstance(2, 0, epaxosproto.PREACCEPTED, 1, []int32{-1, -1, -1})
+	// 0.1 does not conflict with 0.0, and depends on 2.1, which is unknown
+	r.setInstance(0, 1, epaxosproto.COMMITTED, 2, []int32{0, -1, 1})
+
+	g := r.depGraph()
+
+	if len(g.Instances) != 5 {
+		t.Fatalf("got %d instances, want 5: %v", len(g.Instances), g.Instances)
+	}
+	ref := func(q int32, i int32) epaxosproto.InstanceRef {
+		return epaxosproto.InstanceRef{q, i}
+	}
+	wantEdges := [][2]epaxosproto.InstanceRef{
+		{ref(0, 0), ref(1, 0)},
+		{ref(0, 1), ref(2, 1)},
+		{ref(1, 0), ref(0, 0)},
+		{ref(1, 0), ref(2, 0)},
+	}
+	if !reflect.DeepEqual(g.Edges, wantEdges) {
+		t.Fatalf("got edges %v, want %v", g.Edges, wantEdges)
+	}
+	wantSCCs := []epaxosproto.GraphSCC{
+		{[]epaxosproto.InstanceRef{ref(0, 0), ref(1, 0)}, []epaxosproto.InstanceRef{ref(2, 0)}},
+		{[]epaxosproto.InstanceRef{ref(0, 1)}, []epaxosproto.InstanceRef{ref(2, 1)}},
+	}
+	if !reflect.DeepEqual(g.SCCs, wantSCCs) {
+		t.Fatalf("got components %v, want %v", g.SCCs, wantSCCs)
+	}
+
+	// the reply goes over net/rpc
+	var buf bytes.Buffer
+	var decoded epaxosproto.DepGraphReply
+	if err := gob.NewEncoder(&buf).Encode(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, g) {
+		t.Fatalf("decoded %v, want %v", decoded, *g)
+	}
+}
@@ -0,0 +1,108 @@
+package epaxos
+
+import (
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/state"
+	"testing"
+	"time"
+)
+
+func newLeaseNet(t *testing.T, n int) *testNet {
+	net := newTestNet(t, n)
+	for _, r := range net.replicas {
+		r.leases = true
+		r.Exec = true
+	}
+	return net
+}
+
+// get proposes a GET, and tells whether it was served locally
+func (net *testNet) get(id int, key state.Key) bool {
+	r := net.replicas[id]
+	started := r.crtInstance[r.Id]
+	propose, _ := smrtest.Propose(0, state.Command{state.GET, key, state.NIL})
+	r.handlePropose(propose)
+	return r.crtInstance[r.Id] == started
+}
+
+// execute runs what a replica's executor has been handed, and reports back
+func (net *testNet) execute(id int) {
+	r := net.replicas[id]
+	for len(r.exec.committed) > 0 {
+		r.exec.add(<-r.exec.committed)
+	}
+	r.exec.reportExecuted()
+	for len(r.executedChan) > 0 {
+		r.handleExecuted(<-r.executedChan)
+	}
+}
+
+func TestLeaseHolderReadsLocally(t *testing.T) {
+	net := newLeaseNet(t, 3)
+
+	if net.get(1, 7) {
+		t.Fatal("R1 read locally without a lease")
+	}
+	net.DeliverAll()
+
+	// the lease is good once R1 has executed what the grantors know of
+	net.replicas[1].renewLease()
+	net.DeliverAll()
+	if net.get(1, 5) {
+		t.Fatal("R1 read locally before executing 1.0")
+	}
+	net.DeliverAll()
+	net.execute(1)
+	if !net.get(1, 5) {
+		t.Fatal("R1 did not read locally under its lease")
+	}
+
+	// R2 cannot commit a write without R1, which holds a lease from it
+	net.propose(2, 5, 100)
+	net.Deliver(2, 0)
+	net.Deliver(0, 2)
+	inst := net.instance(2, 2, 0)
+	if inst.Status != epaxosproto.PREACCEPTED || !inst.lb.waitingForLeases {
+		t.Fatalf("R2 did not wait for R1 to acknowledge 2.0, status %d", inst.Status)
+	}
+	net.Deliver(2, 1)
+	net.Deliver(1, 2)
+	if inst.Status != epaxosproto.COMMITTED {
+		t.Fatalf("R2 did not commit 2.0 once R1 acknowledged it, status %d", inst.Status)
+	}
+	net.DeliverAll()
+
+	if net.get(1, 5) {
+		t.Fatal("R1 read key 5 locally before executing 2.0")
+	}
+	if !net.get(1, 6) {
+		t.Fatal("R1 did not read key 6 locally")
+	}
+	net.DeliverAll()
+	net.execute(1)
+	if !net.get(1, 5) {
+		t.Fatal("R1 did not read key 5 locally after executing 2.0")
+	}
+}
+
+func TestWriteWaitsForLeaseToExpire(t *testing.T) {
+	net := newLeaseNet(t, 3)
+
+	net.replicas[1].renewLease()
+	net.DeliverAll()
+	net.Crash(1)
+
+	net.propose(2, 5, 100)
+	net.DeliverAll()
+	inst := net.instance(2, 2, 0)
+	if inst.Status == epaxosproto.COMMITTED {
+		t.Fatal("R2 committed 2.0 while R1 held a lease")
+	}
+
+	net.replicas[2].granted[1] = time.Now().Add(-time.Millisecond)
+	net.replicas[2].checkLeaderTimeouts()
+	if inst.Status != epaxosproto.COMMITTED {
+		t.Fatalf("R2 did not commit 2.0 once R1's lease expired, status %d", inst.Status)
+	}
+}
@@ -0,0 +1,362 @@
+package epaxos
+
+import (
+	"bytes"
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/state"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testNet runs the EPaxos handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	t        *testing.T
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+	net := &testNet{nil, t, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, false, false, false, 1, 0)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.prepareRPC:           new(epaxosproto.Prepare),
+		r.prepareReplyRPC:      new(epaxosproto.PrepareReply),
+		r.preAcceptRPC:         new(epaxosproto.PreAccept),
+		r.preAcceptReplyRPC:    new(epaxosproto.PreAcceptReply),
+		r.preAcceptOKRPC:       new(epaxosproto.PreAcceptOK),
+		r.acceptRPC:            new(epaxosproto.Accept),
+		r.acceptReplyRPC:       new(epaxosproto.AcceptReply),
+		r.commitRPC:            new(epaxosproto.Commit),
+		r.commitShortRPC:       new(epaxosproto.CommitShort),
+		r.tryPreAcceptRPC:      new(epaxosproto.TryPreAccept),
+		r.tryPreAcceptReplyRPC: new(epaxosproto.TryPreAcceptReply),
+		r.leaseRequestRPC:      new(epaxosproto.LeaseRequest),
+		r.leaseGrantRPC:        new(epaxosproto.LeaseGrant),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *epaxosproto.Prepare:
+			r.handlePrepare(m)
+		case *epaxosproto.PrepareReply:
+			r.handlePrepareReply(m)
+		case *epaxosproto.PreAccept:
+			r.handlePreAccept(m)
+		case *epaxosproto.PreAcceptReply:
+			r.handlePreAcceptReply(m)
+		case *epaxosproto.PreAcceptOK:
+			r.handlePreAcceptOK(m)
+		case *epaxosproto.Accept:
+			r.handleAccept(m)
+		case *epaxosproto.AcceptReply:
+			r.handleAcceptReply(m)
+		case *epaxosproto.Commit:
+			r.handleCommit(m)
+		case *epaxosproto.CommitShort:
+			r.handleCommitShort(m)
+		case *epaxosproto.TryPreAccept:
+			r.handleTryPreAccept(m)
+		case *epaxosproto.TryPreAcceptReply:
+			r.handleTryPreAcceptReply(m)
+		case *epaxosproto.LeaseRequest:
+			r.handleLeaseRequest(m)
+		case *epaxosproto.LeaseGrant:
+			r.handleLeaseGrant(m)
+		}
+	}
+	return net
+}
+
+// initReplica is a replica of a testNet of three, for tests that drive it alone
+func initReplica(t *testing.T) *Replica {
+	return newTestNet(t, 3).replicas[0]
+}
+
+func (net *testNet) propose(id int, key state.Key, val state.Value) {
+	propose, _ := smrtest.Propose(int32(val), state.Command{state.PUT, key, val})
+	net.replicas[id].handlePropose(propose)
+}
+
+func (net *testNet) instance(id int, replica int32, instance int32) *Instance {
+	return net.replicas[id].InstanceSpace[replica][instance]
+}
+
+// checkCommitted fails unless every live replica has committed the instance
+// with the same commands and attributes, and returns them
+func (net *testNet) checkCommitted(replica int32, instance int32) *Instance {
+	var first *Instance
+	for id, r := range net.replicas {
+		if net.Down[id] {
+			continue
+		}
+		inst := r.InstanceSpace[replica][instance]
+		if inst == nil || inst.Status < epaxosproto.COMMITTED || inst.Cmds == nil {
+			net.t.Fatalf("replica %d has not committed instance %d.%d", id, replica, instance)
+		}
+		if first == nil {
+			first = inst
+			continue
+		}
+		if !reflect.DeepEqual(inst.Cmds, first.Cmds) || inst.Seq != first.Seq || !reflect.DeepEqual(inst.Deps, first.Deps) {
+			net.t.Fatalf("replica %d committed %v seq %d deps %v in instance %d.%d, others %v seq %d deps %v",
+				id, inst.Cmds, inst.Seq, inst.Deps, replica, instance, first.Cmds, first.Seq, first.Deps)
+		}
+	}
+	return first
+}
+
+// executionOrder returns the values written by the committed instances that
+// a replica knows of, in the order its executor runs them
+func (net *testNet) executionOrder(id int) []state.Value {
+	r := net.replicas[id]
+	e := newExec(r)
+	for q := int32(0); q < int32(r.N); q++ {
+		for i := int32(0); i < r.crtInstance[q]; i++ {
+			inst := r.InstanceSpace[q][i]
+			if inst != nil && inst.Status >= epaxosproto.COMMITTED && inst.Cmds != nil {
+				e.add(&execNode{q, i, inst.Cmds, inst.Seq, copyDeps(inst.Deps), nil, true, 0, 0, false})
+			}
+		}
+	}
+
+	var order []state.Value
+	for _, w := range e.workers {
+		for len(w) > 0 {
+			for _, cmd := range (<-w).cmds {
+				order = append(order, cmd.V)
+			}
+		}
+	}
+	return order
+}
+
+func (net *testNet) checkExecutionOrder(want ...state.Value) {
+	for id := range net.replicas {
+		if net.Down[id] {
+			continue
+		}
+		if got := net.executionOrder(id); !reflect.DeepEqual(got, want) {
+			net.t.Fatalf("replica %d executes %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRecoveryKeepsFastCommit(t *testing.T) {
+	net := newTestNet(t, 5)
+
+	// 0.0 commits on the fast path with R1 and R2, but nobody hears of it
+	net.propose(0, 1, 100)
+	net.Deliver(0, 1)
+	net.Deliver(0, 2)
+	net.Deliver(1, 0)
+	net.Deliver(2, 0)
+	if net.instance(0, 0, 0).Status != epaxosproto.COMMITTED {
+		t.Fatal("0.0 did not commit on the fast path")
+	}
+	net.Crash(0)
+
+	// a conflicting command comes after it
+	net.propose(4, 1, 200)
+	net.DeliverAll()
+	net.checkCommitted(4, 0)
+
+	net.replicas[1].startRecoveryForInstance(0, 0)
+	net.DeliverAll()
+
+	inst := net.checkCommitted(0, 0)
+	if len(inst.Cmds) != 1 || inst.Cmds[0].V != 100 || inst.Seq != 0 || !reflect.DeepEqual(inst.Deps, []int32{-1, -1, -1, -1, -1}) {
+		t.Fatalf("recovery changed fast committed 0.0 to %v seq %d deps %v", inst.Cmds, inst.Seq, inst.Deps)
+	}
+	net.checkExecutionOrder(100, 200)
+}
+
+func TestRecoveryPicksHighestAcceptedBallot(t *testing.T) {
+	net := newTestNet(t, 5)
+
+	// only R1 pre-accepts 0.0
+	net.propose(0, 1, 100)
+	net.Deliver(0, 1)
+	net.DropFrom(0)
+	net.DropFrom(1)
+
+	// R2 hears from R3 and R4, who know nothing, and gets R3 to accept a NO-OP
+	net.replicas[2].startRecoveryForInstance(0, 0)
+	net.Deliver(2, 3)
+	net.Deliver(2, 4)
+	net.DropFrom(2)
+	net.Deliver(3, 2)
+	net.Deliver(4, 2)
+	if inst := net.instance(2, 0, 0); inst.Status != epaxosproto.ACCEPTED || len(inst.Cmds) != 0 {
+		t.Fatalf("R2 did not try a NO-OP, 0.0 is %v with status %d", inst.Cmds, inst.Status)
+	}
+	net.Deliver(2, 3)
+	net.DropFrom(2)
+	net.DropFrom(3)
+
+	// R4 hears from R0 and R1, and gets them to accept the command at a
+	// higher ballot, but its Commits are lost
+	net.replicas[4].startRecoveryForInstance(0, 0)
+	for round := 0; round < 3; round++ {
+		net.Deliver(4, 0)
+		net.Deliver(4, 1)
+		net.DropFrom(4)
+		net.Deliver(0, 4)
+		net.Deliver(1, 4)
+	}
+	if inst := net.instance(4, 0, 0); inst.Status != epaxosproto.COMMITTED {
+		t.Fatalf("R4 did not commit 0.0, status %d", inst.Status)
+	}
+	net.DropFrom(4)
+
+	// R1 hears from R2 and R3, which have accepted the NO-OP at a lower
+	// ballot. Its own vote for the command wins.
+	net.replicas[1].startRecoveryForInstance(0, 0)
+	net.Deliver(1, 2)
+	net.Deliver(1, 3)
+	net.DropFrom(1)
+	net.Deliver(2, 1)
+	net.Deliver(3, 1)
+	net.DeliverAll()
+
+	inst := net.checkCommitted(0, 0)
+	if len(inst.Cmds) != 1 || inst.Cmds[0].V != 100 {
+		t.Fatalf("0.0 committed %v, want the command that R4 committed", inst.Cmds)
+	}
+}
+
+func TestTryPreAcceptDefersToConflict(t *testing.T) {
+	net := newTestNet(t, 5)
+
+	// only R1 pre-accepts 0.0
+	net.propose(0, 1, 100)
+	net.Deliver(0, 1)
+	net.Crash(0)
+	net.DropFrom(1)
+
+	// a conflicting command that does not know of 0.0 reaches R3, and R4 later
+	net.propose(2, 1, 200)
+	heldR1 := net.Hold(2, 1)
+	heldR4 := net.Hold(2, 4)
+	net.Deliver(2, 3)
+	net.Deliver(3, 2)
+
+	// 0.0 may have committed on the fast path with R1, R3 and R4. R3 cannot
+	// tell, having pre-accepted 2.0 without it, so R2 waits for 2.0.
+	net.replicas[2].startRecoveryForInstance(0, 0)
+	net.Drop(2, 4)
+	net.Deliver(2, 1)
+	net.Deliver(2, 3)
+	net.Deliver(1, 2)
+	net.Deliver(3, 2)
+	net.Drop(2, 4)
+	net.Deliver(2, 1)
+	net.Deliver(2, 3)
+	net.Deliver(1, 2)
+	net.Deliver(3, 2)
+	lb := net.instance(2, 0, 0).lb
+	if lb.deferUntil.IsZero() {
+		t.Fatal("R2 did not defer recovering 0.0 to 2.0")
+	}
+
+	net.Release(2, 1, heldR1)
+	net.Release(2, 4, heldR4)
+	net.DeliverAll()
+	net.checkCommitted(2, 0)
+
+	// R1 answers first, otherwise R3 and R4 rightly settle on a NO-OP
+	lb.deferUntil = time.Now().Add(-time.Millisecond)
+	net.replicas[2].checkLeaderTimeouts()
+	net.Deliver(2, 1)
+	net.Deliver(1, 2)
+	net.DeliverAll()
+
+	inst := net.checkCommitted(0, 0)
+	if len(inst.Cmds) != 1 || inst.Cmds[0].V != 100 || inst.Deps[2] != 0 {
+		t.Fatalf("0.0 committed %v deps %v, want the command after 2.0", inst.Cmds, inst.Deps)
+	}
+	net.checkExecutionOrder(200, 100)
+}
+
+func TestRecoveryLearnsCommit(t *testing.T) {
+	net := newTestNet(t, 5)
+
+	// 0.0 commits on the fast path, and only R1 hears of it
+	net.propose(0, 1, 100)
+	net.Deliver(0, 1)
+	net.Deliver(0, 2)
+	net.Deliver(1, 0)
+	net.Deliver(2, 0)
+	net.Deliver(0, 1)
+	net.Crash(0)
+	net.DropFrom(1)
+	net.DropFrom(2)
+
+	r3 := net.replicas[3]
+	r3.Durable = true
+	r3.startRecoveryForInstance(0, 0)
+	net.DeliverAll()
+
+	inst := net.checkCommitted(0, 0)
+	if len(inst.Cmds) != 1 || inst.Cmds[0].V != 100 || !reflect.DeepEqual(inst.Deps, []int32{-1, -1, -1, -1, -1}) {
+		t.Fatalf("0.0 committed %v deps %v, want what R0 committed", inst.Cmds, inst.Deps)
+	}
+
+	// the commit is on stable storage before R3 tells the others
+	var want bytes.Buffer
+	inst.Cmds[0].Marshal(&want)
+	fi, err := r3.StableStore.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make([]byte, want.Len())
+	if fi.Size() < int64(want.Len()) {
+		t.Fatalf("R3 did not record the commands it learned")
+	}
+	if _, err := r3.StableStore.ReadAt(stored, fi.Size()-int64(want.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, want.Bytes()) {
+		t.Fatalf("R3 did not record the commands it learned")
+	}
+}
+
+func TestNoOpRequeuesWithFullProposeChan(t *testing.T) {
+	net := newTestNet(t, 3)
+	r0 := net.replicas[0]
+
+	// R1 recovers 0.0 without hearing from R0, and settles on a NO-OP
+	net.propose(0, 1, 100)
+	net.DropFrom(0)
+	net.replicas[1].startRecoveryForInstance(0, 0)
+	net.Drop(1, 0)
+	net.Deliver(1, 2)
+	net.Deliver(2, 1)
+	net.Drop(1, 0)
+	net.Deliver(1, 2)
+	net.Deliver(2, 1)
+	if inst := net.instance(1, 0, 0); inst.Status != epaxosproto.COMMITTED || len(inst.Cmds) != 0 {
+		t.Fatalf("R1 did not commit a NO-OP, 0.0 is %v with status %d", inst.Cmds, inst.Status)
+	}
+
+	// the Commit reaches R0 while its clients keep ProposeChan full
+	propose, _ := smrtest.Propose(200, state.Command{state.PUT, 2, 200})
+	for len(r0.ProposeChan) < cap(r0.ProposeChan) {
+		r0.ProposeChan <- propose
+	}
+	net.Deliver(1, 0)
+	if len(r0.pending) != 1 || r0.pending[0].CommandId != 100 {
+		t.Fatalf("R0 did not put its proposal back")
+	}
+	if r0.nextProposal().CommandId != 100 || r0.queued() != cap(r0.ProposeChan) {
+		t.Fatalf("the proposal put back is not handled first")
+	}
+}
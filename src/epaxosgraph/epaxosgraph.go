@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gus-epaxos/src/epaxosproto"
+	"gus-epaxos/src/state"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+var replicaAddr *string = flag.String("addr", "localhost:8070", "RPC address of the EPaxos replica (its port + 1000). Defaults to localhost:8070.")
+var format *string = flag.String("format", "dot", "Output format, dot or json. Defaults to dot.")
+
+var statusNames = []string{"NONE", "PREACCEPTED", "PREACCEPTED_EQ", "ACCEPTED", "COMMITTED", "EXECUTED"}
+
+func main() {
+	flag.Parse()
+
+	cli, err := rpc.DialHTTP("tcp", *replicaAddr)
+	if err != nil {
+		log.Fatalf("Error connecting to replica %s: %v\n", *replicaAddr, err)
+	}
+	var reply epaxosproto.DepGraphReply
+	if err = cli.Call("Replica.DepGraph", &epaxosproto.DepGraphArgs{}, &reply); err != nil {
+		log.Fatalf("Error getting the dependency graph: %v\n", err)
+	}
+
+	switch *format {
+	case "dot":
+		writeDot(&reply)
+	case "json":
+		writeJSON(&reply)
+	default:
+		log.Fatalf("Unknown format %s\n", *format)
+	}
+}
+
+func status(s int8) string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprint(s)
+}
+
+func name(ref epaxosproto.InstanceRef) string {
+	return fmt.Sprintf("\"%d.%d\"", ref.Replica, ref.Instance)
+}
+
+// writeDot draws every component of committed instances as a cluster, and
+// the instances they wait for in red
+func writeDot(g *epaxosproto.DepGraphReply) {
+	fmt.Println("digraph epaxos {")
+	fmt.Printf("\tlabel=\"ExecedUpTo %v\";\n", g.ExecedUpTo)
+	fmt.Println("\tnode [shape=box];")
+
+	for _, inst := range g.Instances {
+		color := "black"
+		if inst.Status < epaxosproto.COMMITTED {
+			color = "red"
+		}
+		keys := "?"
+		if inst.Keys != nil {
+			keys = strings.Trim(fmt.Sprint(inst.Keys), "[]")
+		}
+		fmt.Printf("\t%s [color=%s, label=\"%d.%d %s\\nseq %d ballot %d\\ndeps %v\\nkeys %s\"];\n",
+			name(inst.InstanceRef), color, inst.Replica, inst.Instance, status(inst.Status), inst.Seq, inst.Ballot, inst.Deps, keys)
+	}
+
+	for c, scc := range g.SCCs {
+		fmt.Printf("\tsubgraph cluster_%d {\n", c)
+		for _, member := range scc.Members {
+			fmt.Printf("\t\t%s;\n", name(member))
+		}
+		fmt.Println("\t}")
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Printf("\t%s -> %s;\n", name(edge[0]), name(edge[1]))
+	}
+	fmt.Println("}")
+}
+
+type jsonInstance struct {
+	Replica  int32
+	Instance int32
+	Status   string
+	Ballot   int32
+	Seq      int32
+	Deps     []int32
+	Keys     []state.Key
+}
+
+func writeJSON(g *epaxosproto.DepGraphReply) {
+	instances := make([]jsonInstance, len(g.Instances))
+	for i, inst := range g.Instances {
+		instances[i] = jsonInstance{inst.Replica, inst.Instance, status(inst.Status), inst.Ballot, inst.Seq, inst.Deps, inst.Keys}
+	}
+
+	out := struct {
+		ExecedUpTo []int32
+		Instances  []jsonInstance
+		Edges      [][2]epaxosproto.InstanceRef
+		SCCs       []epaxosproto.GraphSCC
+	}{g.ExecedUpTo, instances, g.Edges, g.SCCs}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -17,10 +17,11 @@ type PrepareReply struct {
 	Instance   int32
 	OK         uint8
 	Ballot     int32
+	VBallot    int32 // the ballot at which Command, Seq and Deps were (pre-)accepted
 	Status     int8
 	Command    []state.Command
 	Seq        int32
-	Deps       [5]int32
+	Deps       []int32
 }
 
 type PreAccept struct {
@@ -30,21 +31,23 @@ type PreAccept struct {
 	Ballot   int32
 	Command  []state.Command
 	Seq      int32
-	Deps     [5]int32
+	Deps     []int32
 }
 
 type PreAcceptReply struct {
+	AcceptorId    int32
 	Replica       int32
 	Instance      int32
 	OK            uint8
 	Ballot        int32
 	Seq           int32
-	Deps          [5]int32
-	CommittedDeps [5]int32
+	Deps          []int32
+	CommittedDeps []int32
 }
 
 type PreAcceptOK struct {
-	Instance int32
+	AcceptorId int32
+	Instance   int32
 }
 
 type Accept struct {
@@ -54,14 +57,15 @@ type Accept struct {
 	Ballot   int32
 	Count    int32
 	Seq      int32
-	Deps     [5]int32
+	Deps     []int32
 }
 
 type AcceptReply struct {
-	Replica  int32
-	Instance int32
-	OK       uint8
-	Ballot   int32
+	AcceptorId int32
+	Replica    int32
+	Instance   int32
+	OK         uint8
+	Ballot     int32
 }
 
 type Commit struct {
@@ -70,7 +74,7 @@ type Commit struct {
 	Instance int32
 	Command  []state.Command
 	Seq      int32
-	Deps     [5]int32
+	Deps     []int32
 }
 
 type CommitShort struct {
@@ -79,7 +83,7 @@ type CommitShort struct {
 	Instance int32
 	Count    int32
 	Seq      int32
-	Deps     [5]int32
+	Deps     []int32
 }
 
 type TryPreAccept struct {
@@ -89,7 +93,7 @@ type TryPreAccept struct {
 	Ballot   int32
 	Command  []state.Command
 	Seq      int32
-	Deps     [5]int32
+	Deps     []int32
 }
 
 type TryPreAcceptReply struct {
@@ -111,3 +115,54 @@ const (
 	COMMITTED
 	EXECUTED
 )
+
+// Quorum read leases: every replica in the lease quorum asks all replicas for
+// a lease, and serves GETs locally while it holds one from each of them. A
+// replica that has granted a lease waits for the holder to acknowledge its
+// writes before committing them. Grants carry the grantor's crtInstance, which
+// the holder has to execute up to before it reads locally.
+
+type LeaseRequest struct {
+	Sender int32
+	Epoch  int32
+}
+
+type LeaseGrant struct {
+	Sender      int32
+	Epoch       int32
+	CrtInstance []int32
+}
+
+// Dependency graph dump, for debugging execution that does not progress. It
+// is served by the DepGraph RPC on the replica's HTTP port, not over fastrpc.
+
+type InstanceRef struct {
+	Replica  int32
+	Instance int32
+}
+
+type GraphInstance struct {
+	InstanceRef
+	Status int8
+	Ballot int32
+	Seq    int32
+	Deps   []int32
+	Keys   []state.Key // nil if this replica does not know the commands
+}
+
+// GraphSCC is a strongly connected component of committed instances, which
+// executes once the instances it waits for commit
+type GraphSCC struct {
+	Members    []InstanceRef
+	WaitingFor []InstanceRef
+}
+
+type DepGraphArgs struct {
+}
+
+type DepGraphReply struct {
+	ExecedUpTo []int32
+	Instances  []GraphInstance // not executed, or depended on by instances that are not
+	Edges      [][2]InstanceRef
+	SCCs       []GraphSCC
+}
@@ -54,7 +54,7 @@ func (p *TryPreAccept) New() fastrpc.Serializable {
 }
 
 func (t *TryPreAccept) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:16]
 	tmp32 := t.LeaderId
@@ -86,37 +86,27 @@ func (t *TryPreAccept) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	bs = b[:4]
 	tmp32 = t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[12] = byte(tmp32)
-	bs[13] = byte(tmp32 >> 8)
-	bs[14] = byte(tmp32 >> 16)
-	bs[15] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[16] = byte(tmp32)
-	bs[17] = byte(tmp32 >> 8)
-	bs[18] = byte(tmp32 >> 16)
-	bs[19] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[20] = byte(tmp32)
-	bs[21] = byte(tmp32 >> 8)
-	bs[22] = byte(tmp32 >> 16)
-	bs[23] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen2 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
 func (t *TryPreAccept) Unmarshal(rr io.Reader) error {
@@ -125,7 +115,7 @@ func (t *TryPreAccept) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:16]
 	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
@@ -143,21 +133,28 @@ func (t *TryPreAccept) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Deps[0] = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Deps[1] = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Deps[2] = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
-	t.Deps[3] = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
-	t.Deps[4] = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
 func (t *PreAcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 57, true
+	return 0, false
 }
 
 type PreAcceptReplyCache struct {
@@ -196,105 +193,108 @@ func (p *PreAcceptReply) New() fastrpc.Serializable {
 }
 
 func (t *PreAcceptReply) Marshal(wire io.Writer) {
-	var b [57]byte
+	var b [21]byte
 	var bs []byte
-	bs = b[:57]
-	tmp32 := t.Replica
+	bs = b[:21]
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Instance
+	tmp32 = t.Replica
 	bs[4] = byte(tmp32)
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	bs[8] = byte(t.OK)
+	tmp32 = t.Instance
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	bs[12] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[9] = byte(tmp32)
-	bs[10] = byte(tmp32 >> 8)
-	bs[11] = byte(tmp32 >> 16)
-	bs[12] = byte(tmp32 >> 24)
-	tmp32 = t.Seq
 	bs[13] = byte(tmp32)
 	bs[14] = byte(tmp32 >> 8)
 	bs[15] = byte(tmp32 >> 16)
 	bs[16] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
+	tmp32 = t.Seq
 	bs[17] = byte(tmp32)
 	bs[18] = byte(tmp32 >> 8)
 	bs[19] = byte(tmp32 >> 16)
 	bs[20] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[21] = byte(tmp32)
-	bs[22] = byte(tmp32 >> 8)
-	bs[23] = byte(tmp32 >> 16)
-	bs[24] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[25] = byte(tmp32)
-	bs[26] = byte(tmp32 >> 8)
-	bs[27] = byte(tmp32 >> 16)
-	bs[28] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[29] = byte(tmp32)
-	bs[30] = byte(tmp32 >> 8)
-	bs[31] = byte(tmp32 >> 16)
-	bs[32] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[33] = byte(tmp32)
-	bs[34] = byte(tmp32 >> 8)
-	bs[35] = byte(tmp32 >> 16)
-	bs[36] = byte(tmp32 >> 24)
-	tmp32 = t.CommittedDeps[0]
-	bs[37] = byte(tmp32)
-	bs[38] = byte(tmp32 >> 8)
-	bs[39] = byte(tmp32 >> 16)
-	bs[40] = byte(tmp32 >> 24)
-	tmp32 = t.CommittedDeps[1]
-	bs[41] = byte(tmp32)
-	bs[42] = byte(tmp32 >> 8)
-	bs[43] = byte(tmp32 >> 16)
-	bs[44] = byte(tmp32 >> 24)
-	tmp32 = t.CommittedDeps[2]
-	bs[45] = byte(tmp32)
-	bs[46] = byte(tmp32 >> 8)
-	bs[47] = byte(tmp32 >> 16)
-	bs[48] = byte(tmp32 >> 24)
-	tmp32 = t.CommittedDeps[3]
-	bs[49] = byte(tmp32)
-	bs[50] = byte(tmp32 >> 8)
-	bs[51] = byte(tmp32 >> 16)
-	bs[52] = byte(tmp32 >> 24)
-	tmp32 = t.CommittedDeps[4]
-	bs[53] = byte(tmp32)
-	bs[54] = byte(tmp32 >> 8)
-	bs[55] = byte(tmp32 >> 16)
-	bs[56] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.CommittedDeps))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.CommittedDeps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
-func (t *PreAcceptReply) Unmarshal(wire io.Reader) error {
-	var b [57]byte
+func (t *PreAcceptReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [21]byte
 	var bs []byte
-	bs = b[:57]
-	if _, err := io.ReadAtLeast(wire, bs, 57); err != nil {
+	bs = b[:21]
+	if _, err := io.ReadAtLeast(wire, bs, 21); err != nil {
 		return err
 	}
-	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.OK = uint8(bs[8])
-	t.Ballot = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
-	t.Seq = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
-	t.Deps[0] = int32((uint32(bs[17]) | (uint32(bs[18]) << 8) | (uint32(bs[19]) << 16) | (uint32(bs[20]) << 24)))
-	t.Deps[1] = int32((uint32(bs[21]) | (uint32(bs[22]) << 8) | (uint32(bs[23]) << 16) | (uint32(bs[24]) << 24)))
-	t.Deps[2] = int32((uint32(bs[25]) | (uint32(bs[26]) << 8) | (uint32(bs[27]) << 16) | (uint32(bs[28]) << 24)))
-	t.Deps[3] = int32((uint32(bs[29]) | (uint32(bs[30]) << 8) | (uint32(bs[31]) << 16) | (uint32(bs[32]) << 24)))
-	t.Deps[4] = int32((uint32(bs[33]) | (uint32(bs[34]) << 8) | (uint32(bs[35]) << 16) | (uint32(bs[36]) << 24)))
-	t.CommittedDeps[0] = int32((uint32(bs[37]) | (uint32(bs[38]) << 8) | (uint32(bs[39]) << 16) | (uint32(bs[40]) << 24)))
-	t.CommittedDeps[1] = int32((uint32(bs[41]) | (uint32(bs[42]) << 8) | (uint32(bs[43]) << 16) | (uint32(bs[44]) << 24)))
-	t.CommittedDeps[2] = int32((uint32(bs[45]) | (uint32(bs[46]) << 8) | (uint32(bs[47]) << 16) | (uint32(bs[48]) << 24)))
-	t.CommittedDeps[3] = int32((uint32(bs[49]) | (uint32(bs[50]) << 8) | (uint32(bs[51]) << 16) | (uint32(bs[52]) << 24)))
-	t.CommittedDeps[4] = int32((uint32(bs[53]) | (uint32(bs[54]) << 8) | (uint32(bs[55]) << 16) | (uint32(bs[56]) << 24)))
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Replica = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Instance = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.OK = uint8(bs[12])
+	t.Ballot = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	t.Seq = int32((uint32(bs[17]) | (uint32(bs[18]) << 8) | (uint32(bs[19]) << 16) | (uint32(bs[20]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.CommittedDeps = make([]int32, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.CommittedDeps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
@@ -395,7 +395,7 @@ func (t *TryPreAcceptReply) Unmarshal(wire io.Reader) error {
 }
 
 func (t *CommitShort) BinarySize() (nbytes int, sizeKnown bool) {
-	return 40, true
+	return 0, false
 }
 
 type CommitShortCache struct {
@@ -434,9 +434,9 @@ func (p *CommitShort) New() fastrpc.Serializable {
 }
 
 func (t *CommitShort) Marshal(wire io.Writer) {
-	var b [40]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:40]
+	bs = b[:20]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -462,39 +462,33 @@ func (t *CommitShort) Marshal(wire io.Writer) {
 	bs[17] = byte(tmp32 >> 8)
 	bs[18] = byte(tmp32 >> 16)
 	bs[19] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[20] = byte(tmp32)
-	bs[21] = byte(tmp32 >> 8)
-	bs[22] = byte(tmp32 >> 16)
-	bs[23] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[24] = byte(tmp32)
-	bs[25] = byte(tmp32 >> 8)
-	bs[26] = byte(tmp32 >> 16)
-	bs[27] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[28] = byte(tmp32)
-	bs[29] = byte(tmp32 >> 8)
-	bs[30] = byte(tmp32 >> 16)
-	bs[31] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[32] = byte(tmp32)
-	bs[33] = byte(tmp32 >> 8)
-	bs[34] = byte(tmp32 >> 16)
-	bs[35] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[36] = byte(tmp32)
-	bs[37] = byte(tmp32 >> 8)
-	bs[38] = byte(tmp32 >> 16)
-	bs[39] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
-func (t *CommitShort) Unmarshal(wire io.Reader) error {
-	var b [40]byte
+func (t *CommitShort) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [20]byte
 	var bs []byte
-	bs = b[:40]
-	if _, err := io.ReadAtLeast(wire, bs, 40); err != nil {
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
 		return err
 	}
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
@@ -502,11 +496,18 @@ func (t *CommitShort) Unmarshal(wire io.Reader) error {
 	t.Instance = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
 	t.Count = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	t.Seq = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
-	t.Deps[0] = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
-	t.Deps[1] = int32((uint32(bs[24]) | (uint32(bs[25]) << 8) | (uint32(bs[26]) << 16) | (uint32(bs[27]) << 24)))
-	t.Deps[2] = int32((uint32(bs[28]) | (uint32(bs[29]) << 8) | (uint32(bs[30]) << 16) | (uint32(bs[31]) << 24)))
-	t.Deps[3] = int32((uint32(bs[32]) | (uint32(bs[33]) << 8) | (uint32(bs[34]) << 16) | (uint32(bs[35]) << 24)))
-	t.Deps[4] = int32((uint32(bs[36]) | (uint32(bs[37]) << 8) | (uint32(bs[38]) << 16) | (uint32(bs[39]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
@@ -550,7 +551,7 @@ func (p *PreAccept) New() fastrpc.Serializable {
 }
 
 func (t *PreAccept) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:16]
 	tmp32 := t.LeaderId
@@ -582,37 +583,27 @@ func (t *PreAccept) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	bs = b[:4]
 	tmp32 = t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[12] = byte(tmp32)
-	bs[13] = byte(tmp32 >> 8)
-	bs[14] = byte(tmp32 >> 16)
-	bs[15] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[16] = byte(tmp32)
-	bs[17] = byte(tmp32 >> 8)
-	bs[18] = byte(tmp32 >> 16)
-	bs[19] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[20] = byte(tmp32)
-	bs[21] = byte(tmp32 >> 8)
-	bs[22] = byte(tmp32 >> 16)
-	bs[23] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen2 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
 func (t *PreAccept) Unmarshal(rr io.Reader) error {
@@ -621,7 +612,7 @@ func (t *PreAccept) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [24]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:16]
 	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
@@ -639,21 +630,28 @@ func (t *PreAccept) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Deps[0] = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Deps[1] = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Deps[2] = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
-	t.Deps[3] = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
-	t.Deps[4] = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
 func (t *PreAcceptOK) BinarySize() (nbytes int, sizeKnown bool) {
-	return 4, true
+	return 8, true
 }
 
 type PreAcceptOKCache struct {
@@ -692,25 +690,31 @@ func (p *PreAcceptOK) New() fastrpc.Serializable {
 }
 
 func (t *PreAcceptOK) Marshal(wire io.Writer) {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	tmp32 := t.Instance
+	bs = b[:8]
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *PreAcceptOK) Unmarshal(wire io.Reader) error {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
 	}
-	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	return nil
 }
 
@@ -754,9 +758,9 @@ func (p *PrepareReply) New() fastrpc.Serializable {
 }
 
 func (t *PrepareReply) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [22]byte
 	var bs []byte
-	bs = b[:18]
+	bs = b[:22]
 	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -778,7 +782,12 @@ func (t *PrepareReply) Marshal(wire io.Writer) {
 	bs[14] = byte(tmp32 >> 8)
 	bs[15] = byte(tmp32 >> 16)
 	bs[16] = byte(tmp32 >> 24)
-	bs[17] = byte(t.Status)
+	tmp32 = t.VBallot
+	bs[17] = byte(tmp32)
+	bs[18] = byte(tmp32 >> 8)
+	bs[19] = byte(tmp32 >> 16)
+	bs[20] = byte(tmp32 >> 24)
+	bs[21] = byte(t.Status)
 	wire.Write(bs)
 	bs = b[:]
 	alen1 := int64(len(t.Command))
@@ -788,37 +797,27 @@ func (t *PrepareReply) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	bs = b[:4]
 	tmp32 = t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[12] = byte(tmp32)
-	bs[13] = byte(tmp32 >> 8)
-	bs[14] = byte(tmp32 >> 16)
-	bs[15] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[16] = byte(tmp32)
-	bs[17] = byte(tmp32 >> 8)
-	bs[18] = byte(tmp32 >> 16)
-	bs[19] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[20] = byte(tmp32)
-	bs[21] = byte(tmp32 >> 8)
-	bs[22] = byte(tmp32 >> 16)
-	bs[23] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen2 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
 func (t *PrepareReply) Unmarshal(rr io.Reader) error {
@@ -827,10 +826,10 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [24]byte
+	var b [22]byte
 	var bs []byte
-	bs = b[:18]
-	if _, err := io.ReadAtLeast(wire, bs, 18); err != nil {
+	bs = b[:22]
+	if _, err := io.ReadAtLeast(wire, bs, 22); err != nil {
 		return err
 	}
 	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
@@ -838,7 +837,8 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	t.Instance = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
 	t.OK = uint8(bs[12])
 	t.Ballot = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
-	t.Status = int8(bs[17])
+	t.VBallot = int32((uint32(bs[17]) | (uint32(bs[18]) << 8) | (uint32(bs[19]) << 16) | (uint32(bs[20]) << 24)))
+	t.Status = int8(bs[21])
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
@@ -847,16 +847,23 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Deps[0] = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Deps[1] = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Deps[2] = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
-	t.Deps[3] = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
-	t.Deps[4] = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
@@ -900,7 +907,7 @@ func (p *Commit) New() fastrpc.Serializable {
 }
 
 func (t *Commit) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [12]byte
 	var bs []byte
 	bs = b[:12]
 	tmp32 := t.LeaderId
@@ -927,37 +934,27 @@ func (t *Commit) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	bs = b[:4]
 	tmp32 = t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[12] = byte(tmp32)
-	bs[13] = byte(tmp32 >> 8)
-	bs[14] = byte(tmp32 >> 16)
-	bs[15] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[16] = byte(tmp32)
-	bs[17] = byte(tmp32 >> 8)
-	bs[18] = byte(tmp32 >> 16)
-	bs[19] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[20] = byte(tmp32)
-	bs[21] = byte(tmp32 >> 8)
-	bs[22] = byte(tmp32 >> 16)
-	bs[23] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen2 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
 func (t *Commit) Unmarshal(rr io.Reader) error {
@@ -966,7 +963,7 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [24]byte
+	var b [12]byte
 	var bs []byte
 	bs = b[:12]
 	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
@@ -983,21 +980,28 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Deps[0] = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Deps[1] = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Deps[2] = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
-	t.Deps[3] = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
-	t.Deps[4] = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen2)
+	for i := int64(0); i < alen2; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
 func (t *AcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 13, true
+	return 17, true
 }
 
 type AcceptReplyCache struct {
@@ -1036,44 +1040,50 @@ func (p *AcceptReply) New() fastrpc.Serializable {
 }
 
 func (t *AcceptReply) Marshal(wire io.Writer) {
-	var b [13]byte
+	var b [17]byte
 	var bs []byte
-	bs = b[:13]
-	tmp32 := t.Replica
+	bs = b[:17]
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Instance
+	tmp32 = t.Replica
 	bs[4] = byte(tmp32)
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	bs[8] = byte(t.OK)
+	tmp32 = t.Instance
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	bs[12] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[9] = byte(tmp32)
-	bs[10] = byte(tmp32 >> 8)
-	bs[11] = byte(tmp32 >> 16)
-	bs[12] = byte(tmp32 >> 24)
+	bs[13] = byte(tmp32)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32 >> 16)
+	bs[16] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *AcceptReply) Unmarshal(wire io.Reader) error {
-	var b [13]byte
+	var b [17]byte
 	var bs []byte
-	bs = b[:13]
-	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+	bs = b[:17]
+	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
 		return err
 	}
-	t.Replica = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.OK = uint8(bs[8])
-	t.Ballot = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Replica = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Instance = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.OK = uint8(bs[12])
+	t.Ballot = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
 	return nil
 }
 
 func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
-	return 44, true
+	return 0, false
 }
 
 type AcceptCache struct {
@@ -1112,9 +1122,9 @@ func (p *Accept) New() fastrpc.Serializable {
 }
 
 func (t *Accept) Marshal(wire io.Writer) {
-	var b [44]byte
+	var b [24]byte
 	var bs []byte
-	bs = b[:44]
+	bs = b[:24]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -1145,39 +1155,33 @@ func (t *Accept) Marshal(wire io.Writer) {
 	bs[21] = byte(tmp32 >> 8)
 	bs[22] = byte(tmp32 >> 16)
 	bs[23] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[0]
-	bs[24] = byte(tmp32)
-	bs[25] = byte(tmp32 >> 8)
-	bs[26] = byte(tmp32 >> 16)
-	bs[27] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[1]
-	bs[28] = byte(tmp32)
-	bs[29] = byte(tmp32 >> 8)
-	bs[30] = byte(tmp32 >> 16)
-	bs[31] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[2]
-	bs[32] = byte(tmp32)
-	bs[33] = byte(tmp32 >> 8)
-	bs[34] = byte(tmp32 >> 16)
-	bs[35] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[3]
-	bs[36] = byte(tmp32)
-	bs[37] = byte(tmp32 >> 8)
-	bs[38] = byte(tmp32 >> 16)
-	bs[39] = byte(tmp32 >> 24)
-	tmp32 = t.Deps[4]
-	bs[40] = byte(tmp32)
-	bs[41] = byte(tmp32 >> 8)
-	bs[42] = byte(tmp32 >> 16)
-	bs[43] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Deps))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Deps[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
 }
 
-func (t *Accept) Unmarshal(wire io.Reader) error {
-	var b [44]byte
+func (t *Accept) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [24]byte
 	var bs []byte
-	bs = b[:44]
-	if _, err := io.ReadAtLeast(wire, bs, 44); err != nil {
+	bs = b[:24]
+	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
 		return err
 	}
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
@@ -1186,11 +1190,18 @@ func (t *Accept) Unmarshal(wire io.Reader) error {
 	t.Ballot = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	t.Count = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
 	t.Seq = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
-	t.Deps[0] = int32((uint32(bs[24]) | (uint32(bs[25]) << 8) | (uint32(bs[26]) << 16) | (uint32(bs[27]) << 24)))
-	t.Deps[1] = int32((uint32(bs[28]) | (uint32(bs[29]) << 8) | (uint32(bs[30]) << 16) | (uint32(bs[31]) << 24)))
-	t.Deps[2] = int32((uint32(bs[32]) | (uint32(bs[33]) << 8) | (uint32(bs[34]) << 16) | (uint32(bs[35]) << 24)))
-	t.Deps[3] = int32((uint32(bs[36]) | (uint32(bs[37]) << 8) | (uint32(bs[38]) << 16) | (uint32(bs[39]) << 24)))
-	t.Deps[4] = int32((uint32(bs[40]) | (uint32(bs[41]) << 8) | (uint32(bs[42]) << 16) | (uint32(bs[43]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Deps = make([]int32, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Deps[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
 	return nil
 }
 
@@ -1273,3 +1284,170 @@ func (t *Prepare) Unmarshal(wire io.Reader) error {
 	t.Ballot = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	return nil
 }
+
+func (t *LeaseRequest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type LeaseRequestCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRequest
+}
+
+func NewLeaseRequestCache() *LeaseRequestCache {
+	c := &LeaseRequestCache{}
+	c.cache = make([]*LeaseRequest, 0)
+	return c
+}
+
+func (p *LeaseRequestCache) Get() *LeaseRequest {
+	var t *LeaseRequest
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRequest{}
+	}
+	return t
+}
+
+func (p *LeaseRequestCache) Put(t *LeaseRequest) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+
+func (p *LeaseRequest) New() fastrpc.Serializable {
+	return new(LeaseRequest)
+}
+
+func (t *LeaseRequest) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Epoch
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *LeaseRequest) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Epoch = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	return nil
+}
+
+func (t *LeaseGrant) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LeaseGrantCache struct {
+	mu    sync.Mutex
+	cache []*LeaseGrant
+}
+
+func NewLeaseGrantCache() *LeaseGrantCache {
+	c := &LeaseGrantCache{}
+	c.cache = make([]*LeaseGrant, 0)
+	return c
+}
+
+func (p *LeaseGrantCache) Get() *LeaseGrant {
+	var t *LeaseGrant
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseGrant{}
+	}
+	return t
+}
+
+func (p *LeaseGrantCache) Put(t *LeaseGrant) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+
+func (p *LeaseGrant) New() fastrpc.Serializable {
+	return new(LeaseGrant)
+}
+
+func (t *LeaseGrant) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Epoch
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.CrtInstance))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.CrtInstance[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
+}
+
+func (t *LeaseGrant) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Epoch = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.CrtInstance = make([]int32, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.CrtInstance[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
+	return nil
+}
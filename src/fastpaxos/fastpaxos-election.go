@@ -0,0 +1,258 @@
+package fastpaxos
+
+import (
+	"gus-epaxos/src/fastpaxosproto"
+	"gus-epaxos/src/state"
+	"log"
+	"time"
+)
+
+// Coordinator changes. The coordinator sends an Open every HEARTBEAT. A
+// replica that has not heard from it in a while runs Phase 1 for every
+// instance it does not know to be committed, with a fast ballot higher than
+// any it has promised: the replicas ranked right after the coordinator try
+// first. Acceptors that promise the ballot report their votes above the
+// floors of the Prepare. With a majority of promises, the new coordinator
+// proposes again, in the classic round above its ballot, the value it picks
+// for every instance with votes, and then opens its ballot as the fast round
+// of all the others.
+//
+// Acceptors get the Accepts of the new coordinator before its Open, so that
+// none votes in the fast round for an instance that the coordinator
+// recovered.
+
+// How often the coordinator sends an Open
+const HEARTBEAT = 50 * time.Millisecond
+
+// How long the replica ranked right after the coordinator waits for an Open
+// before it runs for coordinator; the next one waits twice as long, and so on
+const COORDINATOR_TIMEOUT = 500 * time.Millisecond
+
+// How long a replica waits for a majority of promises before it tries again
+// with a higher ballot
+const PREPARE_TIMEOUT = 500 * time.Millisecond
+
+// Ballots are (counter << (BALLOT_ID_BITS+1)) | (replica id << 1) | recovery
+const BALLOT_ID_BITS = 4
+const BALLOT_ID_MASK = (1 << BALLOT_ID_BITS) - 1
+
+// campaign is an election in progress
+type campaign struct {
+	ballot  int32
+	acks    []bool
+	oks     int
+	entries map[instanceId][]fastpaxosproto.PrepareEntry
+	sentAt  time.Time
+}
+
+// makeFastBallot is the fast ballot of this replica after counter
+func (r *Replica) makeFastBallot(counter int32) int32 {
+	return (counter << (BALLOT_ID_BITS + 1)) | (r.Id << 1)
+}
+
+func ballotOwner(ballot int32) int32 {
+	return (ballot >> 1) & BALLOT_ID_MASK
+}
+
+// startCampaign runs for coordinator with a ballot higher than any this
+// replica has promised
+func (r *Replica) startCampaign() {
+	ballot := r.makeFastBallot((r.ballot >> (BALLOT_ID_BITS + 1)) + 1)
+	r.ballot = ballot
+	r.recordBallot()
+	r.IsLeader = false
+	r.dropRecoveries()
+
+	c := &campaign{ballot, make([]bool, r.N), 0, make(map[instanceId][]fastpaxosproto.PrepareEntry), time.Now()}
+	r.campaign = c
+	log.Printf("Replica %d campaigning with ballot %d\n", r.Id, ballot)
+
+	// this replica promises its own ballot
+	floors := r.floors()
+	r.addPromise(r.Id, r.entriesAbove(floors))
+	r.sync()
+	if c.oks > r.N>>1 {
+		r.finishCampaign()
+		return
+	}
+	r.bcastAll(r.prepareRPC, &fastpaxosproto.Prepare{r.Id, ballot, floors})
+}
+
+// floors lists the keys this replica knows committed versions of
+func (r *Replica) floors() []fastpaxosproto.Floor {
+	floors := make([]fastpaxosproto.Floor, 0)
+	for key, ks := range r.keys {
+		if ks.committedUpTo > 0 {
+			floors = append(floors, fastpaxosproto.Floor{ks.committedUpTo, key})
+		}
+	}
+	return floors
+}
+
+// entriesAbove lists the votes and values this replica knows of above the
+// floors
+func (r *Replica) entriesAbove(floors []fastpaxosproto.Floor) []fastpaxosproto.PrepareEntry {
+	floorOf := make(map[state.Key]int32, len(floors))
+	for _, f := range floors {
+		floorOf[f.Key] = f.Version
+	}
+	entries := make([]fastpaxosproto.PrepareEntry, 0)
+	for key, ks := range r.keys {
+		for version, inst := range ks.instances {
+			if version <= floorOf[key] || (inst.ballot < 0 && inst.status != COMMITTED) {
+				continue
+			}
+			committed := FALSE
+			if inst.status == COMMITTED {
+				committed = TRUE
+			}
+			entries = append(entries, fastpaxosproto.PrepareEntry{inst.ballot, committed, version, inst.writer, inst.seq, inst.cmd})
+		}
+	}
+	return entries
+}
+
+func (r *Replica) addPromise(acceptor int32, entries []fastpaxosproto.PrepareEntry) {
+	c := r.campaign
+	if c.acks[acceptor] {
+		return
+	}
+	c.acks[acceptor] = true
+	c.oks++
+	for _, e := range entries {
+		id := instanceId{e.Command.K, e.Version}
+		c.entries[id] = append(c.entries[id], e)
+	}
+}
+
+func (r *Replica) handlePrepare(prepare *fastpaxosproto.Prepare) {
+	if prepare.Ballot < r.ballot {
+		r.SendMsg(prepare.LeaderId, r.ackPrepareRPC, &fastpaxosproto.AckPrepare{r.Id, r.ballot, FALSE, nil})
+		return
+	}
+
+	r.observeBallot(prepare.Ballot)
+	r.recordBallot()
+	r.sync()
+	r.lastOpen = time.Now()
+	r.SendMsg(prepare.LeaderId, r.ackPrepareRPC, &fastpaxosproto.AckPrepare{r.Id, prepare.Ballot, TRUE, r.entriesAbove(prepare.Floors)})
+}
+
+func (r *Replica) handleAckPrepare(preply *fastpaxosproto.AckPrepare) {
+	c := r.campaign
+	if c == nil {
+		// we've moved on -- these are delayed replies, so just ignore
+		return
+	}
+
+	if preply.OK == FALSE {
+		if preply.Ballot > c.ballot {
+			// another replica has taken over
+			log.Printf("Replica %d lost its campaign to ballot %d\n", r.Id, preply.Ballot)
+			r.observeBallot(preply.Ballot)
+		}
+		return
+	}
+	if preply.Ballot != c.ballot {
+		// a reply to an earlier campaign
+		return
+	}
+
+	r.addPromise(preply.AcceptorId, preply.Entries)
+	if c.oks > r.N>>1 {
+		r.finishCampaign()
+	}
+}
+
+// finishCampaign recovers every instance the majority reported votes for,
+// then opens the fast round
+func (r *Replica) finishCampaign() {
+	c := r.campaign
+	r.campaign = nil
+	r.IsLeader = true
+	log.Printf("Replica %d is the coordinator with ballot %d\n", r.Id, c.ballot)
+
+	for id, entries := range c.entries {
+		inst := r.instance(id)
+		if inst.status != COMMITTED {
+			for _, e := range entries {
+				if e.Committed == TRUE {
+					r.commit(id, e.WriterID, e.Seq, e.Command)
+					break
+				}
+			}
+		}
+		if inst.status == COMMITTED {
+			// let the others know
+			r.bcastCommitWrite(id, inst.seq, inst.writer, inst.cmd.V)
+			continue
+		}
+
+		votes := make([]vote, len(entries))
+		for i, e := range entries {
+			votes[i] = vote{e.Ballot, e.WriterID, e.Seq, e.Command}
+		}
+		r.proposeClassic(id, inst, c.ballot|1, pick(votes))
+	}
+
+	r.fastBallot = c.ballot
+	r.lastOpen = time.Now()
+	r.bcastAll(r.openRPC, &fastpaxosproto.Open{r.Id, c.ballot})
+}
+
+func (r *Replica) handleOpen(open *fastpaxosproto.Open) {
+	if open.Ballot < r.ballot {
+		return
+	}
+	r.observeBallot(open.Ballot)
+	r.fastBallot = open.Ballot
+	r.lastOpen = time.Now()
+}
+
+// observeBallot promises a higher ballot, and steps down if it belongs to
+// another replica
+func (r *Replica) observeBallot(ballot int32) {
+	if ballot <= r.ballot {
+		return
+	}
+	r.ballot = ballot
+	r.recordBallot()
+	if ballotOwner(ballot) == r.Id {
+		return
+	}
+	if r.IsLeader || r.campaign != nil {
+		log.Printf("Replica %d steps down for ballot %d\n", r.Id, ballot)
+	}
+	r.IsLeader = false
+	r.campaign = nil
+	r.dropRecoveries()
+}
+
+// checkCoordinator sends the heartbeat of the coordinator, runs for
+// coordinator when it is silent, and tries an election again when it took
+// too long
+func (r *Replica) checkCoordinator(now time.Time) {
+	if r.IsLeader {
+		if now.Sub(r.lastOpen) >= HEARTBEAT {
+			r.lastOpen = now
+			r.bcastAll(r.openRPC, &fastpaxosproto.Open{r.Id, r.fastBallot})
+		}
+		return
+	}
+
+	if r.campaign != nil {
+		if now.Sub(r.campaign.sentAt) >= PREPARE_TIMEOUT {
+			r.startCampaign()
+		}
+		return
+	}
+
+	rank := r.Id
+	if r.ballot >= 0 {
+		rank = (r.Id - ballotOwner(r.ballot) - 1 + int32(r.N)) % int32(r.N)
+	}
+	if now.Sub(r.lastOpen) >= time.Duration(rank+1)*COORDINATOR_TIMEOUT {
+		log.Printf("Replica %d has not heard from coordinator %d\n", r.Id, ballotOwner(r.ballot))
+		r.startCampaign()
+	}
+}
@@ -0,0 +1,222 @@
+package fastpaxos
+
+import (
+	"gus-epaxos/src/dlog"
+	"gus-epaxos/src/fastpaxosproto"
+	"gus-epaxos/src/state"
+	"time"
+)
+
+// Collision recovery. The coordinator collects the votes of the acceptors
+// for every instance of its fast round. When a majority has voted and no
+// value can get a fast quorum any more, or the instance is still undecided
+// after RECOVERY_TIMEOUT, it runs the classic round right above the fast one.
+// The votes it has serve as the Phase 1 of that round, as acceptors vote at
+// most once in the fast round, so it proposes the value with the most votes
+// in the highest round reported: if a value could have been chosen in the
+// fast round, it is that one.
+
+// How long the coordinator lets an instance with a majority of votes
+// decide by itself
+const RECOVERY_TIMEOUT = 20 * time.Millisecond
+
+// vote is what an acceptor reported of its vote for an instance
+type vote struct {
+	ballot int32
+	writer int32
+	seq    int32
+	cmd    state.Command
+}
+
+type CoordinatorBookkeeping struct {
+	votes     map[int32]vote // by acceptor
+	firstVote time.Time
+	ballot    int32 // of the classic round in progress, -1 if none
+	value     vote  // proposed in it
+	acks      []bool
+	acceptOKs int
+	sentAt    time.Time
+}
+
+// bookkeeping starts tracking an instance at the coordinator
+func (r *Replica) bookkeeping(id instanceId, inst *Instance) *CoordinatorBookkeeping {
+	if inst.cb == nil {
+		inst.cb = &CoordinatorBookkeeping{make(map[int32]vote), time.Now(), -1, vote{}, nil, 0, time.Time{}}
+		r.recovering[id] = inst
+	}
+	return inst.cb
+}
+
+// dropRecoveries forgets the instances this replica was the coordinator of
+func (r *Replica) dropRecoveries() {
+	for _, inst := range r.recovering {
+		inst.cb = nil
+	}
+	r.recovering = make(map[instanceId]*Instance)
+}
+
+func (r *Replica) addVote(ack *fastpaxosproto.AckWrite) {
+	id := instanceId{ack.Command.K, ack.Version}
+	inst := r.instance(id)
+	if inst.status == COMMITTED {
+		if ack.AcceptorId != r.Id {
+			r.SendMsg(ack.AcceptorId, r.commitWriteRPC, &fastpaxosproto.CommitWrite{inst.seq, inst.writer, id.version, -1, -1, id.key, inst.cmd.V})
+		}
+		return
+	}
+
+	cb := r.bookkeeping(id, inst)
+	cb.votes[ack.AcceptorId] = vote{ack.VoteBallot, ack.WriterID, ack.Seq, ack.Command}
+	if cb.ballot < 0 && r.collided(cb) {
+		dlog.Printf("Collision on version %d of key %d\n", id.version, id.key)
+		r.recover(id, inst)
+	}
+}
+
+// collided tells whether a majority has voted in the fast round, and no value
+// can get the votes of a fast quorum any more
+func (r *Replica) collided(cb *CoordinatorBookkeeping) bool {
+	if len(cb.votes) < r.classicQuorum() {
+		return false
+	}
+	counts := make(map[vote]int)
+	for _, v := range cb.votes {
+		if v.ballot == r.fastBallot {
+			counts[vote{v.ballot, v.writer, v.seq, state.Command{}}]++
+		}
+	}
+	undecided := r.N - len(cb.votes)
+	for _, n := range counts {
+		if n+undecided >= r.fastQuorum() {
+			return false
+		}
+	}
+	return true
+}
+
+// pick is the value to propose in a classic round, given the votes of at
+// least a majority. In a classic round at most one value gets votes. In a
+// fast round, a value v could have been chosen only if a fast quorum voted
+// for it, and then at least q+F-N of the q acceptors that reported did,
+// while any other value has at most N-F votes among them: fewer, as
+// 2N < q+2F.
+func pick(votes []vote) vote {
+	best := vote{-1, -1, -1, state.Command{}}
+	for _, v := range votes {
+		if v.ballot > best.ballot {
+			best = v
+		}
+	}
+	counts := make(map[[2]int32]int)
+	bestCount := 0
+	for _, v := range votes {
+		if v.ballot != best.ballot {
+			continue
+		}
+		value := [2]int32{v.writer, v.seq}
+		counts[value]++
+		if counts[value] > bestCount {
+			bestCount = counts[value]
+			best = v
+		}
+	}
+	return best
+}
+
+// recover runs the classic round right above the fast round for an instance
+func (r *Replica) recover(id instanceId, inst *Instance) {
+	cb := inst.cb
+	votes := make([]vote, 0, len(cb.votes))
+	for _, v := range cb.votes {
+		votes = append(votes, v)
+	}
+	r.proposeClassic(id, inst, r.fastBallot|1, pick(votes))
+}
+
+// proposeClassic proposes a value for an instance in a classic round that
+// this replica ran Phase 1 for
+func (r *Replica) proposeClassic(id instanceId, inst *Instance, ballot int32, v vote) {
+	cb := r.bookkeeping(id, inst)
+	cb.ballot = ballot
+	cb.value = v
+	cb.value.cmd.K = id.key
+	cb.acks = make([]bool, r.N)
+	cb.acceptOKs = 0
+	r.sendAccept(id, cb)
+}
+
+func (r *Replica) sendAccept(id instanceId, cb *CoordinatorBookkeeping) {
+	cb.sentAt = time.Now()
+	accept := &fastpaxosproto.Accept{r.Id, cb.ballot, id.version, cb.value.writer, cb.value.seq, cb.value.cmd}
+	r.bcastAll(r.acceptRPC, accept)
+	r.handleAccept(accept)
+}
+
+// checkRecoveries recovers the instances that did not decide in time, and
+// sends again the Accepts that did not get a majority
+func (r *Replica) checkRecoveries(now time.Time) {
+	for id, inst := range r.recovering {
+		cb := inst.cb
+		if cb.ballot < 0 {
+			if len(cb.votes) >= r.classicQuorum() && now.Sub(cb.firstVote) >= RECOVERY_TIMEOUT {
+				r.recover(id, inst)
+			}
+		} else if now.Sub(cb.sentAt) >= RECOVERY_TIMEOUT {
+			r.sendAccept(id, cb)
+		}
+	}
+}
+
+func (r *Replica) handleAccept(accept *fastpaxosproto.Accept) {
+	id := instanceId{accept.Command.K, accept.Version}
+	inst := r.instance(id)
+	areply := &fastpaxosproto.AckAccept{r.Id, accept.Ballot, TRUE, accept.Version, id.key}
+
+	if accept.Ballot < r.ballot {
+		areply.OK = FALSE
+		areply.Ballot = r.ballot
+	} else if inst.status != COMMITTED && inst.ballot > accept.Ballot {
+		areply.OK = FALSE
+		areply.Ballot = inst.ballot
+	} else {
+		// only a coordinator that a majority promised its fast round sends
+		// Accepts
+		r.observeBallot(accept.Ballot &^ 1)
+		if inst.status != COMMITTED {
+			inst.ballot = accept.Ballot
+			inst.writer = accept.WriterID
+			inst.seq = accept.Seq
+			inst.cmd = accept.Command
+			r.recordInstance(accept.Version, inst)
+			r.sync()
+		}
+	}
+
+	if accept.LeaderId == r.Id {
+		r.handleAckAccept(areply)
+		return
+	}
+	r.SendMsg(accept.LeaderId, r.ackAcceptRPC, areply)
+}
+
+func (r *Replica) handleAckAccept(areply *fastpaxosproto.AckAccept) {
+	if areply.OK == FALSE {
+		r.observeBallot(areply.Ballot &^ 1)
+		return
+	}
+
+	id := instanceId{areply.Key, areply.Version}
+	inst := r.recovering[id]
+	if inst == nil || inst.cb.ballot != areply.Ballot || inst.cb.acks[areply.AcceptorId] {
+		// we've moved on -- these are delayed replies, so just ignore
+		return
+	}
+	cb := inst.cb
+	cb.acks[areply.AcceptorId] = true
+	cb.acceptOKs++
+	if cb.acceptOKs >= r.classicQuorum() {
+		dlog.Printf("Version %d of key %d chosen in round %d\n", id.version, id.key, cb.ballot)
+		r.bcastCommitWrite(id, cb.value.seq, cb.value.writer, cb.value.cmd.V)
+		r.commit(id, cb.value.writer, cb.value.seq, cb.value.cmd)
+	}
+}
@@ -1,15 +1,15 @@
 package fastpaxos
 
 import (
-	"fmt"
+	"encoding/binary"
 	"gus-epaxos/src/dlog"
 	"gus-epaxos/src/fastpaxosproto"
 	"gus-epaxos/src/fastrpc"
 	"gus-epaxos/src/genericsmr"
 	"gus-epaxos/src/genericsmrproto"
 	"gus-epaxos/src/state"
+	"io"
 	"log"
-	"math"
 	"time"
 )
 
@@ -17,13 +17,35 @@ const CHAN_BUFFER_SIZE = 200000
 const TRUE = uint8(1)
 const FALSE = uint8(0)
 
-const MAX_BATCH = 1   // No Batch
-const MAX_OP = 500000 // If this is too large, something blows up
-// const MAX_TAG = MAX_OP*3
-const MAX_TAG = 1000 // 5000*3, MAX_Key = 1000
-const MAX_KEY = 5000 // If this is too large, something blows up
-
-//const MAX_WRITE = 5000
+const CLOCK = 1000 * 10
+
+// Timeouts are checked this often
+const TIMEOUT_CHECK = 5 * time.Millisecond
+
+// A writer that has not learned the fate of its Write in this long sends it
+// again, in the fast round open at that time
+const RETRY_TIMEOUT = 50 * time.Millisecond
+
+// Every version of a key is an instance of Fast Paxos. A replica that gets a
+// PUT from a client proposes it for the version after the last one it knows
+// to be committed, by sending a Write to every acceptor in the fast round the
+// coordinator opened. Acceptors vote for the first value they see for an
+// instance, and report their vote to the writer and to the coordinator. A
+// value with the votes of a fast quorum is chosen: the writer commits it, and
+// tells the others. It replies to the client once a majority has committed
+// the value.
+//
+// Writers that lose an instance, to another value chosen there, propose again
+// for the next version. Collisions, where no value can get a fast quorum any
+// more, are for the coordinator to recover from (see fastpaxos-recovery.go),
+// and a coordinator that stops sending heartbeats is replaced (see
+// fastpaxos-election.go).
+//
+// A GET reads the highest version committed at each replica of a majority.
+// If some of them lack the highest one, the reader writes it back to a
+// majority before it replies. Every completed PUT or GET has left its value
+// committed at a majority, which meets the majority of any later GET, so no
+// later GET returns an older value.
 
 type Replica struct {
 	*genericsmr.Replica // extends a generic Paxos replica
@@ -35,6 +57,9 @@ type Replica struct {
 	ackReadChan         chan fastrpc.Serializable
 	acceptChan          chan fastrpc.Serializable
 	ackAcceptChan       chan fastrpc.Serializable
+	prepareChan         chan fastrpc.Serializable
+	ackPrepareChan      chan fastrpc.Serializable
+	openChan            chan fastrpc.Serializable
 	writeRPC            uint8
 	ackWriteRPC         uint8
 	commitWriteRPC      uint8
@@ -43,37 +68,88 @@ type Replica struct {
 	ackReadRPC          uint8
 	acceptRPC           uint8
 	ackAcceptRPC        uint8
-	IsLeader            bool // does this replica think it is the leader
+	prepareRPC          uint8
+	ackPrepareRPC       uint8
+	openRPC             uint8
+	IsLeader            bool // is this replica the coordinator
 	Shutdown            bool
-	counter             int
-	flush               bool
-	currentVersion      map[state.Key]int32 //currentTag[i] = version for object i
+	ballot              int32 // highest ballot promised, -1 if none
+	fastBallot          int32 // fast round opened by the coordinator, -1 if none
+	keys                map[state.Key]*keyState
 	currentSeq          int32
-	bookkeeping         []OpsBookkeeping
-	storage             map[state.Key]map[int32]state.Value
-	busyKey             map[state.Key]bool
-	pendingOps          []*genericsmr.Propose
+	ops                 map[int32]*OpsBookkeeping           // operations of the clients of this replica, by seq
+	busyKey             map[state.Key]*OpsBookkeeping       // operation in progress, per key
+	pendingOps          map[state.Key][]*genericsmr.Propose // operations waiting for it, per key
+	recovering          map[instanceId]*Instance            // instances this coordinator got votes for, not yet committed
+	campaign            *campaign                           // election in progress, if any
+	lastOpen            time.Time                           // last heartbeat sent, or heard from the coordinator
+	lastCheck           time.Time                           // last time timeouts were checked
+	beTheLeaderChan     chan bool
+}
+
+type InstanceStatus int
+
+const (
+	ACCEPTED InstanceStatus = iota
+	COMMITTED
+)
+
+// Instance is a version of a key
+type Instance struct {
+	ballot int32 // of the vote of this replica, -1 if it has not voted
+	writer int32 // the value voted for, or chosen
+	seq    int32
+	cmd    state.Command
+	status InstanceStatus
+	cb     *CoordinatorBookkeeping
+}
+
+type instanceId struct {
+	key     state.Key
+	version int32
+}
+
+// keyState is what a replica knows of the versions of a key
+type keyState struct {
+	version       int32 // highest version committed
+	value         state.Value
+	committedUpTo int32 // every version up to this one is committed
+	instances     map[int32]*Instance
 }
 
 type OpsBookkeeping struct {
-	ackWrites        int
-	ackReads         int
-	ackCommits       int
-	maxVersion       int32
-	proposal         *genericsmr.Propose // default = nil
-	key              state.Key
-	valueToWrite     state.Value // default = 0
-	doneFirstPhase   bool
-	doneSecondPhase  bool
-	needSecondPhase  bool
-	waitForAckCommit bool
-	waitForAckRead   bool
-	complete         bool
+	seq        int32
+	proposal   *genericsmr.Propose
+	key        state.Key
+	version    int32 // proposed, for a PUT
+	ballot     int32 // fast round of the Write
+	acks       []bool
+	oks        int
+	maxVersion int32 // highest version read, for a GET
+	minVersion int32 // lowest version read
+	writer     int32 // the value of the highest version
+	writerSeq  int32
+	value      state.Value
+	committing bool // is the operation waiting for a majority to commit its value?
+	sentAt     time.Time
 }
 
 func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable)
+
+	go r.run()
+
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+	if len(peerAddrList) > BALLOT_ID_MASK+1 {
+		log.Fatalf("Fast Paxos supports at most %d replicas\n", BALLOT_ID_MASK+1)
+	}
+
 	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, 3*genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
@@ -81,18 +157,23 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		0, 0, 0, 0,
-		0, 0, 0, 0,
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 		false,
 		false,
+		-1,
+		-1,
+		make(map[state.Key]*keyState),
 		0,
-		true,
-		make(map[state.Key]int32),
-		0,
-		make([]OpsBookkeeping, MAX_OP),
-		make(map[state.Key]map[int32]state.Value),
-		make(map[state.Key]bool),
-		[]*genericsmr.Propose{}}
+		make(map[int32]*OpsBookkeeping),
+		make(map[state.Key]*OpsBookkeeping),
+		make(map[state.Key][]*genericsmr.Propose),
+		make(map[instanceId]*Instance),
+		nil,
+		time.Now(),
+		time.Now(),
+		make(chan bool, 1)}
 
 	r.Durable = durable
 
@@ -102,11 +183,53 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 	r.ackCommitRPC = r.RegisterRPC(new(fastpaxosproto.AckCommit), r.ackCommitChan)
 	r.readRPC = r.RegisterRPC(new(fastpaxosproto.Read), r.readChan)
 	r.ackReadRPC = r.RegisterRPC(new(fastpaxosproto.AckRead), r.ackReadChan)
+	r.acceptRPC = r.RegisterRPC(new(fastpaxosproto.Accept), r.acceptChan)
+	r.ackAcceptRPC = r.RegisterRPC(new(fastpaxosproto.AckAccept), r.ackAcceptChan)
+	r.prepareRPC = r.RegisterRPC(new(fastpaxosproto.Prepare), r.prepareChan)
+	r.ackPrepareRPC = r.RegisterRPC(new(fastpaxosproto.AckPrepare), r.ackPrepareChan)
+	r.openRPC = r.RegisterRPC(new(fastpaxosproto.Open), r.openChan)
 
-	go r.run()
 	return r
 }
 
+// classicQuorum is the size of a majority
+func (r *Replica) classicQuorum() int {
+	return r.N/2 + 1
+}
+
+// fastQuorum is the smallest size such that any two fast quorums and a
+// classic quorum intersect: 2N < classicQuorum + 2*fastQuorum
+func (r *Replica) fastQuorum() int {
+	return r.N - (r.classicQuorum()+1)/2 + 1
+}
+
+// append a promise to stable storage
+func (r *Replica) recordBallot() {
+	if !r.Durable {
+		return
+	}
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(r.ballot))
+	r.StableStore.Write(b[:])
+}
+
+// append the vote or the value of an instance to stable storage
+func (r *Replica) recordInstance(version int32, inst *Instance) {
+	if !r.Durable {
+		return
+	}
+
+	var b [17]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(version))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(inst.ballot))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(inst.writer))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(inst.seq))
+	b[16] = byte(inst.status)
+	r.StableStore.Write(b[:])
+	inst.cmd.Marshal(io.Writer(r.StableStore))
+}
+
 // sync with the stable store
 func (r *Replica) sync() {
 	if !r.Durable {
@@ -119,7 +242,11 @@ func (r *Replica) sync() {
 /* RPC to be called by master */
 
 func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
-	r.IsLeader = true
+	// the event loop runs the election
+	select {
+	case r.beTheLeaderChan <- true:
+	default:
+	}
 	return nil
 }
 
@@ -129,7 +256,7 @@ var clockChan chan bool
 
 func (r *Replica) clock() {
 	for !r.Shutdown {
-		time.Sleep(1000)
+		time.Sleep(CLOCK)
 		clockChan <- true
 	}
 }
@@ -145,8 +272,7 @@ func (r *Replica) run() {
 	go r.WaitForClientConnections()
 
 	if r.Id == 0 {
-		r.IsLeader = true
-		//r.currentTag[42].Timestamp = 100 // For testing
+		r.startCampaign()
 	}
 
 	clockChan = make(chan bool, 1)
@@ -159,406 +285,414 @@ func (r *Replica) run() {
 		select {
 
 		case <-clockChan:
-			//activate the new proposals channel
-			onOffProposeChan = r.ProposeChan
+			//activate the new proposals channel, once a fast round is open
+			r.checkTimeouts()
+			if r.fastBallot >= 0 && r.fastBallot == r.ballot {
+				onOffProposeChan = r.ProposeChan
+			}
+			break
+
+		case <-r.beTheLeaderChan:
+			if !r.IsLeader && r.campaign == nil {
+				r.startCampaign()
+			}
 			break
 
 		case propose := <-onOffProposeChan:
 			//got a Propose from a client
 			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
-			//fmt.Printf("Proposal with op %d\n", propose.Command.Op)
-
-			key := propose.Command.K
-
-			if r.busyKey[key] {
-				r.pendingOps = append(r.pendingOps, propose)
-			} else {
-
-				r.busyKey[key] = true
-				r.bookkeeping[r.currentSeq].proposal = propose
-				r.bookkeeping[r.currentSeq].key = key
-
-				_, existence := r.currentVersion[key]
-				if !existence {
-					r.currentVersion[key] = 0
-				}
-
-				r.bookkeeping[r.currentSeq].maxVersion = r.currentVersion[key]
-
-				if propose.Command.Op == state.GET {
-					// GET
-					//fmt.Printf("Fast Paxos: Processing Get by Replica %d\n", r.Id)
-					r.bookkeeping[r.currentSeq].waitForAckRead = true
-					r.bcastRead(r.currentSeq, propose.Command)
-					r.currentSeq++
-				} else {
-					// PUT
-					//fmt.Printf("Fast Paxos: Processing Put by Replica %d\n", r.Id)
-
-					_, existence2 := r.storage[key]
-					if !existence2 {
-						r.storage[key] = make(map[int32]state.Value)
-					}
-
-					r.bookkeeping[r.currentSeq].valueToWrite = propose.Command.V
-
-					r.currentVersion[key] = r.currentVersion[key] + 1
-					r.bookkeeping[r.currentSeq].maxVersion = r.currentVersion[key]
-					r.bcastWrite(r.currentSeq, propose.Command)
-					r.currentSeq++
-
-				}
-
-			}
+			r.handlePropose(propose)
 			//deactivate the new proposals channel to prioritize the handling of protocol messages
 			onOffProposeChan = nil
 			break
 
 		case writeS := <-r.writeChan:
 			write := writeS.(*fastpaxosproto.Write)
-			version := write.Version
-			key := write.Command.K
-			seq := int32(write.Seq)
-			id := write.WriterID
-
-			_, existence := r.currentVersion[key]
-			if !existence {
-				r.currentVersion[key] = 0
-			}
-			myVersion := r.currentVersion[key]
-
-			if myVersion < version {
-				r.currentVersion[key] = version
-
-				_, existence := r.storage[key]
-				if !existence {
-					r.storage[key] = make(map[int32]state.Value)
-				}
-				r.storage[key][version] = write.Command.V
-				r.bcastAckWrite(seq, id, version)
-			} else {
-				r.bcastAckWrite(seq, id, version)
-			}
-
-			fmt.Printf("Replica %d: Received Write from writer %d; value %d; time %d\n", r.Id, write.WriterID, write.Command.V, write.Version)
-
-			//if r.Id == 0 {
-			//	fmt.Printf("Replica %d: +++++++++++++++\n", r.Id)
-			//	for index, element := range r.storage[key] {
-			//		fmt.Println(index.Timestamp, ", ", index.WriterID, "=>", element)
-			//	}
-			//	fmt.Printf("+++++++++++++++\n")
-			//}
+			dlog.Printf("Received Write from writer %d for version %d\n", write.WriterID, write.Version)
+			r.handleWrite(write)
 			break
 
 		case ackWriteS := <-r.ackWriteChan:
 			ackWrite := ackWriteS.(*fastpaxosproto.AckWrite)
-			key := r.bookkeeping[ackWrite.Seq].key
-
-			r.bookkeeping[ackWrite.Seq].ackWrites++
-			if r.bookkeeping[ackWrite.Seq].maxVersion < ackWrite.LatestVersion {
-				r.bookkeeping[ackWrite.Seq].maxVersion = ackWrite.LatestVersion
-				r.bookkeeping[ackWrite.Seq].needSecondPhase = true
-			}
-
-			fastQuorumSize := int(math.Floor(3 * float64(r.N) / 4))
-
-			//fmt.Println("GUS: bookKeeping Seq %d with %d ack-write", ackWrite.Seq, r.bookkeeping[ackWrite.Seq].acks)
-			if (r.bookkeeping[ackWrite.Seq].ackWrites >= fastQuorumSize) && !r.bookkeeping[ackWrite.Seq].doneFirstPhase && !r.bookkeeping[ackWrite.Seq].complete {
-				r.bookkeeping[ackWrite.Seq].doneFirstPhase = true
-				if !r.bookkeeping[ackWrite.Seq].needSecondPhase { // All staleTag = FALSE
-
-					// Reply to client
-					//fmt.Printf("Fasx Paxos: reply to client %d +++ Fast Path +++\n", r.currentSeq)
-					if r.bookkeeping[ackWrite.Seq].proposal != nil {
-						propreply := &genericsmrproto.ProposeReplyTS{
-							TRUE,
-							r.bookkeeping[ackWrite.Seq].proposal.CommandId,
-							state.NIL,
-							r.bookkeeping[ackWrite.Seq].proposal.Timestamp}
-						r.ReplyProposeTS(propreply, r.bookkeeping[ackWrite.Seq].proposal.Reply)
-						r.bookkeeping[ackWrite.Seq].complete = true
-					}
-					r.busyKey[key] = false
-					r.reset(ackWrite.Seq)
-
-					// Tell others to commit
-					r.bcastCommitWrite(ackWrite.Seq, ackWrite.WriterID, r.bookkeeping[ackWrite.Seq].maxVersion)
-					r.storage[key][r.bookkeeping[ackWrite.Seq].maxVersion] = r.bookkeeping[ackWrite.Seq].valueToWrite
-				} else {
-					r.currentVersion[key] = r.bookkeeping[ackWrite.Seq].maxVersion + 1
-					r.bcastCommitWrite(ackWrite.Seq, ackWrite.WriterID, r.bookkeeping[ackWrite.Seq].maxVersion)
-					r.bookkeeping[ackWrite.Seq].waitForAckCommit = true
-				}
-			}
+			r.handleAckWrite(ackWrite)
 			break
 
 		case commitWriteS := <-r.commitWriteChan:
 			commitWrite := commitWriteS.(*fastpaxosproto.CommitWrite)
-			version := commitWrite.Version
-			key := commitWrite.Key
-
-			if version > r.currentVersion[key] {
-				r.currentVersion[key] = version
-			}
-
-			_, existence := r.storage[key]
-			if !existence {
-				r.storage[key] = make(map[int32]state.Value)
-			}
-			r.storage[key][r.currentVersion[key]] = commitWrite.Value
-			r.bcastAckCommit(commitWrite.Seq, commitWrite.ID)
+			r.handleCommitWrite(commitWrite)
 			break
 
 		case ackCommitS := <-r.ackCommitChan:
 			ackCommit := ackCommitS.(*fastpaxosproto.AckCommit)
-			seq := ackCommit.Seq
-
-			r.bookkeeping[seq].ackCommits++
-
-			if (r.bookkeeping[seq].ackCommits >= (r.N-1)/2) && r.bookkeeping[seq].needSecondPhase &&
-				!r.bookkeeping[seq].complete && r.bookkeeping[seq].waitForAckCommit {
-				r.bookkeeping[seq].complete = true
-				key := r.bookkeeping[seq].proposal.Command.K
-				// Reply to client
-				propreply := &genericsmrproto.ProposeReplyTS{
-					TRUE,
-					r.bookkeeping[seq].proposal.CommandId,
-					r.storage[key][r.currentVersion[key]],
-					r.bookkeeping[seq].proposal.Timestamp}
-				r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-				r.bookkeeping[seq].complete = true
-				r.busyKey[key] = false
-				r.reset(seq)
-			}
-
+			r.handleAckCommit(ackCommit)
 			break
 
 		case readS := <-r.readChan:
 			read := readS.(*fastpaxosproto.Read)
-			r.bcastAckRead(read.Seq, read.ReaderID, read.Command.K)
+			r.handleRead(read)
 			break
 
 		case ackReadS := <-r.ackReadChan:
 			ackRead := ackReadS.(*fastpaxosproto.AckRead)
-			key := r.bookkeeping[ackRead.Seq].key
-			r.bookkeeping[ackRead.Seq].ackReads++
-
-			version := r.currentVersion[key]
-
-			if version < ackRead.Version { //A conflicting write
-				r.currentVersion[key] = ackRead.Version
-				_, existence := r.storage[key]
-				if !existence {
-					r.storage[key] = make(map[int32]state.Value)
-				}
-				r.storage[key][r.currentVersion[key]] = ackRead.Value
-				r.bookkeeping[ackRead.Seq].needSecondPhase = true
-			}
-			fastQuorumSize := int(math.Floor(3 * float64(r.N) / 4))
-			if (r.bookkeeping[ackRead.Seq].ackReads >= fastQuorumSize) && r.bookkeeping[ackRead.Seq].waitForAckRead {
-				if r.bookkeeping[ackRead.Seq].needSecondPhase {
-					r.bcastCommitWrite(ackRead.Seq, ackRead.ReaderID, r.bookkeeping[ackRead.Seq].maxVersion)
-					r.bookkeeping[ackRead.Seq].waitForAckCommit = true
-				} else {
-					// Reply to client
-					propreply := &genericsmrproto.ProposeReplyTS{
-						TRUE,
-						r.bookkeeping[ackRead.Seq].proposal.CommandId,
-						r.storage[key][r.currentVersion[key]],
-						r.bookkeeping[ackRead.Seq].proposal.Timestamp}
-					r.ReplyProposeTS(propreply, r.bookkeeping[ackRead.Seq].proposal.Reply)
-					r.bookkeeping[ackRead.Seq].complete = true
-					r.bookkeeping[ackRead.Seq].valueToWrite = r.storage[key][r.currentVersion[key]]
-					r.busyKey[key] = false
-					r.reset(ackRead.Seq)
-				}
-				r.bookkeeping[ackRead.Seq].waitForAckRead = false
-			}
+			r.handleAckRead(ackRead)
+			break
+
+		case acceptS := <-r.acceptChan:
+			accept := acceptS.(*fastpaxosproto.Accept)
+			dlog.Printf("Received Accept from replica %d for version %d\n", accept.LeaderId, accept.Version)
+			r.handleAccept(accept)
+			break
+
+		case ackAcceptS := <-r.ackAcceptChan:
+			ackAccept := ackAcceptS.(*fastpaxosproto.AckAccept)
+			r.handleAckAccept(ackAccept)
+			break
+
+		case prepareS := <-r.prepareChan:
+			prepare := prepareS.(*fastpaxosproto.Prepare)
+			dlog.Printf("Received Prepare from replica %d\n", prepare.LeaderId)
+			r.handlePrepare(prepare)
+			break
 
+		case ackPrepareS := <-r.ackPrepareChan:
+			ackPrepare := ackPrepareS.(*fastpaxosproto.AckPrepare)
+			r.handleAckPrepare(ackPrepare)
+			break
+
+		case openS := <-r.openChan:
+			open := openS.(*fastpaxosproto.Open)
+			r.handleOpen(open)
 			break
 		}
 	}
 }
 
-// seq denotes is associated with the operation that just completes
-func (r *Replica) reset(seq int32) {
-	// Optimization: process pending operations
-	if len(r.pendingOps) != 0 {
-		var proposal *genericsmr.Propose
-		var newSlice []*genericsmr.Propose
-
-		for i := 0; i < len(r.pendingOps); i++ {
-			proposal = r.pendingOps[i]
-			if proposal.Command.Op == state.GET {
-				propreply := &genericsmrproto.ProposeReplyTS{
-					TRUE,
-					proposal.CommandId,
-					r.bookkeeping[seq].valueToWrite,
-					proposal.Timestamp}
-				r.ReplyProposeTS(propreply, proposal.Reply)
-				//TODO: add this proposal to the booking for debugging/logging purpose
-			} else {
-				newSlice = append(newSlice, proposal)
-			}
-			fmt.Print("Handling concurrent operations %d\n", len(r.pendingOps))
-		}
-
-		r.pendingOps = newSlice
+// checkTimeouts retries the Writes, recoveries and elections that are late
+func (r *Replica) checkTimeouts() {
+	now := time.Now()
+	if now.Sub(r.lastCheck) < TIMEOUT_CHECK {
+		return
 	}
+	r.lastCheck = now
 
-	if len(r.pendingOps) != 0 {
-		oldProposal := r.pendingOps[0]
-		r.pendingOps = r.pendingOps[1:]
-		r.ProposeChan <- oldProposal
-		fmt.Println(len(r.pendingOps))
+	r.checkCoordinator(now)
+	if r.IsLeader {
+		r.checkRecoveries(now)
+	}
+	if r.fastBallot < 0 || r.fastBallot != r.ballot {
+		return
+	}
+	for _, op := range r.busyKey {
+		if op.proposal.Command.Op != state.GET && !op.committing && now.Sub(op.sentAt) >= RETRY_TIMEOUT {
+			r.sendWrite(op)
+		}
 	}
 }
 
-/**********************************************************************
-                    inter-replica communication
-***********************************************************************/
+func (r *Replica) keyState(key state.Key) *keyState {
+	ks := r.keys[key]
+	if ks == nil {
+		ks = &keyState{0, state.NIL, 0, make(map[int32]*Instance)}
+		r.keys[key] = ks
+	}
+	return ks
+}
 
-func (r *Replica) bcastAll(whichRPC uint8, msg fastrpc.Serializable) {
+// instance returns a version of a key, which this replica has not voted for
+// if it did not know of it yet
+func (r *Replica) instance(id instanceId) *Instance {
+	ks := r.keyState(id.key)
+	inst := ks.instances[id.version]
+	if inst == nil {
+		inst = &Instance{-1, -1, -1, state.Command{state.PUT, id.key, state.NIL}, ACCEPTED, nil}
+		ks.instances[id.version] = inst
+	}
+	return inst
+}
 
-	//n := r.N - 1
-	n := r.N - 1
-	q := r.Id
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	key := propose.Command.K
+	if r.busyKey[key] != nil {
+		r.pendingOps[key] = append(r.pendingOps[key], propose)
+		return
+	}
+	r.startOp(propose)
+}
 
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
+func (r *Replica) startOp(propose *genericsmr.Propose) {
+	key := propose.Command.K
+	ks := r.keyState(key)
+	writer, writerSeq := r.versionWriter(ks)
+	op := &OpsBookkeeping{r.currentSeq, propose, key, 0, -1, make([]bool, r.N), 0, ks.version, ks.version, writer, writerSeq, ks.value, false, time.Now()}
+	r.currentSeq++
+	r.ops[op.seq] = op
+	r.busyKey[key] = op
+
+	if propose.Command.Op == state.GET {
+		// this replica is part of the majority
+		op.acks[r.Id] = true
+		op.oks = 1
+		if op.oks >= r.classicQuorum() {
+			r.finishOp(op, op.value)
+			return
 		}
-		sent++
-		r.SendMsg(q, whichRPC, msg)
+		r.bcastRead(op.seq, propose.Command)
+		return
 	}
-}
 
-var writeMSG fastpaxosproto.Write
+	op.version = ks.version + 1
+	r.sendWrite(op)
+}
 
-func (r *Replica) bcastWrite(seq int32, command state.Command) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
+// finishOp replies to the client, and starts the next operation on the key
+func (r *Replica) finishOp(op *OpsBookkeeping, value state.Value) {
+	propreply := &genericsmrproto.ProposeReplyTS{
+		TRUE,
+		op.proposal.CommandId,
+		value,
+		op.proposal.Timestamp}
+	r.ReplyProposeTS(propreply, op.proposal.Reply)
+	delete(r.ops, op.seq)
+	delete(r.busyKey, op.key)
+
+	if pending := r.pendingOps[op.key]; len(pending) > 0 {
+		r.pendingOps[op.key] = pending[1:]
+		if len(pending) == 1 {
+			delete(r.pendingOps, op.key)
 		}
-	}()
+		r.startOp(pending[0])
+	}
+}
 
-	writeMSG.Seq = seq
-	writeMSG.WriterID = r.Id
-	writeMSG.Version = r.currentVersion[r.bookkeeping[seq].key]
-	writeMSG.Command = command
-	args := &writeMSG
+// sendWrite proposes the value of a PUT in the open fast round
+func (r *Replica) sendWrite(op *OpsBookkeeping) {
+	op.ballot = r.fastBallot
+	op.acks = make([]bool, r.N)
+	op.oks = 0
+	op.sentAt = time.Now()
 
-	r.bcastAll(r.writeRPC, args)
+	write := &fastpaxosproto.Write{op.seq, r.Id, op.ballot, op.version, op.proposal.Command}
+	r.bcastAll(r.writeRPC, write)
+	r.handleWrite(write)
 }
 
-var ackWriteMSG fastpaxosproto.AckWrite
+func (r *Replica) handleWrite(write *fastpaxosproto.Write) {
+	ks := r.keyState(write.Command.K)
+	inst := ks.instances[write.Version]
 
-func (r *Replica) bcastAckWrite(seq int32, writerID int32, version int32) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
+	if inst != nil && inst.status == COMMITTED {
+		if write.WriterID != r.Id {
+			r.SendMsg(write.WriterID, r.commitWriteRPC, &fastpaxosproto.CommitWrite{inst.seq, inst.writer, write.Version, -1, -1, write.Command.K, inst.cmd.V})
 		}
-	}()
+		return
+	}
 
-	ackWriteMSG.Seq = seq
-	ackWriteMSG.WriterID = writerID
-	ackWriteMSG.LatestVersion = version
+	if write.Ballot != r.fastBallot || r.fastBallot != r.ballot {
+		// not the round this replica is in: the writer tries again later
+		r.sendAckWrite(write.WriterID, &fastpaxosproto.AckWrite{r.Id, r.ballot, FALSE, write.Version, -1, write.WriterID, write.Seq, write.Command})
+		return
+	}
 
-	args := &ackWriteMSG
+	if inst == nil || inst.ballot < 0 {
+		// acceptors vote only once in an instance for a value they did not
+		// get from a coordinator, so that what they report of it stays true
+		inst = r.instance(instanceId{write.Command.K, write.Version})
+		inst.ballot = write.Ballot
+		inst.writer = write.WriterID
+		inst.seq = write.Seq
+		inst.cmd = write.Command
+		r.recordInstance(write.Version, inst)
+		r.sync()
+	}
 
-	// Send ACK-Write to WriterID
-	r.SendMsg(writerID, r.ackWriteRPC, args)
+	ack := &fastpaxosproto.AckWrite{r.Id, write.Ballot, TRUE, write.Version, inst.ballot, inst.writer, inst.seq, inst.cmd}
+	r.sendAckWrite(write.WriterID, ack)
+	if coordinator := ballotOwner(write.Ballot); coordinator != write.WriterID {
+		r.sendAckWrite(coordinator, ack)
+	}
+}
 
+func (r *Replica) sendAckWrite(to int32, ack *fastpaxosproto.AckWrite) {
+	if to == r.Id {
+		r.handleAckWrite(ack)
+		return
+	}
+	r.SendMsg(to, r.ackWriteRPC, ack)
 }
 
-var commitWriteMSG fastpaxosproto.CommitWrite
+func (r *Replica) handleAckWrite(ack *fastpaxosproto.AckWrite) {
+	key := ack.Command.K
+	if ack.OK == FALSE {
+		r.observeBallot(ack.Ballot)
+		return
+	}
 
-func (r *Replica) bcastCommitWrite(seq int32, id int32, version int32) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
+	// as the writer
+	if op := r.busyKey[key]; op != nil && op.proposal.Command.Op != state.GET && !op.committing &&
+		ack.Version == op.version && ack.VoteBallot == op.ballot &&
+		ack.WriterID == r.Id && ack.Seq == op.seq && !op.acks[ack.AcceptorId] {
+		op.acks[ack.AcceptorId] = true
+		op.oks++
+		if op.oks >= r.fastQuorum() {
+			// chosen in the fast round
+			dlog.Printf("Version %d of key %d chosen in the fast round\n", op.version, key)
+			r.commit(instanceId{key, op.version}, r.Id, op.seq, op.proposal.Command)
 		}
-	}()
+	}
 
-	commitWriteMSG.Seq = seq
-	commitWriteMSG.ID = id
-	commitWriteMSG.Version = version
-	commitWriteMSG.Key = r.bookkeeping[seq].proposal.Command.K
-	commitWriteMSG.Value = r.bookkeeping[seq].valueToWrite
+	// as the coordinator
+	if r.IsLeader && ack.Ballot == r.fastBallot {
+		r.addVote(ack)
+	}
+}
 
-	args := &commitWriteMSG
+func (r *Replica) handleCommitWrite(commitWrite *fastpaxosproto.CommitWrite) {
+	r.commit(instanceId{commitWrite.Key, commitWrite.Version}, commitWrite.ID, commitWrite.Seq, state.Command{state.PUT, commitWrite.Key, commitWrite.Value})
+	if commitWrite.ReaderID >= 0 {
+		r.SendMsg(commitWrite.ReaderID, r.ackCommitRPC, &fastpaxosproto.AckCommit{r.Id, commitWrite.ReadSeq})
+	}
+}
+
+// commit learns the value chosen for an instance. The writer of the
+// operation in progress on the key has a majority commit the value if it is
+// its own, and proposes it again for the next version otherwise.
+func (r *Replica) commit(id instanceId, writer int32, seq int32, cmd state.Command) {
+	ks := r.keyState(id.key)
+	inst := r.instance(id)
+	if inst.status == COMMITTED {
+		return
+	}
+	inst.writer = writer
+	inst.seq = seq
+	inst.cmd = cmd
+	inst.status = COMMITTED
+	inst.cb = nil
+	delete(r.recovering, id)
+	r.recordInstance(id.version, inst)
+
+	if id.version > ks.version {
+		ks.version = id.version
+		ks.value = cmd.V
+	}
+	for next := ks.instances[ks.committedUpTo+1]; next != nil && next.status == COMMITTED; next = ks.instances[ks.committedUpTo+1] {
+		ks.committedUpTo++
+	}
 
-	r.bcastAll(r.commitWriteRPC, args)
+	op := r.busyKey[id.key]
+	if op == nil || op.proposal.Command.Op == state.GET || op.version != id.version {
+		return
+	}
+	if writer == r.Id && seq == op.seq {
+		// the reply to a PUT carries no value
+		op.value = state.NIL
+		r.waitForCommit(op, id, writer, seq, cmd.V)
+		return
+	}
+	op.version = ks.version + 1
+	r.sendWrite(op)
 }
 
-var ackCommitMSG fastpaxosproto.AckCommit
+// versionWriter returns the writer and seq of the highest version of a key
+// committed here, or -1, -1 if there is none
+func (r *Replica) versionWriter(ks *keyState) (int32, int32) {
+	inst := ks.instances[ks.version]
+	if inst == nil {
+		return -1, -1
+	}
+	return inst.writer, inst.seq
+}
 
-func (r *Replica) bcastAckCommit(seq int32, coordinator int32) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
-		}
-	}()
+func (r *Replica) handleRead(read *fastpaxosproto.Read) {
+	ks := r.keyState(read.Command.K)
+	writer, writerSeq := r.versionWriter(ks)
+	r.SendMsg(read.ReaderID, r.ackReadRPC, &fastpaxosproto.AckRead{read.Seq, read.ReaderID, ks.version, writer, writerSeq, ks.value})
+}
 
-	ackCommitMSG.Seq = seq
-	ackCommitMSG.Coordinator = coordinator
-	args := &ackCommitMSG
+func (r *Replica) handleAckRead(ackRead *fastpaxosproto.AckRead) {
+	op := r.ops[ackRead.Seq]
+	if op == nil || op.proposal.Command.Op != state.GET || op.committing {
+		return
+	}
+	op.oks++
+	if ackRead.Version > op.maxVersion {
+		op.maxVersion = ackRead.Version
+		op.writer = ackRead.WriterID
+		op.writerSeq = ackRead.WriterSeq
+		op.value = ackRead.Value
+	}
+	if ackRead.Version < op.minVersion {
+		op.minVersion = ackRead.Version
+	}
+	if op.oks < r.classicQuorum() {
+		return
+	}
 
-	// Send ACK-Commit to writerID
-	r.SendMsg(coordinator, r.ackCommitRPC, args)
+	if op.minVersion < op.maxVersion {
+		r.startWriteBack(op)
+		return
+	}
+	r.finishOp(op, op.value)
 }
 
-var readMSG fastpaxosproto.Read
+// startWriteBack commits the value a GET read at the replicas that lack it
+func (r *Replica) startWriteBack(op *OpsBookkeeping) {
+	dlog.Printf("Writing back version %d of key %d\n", op.maxVersion, op.key)
+	id := instanceId{op.key, op.maxVersion}
+	r.commit(id, op.writer, op.writerSeq, state.Command{state.PUT, op.key, op.value})
+	r.waitForCommit(op, id, op.writer, op.writerSeq, op.value)
+}
 
-func (r *Replica) bcastRead(seq int32, command state.Command) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
-		}
-	}()
+// waitForCommit tells every replica that the value of writer, seq is chosen
+// for a version, and has the operation reply with op.value once a majority
+// has committed it
+func (r *Replica) waitForCommit(op *OpsBookkeeping, id instanceId, writer int32, seq int32, value state.Value) {
+	op.committing = true
+	op.acks = make([]bool, r.N)
+	op.acks[r.Id] = true
+	op.oks = 1
+	if op.oks >= r.classicQuorum() {
+		r.finishOp(op, op.value)
+		return
+	}
 
-	readMSG.Seq = seq
-	readMSG.ReaderID = r.Id
-	readMSG.Version = r.bookkeeping[r.currentSeq].maxVersion
-	readMSG.Command = command
-	args := &readMSG
+	r.bcastAll(r.commitWriteRPC, &fastpaxosproto.CommitWrite{seq, writer, id.version, r.Id, op.seq, id.key, value})
+}
 
-	r.bcastAll(r.readRPC, args)
+func (r *Replica) handleAckCommit(ackCommit *fastpaxosproto.AckCommit) {
+	op := r.ops[ackCommit.Seq]
+	if op == nil || !op.committing || op.acks[ackCommit.AcceptorId] {
+		return
+	}
+	op.acks[ackCommit.AcceptorId] = true
+	op.oks++
+	if op.oks >= r.classicQuorum() {
+		r.finishOp(op, op.value)
+	}
 }
 
-var ackReadMSG fastpaxosproto.AckRead
+/**********************************************************************
+                    inter-replica communication
+***********************************************************************/
 
-func (r *Replica) bcastAckRead(seq int32, readerID int32, key state.Key) {
+func (r *Replica) bcastAll(whichRPC uint8, msg fastrpc.Serializable) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Println("Write bcast failed:", err)
+			log.Println("Bcast failed:", err)
 		}
 	}()
 
-	ackReadMSG.Seq = seq
-	ackReadMSG.ReaderID = readerID
-
-	version, existence := r.currentVersion[key]
-	if !existence {
-		r.currentVersion[key] = 0
-		version = 0
-	}
-
-	ackReadMSG.Version = version
-
-	value, existence2 := r.storage[key][version]
-	if !existence2 {
-		value = state.Value(0)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q] {
+			continue
+		}
+		r.SendMsg(q, whichRPC, msg)
 	}
+}
 
-	ackReadMSG.Value = value
-
-	args := &ackReadMSG
+func (r *Replica) bcastCommitWrite(id instanceId, seq int32, writer int32, value state.Value) {
+	r.bcastAll(r.commitWriteRPC, &fastpaxosproto.CommitWrite{seq, writer, id.version, -1, -1, id.key, value})
+}
 
-	r.bcastAll(r.ackReadRPC, args)
+func (r *Replica) bcastRead(seq int32, command state.Command) {
+	r.bcastAll(r.readRPC, &fastpaxosproto.Read{seq, r.Id, r.ops[seq].maxVersion, command})
 }
@@ -0,0 +1,272 @@
+package fastpaxos
+
+import (
+	"bytes"
+	"gus-epaxos/src/fastpaxosproto"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/state"
+	"testing"
+	"time"
+)
+
+// testNet runs the Fast Paxos handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, true)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.writeRPC:       new(fastpaxosproto.Write),
+		r.ackWriteRPC:    new(fastpaxosproto.AckWrite),
+		r.commitWriteRPC: new(fastpaxosproto.CommitWrite),
+		r.ackCommitRPC:   new(fastpaxosproto.AckCommit),
+		r.readRPC:        new(fastpaxosproto.Read),
+		r.ackReadRPC:     new(fastpaxosproto.AckRead),
+		r.acceptRPC:      new(fastpaxosproto.Accept),
+		r.ackAcceptRPC:   new(fastpaxosproto.AckAccept),
+		r.prepareRPC:     new(fastpaxosproto.Prepare),
+		r.ackPrepareRPC:  new(fastpaxosproto.AckPrepare),
+		r.openRPC:        new(fastpaxosproto.Open),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *fastpaxosproto.Write:
+			r.handleWrite(m)
+		case *fastpaxosproto.AckWrite:
+			r.handleAckWrite(m)
+		case *fastpaxosproto.CommitWrite:
+			r.handleCommitWrite(m)
+		case *fastpaxosproto.AckCommit:
+			r.handleAckCommit(m)
+		case *fastpaxosproto.Read:
+			r.handleRead(m)
+		case *fastpaxosproto.AckRead:
+			r.handleAckRead(m)
+		case *fastpaxosproto.Accept:
+			r.handleAccept(m)
+		case *fastpaxosproto.AckAccept:
+			r.handleAckAccept(m)
+		case *fastpaxosproto.Prepare:
+			r.handlePrepare(m)
+		case *fastpaxosproto.AckPrepare:
+			r.handleAckPrepare(m)
+		case *fastpaxosproto.Open:
+			r.handleOpen(m)
+		}
+	}
+	return net
+}
+
+// propose hands an operation to a replica, and returns where its reply goes
+func (net *testNet) propose(id int, op state.Operation, key state.Key, val state.Value) *bytes.Buffer {
+	propose, reply := smrtest.Propose(int32(val), state.Command{op, key, val})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+// committed is the value a replica committed for a version of a key
+func committed(r *Replica, key state.Key, version int32) (state.Value, bool) {
+	inst := r.keyState(key).instances[version]
+	if inst == nil || inst.status != COMMITTED {
+		return 0, false
+	}
+	return inst.cmd.V, true
+}
+
+func TestQuorumSizes(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		r := &Replica{Replica: &genericsmr.Replica{N: n}}
+		q, f := r.classicQuorum(), r.fastQuorum()
+		if 2*q <= n || 2*n >= q+2*f || 2*n < q+2*(f-1) || f > n {
+			t.Errorf("%d replicas: classic quorum %d, fast quorum %d", n, q, f)
+		}
+	}
+}
+
+func TestFastPath(t *testing.T) {
+	net := newTestNet(t, 3)
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	reply := net.propose(1, state.PUT, 7, 70)
+	net.DeliverAll()
+	for _, r := range net.replicas {
+		if v, ok := committed(r, 7, 1); !ok || v != 70 {
+			t.Fatalf("replica %d has not committed the PUT in version 1", r.Id)
+		}
+		if len(r.recovering) != 0 {
+			t.Fatalf("replica %d recovers instances after a fast round", r.Id)
+		}
+	}
+	smrtest.CheckReply(t, reply, 70, TRUE, state.NIL)
+
+	reply = net.propose(2, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+}
+
+func TestReadWritesBack(t *testing.T) {
+	net := newTestNet(t, 5)
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	// the PUT is chosen, but only its writer learns of it, and fails before
+	// it can reply
+	reply := net.propose(1, state.PUT, 7, 70)
+	for to := 0; to < 5; to++ {
+		net.Deliver(1, to)
+	}
+	for from := 0; from < 5; from++ {
+		net.Drop(from, 0)
+		net.Deliver(from, 1)
+	}
+	net.DropFrom(1)
+	if reply.Len() > 0 {
+		t.Fatalf("the PUT completed before a majority committed it")
+	}
+	if _, ok := committed(net.replicas[2], 7, 1); ok {
+		t.Fatalf("replica 2 learned of the PUT")
+	}
+
+	// a GET that sees it at replica 1 writes it back to a majority
+	net.Down[3] = true
+	net.Down[4] = true
+	reply = net.propose(2, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+	for _, id := range []int{0, 2} {
+		if v, ok := committed(net.replicas[id], 7, 1); !ok || v != 70 {
+			t.Fatalf("replica %d has not committed the value read", id)
+		}
+	}
+
+	// so a later GET returns it without replicas 1 and 2
+	net.Crash(1)
+	net.Down[2] = true
+	net.Down[3] = false
+	net.Down[4] = false
+	reply = net.propose(4, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+}
+
+func TestPutThenGet(t *testing.T) {
+	net := newTestNet(t, 5)
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	// the PUT is chosen in the fast round
+	reply := net.propose(1, state.PUT, 7, 70)
+	for to := 0; to < 5; to++ {
+		net.Deliver(1, to)
+	}
+	for from := 0; from < 5; from++ {
+		net.Drop(from, 0)
+		net.Deliver(from, 1)
+	}
+	if _, ok := committed(net.replicas[1], 7, 1); !ok {
+		t.Fatalf("replica 1 has not committed the PUT")
+	}
+
+	// the writer replies once a majority has committed it
+	net.Drop(1, 0)
+	net.Drop(1, 4)
+	net.Deliver(1, 2)
+	net.Deliver(1, 3)
+	net.Deliver(2, 1)
+	if reply.Len() > 0 {
+		t.Fatalf("the PUT completed before a majority committed it")
+	}
+	net.Deliver(3, 1)
+	smrtest.CheckReply(t, reply, 70, TRUE, state.NIL)
+
+	// so a GET at replicas that have not heard of the commit still returns it
+	net.Down[1] = true
+	net.Down[2] = true
+	reply = net.propose(4, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+}
+
+func TestCollisionRecovery(t *testing.T) {
+	net := newTestNet(t, 3)
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	// both writers propose a value for version 1 before hearing of the other
+	reply1 := net.propose(1, state.PUT, 7, 10)
+	reply2 := net.propose(2, state.PUT, 7, 20)
+	net.DeliverAll()
+
+	smrtest.CheckReply(t, reply1, 10, TRUE, state.NIL)
+	smrtest.CheckReply(t, reply2, 20, TRUE, state.NIL)
+	if inst := net.replicas[0].keyState(7).instances[1]; inst.ballot&1 != 1 {
+		t.Fatalf("version 1 was not chosen in the recovery round")
+	}
+	first, _ := committed(net.replicas[0], 7, 1)
+	second, _ := committed(net.replicas[0], 7, 2)
+	if first == second || (first != 10 && first != 20) || (second != 10 && second != 20) {
+		t.Fatalf("versions 1 and 2 hold %d and %d", first, second)
+	}
+	for _, r := range net.replicas {
+		v1, ok1 := committed(r, 7, 1)
+		v2, ok2 := committed(r, 7, 2)
+		if !ok1 || !ok2 || v1 != first || v2 != second {
+			t.Fatalf("replica %d committed %d and %d", r.Id, v1, v2)
+		}
+	}
+}
+
+func TestCoordinatorFailover(t *testing.T) {
+	net := newTestNet(t, 3)
+	r1 := net.replicas[1]
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	// with the coordinator down, a fast quorum of 3 is out of reach
+	net.Down[0] = true
+	reply := net.propose(2, state.PUT, 7, 10)
+	net.DeliverAll()
+	if _, ok := committed(net.replicas[2], 7, 1); ok {
+		t.Fatalf("version 1 committed without a fast quorum")
+	}
+
+	// the next replica takes over, and recovers the instance
+	r1.checkCoordinator(time.Now().Add(COORDINATOR_TIMEOUT))
+	net.DeliverAll()
+	if !r1.IsLeader || net.replicas[2].fastBallot != r1.ballot {
+		t.Fatalf("replica 1 has not become the coordinator")
+	}
+	smrtest.CheckReply(t, reply, 10, TRUE, state.NIL)
+
+	// later writes get a majority of votes, and are recovered in time
+	reply = net.propose(2, state.PUT, 7, 20)
+	net.DeliverAll()
+	r1.checkRecoveries(time.Now().Add(RECOVERY_TIMEOUT))
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 20, TRUE, state.NIL)
+	for _, r := range net.replicas[1:] {
+		if v, ok := committed(r, 7, 2); !ok || v != 20 {
+			t.Fatalf("replica %d has not committed version 2", r.Id)
+		}
+	}
+
+	// the old coordinator comes back, and steps down
+	net.Down[0] = false
+	r1.checkCoordinator(time.Now().Add(HEARTBEAT))
+	net.DeliverAll()
+	if net.replicas[0].IsLeader {
+		t.Fatalf("replica 0 is still the coordinator")
+	}
+}
@@ -4,32 +4,49 @@ import (
 	"gus-epaxos/src/state"
 )
 
-// PreAccept
+// Every version of a key is an instance of Fast Paxos. Ballots are
+// (counter << (BALLOT_ID_BITS+1)) | (coordinator << 1) | recovery: the even
+// ballot of a coordinator is a fast round, the odd one right above it the
+// classic round that recovers from its collisions.
+
+// Write proposes a value for a version of a key in the fast round Ballot
 type Write struct {
 	Seq      int32
 	WriterID int32
+	Ballot   int32
 	Version  int32
 	Command  state.Command
 }
 
-// AckPreAccept/Response
+// AckWrite reports the vote of an acceptor for a version of a key, to the
+// writer and to the coordinator of the round
 type AckWrite struct {
-	Seq           int32
-	WriterID      int32
-	LatestVersion int32
+	AcceptorId int32
+	Ballot     int32 // round of the Write, or the promise that refused it
+	OK         uint8 // FALSE if the acceptor refused the round
+	Version    int32
+	VoteBallot int32 // -1 if the acceptor has not voted
+	WriterID   int32 // the value voted for
+	Seq        int32
+	Command    state.Command
 }
 
+// CommitWrite tells that the value of writer ID, Seq is chosen for a version
 type CommitWrite struct {
-	Seq     int32
-	ID      int32
-	Version int32
-	Key     state.Key
-	Value   state.Value
+	Seq      int32
+	ID       int32
+	Version  int32
+	ReaderID int32 // the writer, or a reader writing the value back, that waits for an AckCommit, or -1
+	ReadSeq  int32
+	Key      state.Key
+	Value    state.Value
 }
 
+// AckCommit tells the replica that sent a CommitWrite that its value is
+// committed
 type AckCommit struct {
-	Seq         int32
-	Coordinator int32
+	AcceptorId int32
+	Seq        int32
 }
 
 // PreAccept
@@ -40,10 +57,68 @@ type Read struct {
 	Command  state.Command
 }
 
-// AckPreAccept/Response
+// AckRead reports the highest version of a key committed at an acceptor
 type AckRead struct {
-	Seq      int32
-	ReaderID int32
+	Seq       int32
+	ReaderID  int32
+	Version   int32
+	WriterID  int32 // the value of the version
+	WriterSeq int32
+	Value     state.Value
+}
+
+// Accept proposes a value for a version of a key in a classic round
+type Accept struct {
+	LeaderId int32
+	Ballot   int32
 	Version  int32
-	Value    state.Value
+	WriterID int32
+	Seq      int32
+	Command  state.Command
+}
+
+type AckAccept struct {
+	AcceptorId int32
+	Ballot     int32
+	OK         uint8
+	Version    int32
+	Key        state.Key
+}
+
+// Prepare runs Phase 1 for every version of every key above its floor
+type Prepare struct {
+	LeaderId int32
+	Ballot   int32
+	Floors   []Floor
+}
+
+// Floor is the highest version of a key up to which the coordinator knows
+// every value
+type Floor struct {
+	Version int32
+	Key     state.Key
+}
+
+type AckPrepare struct {
+	AcceptorId int32
+	Ballot     int32
+	OK         uint8
+	Entries    []PrepareEntry
+}
+
+// PrepareEntry is the vote of an acceptor for a version of a key
+type PrepareEntry struct {
+	Ballot    int32
+	Committed uint8
+	Version   int32
+	WriterID  int32
+	Seq       int32
+	Command   state.Command
+}
+
+// Open makes Ballot the fast round of every instance the coordinator did not
+// recover. The coordinator sends it again as a heartbeat.
+type Open struct {
+	LeaderId int32
+	Ballot   int32
 }
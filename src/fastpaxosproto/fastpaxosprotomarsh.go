@@ -1,16 +1,23 @@
 package fastpaxosproto
 
 import (
+	"bufio"
+	"encoding/binary"
 	"gus-epaxos/src/fastrpc"
 	"io"
 	"sync"
 )
 
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
 func (t *AckWrite) New() fastrpc.Serializable {
 	return new(AckWrite)
 }
 func (t *AckWrite) BinarySize() (nbytes int, sizeKnown bool) {
-	return 12, true
+	return 0, false
 }
 
 type AckWriteCache struct {
@@ -43,37 +50,61 @@ func (p *AckWriteCache) Put(t *AckWrite) {
 	p.mu.Unlock()
 }
 func (t *AckWrite) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [25]byte
 	var bs []byte
-	bs = b[:12]
-	tmp32 := t.Seq
+	bs = b[:25]
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.WriterID
+	tmp32 = t.Ballot
 	bs[4] = byte(tmp32)
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.LatestVersion
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Version
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	tmp32 = t.VoteBallot
+	bs[13] = byte(tmp32)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32 >> 16)
+	bs[16] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[17] = byte(tmp32)
+	bs[18] = byte(tmp32 >> 8)
+	bs[19] = byte(tmp32 >> 16)
+	bs[20] = byte(tmp32 >> 24)
+	tmp32 = t.Seq
+	bs[21] = byte(tmp32)
+	bs[22] = byte(tmp32 >> 8)
+	bs[23] = byte(tmp32 >> 16)
+	bs[24] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	t.Command.Marshal(wire)
 }
 
 func (t *AckWrite) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [25]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:25]
+	if _, err := io.ReadAtLeast(wire, bs, 25); err != nil {
+		return err
+	}
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.OK = uint8(bs[8])
+	t.Version = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	t.VoteBallot = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	t.WriterID = int32((uint32(bs[17]) | (uint32(bs[18]) << 8) | (uint32(bs[19]) << 16) | (uint32(bs[20]) << 24)))
+	t.Seq = int32((uint32(bs[21]) | (uint32(bs[22]) << 8) | (uint32(bs[23]) << 16) | (uint32(bs[24]) << 24)))
+	if err := t.Command.Unmarshal(wire); err != nil {
 		return err
 	}
-	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.LatestVersion = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
 	return nil
 }
 
@@ -114,9 +145,9 @@ func (p *CommitWriteCache) Put(t *CommitWrite) {
 	p.mu.Unlock()
 }
 func (t *CommitWrite) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:20]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -132,23 +163,37 @@ func (t *CommitWrite) Marshal(wire io.Writer) {
 	bs[9] = byte(tmp32 >> 8)
 	bs[10] = byte(tmp32 >> 16)
 	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.ReaderID
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.ReadSeq
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Key.Marshal(wire)
 	t.Value.Marshal(wire)
 }
 
 func (t *CommitWrite) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.ID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Version = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.ReaderID = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.ReadSeq = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
 	t.Key.Unmarshal(wire)
-	t.Value.Unmarshal(wire)
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -156,7 +201,7 @@ func (t *AckCommit) New() fastrpc.Serializable {
 	return new(AckCommit)
 }
 func (t *AckCommit) BinarySize() (nbytes int, sizeKnown bool) {
-	return 4, true
+	return 8, true
 }
 
 type AckCommitCache struct {
@@ -189,25 +234,31 @@ func (p *AckCommitCache) Put(t *AckCommit) {
 	p.mu.Unlock()
 }
 func (t *AckCommit) Marshal(wire io.Writer) {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	tmp32 := t.Seq
+	bs = b[:8]
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Seq
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *AckCommit) Unmarshal(wire io.Reader) error {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
 	}
-	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Seq = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	return nil
 }
 
@@ -321,9 +372,9 @@ func (p *AckReadCache) Put(t *AckRead) {
 	p.mu.Unlock()
 }
 func (t *AckRead) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:20]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -339,21 +390,35 @@ func (t *AckRead) Marshal(wire io.Writer) {
 	bs[9] = byte(tmp32 >> 8)
 	bs[10] = byte(tmp32 >> 16)
 	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.WriterSeq
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Value.Marshal(wire)
 }
 
 func (t *AckRead) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.ReaderID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Version = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Value.Unmarshal(wire)
+	t.WriterID = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.WriterSeq = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -394,9 +459,9 @@ func (p *WriteCache) Put(t *Write) {
 	p.mu.Unlock()
 }
 func (t *Write) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:16]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -407,25 +472,510 @@ func (t *Write) Marshal(wire io.Writer) {
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Version
+	tmp32 = t.Ballot
 	bs[8] = byte(tmp32)
 	bs[9] = byte(tmp32 >> 8)
 	bs[10] = byte(tmp32 >> 16)
 	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.Version
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Command.Marshal(wire)
 }
 
 func (t *Write) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.Version = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Accept) New() fastrpc.Serializable {
+	return new(Accept)
+}
+func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AcceptCache struct {
+	mu    sync.Mutex
+	cache []*Accept
+}
+
+func NewAcceptCache() *AcceptCache {
+	c := &AcceptCache{}
+	c.cache = make([]*Accept, 0)
+	return c
+}
+
+func (p *AcceptCache) Get() *Accept {
+	var t *Accept
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Accept{}
+	}
+	return t
+}
+func (p *AcceptCache) Put(t *Accept) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Accept) Marshal(wire io.Writer) {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.Version
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.Seq
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Command.Marshal(wire)
+}
+
+func (t *Accept) Unmarshal(wire io.Reader) error {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Version = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Command.Unmarshal(wire)
+	t.WriterID = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.Seq = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *AckAccept) New() fastrpc.Serializable {
+	return new(AckAccept)
+}
+func (t *AckAccept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AckAcceptCache struct {
+	mu    sync.Mutex
+	cache []*AckAccept
+}
+
+func NewAckAcceptCache() *AckAcceptCache {
+	c := &AckAcceptCache{}
+	c.cache = make([]*AckAccept, 0)
+	return c
+}
+
+func (p *AckAcceptCache) Get() *AckAccept {
+	var t *AckAccept
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AckAccept{}
+	}
+	return t
+}
+func (p *AckAcceptCache) Put(t *AckAccept) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AckAccept) Marshal(wire io.Writer) {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	tmp32 := t.AcceptorId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Version
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *AckAccept) Unmarshal(wire io.Reader) error {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.OK = uint8(bs[8])
+	t.Version = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	t.Key.Unmarshal(wire)
+	return nil
+}
+
+func (t *Prepare) New() fastrpc.Serializable {
+	return new(Prepare)
+}
+func (t *Prepare) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type PrepareCache struct {
+	mu    sync.Mutex
+	cache []*Prepare
+}
+
+func NewPrepareCache() *PrepareCache {
+	c := &PrepareCache{}
+	c.cache = make([]*Prepare, 0)
+	return c
+}
+
+func (p *PrepareCache) Get() *Prepare {
+	var t *Prepare
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Prepare{}
+	}
+	return t
+}
+func (p *PrepareCache) Put(t *Prepare) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Prepare) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Floors))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Floors[i].Marshal(wire)
+	}
+}
+
+func (t *Prepare) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Floors = make([]Floor, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Floors[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Floor) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Version
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *Floor) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Version = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key.Unmarshal(wire)
+	return nil
+}
+
+func (t *AckPrepare) New() fastrpc.Serializable {
+	return new(AckPrepare)
+}
+func (t *AckPrepare) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AckPrepareCache struct {
+	mu    sync.Mutex
+	cache []*AckPrepare
+}
+
+func NewAckPrepareCache() *AckPrepareCache {
+	c := &AckPrepareCache{}
+	c.cache = make([]*AckPrepare, 0)
+	return c
+}
+
+func (p *AckPrepareCache) Get() *AckPrepare {
+	var t *AckPrepare
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AckPrepare{}
+	}
+	return t
+}
+func (p *AckPrepareCache) Put(t *AckPrepare) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AckPrepare) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.AcceptorId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.OK)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Entries))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Entries[i].Marshal(wire)
+	}
+}
+
+func (t *AckPrepare) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.OK = uint8(bs[8])
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]PrepareEntry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Entries[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *PrepareEntry) Marshal(wire io.Writer) {
+	var b [17]byte
+	var bs []byte
+	bs = b[:17]
+	tmp32 := t.Ballot
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	bs[4] = byte(t.Committed)
+	tmp32 = t.Version
+	bs[5] = byte(tmp32)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32 >> 16)
+	bs[8] = byte(tmp32 >> 24)
+	tmp32 = t.WriterID
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	tmp32 = t.Seq
+	bs[13] = byte(tmp32)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32 >> 16)
+	bs[16] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Command.Marshal(wire)
+}
+
+func (t *PrepareEntry) Unmarshal(wire io.Reader) error {
+	var b [17]byte
+	var bs []byte
+	bs = b[:17]
+	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
+		return err
+	}
+	t.Ballot = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Committed = uint8(bs[4])
+	t.Version = int32((uint32(bs[5]) | (uint32(bs[6]) << 8) | (uint32(bs[7]) << 16) | (uint32(bs[8]) << 24)))
+	t.WriterID = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	t.Seq = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Open) New() fastrpc.Serializable {
+	return new(Open)
+}
+func (t *Open) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type OpenCache struct {
+	mu    sync.Mutex
+	cache []*Open
+}
+
+func NewOpenCache() *OpenCache {
+	c := &OpenCache{}
+	c.cache = make([]*Open, 0)
+	return c
+}
+
+func (p *OpenCache) Get() *Open {
+	var t *Open
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Open{}
+	}
+	return t
+}
+func (p *OpenCache) Put(t *Open) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Open) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *Open) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	return nil
 }
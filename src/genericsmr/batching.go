@@ -0,0 +1,102 @@
+package genericsmr
+
+import (
+	"gus-epaxos/src/genericsmrproto"
+	"sync"
+	"time"
+)
+
+// Number of power-of-two buckets in the batch size histogram
+const BATCH_HISTOGRAM_SIZE = 16
+
+// Batcher decides when a leader starts an instance for the proposals waiting
+// in ProposeChan, and how many of them go in it. It is consulted on every
+// tick of the protocol's clock.
+//
+// A batch takes the whole queue, up to MaxBatch commands. Under load, the
+// batcher waits for the queue to reach a target size before starting an
+// instance, but never holds a proposal back for longer than MaxDelay. The
+// target doubles when batches fill up and falls back to the size of the last
+// batch when the delay runs out, so an idle replica adds no latency.
+type Batcher struct {
+	MaxBatch int
+	MaxDelay time.Duration
+
+	target       int
+	waitingSince time.Time // when the oldest queued proposal was first seen
+
+	mu    sync.Mutex // stats are read by the BatchStats RPC
+	stats genericsmrproto.BatchStatsReply
+}
+
+func NewBatcher(maxBatch int, maxDelay time.Duration) *Batcher {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	b := &Batcher{MaxBatch: maxBatch, MaxDelay: maxDelay, target: 1}
+	b.stats.Histogram = make([]uint64, BATCH_HISTOGRAM_SIZE)
+	return b
+}
+
+// Ready tells whether the next queued proposal should be handled now. With an
+// empty queue, it tells whether a proposal should be handled as soon as it
+// arrives.
+func (b *Batcher) Ready(queued int) bool {
+	if queued == 0 {
+		b.waitingSince = time.Time{}
+		return b.target <= 1
+	}
+	if b.waitingSince.IsZero() {
+		b.waitingSince = time.Now()
+	}
+	return queued >= b.target || time.Since(b.waitingSince) >= b.MaxDelay
+}
+
+// Size is the number of commands in a batch started when queued proposals
+// are waiting, counting the one being handled
+func (b *Batcher) Size(queued int) int {
+	if queued > b.MaxBatch {
+		return b.MaxBatch
+	}
+	return queued
+}
+
+// Record adapts the target to a batch of size commands, after which left
+// proposals are still queued
+func (b *Batcher) Record(size int, left int) {
+	if size >= b.target && left > 0 {
+		b.target *= 2
+		if b.target > b.MaxBatch {
+			b.target = b.MaxBatch
+		}
+	} else if size < b.target {
+		b.target = size
+	}
+	if left == 0 {
+		b.waitingSince = time.Time{}
+	}
+
+	bucket := 0
+	for s := size; s > 1 && bucket < BATCH_HISTOGRAM_SIZE-1; s >>= 1 {
+		bucket++
+	}
+
+	b.mu.Lock()
+	b.stats.Batches++
+	b.stats.Commands += uint64(size)
+	if int32(size) > b.stats.Max {
+		b.stats.Max = int32(size)
+	}
+	b.stats.Target = int32(b.target)
+	b.stats.Histogram[bucket]++
+	b.mu.Unlock()
+}
+
+// Stats copies the batch size metrics into reply
+func (b *Batcher) Stats(reply *genericsmrproto.BatchStatsReply) {
+	b.mu.Lock()
+	*reply = b.stats
+	reply.Histogram = make([]uint64, len(b.stats.Histogram))
+	copy(reply.Histogram, b.stats.Histogram)
+	b.mu.Unlock()
+}
@@ -0,0 +1,73 @@
+package genericsmr
+
+import (
+	"gus-epaxos/src/genericsmrproto"
+	"testing"
+	"time"
+)
+
+func TestBatcherTarget(t *testing.T) {
+	b := NewBatcher(8, time.Hour)
+
+	// an idle replica handles proposals as they arrive
+	if !b.Ready(0) || !b.Ready(1) || b.Size(1) != 1 {
+		t.Fatalf("an idle batcher holds proposals back")
+	}
+
+	// the target doubles while batches fill up, up to MaxBatch
+	for _, want := range []int{2, 4, 8, 8} {
+		size := b.target
+		b.Record(size, 10)
+		if b.target != want {
+			t.Fatalf("target is %d after a full batch of %d, want %d", b.target, size, want)
+		}
+	}
+	if b.Size(20) != 8 {
+		t.Fatalf("a batch takes %d commands, over MaxBatch", b.Size(20))
+	}
+	if b.Ready(7) || !b.Ready(8) {
+		t.Fatalf("the batcher does not wait for %d proposals", b.target)
+	}
+
+	// and falls back to the size of a smaller batch
+	b.Record(3, 0)
+	if b.target != 3 || b.Ready(0) {
+		t.Fatalf("target is %d after a batch of 3", b.target)
+	}
+	b.Record(1, 0)
+	if !b.Ready(0) {
+		t.Fatalf("the batcher holds proposals back after the load is gone")
+	}
+
+	var stats genericsmrproto.BatchStatsReply
+	b.Stats(&stats)
+	if stats.Batches != 6 || stats.Commands != 1+2+4+8+3+1 || stats.Max != 8 || stats.Target != 1 {
+		t.Fatalf("got stats %+v", stats)
+	}
+	for bucket, want := range map[int]uint64{0: 2, 1: 2, 2: 1, 3: 1} {
+		if stats.Histogram[bucket] != want {
+			t.Fatalf("histogram bucket %d counts %d batches, want %d", bucket, stats.Histogram[bucket], want)
+		}
+	}
+}
+
+func TestBatcherDelay(t *testing.T) {
+	b := NewBatcher(8, 10*time.Millisecond)
+	b.Record(1, 1)
+	b.Record(2, 1)
+
+	// a lone proposal waits for the target, but no longer than MaxDelay
+	if b.Ready(1) {
+		t.Fatalf("the batcher did not wait for %d proposals", b.target)
+	}
+	b.waitingSince = b.waitingSince.Add(-b.MaxDelay)
+	if !b.Ready(1) {
+		t.Fatalf("the batcher held a proposal back for longer than MaxDelay")
+	}
+
+	// the delay starts again with the next proposal
+	b.Record(b.Size(1), 0)
+	if b.target != 1 || !b.waitingSince.IsZero() {
+		t.Fatalf("target is %d after the delay ran out", b.target)
+	}
+}
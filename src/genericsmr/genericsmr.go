@@ -6,12 +6,12 @@ import (
 	"fmt"
 	"gus-epaxos/src/fastrpc"
 	"gus-epaxos/src/genericsmrproto"
-	"gus-epaxos/src/rdtsc"
 	"gus-epaxos/src/state"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -62,7 +62,11 @@ type Replica struct {
 	rpcTable map[uint8]*RPCPair
 	rpcCode  uint8
 
-	Ewma []float64
+	Ewma       []float64 // smoothed round-trip time to each peer, in ns
+	rttSamples []uint64
+	rttMutex   sync.Mutex // beacon replies are handled by the peer listeners
+	lastRank   time.Time
+	reorders   uint64
 
 	OnClientConnect chan bool
 }
@@ -91,6 +95,10 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(map[uint8]*RPCPair),
 		genericsmrproto.GENERIC_SMR_BEACON_REPLY + 1,
 		make([]float64, len(peerAddrList)),
+		make([]uint64, len(peerAddrList)),
+		sync.Mutex{},
+		time.Time{},
+		0,
 		make(chan bool, 500000)}
 
 	var err error
@@ -252,9 +260,7 @@ func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
 			if err = gbeaconReply.Unmarshal(reader); err != nil {
 				break
 			}
-			//TODO: UPDATE STUFF
-			r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(rdtsc.Cputicks()-gbeaconReply.Timestamp)
-			log.Println(r.Ewma)
+			r.recordRTT(rid, gbeaconReply.Timestamp)
 			break
 
 		default:
@@ -353,7 +359,7 @@ func (r *Replica) ReplyProposeTS(reply *genericsmrproto.ProposeReplyTS, w *bufio
 func (r *Replica) SendBeacon(peerId int32) {
 	w := r.PeerWriters[peerId]
 	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON)
-	beacon := &genericsmrproto.Beacon{rdtsc.Cputicks()}
+	beacon := &genericsmrproto.Beacon{beaconTimestamp()}
 	beacon.Marshal(w)
 	w.Flush()
 }
@@ -392,5 +398,7 @@ func (r *Replica) UpdatePreferredPeerOrder(quorum []int32) {
 		}
 	}
 
+	r.rttMutex.Lock()
 	r.PreferredPeerOrder = aux
+	r.rttMutex.Unlock()
 }
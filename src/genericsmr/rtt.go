@@ -0,0 +1,122 @@
+package genericsmr
+
+import (
+	"gus-epaxos/src/genericsmrproto"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Replicas that send beacons keep a moving average of the round-trip time to
+// every peer, measured in wall-clock time, and rank their peers by it so that
+// thrifty rounds go to the closest quorum. Beacons keep going for as long as
+// the replica runs, so the ranking follows latencies that change mid-run.
+
+// Weight of a new sample in the moving average
+const RTT_EWMA_WEIGHT = 0.1
+
+// How often the peers are re-ranked
+const RANK_PERIOD = 1 * time.Second
+
+// A new ranking is only adopted if it makes the closest quorum faster by more
+// than this fraction, so that peers with similar RTTs do not keep swapping
+const RANK_HYSTERESIS = 0.1
+
+// beaconTimestamp is the wall-clock time carried by a beacon, and echoed back
+// in its reply
+func beaconTimestamp() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// recordRTT adds the sample given by the reply to a beacon sent at timestamp
+func (r *Replica) recordRTT(rid int, timestamp uint64) {
+	now := beaconTimestamp()
+	if now < timestamp {
+		// the clock went back
+		return
+	}
+	rtt := float64(now - timestamp)
+
+	r.rttMutex.Lock()
+	if r.rttSamples[rid] == 0 {
+		r.Ewma[rid] = rtt
+	} else {
+		r.Ewma[rid] = (1-RTT_EWMA_WEIGHT)*r.Ewma[rid] + RTT_EWMA_WEIGHT*rtt
+	}
+	r.rttSamples[rid]++
+	r.rttMutex.Unlock()
+}
+
+// peerRTT is the RTT to a peer for ranking. Peers that were never measured,
+// or are down, count as infinitely far.
+func (r *Replica) peerRTT(q int32) float64 {
+	if r.rttSamples[q] == 0 || !r.Alive[q] {
+		return math.Inf(1)
+	}
+	return r.Ewma[q]
+}
+
+// quorumRTT is how long a round to the first quorum peers of order takes,
+// which is the RTT of the slowest of them
+func (r *Replica) quorumRTT(order []int32, quorum int) float64 {
+	slowest := 0.0
+	for _, p := range order[:quorum] {
+		if rtt := r.peerRTT(p); rtt > slowest {
+			slowest = rtt
+		}
+	}
+	return slowest
+}
+
+// RankPeers orders the peers by RTT, at most once every RANK_PERIOD, and
+// tells whether PreferredPeerOrder changed. Thrifty rounds are sent to the
+// first quorum peers in the order.
+func (r *Replica) RankPeers(quorum int) bool {
+	now := time.Now()
+	if now.Sub(r.lastRank) < RANK_PERIOD {
+		return false
+	}
+	r.lastRank = now
+	if quorum > r.N-1 {
+		quorum = r.N - 1
+	}
+
+	r.rttMutex.Lock()
+	defer r.rttMutex.Unlock()
+
+	peers := make([]int32, r.N-1)
+	copy(peers, r.PreferredPeerOrder[:r.N-1])
+	sort.SliceStable(peers, func(i, j int) bool {
+		return r.peerRTT(peers[i]) < r.peerRTT(peers[j])
+	})
+
+	if r.quorumRTT(peers, quorum) >= (1-RANK_HYSTERESIS)*r.quorumRTT(r.PreferredPeerOrder, quorum) {
+		return false
+	}
+	order := make([]int32, r.N)
+	copy(order, peers)
+	order[r.N-1] = r.Id
+	r.PreferredPeerOrder = order
+	r.reorders++
+	log.Println("Preferred peer order:", r.PreferredPeerOrder)
+	return true
+}
+
+// RTTStats reports the round-trip times measured by beacons, and the order in
+// which thrifty rounds contact the peers
+func (r *Replica) RTTStats(args *genericsmrproto.RTTStatsArgs, reply *genericsmrproto.RTTStatsReply) error {
+	r.rttMutex.Lock()
+	defer r.rttMutex.Unlock()
+
+	reply.RTT = make([]int64, r.N)
+	for q := range reply.RTT {
+		reply.RTT[q] = int64(r.Ewma[q])
+	}
+	reply.Samples = make([]uint64, r.N)
+	copy(reply.Samples, r.rttSamples)
+	reply.PreferredPeerOrder = make([]int32, r.N)
+	copy(reply.PreferredPeerOrder, r.PreferredPeerOrder)
+	reply.Reorders = r.reorders
+	return nil
+}
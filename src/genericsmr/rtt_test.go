@@ -0,0 +1,65 @@
+package genericsmr
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newRTTReplica(n int) *Replica {
+	r := &Replica{N: n, Id: 0, Alive: make([]bool, n), PreferredPeerOrder: make([]int32, n),
+		Ewma: make([]float64, n), rttSamples: make([]uint64, n)}
+	for i := 0; i < n; i++ {
+		r.PreferredPeerOrder[i] = int32((i + 1) % n)
+		r.Alive[i] = true
+	}
+	return r
+}
+
+func (r *Replica) setRTT(q int32, rtt time.Duration) {
+	r.Ewma[q] = float64(rtt)
+	r.rttSamples[q]++
+}
+
+func TestRankPeers(t *testing.T) {
+	r := newRTTReplica(5)
+
+	// nothing is known until the peers are measured
+	if r.RankPeers(2) {
+		t.Fatal("ranked peers without measurements")
+	}
+
+	r.setRTT(1, 80*time.Millisecond)
+	r.setRTT(2, 50*time.Millisecond)
+	r.setRTT(3, 10*time.Millisecond)
+	r.setRTT(4, 20*time.Millisecond)
+	r.lastRank = time.Time{}
+	if !r.RankPeers(2) || !reflect.DeepEqual(r.PreferredPeerOrder, []int32{3, 4, 2, 1, 0}) {
+		t.Fatalf("got order %v, want [3 4 2 1 0]", r.PreferredPeerOrder)
+	}
+
+	// a slightly faster peer outside the quorum does not displace it
+	r.setRTT(2, 19*time.Millisecond)
+	r.lastRank = time.Time{}
+	if r.RankPeers(2) {
+		t.Fatalf("re-ranked for a marginal gain, order %v", r.PreferredPeerOrder)
+	}
+
+	// but a much faster one does, and so does a member going down
+	r.setRTT(2, 5*time.Millisecond)
+	r.lastRank = time.Time{}
+	if !r.RankPeers(2) || !reflect.DeepEqual(r.PreferredPeerOrder, []int32{2, 3, 4, 1, 0}) {
+		t.Fatalf("got order %v, want [2 3 4 1 0]", r.PreferredPeerOrder)
+	}
+	r.Alive[3] = false
+	r.lastRank = time.Time{}
+	if !r.RankPeers(2) || !reflect.DeepEqual(r.PreferredPeerOrder, []int32{2, 4, 1, 3, 0}) {
+		t.Fatalf("got order %v, want [2 4 1 3 0]", r.PreferredPeerOrder)
+	}
+
+	// peers are ranked at most once every RANK_PERIOD
+	r.Alive[3] = true
+	if r.RankPeers(2) {
+		t.Fatal("re-ranked within RANK_PERIOD")
+	}
+}
@@ -0,0 +1,165 @@
+// Package smrtest runs replicas in-process, for the tests of the protocols.
+// Only tests import it.
+package smrtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/state"
+	"os"
+	"testing"
+)
+
+// Net connects replicas in-process.
+// Messages queue on one link per ordered pair of replicas until the test
+// delivers or drops them, so a test decides exactly who hears what, and when.
+// Messages on the links of a replica that is down are lost.
+type Net struct {
+	t        testing.TB
+	Replicas []*genericsmr.Replica
+	Links    [][]*bytes.Buffer // Links[from][to]
+	Down     []bool
+
+	// an empty message of the type each code was registered for
+	Messages map[uint8]fastrpc.Serializable
+	// hands a message to a replica
+	Handle func(to int, msg fastrpc.Serializable)
+	// runs what the event loops do besides handling messages, and tells
+	// whether there was anything to do, if set
+	Step func() bool
+}
+
+// NewNet connects n replicas made by newReplica. Replicas create their
+// stable store in the current directory, so they are made in a temporary
+// one, and the tests that use a Net cannot run in parallel.
+func NewNet(t testing.TB, n int, newReplica func(id int, peers []string) *genericsmr.Replica) *Net {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("replica%d", i)
+	}
+
+	net := &Net{t, make([]*genericsmr.Replica, n), make([][]*bytes.Buffer, n), make([]bool, n), nil, nil, nil}
+	for i := 0; i < n; i++ {
+		r := newReplica(i, peers)
+		t.Cleanup(func() { r.StableStore.Close() })
+		net.Replicas[i] = r
+		net.Links[i] = make([]*bytes.Buffer, n)
+		for j := 0; j < n; j++ {
+			net.Links[i][j] = new(bytes.Buffer)
+			r.PeerWriters[j] = bufio.NewWriter(net.Links[i][j])
+			r.Alive[j] = true
+		}
+	}
+	return net
+}
+
+// Deliver hands every message queued from one replica to another to the
+// receiver, unless either of them is down
+func (net *Net) Deliver(from int, to int) {
+	net.Replicas[from].PeerWriters[to].Flush()
+	link := net.Links[from][to]
+	for link.Len() > 0 {
+		code, _ := link.ReadByte()
+		obj, present := net.Messages[code]
+		if !present {
+			net.t.Fatalf("unknown message code %d from %d to %d", code, from, to)
+		}
+		msg := obj.New()
+		if err := msg.Unmarshal(link); err != nil {
+			net.t.Fatal(err)
+		}
+		if net.Down[from] || net.Down[to] {
+			continue
+		}
+		net.Handle(to, msg)
+	}
+}
+
+// DeliverAll delivers messages, and runs Step, until nothing is left
+func (net *Net) DeliverAll() {
+	for delivered := true; delivered; {
+		delivered = net.Step != nil && net.Step()
+		for from := range net.Links {
+			for to := range net.Links[from] {
+				net.Replicas[from].PeerWriters[to].Flush()
+				if net.Links[from][to].Len() > 0 {
+					net.Deliver(from, to)
+					delivered = true
+				}
+			}
+		}
+	}
+}
+
+func (net *Net) Drop(from int, to int) {
+	net.Replicas[from].PeerWriters[to].Flush()
+	net.Links[from][to].Reset()
+}
+
+// DropFrom drops every message queued from a replica
+func (net *Net) DropFrom(from int) {
+	for to := range net.Links[from] {
+		net.Drop(from, to)
+	}
+}
+
+// Hold takes the messages queued from one replica to another off the link,
+// to be put back in front of it with Release
+func (net *Net) Hold(from int, to int) []byte {
+	net.Replicas[from].PeerWriters[to].Flush()
+	held := append([]byte(nil), net.Links[from][to].Bytes()...)
+	net.Links[from][to].Reset()
+	return held
+}
+
+func (net *Net) Release(from int, to int, held []byte) {
+	link := net.Links[from][to]
+	queued := append(held, link.Bytes()...)
+	link.Reset()
+	link.Write(queued)
+}
+
+// Crash takes a replica down, and drops what it has sent
+func (net *Net) Crash(id int) {
+	net.Down[id] = true
+	net.DropFrom(id)
+}
+
+// Propose makes a client proposal, and returns where its reply goes
+func Propose(id int32, cmd state.Command) (*genericsmr.Propose, *bytes.Buffer) {
+	reply := new(bytes.Buffer)
+	return &genericsmr.Propose{&genericsmrproto.Propose{id, cmd, 0}, bufio.NewWriter(reply)}, reply
+}
+
+// ReadReply reads the next reply to a proposal
+func ReadReply(t testing.TB, reply *bytes.Buffer) genericsmrproto.ProposeReplyTS {
+	var preply genericsmrproto.ProposeReplyTS
+	if err := preply.Unmarshal(reply); err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	return preply
+}
+
+// CheckReply fails unless the next reply to a proposal is the one given
+func CheckReply(t testing.TB, reply *bytes.Buffer, id int32, ok uint8, val state.Value) {
+	var preply genericsmrproto.ProposeReplyTS
+	if err := preply.Unmarshal(reply); err != nil {
+		t.Fatalf("no reply to command %d: %v", id, err)
+	}
+	if preply.OK != ok || preply.CommandId != id || preply.Value != val {
+		t.Fatalf("command %d got reply %+v", id, preply)
+	}
+}
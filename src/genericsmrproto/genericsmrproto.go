@@ -30,7 +30,7 @@ type ProposeReplyTS struct {
 	OK        uint8
 	CommandId int32
 	Value     state.Value
-	Timestamp int64
+	Timestamp int64 // the client's, or in Gus the HLC timestamp of the version written or read
 }
 
 type Read struct {
@@ -77,3 +77,44 @@ type BeTheLeaderArgs struct {
 
 type BeTheLeaderReply struct {
 }
+
+// batching metrics
+
+type BatchStatsArgs struct {
+}
+
+type BatchStatsReply struct {
+	Batches   uint64
+	Commands  uint64
+	Max       int32
+	Target    int32    // current target batch size
+	Histogram []uint64 // Histogram[i] counts the batches of 2^i to 2^(i+1)-1 commands
+}
+
+// round-trip time metrics
+
+type RTTStatsArgs struct {
+}
+
+type RTTStatsReply struct {
+	RTT                []int64  // smoothed round-trip time to each replica, in ns, 0 if never measured
+	Samples            []uint64 // beacon replies received from each replica
+	PreferredPeerOrder []int32
+	Reorders           uint64 // times the peers were re-ranked
+}
+
+// pipelining metrics
+
+type WindowStatsArgs struct {
+}
+
+type WindowStatsReply struct {
+	Window      int32 // most uncommitted instances at the leader, 0 if unlimited
+	InFlight    int32 // uncommitted instances
+	MaxInFlight int32
+	Queued      int32 // proposals waiting for the window to open
+	MaxQueued   int32
+	Started     uint64 // instances started by the leader
+	Stalls      uint64 // clock ticks on which proposals waited for a full window
+	LogSize     int32  // instances allocated in the log
+}
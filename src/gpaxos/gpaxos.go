@@ -2,11 +2,14 @@ package gpaxos
 
 import (
 	"bufio"
+	"encoding/binary"
 	"gus-epaxos/src/dlog"
+	"gus-epaxos/src/fastrpc"
 	"gus-epaxos/src/genericsmr"
 	"gus-epaxos/src/genericsmrproto"
 	"gus-epaxos/src/gpaxosproto"
 	"gus-epaxos/src/state"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -22,13 +25,16 @@ const ALL_TO_ALL = true
 type Replica struct {
 	*genericsmr.Replica // extends a generic Paxos replica
 
-	prepareChan chan *gpaxosproto.Prepare // channel for Prepare's
-
-	m1aChan    chan *gpaxosproto.M_1a
-	m1bChan    chan *gpaxosproto.M_1b
-	m2aChan    chan *gpaxosproto.M_2a
-	m2bChan    chan *gpaxosproto.M_2b
-	commitChan chan *gpaxosproto.Commit // channel for Commit's
+	m1aChan    chan fastrpc.Serializable
+	m1bChan    chan fastrpc.Serializable
+	m2aChan    chan fastrpc.Serializable
+	m2bChan    chan fastrpc.Serializable
+	commitChan chan fastrpc.Serializable // channel for Commit's
+	m1aRPC     uint8
+	m1bRPC     uint8
+	m2aRPC     uint8
+	m2bRPC     uint8
+	commitRPC  uint8
 
 	isLeader bool
 	leaderId int32
@@ -37,13 +43,15 @@ type Replica struct {
 
 	ballotArray    []*Ballot
 	commands       map[int32]*state.Command
-	commandsMutex  *sync.Mutex
+	commandsMutex  *sync.Mutex // the executor reads the commands, the log and the replies too
 	committed      map[int32]bool
+	commitLog      []int32 // committed commands, in the order they were learned
 	commandReplies map[int32]*genericsmr.Propose
-	crtBalnum      int32 // highest active balnum
-	fastRound      bool  // is this a fast round?
+	clientMutex    *sync.Mutex // for synchronizing when sending replies to clients from multiple go-routines
+	crtBalnum      int32       // highest active balnum
+	fastRound      bool        // is this a fast round?
 	shutdown       bool
-	execedUpTo     int32 // balnum up to which all commands have been executed (including iteslf)
+	execedUpTo     int32 // position in commitLog up to which all commands have been executed (including iteslf)
 	//conflicts []map[state.Key]int32
 	Shutdown bool
 }
@@ -74,14 +82,20 @@ type LeaderBookkeeping struct {
 	cstructs      [][]int32
 }
 
-func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool) *Replica {
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable)
+	go r.run()
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
 	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
-		make(chan *gpaxosproto.Prepare, CHAN_BUFFER_SIZE),
-		make(chan *gpaxosproto.M_1a, CHAN_BUFFER_SIZE),
-		make(chan *gpaxosproto.M_1b, CHAN_BUFFER_SIZE),
-		make(chan *gpaxosproto.M_2a, CHAN_BUFFER_SIZE),
-		make(chan *gpaxosproto.M_2b, CHAN_BUFFER_SIZE),
-		make(chan *gpaxosproto.Commit, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0, 0,
 		false,
 		0,
 		3,
@@ -89,174 +103,120 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(map[int32]*state.Command, 100000),
 		new(sync.Mutex),
 		make(map[int32]bool, 100000),
+		make([]int32, 0, 100000),
 		make(map[int32]*genericsmr.Propose, 200),
+		new(sync.Mutex),
 		-1,
 		false,
 		false,
-		0,
+		-1,
 		false}
 
+	r.Durable = durable
+
 	r.fastQSize = 3 * r.N / 4
 	if r.fastQSize*4 < 3*r.N {
 		r.fastQSize++
 	}
 
-	go r.run()
+	r.m1aRPC = r.RegisterRPC(new(gpaxosproto.M_1a), r.m1aChan)
+	r.m1bRPC = r.RegisterRPC(new(gpaxosproto.M_1b), r.m1bChan)
+	r.m2aRPC = r.RegisterRPC(new(gpaxosproto.M_2a), r.m2aChan)
+	r.m2bRPC = r.RegisterRPC(new(gpaxosproto.M_2b), r.m2bChan)
+	r.commitRPC = r.RegisterRPC(new(gpaxosproto.Commit), r.commitChan)
 
 	return r
 }
 
-/* Inter-replica communication */
-
-func (r *Replica) handleReplicaConnection(rid int, reader *bufio.Reader) error {
-	var msgType byte
-	var err error
-	for !r.Shutdown && err == nil {
-
-		if msgType, err = reader.ReadByte(); err != nil {
-			break
-		}
-
-		switch uint8(msgType) {
-
-		case gpaxosproto.PREPARE:
-			prep := new(gpaxosproto.Prepare)
-			if err = prep.Unmarshal(reader); err != nil {
-				break
-			}
-			r.prepareChan <- prep
-			break
-
-			/*        case gpaxosproto.PREPARE_REPLY:
-			          preply := new(gpaxosproto.PrepareReply)
-			          if err = preply.Unmarshal(reader); err != nil {
-			             break
-			          }
-			          r.prepareReplyChan <- preply
-			          break*/
-
-		case gpaxosproto.M1A:
-			msg := new(gpaxosproto.M_1a)
-			if err = msg.Unmarshal(reader); err != nil {
-				break
-			}
-			r.m1aChan <- msg
-			break
-
-		case gpaxosproto.M1B:
-			msg := new(gpaxosproto.M_1b)
-			if err = msg.Unmarshal(reader); err != nil {
-				break
-			}
+// append a ballot's cstruct to stable storage
+func (r *Replica) recordCStruct(balnum int32, cstruct []int32) {
+	if !r.Durable {
+		return
+	}
 
-			//HACK
-			for _, cid := range msg.Cstruct {
-				cmd := new(state.Command)
-				cmd.Unmarshal(reader)
-				r.commandsMutex.Lock()
-				if _, present := r.commands[cid]; !present {
-					if cmd.Op != 0 || cmd.K != 0 || cmd.V != 0 {
-						r.commands[cid] = cmd
-					}
-				}
-				r.commandsMutex.Unlock()
-			}
+	b := make([]byte, 8+4*len(cstruct))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(balnum))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(cstruct)))
+	for i, cid := range cstruct {
+		binary.LittleEndian.PutUint32(b[8+4*i:], uint32(cid))
+	}
+	r.StableStore.Write(b)
+}
 
-			r.m1bChan <- msg
-			break
+// write a command and its id to stable storage
+func (r *Replica) recordCommand(cid int32, cmd *state.Command) {
+	if !r.Durable {
+		return
+	}
 
-		case gpaxosproto.M2A:
-			msg := new(gpaxosproto.M_2a)
-			if err = msg.Unmarshal(reader); err != nil {
-				break
-			}
-			r.m2aChan <- msg
-			break
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(cid))
+	r.StableStore.Write(b[:])
+	cmd.Marshal(io.Writer(r.StableStore))
+}
 
-		case gpaxosproto.M2B:
-			msg := new(gpaxosproto.M_2b)
-			if err = msg.Unmarshal(reader); err != nil {
-				break
-			}
-			//HACK
-			for _, cid := range msg.Cids {
-				cmd := new(state.Command)
-				cmd.Unmarshal(reader)
-				r.commandsMutex.Lock()
-				if _, present := r.commands[cid]; !present {
-					r.commands[cid] = cmd
-				}
-				r.commandsMutex.Unlock()
-			}
-			r.m2bChan <- msg
-			break
+// sync with the stable store
+func (r *Replica) sync() {
+	if !r.Durable {
+		return
+	}
 
-		case gpaxosproto.COMMIT:
-			commit := new(gpaxosproto.Commit)
-			if err = commit.Unmarshal(reader); err != nil {
-				break
-			}
-			r.commitChan <- commit
-			break
+	r.StableStore.Sync()
+}
 
+// addCommands stores the commands that came with a 1b or a 2b
+func (r *Replica) addCommands(cids []int32, cmds []state.Command) {
+	for i := 0; i < len(cids) && i < len(cmds); i++ {
+		if _, present := r.commands[cids[i]]; present {
+			continue
 		}
+		if cmds[i].Op == 0 && cmds[i].K == 0 && cmds[i].V == 0 {
+			// unknown to the sender
+			continue
+		}
+		cmd := cmds[i]
+		r.commands[cids[i]] = &cmd
+		r.recordCommand(cids[i], &cmd)
 	}
-	if err != nil {
-		log.Println("Error when reading from the connection with replica", rid, err)
-		r.Alive[rid] = false
-		return err
-	}
-	return nil
-}
-
-func (r *Replica) replyPrepare(reply *gpaxosproto.PrepareReply, w *bufio.Writer) {
-	w.WriteByte(gpaxosproto.PREPARE_REPLY)
-	reply.Marshal(w)
-	w.Flush()
 }
 
-func (r *Replica) send1b(msg *gpaxosproto.M_1b, w *bufio.Writer) {
-	w.WriteByte(gpaxosproto.M1B)
-	msg.Marshal(w)
-	dummy := state.Command{0, 0, 0}
-	for _, cid := range msg.Cstruct {
+// commandsOf lists the commands of cids, with zero commands for those this
+// replica does not know
+func (r *Replica) commandsOf(cids []int32) []state.Command {
+	cmds := make([]state.Command, len(cids))
+	for i, cid := range cids {
 		if cmd, present := r.commands[cid]; present {
-			cmd.Marshal(w)
-		} else {
-			dummy.Marshal(w)
+			cmds[i] = *cmd
 		}
 	}
-	w.Flush()
+	return cmds
 }
 
-func (r *Replica) send2b(msg *gpaxosproto.M_2b, w *bufio.Writer) {
-	w.WriteByte(gpaxosproto.M2B)
-	msg.Marshal(w)
-	for _, cid := range msg.Cids {
-		cmd := r.commands[cid]
-		cmd.Marshal(w)
-	}
-	w.Flush()
+/* Inter-replica communication */
+
+func (r *Replica) send1b(msg *gpaxosproto.M_1b, to int32) {
+	msg.Cmds = r.commandsOf(msg.Cstruct)
+	r.SendMsg(to, r.m1bRPC, msg)
+}
+
+func (r *Replica) send2b(msg *gpaxosproto.M_2b, to int32) {
+	msg.Cmds = r.commandsOf(msg.Cids)
+	r.SendMsg(to, r.m2bRPC, msg)
 }
 
 func (r *Replica) bcast2b(msg *gpaxosproto.M_2b) {
 	defer func() {
 		if err := recover(); err != nil {
-			dlog.Println("Commit bcast failed:", err)
+			dlog.Println("2b bcast failed:", err)
 		}
 	}()
 
-	for rid, w := range r.PeerWriters {
-		if int32(rid) == r.Id {
+	msg.Cmds = r.commandsOf(msg.Cids)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q] {
 			continue
 		}
-		w.WriteByte(gpaxosproto.M2B)
-		msg.Marshal(w)
-		for _, cid := range msg.Cids {
-			cmd := r.commands[cid]
-			cmd.Marshal(w)
-		}
-		w.Flush()
+		r.SendMsg(q, r.m2bRPC, msg)
 	}
 }
 
@@ -278,134 +238,89 @@ func (r *Replica) run() {
 		r.isLeader = true
 	}
 
-	r.ConnectToPeersNoListeners()
-
-	for rid, peerReader := range r.PeerReaders {
-		if int32(rid) == r.Id {
-			continue
-		}
-		go r.handleReplicaConnection(rid, peerReader)
-	}
+	r.ConnectToPeers()
 
 	dlog.Println("Waiting for client connections")
 
 	go r.WaitForClientConnections()
 
-	/*if r.Exec {
-	    go r.executeCommands()
-	}*/
+	if r.Exec {
+		go r.executeCommands()
+	}
 
 	clockChan = make(chan bool, 1)
 	go r.clock()
 
 	if r.isLeader {
-		r.crtBalnum = 0
-		r.fastRound = true
-		r.ballotArray[0] = &Ballot{nil, 0, PHASE1, false, &LeaderBookkeeping{cstructs: make([][]int32, 0)}}
-		r.ballotArray[0].lb.cstructs = append(r.ballotArray[0].lb.cstructs, make([]int32, 0))
-		r.bcast1a(0, true)
+		r.startFirstBallot()
 	}
 
 	for !r.Shutdown {
 
+		proposeChan := r.ProposeChan
 		if r.crtBalnum >= 0 && len(r.ballotArray[r.crtBalnum].cstruct) >= CMDS_PER_BALLOT {
+			// the ballot is full, take new proposals only on clock ticks
+			proposeChan = nil
+		}
 
-			select {
-
-			case prepare := <-r.prepareChan:
-				//got a Prepare message
-				dlog.Printf("Received Prepare for balnum %d\n", prepare.Balnum)
-				r.commandsMutex.Lock()
-				r.handlePrepare(prepare)
-				r.commandsMutex.Unlock()
-				break
-
-			case msg := <-r.m1aChan:
-				dlog.Printf("Received 1a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle1a(msg)
-				r.commandsMutex.Unlock()
-				break
+		select {
 
-			case msg := <-r.m1bChan:
-				dlog.Printf("Received 1b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle1b(msg)
-				r.commandsMutex.Unlock()
-				break
+		case msgS := <-r.m1aChan:
+			msg := msgS.(*gpaxosproto.M_1a)
+			dlog.Printf("Received 1a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
+			r.commandsMutex.Lock()
+			r.handle1a(msg)
+			r.commandsMutex.Unlock()
+			break
 
-			case msg := <-r.m2aChan:
-				dlog.Printf("Received 2a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle2a(msg)
-				r.commandsMutex.Unlock()
-				break
+		case msgS := <-r.m1bChan:
+			msg := msgS.(*gpaxosproto.M_1b)
+			dlog.Printf("Received 1b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
+			r.commandsMutex.Lock()
+			r.handle1b(msg)
+			r.commandsMutex.Unlock()
+			break
 
-			case msg := <-r.m2bChan:
-				dlog.Printf("Received 2b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle2b(msg)
-				r.commandsMutex.Unlock()
-				break
+		case msgS := <-r.m2aChan:
+			msg := msgS.(*gpaxosproto.M_2a)
+			dlog.Printf("Received 2a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
+			r.commandsMutex.Lock()
+			r.handle2a(msg)
+			r.commandsMutex.Unlock()
+			break
 
-			case <-clockChan:
-				//way out of deadlock
+		case msgS := <-r.m2bChan:
+			msg := msgS.(*gpaxosproto.M_2b)
+			dlog.Printf("Received 2b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
+			r.commandsMutex.Lock()
+			r.handle2b(msg)
+			r.commandsMutex.Unlock()
+			break
 
-				select {
+		case commitS := <-r.commitChan:
+			commit := commitS.(*gpaxosproto.Commit)
+			dlog.Printf("Received Commit @ replica %d\n", r.Id)
+			r.commandsMutex.Lock()
+			r.handleCommit(commit)
+			r.commandsMutex.Unlock()
+			break
 
-				case propose := <-r.ProposeChan:
-					//got a Propose from a client
-					dlog.Printf("Proposal with id %d @ replica %d\n", propose.CommandId, r.Id)
-					r.commandsMutex.Lock()
-					r.handlePropose(propose)
-					r.commandsMutex.Unlock()
-					break
+		case propose := <-proposeChan:
+			//got a Propose from a client
+			dlog.Printf("Proposal with id %d @ replica %d\n", propose.CommandId, r.Id)
+			r.commandsMutex.Lock()
+			r.handlePropose(propose)
+			r.commandsMutex.Unlock()
+			break
 
-				default:
-					break
-				}
+		case <-clockChan:
+			//way out of deadlock
+			if proposeChan != nil {
+				break
 			}
 
-		} else {
-
 			select {
 
-			case prepare := <-r.prepareChan:
-				//got a Prepare message
-				dlog.Printf("Received Prepare for balnum %d\n", prepare.Balnum)
-				r.commandsMutex.Lock()
-				r.handlePrepare(prepare)
-				r.commandsMutex.Unlock()
-				break
-
-			case msg := <-r.m1aChan:
-				dlog.Printf("Received 1a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle1a(msg)
-				r.commandsMutex.Unlock()
-				break
-
-			case msg := <-r.m1bChan:
-				dlog.Printf("Received 1b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle1b(msg)
-				r.commandsMutex.Unlock()
-				break
-
-			case msg := <-r.m2aChan:
-				dlog.Printf("Received 2a for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle2a(msg)
-				r.commandsMutex.Unlock()
-				break
-
-			case msg := <-r.m2bChan:
-				dlog.Printf("Received 2b for balnum %d @ replica %d\n", msg.Balnum, r.Id)
-				r.commandsMutex.Lock()
-				r.handle2b(msg)
-				r.commandsMutex.Unlock()
-				break
-
 			case propose := <-r.ProposeChan:
 				//got a Propose from a client
 				dlog.Printf("Proposal with id %d @ replica %d\n", propose.CommandId, r.Id)
@@ -413,11 +328,23 @@ func (r *Replica) run() {
 				r.handlePropose(propose)
 				r.commandsMutex.Unlock()
 				break
+
+			default:
+				break
 			}
 		}
 	}
 }
 
+// startFirstBallot has the leader start ballot 0, a fast one
+func (r *Replica) startFirstBallot() {
+	r.crtBalnum = 0
+	r.fastRound = true
+	r.ballotArray[0] = &Ballot{nil, 0, PHASE1, false, &LeaderBookkeeping{cstructs: make([][]int32, 0)}}
+	r.ballotArray[0].lb.cstructs = append(r.ballotArray[0].lb.cstructs, make([]int32, 0))
+	r.bcast1a(0, true)
+}
+
 func (r *Replica) makeUniqueBallot(ballot int32) int32 {
 	return (ballot << 4) | r.Id
 }
@@ -426,38 +353,6 @@ func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
 	return r.makeUniqueBallot((ballot >> 4) + 1)
 }
 
-func (r *Replica) bcastPrepare(replica int32, instance int32, ballot int32) {
-	defer func() {
-		if err := recover(); err != nil {
-			dlog.Println("Prepare bcast failed:", err)
-		}
-	}()
-	args := &gpaxosproto.Prepare{r.Id, instance, ballot}
-
-	n := r.N - 1
-	//TODO: fix quorum size
-	if r.Thrifty {
-		n = r.N >> 1
-	}
-	q := r.Id
-	var w *bufio.Writer
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			dlog.Println("Not enough replicas alive!")
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-		sent++
-		w = r.PeerWriters[q]
-		w.WriteByte(gpaxosproto.PREPARE)
-		args.Marshal(w)
-		w.Flush()
-	}
-}
-
 func (r *Replica) bcast1a(balnum int32, fast bool) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -478,7 +373,6 @@ func (r *Replica) bcast1a(balnum int32, fast bool) {
 		}
 	}
 	q := r.Id
-	var w *bufio.Writer
 	for sent := 0; sent < n; {
 		q = (q + 1) % int32(r.N)
 		if q == r.Id {
@@ -488,17 +382,14 @@ func (r *Replica) bcast1a(balnum int32, fast bool) {
 			continue
 		}
 		sent++
-		w = r.PeerWriters[q]
-		w.WriteByte(gpaxosproto.M1A)
-		args.Marshal(w)
-		w.Flush()
+		r.SendMsg(q, r.m1aRPC, args)
 	}
 }
 
 func (r *Replica) bcast2a(balnum int32, cstruct []int32, fast bool) {
 	defer func() {
 		if err := recover(); err != nil {
-			dlog.Println("1a bcast failed:", err)
+			dlog.Println("2a bcast failed:", err)
 		}
 	}()
 	args := &gpaxosproto.M_2a{r.Id, balnum, cstruct}
@@ -512,7 +403,6 @@ func (r *Replica) bcast2a(balnum int32, cstruct []int32, fast bool) {
 		}
 	}
 	q := r.Id
-	var w *bufio.Writer
 	for sent := 0; sent < n; {
 		q = (q + 1) % int32(r.N)
 		if q == r.Id {
@@ -522,10 +412,7 @@ func (r *Replica) bcast2a(balnum int32, cstruct []int32, fast bool) {
 			continue
 		}
 		sent++
-		w = r.PeerWriters[q]
-		w.WriteByte(gpaxosproto.M2A)
-		args.Marshal(w)
-		w.Flush()
+		r.SendMsg(q, r.m2aRPC, args)
 	}
 }
 
@@ -539,7 +426,6 @@ func (r *Replica) bcastCommit(cstruct []int32) {
 
 	n := r.N - 1
 	q := r.Id
-	var w *bufio.Writer
 	for sent := 0; sent < n; {
 		q = (q + 1) % int32(r.N)
 		if q == r.Id {
@@ -549,10 +435,7 @@ func (r *Replica) bcastCommit(cstruct []int32) {
 			continue
 		}
 		sent++
-		w = r.PeerWriters[q]
-		w.WriteByte(gpaxosproto.COMMIT)
-		args.Marshal(w)
-		w.Flush()
+		r.SendMsg(q, r.commitRPC, args)
 	}
 }
 
@@ -566,15 +449,18 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 
 	if !r.isLeader && r.crtBalnum < 0 {
 		log.Println("Received request before leader 1a message")
-		r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{FALSE, -1, state.NIL, propose.Timestamp}, propose.Reply)
+		r.replyClient(&genericsmrproto.ProposeReplyTS{FALSE, -1, state.NIL, propose.Timestamp}, propose.Reply)
 		return
 	}
 
-	r.commands[propose.CommandId] = &propose.Command
+	if _, present := r.commands[propose.CommandId]; !present {
+		r.commands[propose.CommandId] = &propose.Command
+		r.recordCommand(propose.CommandId, &propose.Command)
+	}
 
 	if _, present := r.committed[propose.CommandId]; present {
 		if r.isLeader || ALL_TO_ALL {
-			r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, propose.CommandId, state.NIL, propose.Timestamp}, propose.Reply)
+			r.replyClient(&genericsmrproto.ProposeReplyTS{TRUE, propose.CommandId, state.NIL, propose.Timestamp}, propose.Reply)
 		}
 		return
 	} else {
@@ -591,6 +477,8 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 
 	crtBallot.cstruct = append(crtBallot.cstruct, propose.CommandId)
 	crtBallot.lb.cstructs[r.Id] = crtBallot.cstruct
+	r.recordCStruct(r.crtBalnum, crtBallot.cstruct)
+	r.sync()
 
 	b := [...]int32{propose.CommandId}
 
@@ -599,7 +487,7 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 			r.bcast2a(r.crtBalnum, crtBallot.cstruct, false)
 		} else {
 			if ALL_TO_ALL {
-				r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1]})
+				r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1], nil})
 			}
 			r.tryToLearn()
 		}
@@ -607,19 +495,16 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 		if r.fastRound {
 			if crtBallot.received2a {
 				if ALL_TO_ALL {
-					r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1]})
+					r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1], nil})
 					r.tryToLearn()
 				} else {
-					r.send2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1]}, r.PeerWriters[r.leaderId])
+					r.send2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtBallot.cstruct, b[:1], nil}, r.leaderId)
 				}
 			}
 		}
 	}
 }
 
-func (r *Replica) handlePrepare(prep *gpaxosproto.Prepare) {
-}
-
 func (r *Replica) handle1a(msg *gpaxosproto.M_1a) {
 	if msg.LeaderId != r.leaderId {
 		log.Println("Incorrect leader")
@@ -631,9 +516,9 @@ func (r *Replica) handle1a(msg *gpaxosproto.M_1a) {
 	}
 
 	if r.crtBalnum >= 0 {
-		r.send1b(&gpaxosproto.M_1b{r.Id, msg.Balnum, r.ballotArray[r.crtBalnum].cstruct}, r.PeerWriters[r.leaderId])
+		r.send1b(&gpaxosproto.M_1b{r.Id, msg.Balnum, r.ballotArray[r.crtBalnum].cstruct, nil}, r.leaderId)
 	} else {
-		r.send1b(&gpaxosproto.M_1b{r.Id, msg.Balnum, make([]int32, 0)}, r.PeerWriters[r.leaderId])
+		r.send1b(&gpaxosproto.M_1b{r.Id, msg.Balnum, make([]int32, 0), nil}, r.leaderId)
 	}
 
 	r.crtBalnum = msg.Balnum
@@ -658,6 +543,7 @@ func (r *Replica) handle1b(msg *gpaxosproto.M_1b) {
 		return
 	}
 
+	r.addCommands(msg.Cstruct, msg.Cmds)
 	dlog.Println("msg.Cstruct: ", msg.Cstruct)
 	crtbal.lb.cstructs = append(crtbal.lb.cstructs, msg.Cstruct)
 	count := len(crtbal.lb.cstructs)
@@ -667,11 +553,13 @@ func (r *Replica) handle1b(msg *gpaxosproto.M_1b) {
 		(!r.fastRound && count == r.N/2+1) {
 		_, _, crtbal.cstruct = r.learn(true)
 		dlog.Println("LUB:", crtbal.cstruct)
+		r.recordCStruct(r.crtBalnum, crtbal.cstruct)
+		r.sync()
 		r.bcast2a(r.crtBalnum, crtbal.cstruct, r.fastRound)
 		crtbal.lb.cstructs = make([][]int32, r.N)
 		crtbal.status = PHASE2
 		if r.fastRound && ALL_TO_ALL {
-			r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, crtbal.cstruct})
+			r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, crtbal.cstruct, nil})
 		}
 	}
 }
@@ -718,16 +606,20 @@ func (r *Replica) handle2a(msg *gpaxosproto.M_2a) {
 		}
 		crtbal.cstruct = msg.Cstruct
 	}
+	r.recordCStruct(r.crtBalnum, crtbal.cstruct)
+	r.sync()
 
 	if ALL_TO_ALL {
-		r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, cids})
+		r.bcast2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, cids, nil})
 		r.tryToLearn()
 	} else {
-		r.send2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, cids}, r.PeerWriters[r.leaderId])
+		r.send2b(&gpaxosproto.M_2b{r.Id, r.crtBalnum, crtbal.cstruct, cids, nil}, r.leaderId)
 	}
 }
 
 func (r *Replica) handle2b(msg *gpaxosproto.M_2b) {
+	r.addCommands(msg.Cids, msg.Cmds)
+
 	if msg.Balnum != r.crtBalnum {
 		dlog.Println("2b from a different ballot")
 		return
@@ -763,13 +655,11 @@ func (r *Replica) tryToLearn() {
 	} else if glb != nil {
 		dlog.Println("Got GLB:", glb)
 		for _, cid := range glb {
-			dlog.Println("Committing command ", cid)
-			r.committed[cid] = true
+			r.commit(cid)
 			crtbal.lb.committed++
-			if prop, present := r.commandReplies[cid]; present {
-				r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, cid, state.NIL, prop.Timestamp}, prop.Reply)
-				delete(r.commandReplies, cid)
-			}
+		}
+		if r.isLeader && !ALL_TO_ALL {
+			r.bcastCommit(glb)
 		}
 		if r.isLeader && crtbal.lb.committed >= CMDS_PER_BALLOT {
 			r.startHigherBallot()
@@ -777,6 +667,70 @@ func (r *Replica) tryToLearn() {
 	}
 }
 
+// commit adds a command to the log of commands to execute
+func (r *Replica) commit(cid int32) {
+	dlog.Println("Committing command ", cid)
+	r.committed[cid] = true
+	r.commitLog = append(r.commitLog, cid)
+	if prop, present := r.commandReplies[cid]; present && !r.Dreply {
+		r.replyClient(&genericsmrproto.ProposeReplyTS{TRUE, cid, state.NIL, prop.Timestamp}, prop.Reply)
+		delete(r.commandReplies, cid)
+	}
+}
+
+// handleCommit learns the commands the leader committed, when replicas do
+// not send their 2b's to each other
+func (r *Replica) handleCommit(commit *gpaxosproto.Commit) {
+	for _, cid := range commit.Cstruct {
+		if _, present := r.committed[cid]; present {
+			continue
+		}
+		if _, present := r.commands[cid]; !present {
+			log.Println("Commit for an unknown command", cid)
+			continue
+		}
+		r.commit(cid)
+	}
+}
+
+// replyClient sends a reply to a client. The event loop and the executor
+// both reply.
+func (r *Replica) replyClient(reply *genericsmrproto.ProposeReplyTS, w *bufio.Writer) {
+	r.clientMutex.Lock()
+	r.ReplyProposeTS(reply, w)
+	r.clientMutex.Unlock()
+}
+
+func (r *Replica) executeCommands() {
+	for !r.Shutdown {
+		// take the commands committed since the last round under the lock, and
+		// execute them and reply without holding up the event loop
+		r.commandsMutex.Lock()
+		cids := r.commitLog[r.execedUpTo+1:]
+		cmds := make([]*state.Command, len(cids))
+		props := make([]*genericsmr.Propose, len(cids))
+		for i, cid := range cids {
+			cmds[i] = r.commands[cid]
+			if prop, present := r.commandReplies[cid]; present && r.Dreply {
+				props[i] = prop
+				delete(r.commandReplies, cid)
+			}
+		}
+		r.execedUpTo += int32(len(cids))
+		r.commandsMutex.Unlock()
+
+		for i, cid := range cids {
+			val := cmds[i].Execute(r.State)
+			if props[i] != nil {
+				r.replyClient(&genericsmrproto.ProposeReplyTS{TRUE, cid, val, props[i].Timestamp}, props[i].Reply)
+			}
+		}
+		if len(cids) == 0 {
+			time.Sleep(1000 * 1000)
+		}
+	}
+}
+
 func (r *Replica) startHigherBallot() {
 	//TODO: can Phase 1 be bypassed in this situation, as an optimization?
 	r.crtBalnum++
@@ -0,0 +1,82 @@
+package gpaxos
+
+import (
+	"bytes"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/gpaxosproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+// testNet runs the Generalized Paxos handlers over an smrtest.Net,
+// with replica 0 as the leader
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, true)
+		return net.replicas[id].Replica
+	})
+	net.replicas[0].isLeader = true
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.m1aRPC:    new(gpaxosproto.M_1a),
+		r.m1bRPC:    new(gpaxosproto.M_1b),
+		r.m2aRPC:    new(gpaxosproto.M_2a),
+		r.m2bRPC:    new(gpaxosproto.M_2b),
+		r.commitRPC: new(gpaxosproto.Commit),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *gpaxosproto.M_1a:
+			r.handle1a(m)
+		case *gpaxosproto.M_1b:
+			r.handle1b(m)
+		case *gpaxosproto.M_2a:
+			r.handle2a(m)
+		case *gpaxosproto.M_2b:
+			r.handle2b(m)
+		case *gpaxosproto.Commit:
+			r.handleCommit(m)
+		}
+	}
+	return net
+}
+
+func TestFastRoundCommits(t *testing.T) {
+	net := newTestNet(t, 3)
+	net.replicas[0].startFirstBallot()
+	net.DeliverAll()
+
+	// clients send their commands to every replica in a fast round
+	replies := make([]*bytes.Buffer, 2)
+	for cid := int32(0); cid < 2; cid++ {
+		for id, r := range net.replicas {
+			propose, reply := smrtest.Propose(cid, state.Command{state.PUT, state.Key(cid), state.Value(10 + cid)})
+			if id == 0 {
+				replies[cid] = reply
+			}
+			r.handlePropose(propose)
+		}
+		net.DeliverAll()
+	}
+
+	for _, r := range net.replicas {
+		if len(r.commitLog) != 2 {
+			t.Fatalf("replica %d committed %v, want both commands", r.Id, r.commitLog)
+		}
+	}
+	for cid, reply := range replies {
+		if preply := smrtest.ReadReply(t, reply); preply.OK != TRUE || preply.CommandId != int32(cid) {
+			t.Fatalf("command %d got reply %+v", cid, preply)
+		}
+	}
+}
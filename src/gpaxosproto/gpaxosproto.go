@@ -1,17 +1,7 @@
 package gpaxosproto
 
-//import (
-//    "state"
-//)
-
-const (
-	PREPARE uint8 = iota
-	PREPARE_REPLY
-	M1A
-	M1B
-	M2A
-	M2B
-	COMMIT
+import (
+	"gus-epaxos/src/state"
 )
 
 type Prepare struct {
@@ -37,6 +27,7 @@ type M_1b struct {
 	ReplicaId int32
 	Balnum    int32
 	Cstruct   []int32
+	Cmds      []state.Command // the commands of Cstruct, zero where unknown
 }
 
 type M_2a struct {
@@ -50,6 +41,7 @@ type M_2b struct {
 	Balnum    int32
 	Cstruct   []int32
 	Cids      []int32
+	Cmds      []state.Command // the commands of Cids
 }
 
 type Commit struct {
@@ -3,6 +3,8 @@ package gpaxosproto
 import (
 	"bufio"
 	"encoding/binary"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/state"
 	"io"
 	"sync"
 )
@@ -12,6 +14,9 @@ type byteReader interface {
 	ReadByte() (c byte, err error)
 }
 
+func (t *M_1a) New() fastrpc.Serializable {
+	return new(M_1a)
+}
 func (t *M_1a) BinarySize() (nbytes int, sizeKnown bool) {
 	return 9, true
 }
@@ -76,6 +81,9 @@ func (t *M_1a) Unmarshal(wire io.Reader) error {
 	return nil
 }
 
+func (t *M_1b) New() fastrpc.Serializable {
+	return new(M_1b)
+}
 func (t *M_1b) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -138,6 +146,14 @@ func (t *M_1b) Marshal(wire io.Writer) {
 		bs[3] = byte(tmp32 >> 24)
 		wire.Write(bs)
 	}
+	bs = b[:]
+	alen2 := int64(len(t.Cmds))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		t.Cmds[i].Marshal(wire)
+	}
 }
 
 func (t *M_1b) Unmarshal(rr io.Reader) error {
@@ -166,9 +182,22 @@ func (t *M_1b) Unmarshal(rr io.Reader) error {
 		}
 		t.Cstruct[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Cmds = make([]state.Command, alen2)
+	for i := int64(0); i < alen2; i++ {
+		if err := t.Cmds[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (t *Prepare) New() fastrpc.Serializable {
+	return new(Prepare)
+}
 func (t *Prepare) BinarySize() (nbytes int, sizeKnown bool) {
 	return 12, true
 }
@@ -237,6 +266,9 @@ func (t *Prepare) Unmarshal(wire io.Reader) error {
 	return nil
 }
 
+func (t *M_2a) New() fastrpc.Serializable {
+	return new(M_2a)
+}
 func (t *M_2a) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -330,6 +362,9 @@ func (t *M_2a) Unmarshal(rr io.Reader) error {
 	return nil
 }
 
+func (t *M_2b) New() fastrpc.Serializable {
+	return new(M_2b)
+}
 func (t *M_2b) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -406,6 +441,14 @@ func (t *M_2b) Marshal(wire io.Writer) {
 		bs[3] = byte(tmp32 >> 24)
 		wire.Write(bs)
 	}
+	bs = b[:]
+	alen3 := int64(len(t.Cmds))
+	if wlen := binary.PutVarint(bs, alen3); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen3; i++ {
+		t.Cmds[i].Marshal(wire)
+	}
 }
 
 func (t *M_2b) Unmarshal(rr io.Reader) error {
@@ -445,9 +488,22 @@ func (t *M_2b) Unmarshal(rr io.Reader) error {
 		}
 		t.Cids[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	}
+	alen3, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Cmds = make([]state.Command, alen3)
+	for i := int64(0); i < alen3; i++ {
+		if err := t.Cmds[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (t *Commit) New() fastrpc.Serializable {
+	return new(Commit)
+}
 func (t *Commit) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -523,6 +579,9 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	return nil
 }
 
+func (t *PrepareReply) New() fastrpc.Serializable {
+	return new(PrepareReply)
+}
 func (t *PrepareReply) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
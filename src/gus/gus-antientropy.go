@@ -0,0 +1,190 @@
+package gus
+
+import (
+	"encoding/binary"
+	"gus-epaxos/src/dlog"
+	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/state"
+	"hash/fnv"
+	"log"
+)
+
+// Number of key ranges that are compared independently by anti-entropy
+const NB_RANGES = 64
+
+// Anti-entropy runs every ANTI_ENTROPY_TICKS ticks of the slow clock (~1s)
+const ANTI_ENTROPY_TICKS = 7
+
+func keyRange(key state.Key) int32 {
+	return int32(uint64(key) % NB_RANGES)
+}
+
+func hashTag(key state.Key, tag gusproto.Tag) uint64 {
+	var b [20]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(tag.Timestamp))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(tag.WriterID))
+	h := fnv.New64a()
+	h.Write(b[:])
+	return h.Sum64()
+}
+
+// digest computes one hash per key range over the stored tags. The hashes of
+// the keys in a range are XORed, so the result does not depend on the order
+// in which replicas learned about the keys.
+func (r *Replica) digest() []uint64 {
+	hashes := make([]uint64, NB_RANGES)
+	for key, tag := range r.currentTag {
+		// a key at the default tag is the same as a key that was never written
+		if tag.Timestamp == 0 {
+			continue
+		}
+		if _, stored := r.storage[key][tag]; !stored {
+			continue
+		}
+		hashes[keyRange(key)] ^= hashTag(key, tag)
+	}
+	return hashes
+}
+
+// storedTag is the tag of the newest value that is in storage. currentTag can
+// run ahead of storage while a write from this replica is in flight.
+func (r *Replica) storedTag(key state.Key) (gusproto.Tag, bool) {
+	tag, existence := r.currentTag[key]
+	if !existence || tag.Timestamp == 0 {
+		return tag, false
+	}
+	_, stored := r.storage[key][tag]
+	return tag, stored
+}
+
+// startAntiEntropy sends this replica's digest to the next live peer
+func (r *Replica) startAntiEntropy() {
+	for i := 0; i < r.N; i++ {
+		r.antiEntropyPeer = (r.antiEntropyPeer + 1) % int32(r.N)
+		if r.antiEntropyPeer != r.Id && r.Alive[r.antiEntropyPeer] {
+			break
+		}
+	}
+	if r.antiEntropyPeer == r.Id {
+		return
+	}
+
+	digest := &gusproto.Digest{r.Id, r.digest()}
+	r.SendMsg(r.antiEntropyPeer, r.digestRPC, digest)
+}
+
+// handleDigest pulls the key ranges whose hashes differ from the sender
+func (r *Replica) handleDigest(digest *gusproto.Digest) {
+	if len(digest.Hashes) != NB_RANGES {
+		log.Println("Ignoring digest with the wrong number of key ranges from", digest.Sender)
+		return
+	}
+
+	mine := r.digest()
+	differ := make(map[int32]bool)
+	pull := &gusproto.RepairPull{r.Id, []int32{}, []state.Key{}, []gusproto.Tag{}}
+	for i, h := range digest.Hashes {
+		if h != mine[i] {
+			differ[int32(i)] = true
+			pull.Ranges = append(pull.Ranges, int32(i))
+		}
+	}
+	if len(pull.Ranges) == 0 {
+		return
+	}
+
+	for key := range r.currentTag {
+		if !differ[keyRange(key)] {
+			continue
+		}
+		if tag, stored := r.storedTag(key); stored {
+			pull.Keys = append(pull.Keys, key)
+			pull.Tags = append(pull.Tags, tag)
+		}
+	}
+
+	dlog.Printf("GUS: Replica %d: pulling %d key ranges from %d\n", r.Id, len(pull.Ranges), digest.Sender)
+	r.SendMsg(digest.Sender, r.repairPullRPC, pull)
+}
+
+// handleRepairPull sends back every key in the pulled ranges for which this
+// replica has a newer value than the puller
+func (r *Replica) handleRepairPull(pull *gusproto.RepairPull) {
+	ranges := make(map[int32]bool)
+	for _, i := range pull.Ranges {
+		ranges[i] = true
+	}
+	theirs := make(map[state.Key]gusproto.Tag)
+	for i, key := range pull.Keys {
+		theirs[key] = pull.Tags[i]
+	}
+
+	push := &gusproto.RepairPush{r.Id, []state.Key{}, []gusproto.Tag{}, []state.Value{}}
+	for key := range r.currentTag {
+		if !ranges[keyRange(key)] {
+			continue
+		}
+		tag, stored := r.storedTag(key)
+		theirTag := theirs[key]
+		if !stored || !theirTag.LessThan(tag) {
+			continue
+		}
+		push.Keys = append(push.Keys, key)
+		push.Tags = append(push.Tags, tag)
+		push.Values = append(push.Values, r.storage[key][tag])
+	}
+	if len(push.Keys) == 0 {
+		return
+	}
+
+	r.SendMsg(pull.Sender, r.repairPushRPC, push)
+}
+
+// handleRepairPush installs the values that are newer than what is stored
+func (r *Replica) handleRepairPush(push *gusproto.RepairPush) {
+	repaired := 0
+	for i, key := range push.Keys {
+		if r.installValue(key, push.Tags[i], push.Values[i]) {
+			repaired++
+		}
+	}
+	if repaired > 0 {
+		r.sync()
+		dlog.Printf("GUS: Replica %d: repaired %d keys from %d\n", r.Id, repaired, push.Sender)
+	}
+}
+
+// installValue makes value the newest version of key if tag is newer than
+// the current one
+func (r *Replica) installValue(key state.Key, tag gusproto.Tag, value state.Value) bool {
+	currentTag := r.currentTag[key]
+	if !currentTag.LessThan(tag) {
+		return false
+	}
+
+	r.currentTag[key] = tag
+	_, existence := r.storage[key]
+	if !existence {
+		r.storage[key] = make(map[gusproto.Tag]state.Value)
+	}
+	r.storage[key][tag] = value
+	r.recordWrite(key, tag, value)
+
+	r.initializeView(key, tag)
+	r.view[key][tag][r.Id] = true
+	r.bcastUpdateView(0, key, tag.WriterID, tag.Timestamp)
+	return true
+}
+
+// readRepair sends the newest value of key to a replica that answered a read
+// with an older tag
+func (r *Replica) readRepair(peer int32, key state.Key) {
+	tag, stored := r.storedTag(key)
+	if !stored {
+		return
+	}
+
+	push := &gusproto.RepairPush{r.Id, []state.Key{key}, []gusproto.Tag{tag}, []state.Value{r.storage[key][tag]}}
+	r.SendMsg(peer, r.repairPushRPC, push)
+}
@@ -0,0 +1,231 @@
+package gus
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/state"
+	"time"
+)
+
+// How long a lease lasts, counted from the moment it was requested
+const LEASE_DURATION = 1 * time.Second
+
+// Grantors keep a lease for longer than its holder, to absorb clock drift
+const LEASE_GUARD = 100 * time.Millisecond
+
+// A lease is renewed when a read finds it this close to expiring
+const LEASE_RENEW = LEASE_DURATION / 2
+
+// A write that was acknowledged as stale but never committed is given up on
+// after this long, and no longer blocks leases on its key
+const WRITE_PENDING_TIMEOUT = 5 * LEASE_DURATION
+
+// lease is a lease this replica holds, or is requesting, on a key
+type lease struct {
+	epoch      int32     // grants for older requests are ignored
+	pending    bool      // waiting for grants
+	sentAt     time.Time // when the request for this epoch was sent
+	grants     int
+	pendingTag gusproto.Tag // newest tag among the grants of this epoch
+	tag        gusproto.Tag // storage must be at least this recent to be read
+	expiry     time.Time
+}
+
+// readLocally replies to a GET from storage if this replica holds a lease on
+// the key and a quorum stores the current tag. It also renews the lease.
+func (r *Replica) readLocally(propose *genericsmr.Propose) bool {
+	key := propose.Command.K
+	now := time.Now()
+
+	l := r.held[key]
+	if l == nil || l.expiry.Sub(now) < LEASE_RENEW {
+		r.requestLease(key)
+		l = r.held[key]
+	}
+	if !now.Before(l.expiry) || r.activeWrite[key] {
+		return false
+	}
+
+	tag := r.currentTag[key]
+	value, stored := r.storage[key][tag]
+	if tag.Timestamp != 0 && !stored {
+		return false
+	}
+	if tag.LessThan(l.tag) {
+		return false
+	}
+	if r.storedAt(key, tag) < (r.N+1)/2 {
+		return false
+	}
+
+	r.reply(propose, value, tag)
+	return true
+}
+
+// storedAt is the number of replicas that this replica knows store key at tag
+func (r *Replica) storedAt(key state.Key, tag gusproto.Tag) int {
+	r.initializeView(key, tag)
+	count := 0
+	for _, stored := range r.view[key][tag] {
+		if stored {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Replica) requestLease(key state.Key) {
+	l := r.held[key]
+	if l == nil {
+		l = &lease{}
+		r.held[key] = l
+	}
+	if l.pending && time.Since(l.sentAt) < LEASE_DURATION {
+		return
+	}
+
+	l.epoch++
+	l.pending = true
+	l.sentAt = time.Now()
+	l.grants = 0
+	l.pendingTag = gusproto.Tag{0, 0}
+
+	r.bcastAll(r.leaseRequestRPC, &gusproto.LeaseRequest{r.Id, key, l.epoch})
+}
+
+// dropLease stops local reads of key until a new lease is granted
+func (r *Replica) dropLease(key state.Key) {
+	l := r.held[key]
+	if l == nil {
+		return
+	}
+	l.epoch++
+	l.pending = false
+	l.expiry = time.Time{}
+}
+
+// writePending tells whether a write to key reached this replica but is not
+// in storage yet. Granting a lease then could let the holder miss it.
+func (r *Replica) writePending(key state.Key) bool {
+	if r.activeWrite[key] || len(r.deferred[key]) > 0 {
+		return true
+	}
+	if t, existence := r.staleWrites[key]; existence {
+		if time.Since(t) < WRITE_PENDING_TIMEOUT {
+			return true
+		}
+		delete(r.staleWrites, key)
+	}
+	for _, obj := range r.asyncStorage {
+		if obj.key == key {
+			return true
+		}
+	}
+	for _, obj := range r.tmpAsyncStorage {
+		if obj.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replica) handleLeaseRequest(request *gusproto.LeaseRequest) {
+	key := request.Key
+	grant := &gusproto.LeaseGrant{r.Id, key, request.Epoch, FALSE, r.currentTag[key]}
+
+	if !r.writePending(key) {
+		_, existence := r.granted[key]
+		if !existence {
+			r.granted[key] = make(map[int32]time.Time)
+		}
+		r.granted[key][request.Sender] = time.Now().Add(LEASE_DURATION + LEASE_GUARD)
+		grant.OK = TRUE
+	}
+
+	r.SendMsg(request.Sender, r.leaseGrantRPC, grant)
+}
+
+func (r *Replica) handleLeaseGrant(grant *gusproto.LeaseGrant) {
+	l := r.held[grant.Key]
+	if l == nil || !l.pending || grant.Epoch != l.epoch {
+		return
+	}
+	if grant.OK == FALSE {
+		// reads go through a quorum until the next request
+		l.pending = false
+		return
+	}
+
+	l.grants++
+	if l.pendingTag.LessThan(grant.Tag) {
+		l.pendingTag = grant.Tag
+	}
+	if l.grants >= (r.N-1)/2 {
+		l.pending = false
+		l.expiry = l.sentAt.Add(LEASE_DURATION)
+		if l.tag.LessThan(l.pendingTag) {
+			l.tag = l.pendingTag
+		}
+	}
+}
+
+func (r *Replica) handleLeaseRevoke(revoke *gusproto.LeaseRevoke) {
+	r.dropLease(revoke.Key)
+	r.SendMsg(revoke.Sender, r.leaseRevokeAckRPC, &gusproto.LeaseRevokeAck{r.Id, revoke.Key})
+}
+
+func (r *Replica) handleLeaseRevokeAck(ack *gusproto.LeaseRevokeAck) {
+	delete(r.granted[ack.Key], ack.Sender)
+	r.flushDeferred(ack.Key)
+}
+
+// revokeLeases asks every replica holding a lease on key from this replica,
+// other than except, to give it up. It returns true if the caller has to
+// wait with deferUntilRevoked.
+func (r *Replica) revokeLeases(key state.Key, except int32) bool {
+	now := time.Now()
+	holders := r.granted[key]
+	for holder, expiry := range holders {
+		if holder == except || now.After(expiry) {
+			delete(holders, holder)
+			continue
+		}
+		r.SendMsg(holder, r.leaseRevokeRPC, &gusproto.LeaseRevoke{r.Id, key})
+	}
+	return len(holders) > 0 || len(r.deferred[key]) > 0
+}
+
+// deferUntilRevoked runs f once no replica holds a lease on key from this
+// replica. Deferred actions on a key run in order.
+func (r *Replica) deferUntilRevoked(key state.Key, f func()) {
+	r.deferred[key] = append(r.deferred[key], f)
+}
+
+func (r *Replica) flushDeferred(key state.Key) {
+	if len(r.granted[key]) > 0 {
+		return
+	}
+	deferred := r.deferred[key]
+	delete(r.deferred, key)
+	for _, f := range deferred {
+		f()
+	}
+}
+
+// expireLeases lets deferred actions go ahead once the leases they wait on
+// have expired, in case a holder never answers the revocation
+func (r *Replica) expireLeases() {
+	if len(r.deferred) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for key := range r.deferred {
+		for holder, expiry := range r.granted[key] {
+			if now.After(expiry) {
+				delete(r.granted[key], holder)
+			}
+		}
+		r.flushDeferred(key)
+	}
+}
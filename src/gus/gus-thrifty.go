@@ -0,0 +1,86 @@
+package gus
+
+import (
+	"gus-epaxos/src/fastrpc"
+	"time"
+)
+
+// How long a thrifty broadcast waits for the closest quorum before the
+// message is also sent to the remaining peers
+const THRIFTY_TIMEOUT = 100 * time.Millisecond
+
+// thriftyOp is a message that was only sent to the closest quorum and may have
+// to be sent to the rest of the peers if that quorum is slow to answer
+type thriftyOp struct {
+	seq    int32
+	rpc    uint8
+	msg    fastrpc.Serializable
+	sentTo []bool
+	sentAt time.Time
+}
+
+// bcastQuorum sends msg to every live peer, or, in thrifty mode, only to the
+// closest quorum, and remembers it so that checkThrifty can fall back to the
+// other peers. A thrifty msg must not be reused for later messages.
+func (r *Replica) bcastQuorum(seq int32, whichRPC uint8, msg fastrpc.Serializable) {
+	if !r.Thrifty {
+		r.bcastAll(whichRPC, msg)
+		return
+	}
+
+	n := (r.N - 1) / 2
+	sentTo := make([]bool, r.N)
+	sent := 0
+	for q := 0; q < r.N-1 && sent < n; q++ {
+		p := r.PreferredPeerOrder[q]
+		if !r.Alive[p] {
+			continue
+		}
+		r.SendMsg(p, whichRPC, msg)
+		sentTo[p] = true
+		sent++
+	}
+
+	r.thriftyOps = append(r.thriftyOps, &thriftyOp{seq, whichRPC, msg, sentTo, time.Now()})
+}
+
+// thriftyDone tells whether the phase op was sent for no longer waits on replies
+func (r *Replica) thriftyDone(op *thriftyOp) bool {
+	switch op.rpc {
+	case r.writeRPC:
+		return r.bookkeeping[op.seq].doneFirstWait
+	case r.commitWriteRPC:
+		return r.bookkeeping[op.seq].complete
+	case r.readRPC:
+		return !r.bookkeeping[op.seq].waitForAckRead
+	}
+	return true
+}
+
+// checkThrifty sends the messages whose quorum did not answer within
+// THRIFTY_TIMEOUT to the peers that were left out
+func (r *Replica) checkThrifty() {
+	if len(r.thriftyOps) == 0 {
+		return
+	}
+
+	now := time.Now()
+	i := 0
+	for ; i < len(r.thriftyOps); i++ {
+		op := r.thriftyOps[i]
+		if r.thriftyDone(op) {
+			continue
+		}
+		// ops are queued in the order they were sent
+		if now.Sub(op.sentAt) < THRIFTY_TIMEOUT {
+			break
+		}
+		for q := int32(0); q < int32(r.N); q++ {
+			if q == r.Id || op.sentTo[q] || !r.Alive[q] {
+				continue
+			}
+			r.SendMsg(q, op.rpc, op.msg)
+		}
+	}
+	r.thriftyOps = r.thriftyOps[i:]
+}
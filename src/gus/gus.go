@@ -2,14 +2,15 @@ package gus
 
 import (
 	"encoding/binary"
-	"fmt"
 	"gus-epaxos/src/dlog"
 	"gus-epaxos/src/fastrpc"
 	"gus-epaxos/src/genericsmr"
 	"gus-epaxos/src/genericsmrproto"
 	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/hlc"
 	"gus-epaxos/src/state"
 	"log"
+	"sort"
 	"time"
 )
 
@@ -28,6 +29,13 @@ type Replica struct {
 	updateViewChan      chan fastrpc.Serializable
 	readChan            chan fastrpc.Serializable
 	ackReadChan         chan fastrpc.Serializable
+	digestChan          chan fastrpc.Serializable
+	repairPullChan      chan fastrpc.Serializable
+	repairPushChan      chan fastrpc.Serializable
+	leaseRequestChan    chan fastrpc.Serializable
+	leaseGrantChan      chan fastrpc.Serializable
+	leaseRevokeChan     chan fastrpc.Serializable
+	leaseRevokeAckChan  chan fastrpc.Serializable
 	writeRPC            uint8
 	ackWriteRPC         uint8
 	commitWriteRPC      uint8
@@ -35,6 +43,13 @@ type Replica struct {
 	updateViewRPC       uint8
 	readRPC             uint8
 	ackReadRPC          uint8
+	digestRPC           uint8
+	repairPullRPC       uint8
+	repairPushRPC       uint8
+	leaseRequestRPC     uint8
+	leaseGrantRPC       uint8
+	leaseRevokeRPC      uint8
+	leaseRevokeAckRPC   uint8
 	IsLeader            bool // does this replica think it is the leader
 	Shutdown            bool
 	counter             int
@@ -44,13 +59,23 @@ type Replica struct {
 	bookkeeping         []OpsBookkeeping
 	storage             map[state.Key]map[gusproto.Tag]state.Value
 	tmpStorage          map[state.Key]map[gusproto.Tag]state.Value
-	asyncStorage        []*AsyncObj
-	tmpAsyncStorage     []*AsyncObj
+	asyncStorage        []*AsyncObj                           // completed async writes, applied on the next clock tick
+	tmpAsyncStorage     []*AsyncObj                           // async writes waiting for their writer to complete them
 	view                map[state.Key]map[gusproto.Tag][]bool //view[i][j][k] = Replica k has object i with tag j
 	activeRead          map[state.Key]bool
 	activeWrite         map[state.Key]bool
 	leadingOp           map[state.Key]int32
 	pendingReads        []*genericsmr.Propose
+	thriftyOps          []*thriftyOp // messages sent only to the closest quorum
+	tagClock            *hlc.Clock   // source of tag timestamps
+	antiEntropy         bool         // exchange digests with the other replicas in the background?
+	antiEntropyPeer     int32        // peer that got the last anti-entropy digest
+	slowTicks           int
+	leases              bool                              // serve reads locally under leases?
+	held                map[state.Key]*lease              // leases held by this replica
+	granted             map[state.Key]map[int32]time.Time // granted[i][k] = expiry of the lease on object i granted to replica k
+	deferred            map[state.Key][]func()            // actions waiting for leases on object i to be revoked
+	staleWrites         map[state.Key]time.Time           // stale writes waiting for their CommitWrite
 }
 
 type AsyncObj struct {
@@ -64,7 +89,7 @@ type OpsBookkeeping struct {
 	ackWrites           int
 	ackCommits          int
 	staleTag            uint8 //match the type in gusproto (no bool field in GoBin)
-	maxTime             int32 //match the type of Tag in gusproto
+	maxTime             int64 //match the type of Tag in gusproto
 	doneFirstWait       bool  //default = false
 	ackReads            int
 	doneRead            bool
@@ -76,10 +101,26 @@ type OpsBookkeeping struct {
 	checkStorageForRead bool        // default = false
 	complete            bool
 	isAsyncWrite        uint8
+	tag                 gusproto.Tag // tag the write is installed with once it completes
 }
 
-func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, beacon bool, durable bool, leases bool, antiEntropy bool) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, beacon, durable, leases, antiEntropy)
+
+	go r.run()
+
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, beacon bool, durable bool, leases bool, antiEntropy bool) *Replica {
 	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
@@ -88,7 +129,8 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		0, 0, 0, 0, 0, 0,
-		0,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
 		false,
 		false,
 		0,
@@ -104,9 +146,20 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(map[state.Key]bool),
 		make(map[state.Key]bool),
 		make(map[state.Key]int32),
-		[]*genericsmr.Propose{}}
+		[]*genericsmr.Propose{},
+		[]*thriftyOp{},
+		hlc.NewClock(),
+		antiEntropy,
+		int32(id),
+		0,
+		leases,
+		make(map[state.Key]*lease),
+		make(map[state.Key]map[int32]time.Time),
+		make(map[state.Key][]func()),
+		make(map[state.Key]time.Time)}
 
 	r.Durable = durable
+	r.Beacon = beacon
 
 	r.writeRPC = r.RegisterRPC(new(gusproto.Write), r.writeChan)
 	r.ackWriteRPC = r.RegisterRPC(new(gusproto.AckWrite), r.ackWriteChan)
@@ -115,8 +168,14 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 	r.updateViewRPC = r.RegisterRPC(new(gusproto.UpdateView), r.updateViewChan)
 	r.readRPC = r.RegisterRPC(new(gusproto.Read), r.readChan)
 	r.ackReadRPC = r.RegisterRPC(new(gusproto.AckRead), r.ackReadChan)
+	r.digestRPC = r.RegisterRPC(new(gusproto.Digest), r.digestChan)
+	r.repairPullRPC = r.RegisterRPC(new(gusproto.RepairPull), r.repairPullChan)
+	r.repairPushRPC = r.RegisterRPC(new(gusproto.RepairPush), r.repairPushChan)
+	r.leaseRequestRPC = r.RegisterRPC(new(gusproto.LeaseRequest), r.leaseRequestChan)
+	r.leaseGrantRPC = r.RegisterRPC(new(gusproto.LeaseGrant), r.leaseGrantChan)
+	r.leaseRevokeRPC = r.RegisterRPC(new(gusproto.LeaseRevoke), r.leaseRevokeChan)
+	r.leaseRevokeAckRPC = r.RegisterRPC(new(gusproto.LeaseRevokeAck), r.leaseRevokeAckChan)
 
-	go r.run()
 	return r
 }
 
@@ -139,6 +198,7 @@ func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *gene
 /* ============= */
 
 var clockChan chan bool
+var slowClockChan chan bool
 
 func (r *Replica) clock() {
 	for !r.Shutdown {
@@ -147,6 +207,13 @@ func (r *Replica) clock() {
 	}
 }
 
+func (r *Replica) slowClock() {
+	for !r.Shutdown {
+		time.Sleep(150 * 1e6) // 150 ms
+		slowClockChan <- true
+	}
+}
+
 /* Main event processing loop */
 func (r *Replica) run() {
 
@@ -157,7 +224,9 @@ func (r *Replica) run() {
 		r.IsLeader = true
 	}
 	clockChan = make(chan bool, 1)
+	slowClockChan = make(chan bool, 1)
 	go r.clock()
+	go r.slowClock()
 
 	onOffProposeChan := r.ProposeChan
 
@@ -168,334 +237,98 @@ func (r *Replica) run() {
 		case <-clockChan:
 			//activate the new proposals channel
 			onOffProposeChan = r.ProposeChan
+			r.applyAsyncWrites()
+			r.checkThrifty()
+			r.expireLeases()
 			break
 
-		case propose := <-onOffProposeChan:
-			//got a Propose from a client
-			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
-
-			key := propose.Command.K
-
-			if r.activeRead[key] && propose.Command.Op == state.GET && OptimizedRead {
-				// These reads can be optimized by tagging along with prior operations
-				r.pendingReads = append(r.pendingReads, propose)
-
-			} else {
-
-				// Initialize bookkeeping struct
-				r.bookkeeping[r.currentSeq].proposal = propose
-				r.bookkeeping[r.currentSeq].key = key
-
-				if propose.Command.Op == state.GET {
-					// GET
-					dlog.Printf("GUS: Processing Get by Replica %d\n", r.Id)
-					// Wait for a quorum in the first phase
-					r.activeRead[key] = true
-					r.bookkeeping[r.currentSeq].waitForAckRead = true
-					r.bcastRead(r.currentSeq, propose.Command)
-					r.currentSeq++
-				} else {
-					// PUT
-					dlog.Printf("GUS: Processing Put by Replica %d\n", r.Id)
-
-					if r.activeWrite[key] {
-						r.bookkeeping[r.currentSeq].isAsyncWrite = uint8(1)
-						r.bookkeeping[r.currentSeq].maxTime = r.currentTag[key].Timestamp
-					} else {
-						// Initialize storage space if key is not already existed
-						_, existence := r.storage[key]
-						if !existence {
-							r.storage[key] = make(map[gusproto.Tag]state.Value)
-						}
-						_, existence = r.tmpStorage[key]
-						if !existence {
-							r.tmpStorage[key] = make(map[gusproto.Tag]state.Value)
-						}
-
-						// Put value and tag in the bookkeeping
-						r.bookkeeping[r.currentSeq].valueToWrite = propose.Command.V
-						r.bookkeeping[r.currentSeq].maxTime = r.currentTag[key].Timestamp + 1
-						r.currentTag[key] = gusproto.Tag{r.currentTag[key].Timestamp + 1, r.Id}
+		case <-slowClockChan:
+			r.slowTicks++
+			if r.antiEntropy && r.slowTicks%ANTI_ENTROPY_TICKS == 0 {
+				r.startAntiEntropy()
+			}
+			if r.Beacon {
+				for q := int32(0); q < int32(r.N); q++ {
+					if q == r.Id || !r.Alive[q] {
+						continue
 					}
-					r.bcastWrite(r.currentSeq, propose.Command, r.bookkeeping[r.currentSeq].isAsyncWrite)
-					r.currentSeq++
+					r.SendBeacon(q)
 				}
+				r.RankPeers((r.N - 1) / 2)
 			}
+			break
+
+		case beacon := <-r.BeaconChan:
+			dlog.Printf("Received Beacon from replica %d with timestamp %d\n", beacon.Rid, beacon.Timestamp)
+			r.ReplyBeacon(beacon)
+			break
+
+		case propose := <-onOffProposeChan:
+			//got a Propose from a client
+			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
+			r.handlePropose(propose)
 			//deactivate the new proposals channel to prioritize the handling of protocol messages
 			onOffProposeChan = nil
 			break
 
 		case writeS := <-r.writeChan:
 			write := writeS.(*gusproto.Write)
-			writeTag := gusproto.Tag{write.CurrentTime, write.WriterID}
-			key := write.Command.K
-			seq := int32(write.Seq)
-			staleTag := uint8(0) // 0 = False
-			isAsyncWrite := write.IsAsync
-
-			// Default tag is (0, 0)
-			_, existence := r.currentTag[key]
-			if !existence {
-				r.currentTag[key] = gusproto.Tag{0, 0}
-			}
-			currentTag := r.currentTag[key]
-			if isAsyncWrite == 0 {
-				// Incoming write has a larger tag
-				if currentTag.LessThan(writeTag) {
-					// Update tag and initialize storage
-					r.currentTag[key] = gusproto.Tag{write.CurrentTime, write.WriterID}
-					_, existence2 := r.storage[key]
-					if !existence2 {
-						r.storage[key] = make(map[gusproto.Tag]state.Value)
-					}
-					r.initializeView(key, r.currentTag[key])
-					r.view[key][r.currentTag[key]][r.Id] = true
-					r.storage[key][r.currentTag[key]] = write.Command.V
-
-					// transform write into byte array
-					if r.Durable {
-						var b [24]byte
-						binary.LittleEndian.PutUint64(b[0:8], uint64(key))
-						binary.LittleEndian.PutUint32(b[8:12], uint32(r.currentTag[key].Timestamp))
-						binary.LittleEndian.PutUint32(b[12:16], uint32(r.currentTag[key].WriterID))
-						binary.LittleEndian.PutUint64(b[16:24], uint64(write.Command.V))
-						r.StableStore.Write(b[:])
-						r.sync()
-					}
-
-					r.bcastUpdateView(seq, write.WriterID, r.currentTag[key].Timestamp)
-				} else {
-					// Incoming write has a smaller tag, so put it in the tmpStorage
-					_, existence2 := r.tmpStorage[key]
-					if !existence2 {
-						r.tmpStorage[key] = make(map[gusproto.Tag]state.Value)
-					}
-					r.tmpStorage[key][r.currentTag[key]] = write.Command.V
-					// Notify writer that it has a stale tag
-					staleTag = 1
-				}
-			} else {
-				if currentTag.LessThan(writeTag) {
-					r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, writeTag, write.Command.V})
-				} else {
-					staleTag = 1
-					r.tmpAsyncStorage = append(r.tmpAsyncStorage, &AsyncObj{key, seq, writeTag, write.Command.V})
-				}
-			}
-			r.bcastAckWrite(write.Seq, write.WriterID, staleTag, r.currentTag[key])
+			r.handleWrite(write)
 			break
 
 		case ackWriteS := <-r.ackWriteChan:
 			ackWrite := ackWriteS.(*gusproto.AckWrite)
-			seq := ackWrite.Seq
-			key := r.bookkeeping[seq].key
-
-			r.bookkeeping[seq].ackWrites++
-			// See if I have a staleTag
-			r.bookkeeping[seq].staleTag = r.bookkeeping[seq].staleTag + ackWrite.StaleTag
-			// Update my timestamp if my timestamp is smaller
-			if r.bookkeeping[seq].maxTime < ackWrite.OtherTag.Timestamp {
-				r.bookkeeping[seq].maxTime = ackWrite.OtherTag.Timestamp
-			}
-
-			if r.bookkeeping[seq].isAsyncWrite == 0 {
-				// Check if I have received responses from a quorum
-				if (r.bookkeeping[seq].ackWrites >= (r.N-1)/2) && !r.bookkeeping[seq].doneFirstWait && !r.bookkeeping[seq].complete {
-					r.bookkeeping[seq].doneFirstWait = true
-					if r.bookkeeping[seq].staleTag == 0 { // All staleTag = FALSE
-						// Reply to writer client
-						dlog.Printf("GUS: reply to client %d +++ Fast Path +++\n", r.currentSeq)
-						if r.bookkeeping[seq].proposal != nil {
-							propreply := &genericsmrproto.ProposeReplyTS{
-								TRUE,
-								r.bookkeeping[seq].proposal.CommandId,
-								state.NIL,
-								r.bookkeeping[seq].proposal.Timestamp}
-							r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-							r.bookkeeping[seq].complete = true
-						}
-						r.bcastUpdateView(seq, ackWrite.WriterID, r.currentTag[key].Timestamp)
-						r.initializeView(key, r.currentTag[key])
-						r.view[key][r.currentTag[key]][r.Id] = true
-						r.storage[key][r.currentTag[key]] = r.bookkeeping[seq].valueToWrite
-
-						// transform write into byte array
-						if r.Durable {
-							var b [24]byte
-							binary.LittleEndian.PutUint64(b[0:8], uint64(key))
-							binary.LittleEndian.PutUint32(b[8:12], uint32(r.currentTag[key].Timestamp))
-							binary.LittleEndian.PutUint32(b[12:16], uint32(r.currentTag[key].WriterID))
-							binary.LittleEndian.PutUint64(b[16:24], uint64(r.bookkeeping[seq].valueToWrite))
-							r.StableStore.Write(b[:])
-							r.sync()
-						}
-					} else {
-						// There is a staleTag = TRUE
-						r.currentTag[key] = gusproto.Tag{r.bookkeeping[seq].maxTime + 1, r.Id}
-						r.bcastCommitWrite(seq, ackWrite.WriterID, r.currentTag[key].Timestamp, key, r.bookkeeping[seq].isAsyncWrite)
-						// Make sure to receive AckCommit from a quorum
-						r.bookkeeping[seq].waitForAckCommit = true
-					}
-				}
-			} else {
-				if (r.bookkeeping[seq].ackWrites >= (r.N-1)/2) && !r.bookkeeping[seq].doneFirstWait && !r.bookkeeping[seq].complete {
-					r.bookkeeping[seq].doneFirstWait = true
-					if r.bookkeeping[seq].staleTag == 0 { // All staleTag = FALSE
-						// Reply to writer client
-						dlog.Printf("GUS: reply to client %d +++ Fast Path +++\n", r.currentSeq)
-						if r.bookkeeping[seq].proposal != nil {
-							propreply := &genericsmrproto.ProposeReplyTS{
-								TRUE,
-								r.bookkeeping[seq].proposal.CommandId,
-								state.NIL,
-								r.bookkeeping[seq].proposal.Timestamp}
-							r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-							r.bookkeeping[seq].complete = true
-						}
-						r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, r.currentTag[key], r.bookkeeping[seq].valueToWrite})
-					} else {
-						// There is a staleTag = TRUE
-						r.bcastCommitWrite(seq, ackWrite.WriterID, r.bookkeeping[seq].maxTime+1, key, r.bookkeeping[seq].isAsyncWrite)
-						// Make sure to receive AckCommit from a quorum
-						r.bookkeeping[seq].waitForAckCommit = true
-					}
-				}
-			}
+			r.handleAckWrite(ackWrite)
 			break
 
 		case commitWriteS := <-r.commitWriteChan:
 			commitWrite := commitWriteS.(*gusproto.CommitWrite)
-			commitTag := gusproto.Tag{commitWrite.CurrentTime, commitWrite.WriterID}
-			seq := commitWrite.Seq
-			key := commitWrite.Key
-			isAsyncWrite := commitWrite.IsAsync
-
-			if isAsyncWrite == 0 {
-				if commitTag.GreaterThan(r.currentTag[key]) {
-					r.bcastUpdateView(commitWrite.Seq, commitWrite.WriterID, commitWrite.CurrentTime)
-					r.currentTag[key] = gusproto.Tag{commitTag.Timestamp, commitTag.WriterID}
-				}
-
-				_, existence := r.storage[key]
-				if !existence {
-					r.storage[key] = make(map[gusproto.Tag]state.Value)
-				}
-				// Move value from tmpStorage to Storage
-				r.storage[key][commitTag] = r.tmpStorage[key][r.currentTag[key]]
-
-				// transform write into byte array
-				if r.Durable {
-					var b [24]byte
-					binary.LittleEndian.PutUint64(b[0:8], uint64(key))
-					binary.LittleEndian.PutUint32(b[8:12], uint32(commitTag.Timestamp))
-					binary.LittleEndian.PutUint32(b[12:16], uint32(commitTag.WriterID))
-					binary.LittleEndian.PutUint64(b[16:24], uint64(r.tmpStorage[key][r.currentTag[key]]))
-					r.StableStore.Write(b[:])
-					r.sync()
-				}
-
-				delete(r.tmpStorage[key], commitTag)
-				r.initializeView(key, commitTag)
-				r.view[key][commitTag][r.Id] = true
-			} else {
-				//Find stuff from tmpAsyncStorage
-				for i, obj := range r.tmpAsyncStorage {
-					if obj.seq == seq && obj.tag.WriterID == commitWrite.WriterID {
-						value := obj.value
-						r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, commitTag, value})
-						// remove this object from tmpAsyncStorage
-						r.tmpAsyncStorage[i] = r.tmpAsyncStorage[len(r.tmpAsyncStorage)-1]
-						r.tmpAsyncStorage = r.tmpAsyncStorage[:len(r.tmpAsyncStorage)-1]
-						break
-					}
-				}
-			}
-			r.bcastAckCommit(commitWrite.Seq, commitWrite.WriterID)
+			r.handleCommitWrite(commitWrite)
 			break
 
 		case ackCommitS := <-r.ackCommitChan:
 			ackCommit := ackCommitS.(*gusproto.AckCommit)
-			seq := ackCommit.Seq
-			r.bookkeeping[seq].ackCommits++
-			key := r.bookkeeping[seq].key
-
-			if r.bookkeeping[seq].isAsyncWrite == 0 {
-				if r.bookkeeping[seq].waitForAckCommit && !r.bookkeeping[seq].complete && r.bookkeeping[seq].ackCommits >= (r.N-1)/2 {
-					// Reply to client
-					dlog.Printf("GUS: reply to client %d +++ Slow Path +++\n", r.currentSeq)
-					if r.bookkeeping[seq].proposal != nil {
-						propreply := &genericsmrproto.ProposeReplyTS{
-							TRUE,
-							r.bookkeeping[seq].proposal.CommandId,
-							state.NIL,
-							r.bookkeeping[seq].proposal.Timestamp}
-						r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-					}
-					r.bookkeeping[seq].complete = true
-					r.bcastUpdateView(seq, ackCommit.WriterID, r.currentTag[key].Timestamp)
-					r.storage[key][r.currentTag[key]] = r.bookkeeping[seq].valueToWrite
-
-					// transform write into byte array
-					if r.Durable {
-						var b [24]byte
-						binary.LittleEndian.PutUint64(b[0:8], uint64(key))
-						binary.LittleEndian.PutUint32(b[8:12], uint32(r.currentTag[key].Timestamp))
-						binary.LittleEndian.PutUint32(b[12:16], uint32(r.currentTag[key].WriterID))
-						binary.LittleEndian.PutUint64(b[16:24], uint64(r.bookkeeping[seq].valueToWrite))
-						r.StableStore.Write(b[:])
-						r.sync()
-					}
-
-					r.initializeView(key, r.currentTag[key])
-					r.view[key][r.currentTag[key]][r.Id] = true
-				}
-			} else {
-				if r.bookkeeping[seq].proposal != nil {
-					propreply := &genericsmrproto.ProposeReplyTS{
-						TRUE,
-						r.bookkeeping[seq].proposal.CommandId,
-						state.NIL,
-						r.bookkeeping[seq].proposal.Timestamp}
-					r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-				}
-				r.bookkeeping[seq].complete = true
-				r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, r.currentTag[key], r.bookkeeping[seq].valueToWrite})
-			}
+			r.handleAckCommit(ackCommit)
 			break
 
 		case updateViewS := <-r.updateViewChan:
 			updateView := updateViewS.(*gusproto.UpdateView)
-			dlog.Printf("GUS: Replica %d: updating view from %d\n", r.Id, updateView.Sender)
-			key := updateView.Key
-			//seq := updateView.Seq
+			r.handleUpdateView(updateView)
+			break
 
-			r.initializeView(key, r.currentTag[key])
-			r.view[key][r.currentTag[key]][updateView.Sender] = true
-
-			// This piece of code is for n=5
-			//if r.busyKey[key] {
-			//	// If I'm still waiting to complete a read operation, only needed for n=5
-			//	if r.bookkeeping[seq].proposal != nil && !r.bookkeeping[seq].complete {
-			//		if (r.bookkeeping[seq].proposal.Command.Op == state.GET) && r.bookkeeping[seq].checkStorageForRead {
-			//
-			//			r.bookkeeping[seq].complete = true
-			//			tag := gusproto.Tag{r.currentTag[key].Timestamp, r.currentTag[key].WriterID}
-			//			// Reply to client
-			//			propreply := &genericsmrproto.ProposeReplyTS{
-			//				TRUE,
-			//				r.bookkeeping[seq].proposal.CommandId,
-			//				r.storage[key][tag],
-			//				r.bookkeeping[seq].proposal.Timestamp}
-			//			r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
-			//
-			//			// This line below simplifies the logic of reset()
-			//			r.bookkeeping[seq].valueToWrite = r.storage[key][tag]
-			//			r.busyKey[key] = false
-			//			r.reset(seq)
-			//		}
-			//
-			//	}
-			//}
+		case digestS := <-r.digestChan:
+			digest := digestS.(*gusproto.Digest)
+			r.handleDigest(digest)
+			break
+
+		case repairPullS := <-r.repairPullChan:
+			repairPull := repairPullS.(*gusproto.RepairPull)
+			r.handleRepairPull(repairPull)
+			break
+
+		case repairPushS := <-r.repairPushChan:
+			repairPush := repairPushS.(*gusproto.RepairPush)
+			r.handleRepairPush(repairPush)
+			break
+
+		case leaseRequestS := <-r.leaseRequestChan:
+			leaseRequest := leaseRequestS.(*gusproto.LeaseRequest)
+			r.handleLeaseRequest(leaseRequest)
+			break
+
+		case leaseGrantS := <-r.leaseGrantChan:
+			leaseGrant := leaseGrantS.(*gusproto.LeaseGrant)
+			r.handleLeaseGrant(leaseGrant)
+			break
+
+		case leaseRevokeS := <-r.leaseRevokeChan:
+			leaseRevoke := leaseRevokeS.(*gusproto.LeaseRevoke)
+			r.handleLeaseRevoke(leaseRevoke)
+			break
+
+		case leaseRevokeAckS := <-r.leaseRevokeAckChan:
+			leaseRevokeAck := leaseRevokeAckS.(*gusproto.LeaseRevokeAck)
+			r.handleLeaseRevokeAck(leaseRevokeAck)
 			break
 
 		case readS := <-r.readChan:
@@ -505,68 +338,394 @@ func (r *Replica) run() {
 
 		case ackReadS := <-r.ackReadChan:
 			ackRead := ackReadS.(*gusproto.AckRead)
-			seq := ackRead.Seq
-			key := r.bookkeeping[seq].key
-
-			r.bookkeeping[seq].ackReads++
-			currentTag := r.currentTag[key]
-			// I receive a larger tag
-			if currentTag.LessThan(ackRead.CurrentTag) {
-				// Update key
-				r.currentTag[key] = gusproto.Tag{ackRead.CurrentTag.Timestamp, ackRead.CurrentTag.WriterID}
-
-				// Optimizing read for n=3
-				_, existence := r.storage[key]
-				if !existence {
-					r.storage[key] = make(map[gusproto.Tag]state.Value)
-				}
-				r.storage[key][ackRead.CurrentTag] = ackRead.Value
-
-				// This is not needed, because this replica can write to disk when receiving the write request
-				//// transform write into byte array
-				//if r.Durable {
-				//	var b [24]byte
-				//	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
-				//	binary.LittleEndian.PutUint32(b[8:12], uint32(ackRead.CurrentTag.Timestamp))
-				//	binary.LittleEndian.PutUint32(b[12:16], uint32(ackRead.CurrentTag.WriterID))
-				//	binary.LittleEndian.PutUint64(b[16:24], uint64(ackRead.Value))
-				//	r.StableStore.Write(b[:])
-				//	r.sync()
-				//}
-
-				r.initializeView(key, ackRead.CurrentTag)
-				r.view[key][ackRead.CurrentTag][r.Id] = true
-				r.bcastUpdateView(0, ackRead.CurrentTag.WriterID, ackRead.CurrentTag.Timestamp)
+			r.handleAckRead(ackRead)
+			break
+		}
+	}
+}
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	key := propose.Command.K
+
+	if propose.Command.Op == state.GET && r.leases && r.readLocally(propose) {
+		// Served from storage under a lease
+
+	} else if r.activeRead[key] && propose.Command.Op == state.GET && OptimizedRead {
+		// These reads can be optimized by tagging along with prior operations
+		r.pendingReads = append(r.pendingReads, propose)
+
+	} else if propose.Command.Op == state.GET {
+		// GET
+		dlog.Printf("GUS: Processing Get by Replica %d\n", r.Id)
+		// Initialize bookkeeping struct
+		r.bookkeeping[r.currentSeq].proposal = propose
+		r.bookkeeping[r.currentSeq].key = key
+		// Wait for a quorum in the first phase
+		r.activeRead[key] = true
+		r.bookkeeping[r.currentSeq].waitForAckRead = true
+		r.bcastRead(r.currentSeq, propose.Command)
+		r.currentSeq++
+
+	} else if r.leases && r.revokeLeases(key, r.Id) {
+		// PUT, which has to wait until no other replica reads this key locally
+		r.deferUntilRevoked(key, func() { r.startWrite(propose) })
+
+	} else {
+		// PUT
+		r.startWrite(propose)
+	}
+}
+
+func (r *Replica) handleWrite(write *gusproto.Write) {
+	writeTag := gusproto.Tag{write.CurrentTime, write.WriterID}
+	key := write.Command.K
+	seq := int32(write.Seq)
+	staleTag := uint8(0) // 0 = False
+	isAsyncWrite := write.IsAsync
+	r.tagClock.Update(write.CurrentTime)
+	if r.leases {
+		// This write may not be in storage for a while
+		r.dropLease(key)
+	}
+
+	// Default tag is (0, 0)
+	_, existence := r.currentTag[key]
+	if !existence {
+		r.currentTag[key] = gusproto.Tag{0, 0}
+	}
+	currentTag := r.currentTag[key]
+	if isAsyncWrite == 0 {
+		// Incoming write has a larger tag
+		if currentTag.LessThan(writeTag) {
+			// Update tag and initialize storage
+			r.currentTag[key] = gusproto.Tag{write.CurrentTime, write.WriterID}
+			_, existence2 := r.storage[key]
+			if !existence2 {
+				r.storage[key] = make(map[gusproto.Tag]state.Value)
 			}
+			r.initializeView(key, r.currentTag[key])
+			r.view[key][r.currentTag[key]][r.Id] = true
+			r.storage[key][r.currentTag[key]] = write.Command.V
+
+			r.recordWrite(key, r.currentTag[key], write.Command.V)
+			r.sync()
+
+			r.bcastUpdateView(seq, key, write.WriterID, r.currentTag[key].Timestamp)
+		} else {
+			// Incoming write has a smaller tag, so put it in the tmpStorage
+			_, existence2 := r.tmpStorage[key]
+			if !existence2 {
+				r.tmpStorage[key] = make(map[gusproto.Tag]state.Value)
+			}
+			r.tmpStorage[key][r.currentTag[key]] = write.Command.V
+			r.staleWrites[key] = time.Now()
+			// Notify writer that it has a stale tag
+			staleTag = 1
+		}
+	} else {
+		// An async write is held back until the writer completes it, through
+		// UpdateView on the fast path, or CommitWrite on the slow one
+		if !currentTag.LessThan(writeTag) {
+			staleTag = 1
+		}
+		r.tmpAsyncStorage = append(r.tmpAsyncStorage, &AsyncObj{key, seq, writeTag, write.Command.V})
+	}
+	if r.leases && r.revokeLeases(key, write.WriterID) {
+		// The writer must not complete while a lease holder can still read the old value
+		writerID, tag := write.WriterID, r.currentTag[key]
+		r.deferUntilRevoked(key, func() { r.bcastAckWrite(seq, writerID, staleTag, tag) })
+	} else {
+		r.bcastAckWrite(write.Seq, write.WriterID, staleTag, r.currentTag[key])
+	}
+}
+
+func (r *Replica) handleAckWrite(ackWrite *gusproto.AckWrite) {
+	seq := ackWrite.Seq
+	key := r.bookkeeping[seq].key
+
+	r.bookkeeping[seq].ackWrites++
+	// See if I have a staleTag
+	r.bookkeeping[seq].staleTag = r.bookkeeping[seq].staleTag + ackWrite.StaleTag
+	// Update my timestamp if my timestamp is smaller
+	if r.bookkeeping[seq].maxTime < ackWrite.OtherTag.Timestamp {
+		r.bookkeeping[seq].maxTime = ackWrite.OtherTag.Timestamp
+	}
 
-			if (r.bookkeeping[seq].ackReads >= (r.N-1)/2) && r.bookkeeping[seq].waitForAckRead {
-				r.initializeView(key, r.currentTag[key])
-				// Check if a quorum of replicas have received this value/tag
-				if len(r.view[key][r.currentTag[key]]) >= (r.N-1)/2 {
-					tag := gusproto.Tag{r.currentTag[key].Timestamp, r.currentTag[key].WriterID}
-					// Reply to reader client
-					propreply := &genericsmrproto.ProposeReplyTS{
-						TRUE,
-						r.bookkeeping[seq].proposal.CommandId,
-						r.storage[key][tag],
-						r.bookkeeping[seq].proposal.Timestamp}
-					r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
+	if r.bookkeeping[seq].isAsyncWrite == 0 {
+		// Check if I have received responses from a quorum
+		if (r.bookkeeping[seq].ackWrites >= (r.N-1)/2) && !r.bookkeeping[seq].doneFirstWait && !r.bookkeeping[seq].complete {
+			r.bookkeeping[seq].doneFirstWait = true
+			if r.bookkeeping[seq].staleTag == 0 { // All staleTag = FALSE
+				// Reply to writer client
+				dlog.Printf("GUS: reply to client %d +++ Fast Path +++\n", r.currentSeq)
+				if r.bookkeeping[seq].proposal != nil {
+					r.reply(r.bookkeeping[seq].proposal, state.NIL, r.bookkeeping[seq].tag)
 					r.bookkeeping[seq].complete = true
-					// This line below simplifies the logic of reset()
-					r.bookkeeping[seq].valueToWrite = r.storage[key][tag]
-					r.activeRead[key] = false
-					r.reset(seq)
-				} else {
-					// Make sure the second phase waits for a quorum
-					r.bookkeeping[seq].checkStorageForRead = true
 				}
-				r.bookkeeping[seq].waitForAckRead = false
+				r.activeWrite[key] = false
+				tag := r.bookkeeping[seq].tag
+				r.bcastUpdateView(seq, key, ackWrite.WriterID, tag.Timestamp)
+				r.initializeView(key, tag)
+				r.view[key][tag][r.Id] = true
+				r.storage[key][tag] = r.bookkeeping[seq].valueToWrite
+
+				r.recordWrite(key, tag, r.bookkeeping[seq].valueToWrite)
+				r.sync()
+			} else {
+				// There is a staleTag = TRUE
+				r.bookkeeping[seq].tag = gusproto.Tag{r.tagClock.Update(r.bookkeeping[seq].maxTime), r.Id}
+				currentTag := r.currentTag[key]
+				if currentTag.LessThan(r.bookkeeping[seq].tag) {
+					r.currentTag[key] = r.bookkeeping[seq].tag
+				}
+				r.bcastCommitWrite(seq, ackWrite.WriterID, r.bookkeeping[seq].tag.Timestamp, key, r.bookkeeping[seq].isAsyncWrite)
+				// Make sure to receive AckCommit from a quorum
+				r.bookkeeping[seq].waitForAckCommit = true
 			}
-			break
 		}
+	} else {
+		if (r.bookkeeping[seq].ackWrites >= (r.N-1)/2) && !r.bookkeeping[seq].doneFirstWait && !r.bookkeeping[seq].complete {
+			r.bookkeeping[seq].doneFirstWait = true
+			if r.bookkeeping[seq].staleTag == 0 { // All staleTag = FALSE
+				// Reply to writer client
+				dlog.Printf("GUS: reply to client %d +++ Fast Path +++\n", r.currentSeq)
+				if r.bookkeeping[seq].proposal != nil {
+					r.reply(r.bookkeeping[seq].proposal, state.NIL, r.bookkeeping[seq].tag)
+					r.bookkeeping[seq].complete = true
+				}
+				r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, r.bookkeeping[seq].tag, r.bookkeeping[seq].valueToWrite})
+			} else {
+				// There is a staleTag = TRUE
+				r.bookkeeping[seq].tag = gusproto.Tag{r.tagClock.Update(r.bookkeeping[seq].maxTime), r.Id}
+				r.bcastCommitWrite(seq, ackWrite.WriterID, r.bookkeeping[seq].tag.Timestamp, key, r.bookkeeping[seq].isAsyncWrite)
+				// Make sure to receive AckCommit from a quorum
+				r.bookkeeping[seq].waitForAckCommit = true
+			}
+		}
+	}
+}
+
+func (r *Replica) handleCommitWrite(commitWrite *gusproto.CommitWrite) {
+	commitTag := gusproto.Tag{commitWrite.CurrentTime, commitWrite.WriterID}
+	seq := commitWrite.Seq
+	key := commitWrite.Key
+	isAsyncWrite := commitWrite.IsAsync
+
+	if isAsyncWrite == 0 {
+		if commitTag.GreaterThan(r.currentTag[key]) {
+			r.bcastUpdateView(commitWrite.Seq, key, commitWrite.WriterID, commitWrite.CurrentTime)
+			r.currentTag[key] = gusproto.Tag{commitTag.Timestamp, commitTag.WriterID}
+		}
+
+		_, existence := r.storage[key]
+		if !existence {
+			r.storage[key] = make(map[gusproto.Tag]state.Value)
+		}
+		// Move value from tmpStorage to Storage
+		r.storage[key][commitTag] = r.tmpStorage[key][r.currentTag[key]]
+
+		r.recordWrite(key, commitTag, r.tmpStorage[key][r.currentTag[key]])
+		r.sync()
+
+		delete(r.tmpStorage[key], commitTag)
+		delete(r.staleWrites, key)
+		r.initializeView(key, commitTag)
+		r.view[key][commitTag][r.Id] = true
+	} else {
+		r.completeAsyncWrite(func(obj *AsyncObj) bool {
+			return obj.seq == seq && obj.tag.WriterID == commitWrite.WriterID
+		}, commitTag)
+	}
+	if r.leases {
+		r.dropLease(key)
+	}
+	if r.leases && r.revokeLeases(key, commitWrite.WriterID) {
+		writerID := commitWrite.WriterID
+		r.deferUntilRevoked(key, func() { r.bcastAckCommit(seq, writerID) })
+	} else {
+		r.bcastAckCommit(commitWrite.Seq, commitWrite.WriterID)
 	}
 }
 
+func (r *Replica) handleAckCommit(ackCommit *gusproto.AckCommit) {
+	seq := ackCommit.Seq
+	r.bookkeeping[seq].ackCommits++
+	key := r.bookkeeping[seq].key
+
+	if r.bookkeeping[seq].isAsyncWrite == 0 {
+		if r.bookkeeping[seq].waitForAckCommit && !r.bookkeeping[seq].complete && r.bookkeeping[seq].ackCommits >= (r.N-1)/2 {
+			// Reply to client
+			dlog.Printf("GUS: reply to client %d +++ Slow Path +++\n", r.currentSeq)
+			if r.bookkeeping[seq].proposal != nil {
+				r.reply(r.bookkeeping[seq].proposal, state.NIL, r.bookkeeping[seq].tag)
+			}
+			r.bookkeeping[seq].complete = true
+			r.activeWrite[key] = false
+			tag := r.bookkeeping[seq].tag
+			r.bcastUpdateView(seq, key, ackCommit.WriterID, tag.Timestamp)
+			r.storage[key][tag] = r.bookkeeping[seq].valueToWrite
+
+			r.recordWrite(key, tag, r.bookkeeping[seq].valueToWrite)
+			r.sync()
+
+			r.initializeView(key, tag)
+			r.view[key][tag][r.Id] = true
+		}
+	} else {
+		if r.bookkeeping[seq].waitForAckCommit && !r.bookkeeping[seq].complete && r.bookkeeping[seq].ackCommits >= (r.N-1)/2 {
+			if r.bookkeeping[seq].proposal != nil {
+				r.reply(r.bookkeeping[seq].proposal, state.NIL, r.bookkeeping[seq].tag)
+			}
+			r.bookkeeping[seq].complete = true
+			r.asyncStorage = append(r.asyncStorage, &AsyncObj{key, seq, r.bookkeeping[seq].tag, r.bookkeeping[seq].valueToWrite})
+		}
+	}
+}
+
+func (r *Replica) handleUpdateView(updateView *gusproto.UpdateView) {
+	dlog.Printf("GUS: Replica %d: updating view from %d\n", r.Id, updateView.Sender)
+	key := updateView.Key
+	//seq := updateView.Seq
+
+	tag := gusproto.Tag{updateView.CurrentTime, updateView.WriterID}
+	r.initializeView(key, tag)
+	r.view[key][tag][updateView.Sender] = true
+	if updateView.Sender == updateView.WriterID {
+		// The writer has installed the value, so an async write it sent
+		// with this tag completed on the fast path
+		r.completeAsyncWrite(func(obj *AsyncObj) bool {
+			return obj.key == key && obj.tag.Equals(tag)
+		}, tag)
+	}
+
+	// This piece of code is for n=5
+	//if r.busyKey[key] {
+	//	// If I'm still waiting to complete a read operation, only needed for n=5
+	//	if r.bookkeeping[seq].proposal != nil && !r.bookkeeping[seq].complete {
+	//		if (r.bookkeeping[seq].proposal.Command.Op == state.GET) && r.bookkeeping[seq].checkStorageForRead {
+	//
+	//			r.bookkeeping[seq].complete = true
+	//			tag := gusproto.Tag{r.currentTag[key].Timestamp, r.currentTag[key].WriterID}
+	//			// Reply to client
+	//			propreply := &genericsmrproto.ProposeReplyTS{
+	//				TRUE,
+	//				r.bookkeeping[seq].proposal.CommandId,
+	//				r.storage[key][tag],
+	//				r.bookkeeping[seq].proposal.Timestamp}
+	//			r.ReplyProposeTS(propreply, r.bookkeeping[seq].proposal.Reply)
+	//
+	//			// This line below simplifies the logic of reset()
+	//			r.bookkeeping[seq].valueToWrite = r.storage[key][tag]
+	//			r.busyKey[key] = false
+	//			r.reset(seq)
+	//		}
+	//
+	//	}
+	//}
+}
+
+func (r *Replica) handleAckRead(ackRead *gusproto.AckRead) {
+	seq := ackRead.Seq
+	key := r.bookkeeping[seq].key
+
+	r.bookkeeping[seq].ackReads++
+	currentTag := r.currentTag[key]
+	// The sender is behind, so bring it up to date
+	if ackRead.CurrentTag.LessThan(currentTag) {
+		r.readRepair(ackRead.Sender, key)
+	}
+	// I receive a larger tag
+	if currentTag.LessThan(ackRead.CurrentTag) {
+		// Update key
+		r.currentTag[key] = gusproto.Tag{ackRead.CurrentTag.Timestamp, ackRead.CurrentTag.WriterID}
+
+		// Optimizing read for n=3
+		_, existence := r.storage[key]
+		if !existence {
+			r.storage[key] = make(map[gusproto.Tag]state.Value)
+		}
+		r.storage[key][ackRead.CurrentTag] = ackRead.Value
+
+		// This is not needed, because this replica can write to disk when receiving the write request
+		//// transform write into byte array
+		//if r.Durable {
+		//	var b [24]byte
+		//	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
+		//	binary.LittleEndian.PutUint32(b[8:12], uint32(ackRead.CurrentTag.Timestamp))
+		//	binary.LittleEndian.PutUint32(b[12:16], uint32(ackRead.CurrentTag.WriterID))
+		//	binary.LittleEndian.PutUint64(b[16:24], uint64(ackRead.Value))
+		//	r.StableStore.Write(b[:])
+		//	r.sync()
+		//}
+
+		r.initializeView(key, ackRead.CurrentTag)
+		r.view[key][ackRead.CurrentTag][r.Id] = true
+		r.bcastUpdateView(0, key, ackRead.CurrentTag.WriterID, ackRead.CurrentTag.Timestamp)
+	}
+
+	if (r.bookkeeping[seq].ackReads >= (r.N-1)/2) && r.bookkeeping[seq].waitForAckRead {
+		r.initializeView(key, r.currentTag[key])
+		// Check if a quorum of replicas have received this value/tag
+		if len(r.view[key][r.currentTag[key]]) >= (r.N-1)/2 {
+			tag := gusproto.Tag{r.currentTag[key].Timestamp, r.currentTag[key].WriterID}
+			// Reply to reader client
+			r.reply(r.bookkeeping[seq].proposal, r.storage[key][tag], tag)
+			r.bookkeeping[seq].complete = true
+			// These lines below simplify the logic of reset()
+			r.bookkeeping[seq].valueToWrite = r.storage[key][tag]
+			r.bookkeeping[seq].tag = tag
+			r.activeRead[key] = false
+			r.reset(seq)
+		} else {
+			// Make sure the second phase waits for a quorum
+			r.bookkeeping[seq].checkStorageForRead = true
+		}
+		r.bookkeeping[seq].waitForAckRead = false
+	}
+}
+
+// startWrite issues a client PUT, through the async path if a write to the
+// same key is already in flight
+func (r *Replica) startWrite(propose *genericsmr.Propose) {
+	dlog.Printf("GUS: Processing Put by Replica %d\n", r.Id)
+	key := propose.Command.K
+
+	// Initialize bookkeeping struct
+	r.bookkeeping[r.currentSeq].proposal = propose
+	r.bookkeeping[r.currentSeq].key = key
+
+	if r.activeWrite[key] {
+		// Another write to this key is in flight, so this one goes through
+		// the async path and is applied later by applyAsyncWrites
+		r.bookkeeping[r.currentSeq].isAsyncWrite = uint8(1)
+		r.bookkeeping[r.currentSeq].valueToWrite = propose.Command.V
+		// A tag of its own, above the write in flight
+		timestamp := r.tagClock.Update(r.currentTag[key].Timestamp)
+		r.bookkeeping[r.currentSeq].maxTime = timestamp
+		r.bookkeeping[r.currentSeq].tag = gusproto.Tag{timestamp, r.Id}
+	} else {
+		// Initialize storage space if key is not already existed
+		_, existence := r.storage[key]
+		if !existence {
+			r.storage[key] = make(map[gusproto.Tag]state.Value)
+		}
+		_, existence = r.tmpStorage[key]
+		if !existence {
+			r.tmpStorage[key] = make(map[gusproto.Tag]state.Value)
+		}
+
+		// Put value and tag in the bookkeeping
+		r.bookkeeping[r.currentSeq].valueToWrite = propose.Command.V
+		timestamp := r.tagClock.Update(r.currentTag[key].Timestamp)
+		r.bookkeeping[r.currentSeq].maxTime = timestamp
+		r.currentTag[key] = gusproto.Tag{timestamp, r.Id}
+		r.bookkeeping[r.currentSeq].tag = r.currentTag[key]
+		r.activeWrite[key] = true
+	}
+	r.bcastWrite(r.currentSeq, propose.Command, r.bookkeeping[r.currentSeq].isAsyncWrite)
+	r.currentSeq++
+}
+
 func (r *Replica) initializeView(key state.Key, tag gusproto.Tag) {
 	_, existence := r.view[key]
 	if !existence {
@@ -583,21 +742,90 @@ func (r *Replica) initializeView(key state.Key, tag gusproto.Tag) {
 	}
 }
 
+// completeAsyncWrite moves the pending async write that matches to the writes
+// applyAsyncWrites merges into storage, under the tag it completed with
+func (r *Replica) completeAsyncWrite(match func(obj *AsyncObj) bool, tag gusproto.Tag) {
+	for i, obj := range r.tmpAsyncStorage {
+		if match(obj) {
+			r.asyncStorage = append(r.asyncStorage, &AsyncObj{obj.key, obj.seq, tag, obj.value})
+			r.tmpAsyncStorage[i] = r.tmpAsyncStorage[len(r.tmpAsyncStorage)-1]
+			r.tmpAsyncStorage = r.tmpAsyncStorage[:len(r.tmpAsyncStorage)-1]
+			return
+		}
+	}
+}
+
+// applyAsyncWrites merges the async writes that are ready into storage. They
+// are applied in tag order so that currentTag only ever moves forward, and the
+// other replicas learn about each of them through UpdateView.
+func (r *Replica) applyAsyncWrites() {
+	if len(r.asyncStorage) == 0 {
+		return
+	}
+
+	sort.Slice(r.asyncStorage, func(i, j int) bool {
+		return r.asyncStorage[i].tag.LessThan(r.asyncStorage[j].tag)
+	})
+
+	for _, obj := range r.asyncStorage {
+		key := obj.key
+		_, existence := r.storage[key]
+		if !existence {
+			r.storage[key] = make(map[gusproto.Tag]state.Value)
+		}
+		r.storage[key][obj.tag] = obj.value
+		r.recordWrite(key, obj.tag, obj.value)
+
+		// An older write still lands in storage, but must not move the tag back
+		currentTag := r.currentTag[key]
+		if currentTag.LessThan(obj.tag) {
+			r.currentTag[key] = obj.tag
+		}
+		r.initializeView(key, obj.tag)
+		r.view[key][obj.tag][r.Id] = true
+		r.bcastUpdateView(obj.seq, key, obj.tag.WriterID, obj.tag.Timestamp)
+	}
+	r.sync()
+
+	r.asyncStorage = r.asyncStorage[:0]
+}
+
+// recordWrite logs a key/tag/value triple to the stable store
+func (r *Replica) recordWrite(key state.Key, tag gusproto.Tag, value state.Value) {
+	if !r.Durable {
+		return
+	}
+
+	var b [28]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(tag.Timestamp))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(tag.WriterID))
+	binary.LittleEndian.PutUint64(b[20:28], uint64(value))
+	r.StableStore.Write(b[:])
+}
+
+// reply answers a client with the value of a version of a key. In place of
+// the client's timestamp, the reply carries the HLC timestamp of the tag of
+// that version, which tells the client how recent the value is.
+func (r *Replica) reply(propose *genericsmr.Propose, value state.Value, tag gusproto.Tag) {
+	propreply := &genericsmrproto.ProposeReplyTS{
+		TRUE,
+		propose.CommandId,
+		value,
+		tag.Timestamp}
+	r.ReplyProposeTS(propreply, propose.Reply)
+}
+
 // seq is associated with the operation that just completes
 func (r *Replica) reset(seq int32) {
 	// Optimization: process pending operations
 	if len(r.pendingReads) != 0 {
-		fmt.Print("Handling parallel read operations %d\n", len(r.pendingReads))
+		dlog.Printf("Handling parallel read operations %d\n", len(r.pendingReads))
 		var proposal *genericsmr.Propose
 		for i := 0; i < len(r.pendingReads); i++ {
 			proposal = r.pendingReads[i]
 
-			propreply := &genericsmrproto.ProposeReplyTS{
-				TRUE,
-				proposal.CommandId,
-				r.bookkeeping[seq].valueToWrite,
-				proposal.Timestamp}
-			r.ReplyProposeTS(propreply, proposal.Reply)
+			r.reply(proposal, r.bookkeeping[seq].valueToWrite, r.bookkeeping[seq].tag)
 			//TODO: add this proposal to the booking for debugging/logging purpose
 		}
 		r.pendingReads = []*genericsmr.Propose{}
@@ -640,8 +868,12 @@ func (r *Replica) bcastRead(seq int32, command state.Command) {
 	readMSG.ReaderID = r.Id
 	readMSG.Command = command
 	args := &readMSG
+	if r.Thrifty {
+		msg := readMSG
+		args = &msg
+	}
 
-	r.bcastAll(r.readRPC, args)
+	r.bcastQuorum(seq, r.readRPC, args)
 }
 
 var ackReadMSG gusproto.AckRead
@@ -658,6 +890,7 @@ func (r *Replica) bcastAckRead(seq int32, readerID int32, key state.Key) {
 	ackReadMSG.CurrentTag.Timestamp = r.currentTag[key].Timestamp
 	ackReadMSG.CurrentTag.WriterID = r.currentTag[key].WriterID
 	ackReadMSG.Value = r.storage[key][r.currentTag[key]]
+	ackReadMSG.Sender = r.Id
 	args := &ackReadMSG
 
 	r.SendMsg(readerID, r.ackReadRPC, args)
@@ -674,12 +907,16 @@ func (r *Replica) bcastWrite(seq int32, command state.Command, isAsync uint8) {
 
 	writeMSG.Seq = seq
 	writeMSG.WriterID = r.Id
-	writeMSG.CurrentTime = r.currentTag[r.bookkeeping[seq].key].Timestamp
+	writeMSG.CurrentTime = r.bookkeeping[seq].tag.Timestamp
 	writeMSG.Command = command
 	writeMSG.IsAsync = isAsync
 	args := &writeMSG
+	if r.Thrifty {
+		msg := writeMSG
+		args = &msg
+	}
 
-	r.bcastAll(r.writeRPC, args)
+	r.bcastQuorum(seq, r.writeRPC, args)
 }
 
 var ackWriteMSG gusproto.AckWrite
@@ -705,7 +942,7 @@ func (r *Replica) bcastAckWrite(seq int32, writerID int32, staleTag uint8, tag g
 
 var commitWriteMSG gusproto.CommitWrite
 
-func (r *Replica) bcastCommitWrite(seq int32, writerID int32, timestamp int32, key state.Key, isAsync uint8) {
+func (r *Replica) bcastCommitWrite(seq int32, writerID int32, timestamp int64, key state.Key, isAsync uint8) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Write bcast failed:", err)
@@ -719,8 +956,19 @@ func (r *Replica) bcastCommitWrite(seq int32, writerID int32, timestamp int32, k
 	commitWriteMSG.IsAsync = isAsync
 
 	args := &commitWriteMSG
+	if isAsync == 1 {
+		// Every replica the Write reached holds the async write back until
+		// it hears the tag it completed with, and the thrifty fallback may
+		// have sent the Write to any of them
+		r.bcastAll(r.commitWriteRPC, args)
+		return
+	}
+	if r.Thrifty {
+		msg := commitWriteMSG
+		args = &msg
+	}
 
-	r.bcastAll(r.commitWriteRPC, args)
+	r.bcastQuorum(seq, r.commitWriteRPC, args)
 }
 
 var ackCommitMSG gusproto.AckCommit
@@ -742,7 +990,7 @@ func (r *Replica) bcastAckCommit(seq int32, writerID int32) {
 
 var updateViewMSG gusproto.UpdateView
 
-func (r *Replica) bcastUpdateView(seq int32, writerID int32, timestamp int32) {
+func (r *Replica) bcastUpdateView(seq int32, key state.Key, writerID int32, timestamp int64) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Write bcast failed:", err)
@@ -750,6 +998,7 @@ func (r *Replica) bcastUpdateView(seq int32, writerID int32, timestamp int32) {
 	}()
 
 	updateViewMSG.Seq = seq
+	updateViewMSG.Key = key
 	updateViewMSG.WriterID = writerID
 	updateViewMSG.CurrentTime = timestamp
 	updateViewMSG.Sender = r.Id
@@ -0,0 +1,305 @@
+package gus
+
+import (
+	"bytes"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/gusproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+// testNet runs the Gus handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int, thrifty bool, leases bool) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, thrifty, false, false, false, false, leases, true)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.writeRPC:          new(gusproto.Write),
+		r.ackWriteRPC:       new(gusproto.AckWrite),
+		r.commitWriteRPC:    new(gusproto.CommitWrite),
+		r.ackCommitRPC:      new(gusproto.AckCommit),
+		r.updateViewRPC:     new(gusproto.UpdateView),
+		r.readRPC:           new(gusproto.Read),
+		r.ackReadRPC:        new(gusproto.AckRead),
+		r.digestRPC:         new(gusproto.Digest),
+		r.repairPullRPC:     new(gusproto.RepairPull),
+		r.repairPushRPC:     new(gusproto.RepairPush),
+		r.leaseRequestRPC:   new(gusproto.LeaseRequest),
+		r.leaseGrantRPC:     new(gusproto.LeaseGrant),
+		r.leaseRevokeRPC:    new(gusproto.LeaseRevoke),
+		r.leaseRevokeAckRPC: new(gusproto.LeaseRevokeAck),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *gusproto.Write:
+			r.handleWrite(m)
+		case *gusproto.AckWrite:
+			r.handleAckWrite(m)
+		case *gusproto.CommitWrite:
+			r.handleCommitWrite(m)
+		case *gusproto.AckCommit:
+			r.handleAckCommit(m)
+		case *gusproto.UpdateView:
+			r.handleUpdateView(m)
+		case *gusproto.Read:
+			r.bcastAckRead(m.Seq, m.ReaderID, m.Command.K)
+		case *gusproto.AckRead:
+			r.handleAckRead(m)
+		case *gusproto.Digest:
+			r.handleDigest(m)
+		case *gusproto.RepairPull:
+			r.handleRepairPull(m)
+		case *gusproto.RepairPush:
+			r.handleRepairPush(m)
+		case *gusproto.LeaseRequest:
+			r.handleLeaseRequest(m)
+		case *gusproto.LeaseGrant:
+			r.handleLeaseGrant(m)
+		case *gusproto.LeaseRevoke:
+			r.handleLeaseRevoke(m)
+		case *gusproto.LeaseRevokeAck:
+			r.handleLeaseRevokeAck(m)
+		}
+	}
+	return net
+}
+
+// propose hands an operation to a replica, and returns where its reply goes
+func (net *testNet) propose(id int, op state.Operation, key state.Key, val state.Value) *bytes.Buffer {
+	propose, reply := smrtest.Propose(int32(val), state.Command{op, key, val})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+// stored is the value of the current tag of a key at a replica
+func stored(r *Replica, key state.Key) state.Value {
+	return r.storage[key][r.currentTag[key]]
+}
+
+func TestWriteThenRead(t *testing.T) {
+	net := newTestNet(t, 3, false, false)
+
+	reply := net.propose(0, state.PUT, 7, 70)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 70, TRUE, state.NIL)
+	for _, r := range net.replicas {
+		if stored(r, 7) != 70 {
+			t.Fatalf("replica %d stores %d for key 7", r.Id, stored(r, 7))
+		}
+	}
+
+	reply = net.propose(1, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+}
+
+func TestRepliesCarryTag(t *testing.T) {
+	net := newTestNet(t, 3, false, false)
+
+	reply := net.propose(0, state.PUT, 7, 70)
+	net.DeliverAll()
+	tag := net.replicas[0].currentTag[7]
+	if preply := smrtest.ReadReply(t, reply); preply.Timestamp != tag.Timestamp {
+		t.Fatalf("the PUT reply carries timestamp %d, its tag is %v", preply.Timestamp, tag)
+	}
+
+	// a GET gets the timestamp of the version it read, however late it runs
+	net.propose(2, state.PUT, 8, 80)
+	net.DeliverAll()
+	reply = net.propose(1, state.GET, 7, 0)
+	net.DeliverAll()
+	if preply := smrtest.ReadReply(t, reply); preply.Value != 70 || preply.Timestamp != tag.Timestamp {
+		t.Fatalf("the GET got %d with timestamp %d, want 70 with %d", preply.Value, preply.Timestamp, tag.Timestamp)
+	}
+}
+
+// tick runs what every replica does on a clock tick, and delivers what it sends
+func (net *testNet) tick() {
+	for _, r := range net.replicas {
+		r.applyAsyncWrites()
+	}
+	net.DeliverAll()
+}
+
+func TestAsyncWriteWaitsForCompletion(t *testing.T) {
+	net := newTestNet(t, 3, false, false)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	// the second PUT goes through the async path, with a tag of its own
+	first := net.propose(0, state.PUT, 7, 10)
+	second := net.propose(0, state.PUT, 7, 20)
+	if r0.bookkeeping[1].isAsyncWrite != 1 || !r0.bookkeeping[0].tag.LessThan(r0.bookkeeping[1].tag) {
+		t.Fatalf("the async write has tag %v, after %v", r0.bookkeeping[1].tag, r0.bookkeeping[0].tag)
+	}
+
+	// acceptors hold the async write back until the writer completes it
+	net.Deliver(0, 1)
+	net.Deliver(0, 2)
+	net.tick()
+	if stored(r1, 7) != 10 || len(r1.tmpAsyncStorage) != 1 {
+		t.Fatalf("replica 1 applied the async write before it completed")
+	}
+	smrtest.CheckReply(t, first, 10, TRUE, state.NIL)
+	smrtest.CheckReply(t, second, 20, TRUE, state.NIL)
+
+	// the writer applies it, and the others follow in tag order
+	net.tick()
+	net.tick()
+	asyncTag := r0.bookkeeping[1].tag
+	for _, r := range net.replicas {
+		if r.currentTag[7] != asyncTag || stored(r, 7) != 20 || len(r.tmpAsyncStorage) != 0 {
+			t.Fatalf("replica %d stores %d with tag %v", r.Id, stored(r, 7), r.currentTag[7])
+		}
+	}
+}
+
+func TestThriftyFallback(t *testing.T) {
+	net := newTestNet(t, 5, true, false)
+	r0 := net.replicas[0]
+
+	// the Write only goes to the closest quorum, which does not answer
+	reply := net.propose(0, state.PUT, 7, 70)
+	for to := 1; to < 5; to++ {
+		if sent := net.Hold(0, to); len(sent) > 0 != (to <= 2) {
+			t.Fatalf("thrifty Write sent to replica %d: %v", to, len(sent) > 0)
+		}
+	}
+	net.DeliverAll()
+	if reply.Len() > 0 {
+		t.Fatalf("the PUT completed without a quorum")
+	}
+
+	// so it goes to the other peers once the quorum is late
+	r0.thriftyOps[0].sentAt = r0.thriftyOps[0].sentAt.Add(-THRIFTY_TIMEOUT)
+	r0.checkThrifty()
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 70, TRUE, state.NIL)
+
+	// and every replica learns that the writer installed it
+	tag := r0.currentTag[7]
+	for _, r := range net.replicas {
+		if !r.view[7][tag][0] {
+			t.Fatalf("replica %d did not hear that the writer installed tag %v", r.Id, tag)
+		}
+	}
+}
+
+func TestThriftyAsyncWriteCompletesEverywhere(t *testing.T) {
+	net := newTestNet(t, 5, true, false)
+	r0 := net.replicas[0]
+
+	// the closest quorum is late, so both Writes go to every peer
+	first := net.propose(0, state.PUT, 7, 10)
+	second := net.propose(0, state.PUT, 7, 20)
+	held1, held2 := net.Hold(0, 1), net.Hold(0, 2)
+	for _, op := range r0.thriftyOps {
+		op.sentAt = op.sentAt.Add(-THRIFTY_TIMEOUT)
+	}
+	r0.checkThrifty()
+
+	// replica 3 has seen a later write to key 7, and answers first, so both
+	// writes take the slow path
+	net.replicas[3].currentTag[7] = gusproto.Tag{r0.bookkeeping[1].tag.Timestamp + 1, 4}
+	net.Deliver(0, 3)
+	net.Deliver(0, 4)
+	net.Deliver(3, 0)
+	net.Deliver(4, 0)
+	if !r0.bookkeeping[1].waitForAckCommit {
+		t.Fatalf("the async write took the fast path")
+	}
+	net.Release(0, 1, held1)
+	net.Release(0, 2, held2)
+	net.DeliverAll()
+	smrtest.CheckReply(t, first, 10, TRUE, state.NIL)
+	smrtest.CheckReply(t, second, 20, TRUE, state.NIL)
+
+	// replicas outside that quorum still learn how the async write completed
+	net.tick()
+	net.tick()
+	asyncTag := r0.bookkeeping[1].tag
+	for _, r := range net.replicas {
+		if len(r.tmpAsyncStorage) != 0 || r.storage[7][asyncTag] != 20 {
+			t.Fatalf("replica %d holds %d async writes, and stores %d with tag %v",
+				r.Id, len(r.tmpAsyncStorage), r.storage[7][asyncTag], asyncTag)
+		}
+	}
+}
+
+func TestAntiEntropyRepair(t *testing.T) {
+	net := newTestNet(t, 3, false, false)
+	r1, r2 := net.replicas[1], net.replicas[2]
+
+	// replica 2 misses two writes
+	net.Down[2] = true
+	net.propose(0, state.PUT, 7, 70)
+	net.DeliverAll()
+	net.propose(1, state.PUT, 8, 80)
+	net.DeliverAll()
+	net.Down[2] = false
+	if _, present := r2.currentTag[7]; present {
+		t.Fatalf("replica 2 heard of the write to key 7")
+	}
+
+	// it pulls them when replica 1's digest reaches it
+	r1.startAntiEntropy()
+	if r1.antiEntropyPeer != 2 {
+		t.Fatalf("replica 1 sent its digest to replica %d", r1.antiEntropyPeer)
+	}
+	net.DeliverAll()
+	for key, val := range map[state.Key]state.Value{7: 70, 8: 80} {
+		if r2.currentTag[key] != r1.currentTag[key] || stored(r2, key) != val {
+			t.Fatalf("replica 2 stores %d with tag %v for key %d", stored(r2, key), r2.currentTag[key], key)
+		}
+	}
+	if r2.digest()[keyRange(7)] != r1.digest()[keyRange(7)] {
+		t.Fatalf("the digests still differ after the repair")
+	}
+}
+
+func TestLeaseRevocation(t *testing.T) {
+	net := newTestNet(t, 3, false, true)
+	r1 := net.replicas[1]
+
+	net.propose(0, state.PUT, 7, 70)
+	net.DeliverAll()
+
+	// the first GET goes through a quorum, and gets replica 1 a lease
+	reply := net.propose(1, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+	reply = net.propose(1, state.GET, 7, 0)
+	smrtest.CheckReply(t, reply, 0, TRUE, 70)
+	for to := range net.Links[1] {
+		if r1.PeerWriters[to].Buffered() > 0 || net.Links[1][to].Len() > 0 {
+			t.Fatalf("a GET under a lease sent messages")
+		}
+	}
+
+	// a PUT waits until the holder gives its lease up
+	reply = net.propose(2, state.PUT, 7, 80)
+	if r2 := net.replicas[2]; len(r2.deferred[7]) != 1 || r2.activeWrite[7] {
+		t.Fatalf("replica 2 started the PUT while replica 1 holds a lease")
+	}
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 80, TRUE, state.NIL)
+	if l := r1.held[7]; !l.expiry.IsZero() || len(net.replicas[0].granted[7]) != 0 || len(net.replicas[2].granted[7]) != 0 {
+		t.Fatalf("replica 1 still holds its lease after the PUT")
+	}
+
+	// so the holder reads through a quorum again
+	reply = net.propose(1, state.GET, 7, 0)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 0, TRUE, 80)
+}
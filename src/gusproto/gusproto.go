@@ -16,8 +16,11 @@ const (
 	COMMITWRITE
 )
 
+// Timestamp is a hybrid logical clock reading (see package hlc). Replies to
+// clients carry the Timestamp of the version they wrote or read, in the
+// Timestamp of the generic ProposeReplyTS.
 type Tag struct {
-	Timestamp int32
+	Timestamp int64
 	WriterID  int32
 }
 
@@ -49,7 +52,7 @@ func (a *Tag) Equals(b Tag) bool {
 type Write struct {
 	Seq         int32
 	WriterID    int32
-	CurrentTime int32
+	CurrentTime int64
 	Command     state.Command
 	IsAsync     uint8
 }
@@ -65,7 +68,7 @@ type CommitWrite struct {
 	Seq         int32
 	Key         state.Key
 	WriterID    int32
-	CurrentTime int32
+	CurrentTime int64
 	IsAsync     uint8
 }
 
@@ -78,7 +81,7 @@ type UpdateView struct {
 	Seq         int32
 	Key         state.Key
 	WriterID    int32
-	CurrentTime int32
+	CurrentTime int64
 	Sender      int32
 }
 
@@ -93,6 +96,31 @@ type AckRead struct {
 	ReaderID   int32
 	CurrentTag Tag
 	Value      state.Value
+	Sender     int32
+}
+
+// Anti-entropy: a replica periodically sends a Digest with one hash per key
+// range, and the receiver pulls the ranges that differ with a RepairPull.
+// RepairPush carries the newer tag/value pairs back, and is also used for read
+// repair.
+
+type Digest struct {
+	Sender int32
+	Hashes []uint64
+}
+
+type RepairPull struct {
+	Sender int32
+	Ranges []int32
+	Keys   []state.Key
+	Tags   []Tag
+}
+
+type RepairPush struct {
+	Sender int32
+	Keys   []state.Key
+	Tags   []Tag
+	Values []state.Value
 }
 
 type Prepare struct {
@@ -136,3 +164,31 @@ type CommitShort struct {
 	Count    int32
 	Ballot   int32
 }
+
+// Leases: a replica that holds a lease on a key from a quorum serves GETs on
+// that key from its own storage. Grantors revoke the lease before they
+// acknowledge a write to the key.
+
+type LeaseRequest struct {
+	Sender int32
+	Key    state.Key
+	Epoch  int32
+}
+
+type LeaseGrant struct {
+	Sender int32
+	Key    state.Key
+	Epoch  int32
+	OK     uint8
+	Tag    Tag
+}
+
+type LeaseRevoke struct {
+	Sender int32
+	Key    state.Key
+}
+
+type LeaseRevokeAck struct {
+	Sender int32
+	Key    state.Key
+}
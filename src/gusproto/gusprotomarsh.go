@@ -51,7 +51,7 @@ func (p *UpdateViewCache) Put(t *UpdateView) {
 	p.mu.Unlock()
 }
 func (t *UpdateView) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:4]
 	tmp32 := t.Seq
@@ -61,27 +61,31 @@ func (t *UpdateView) Marshal(wire io.Writer) {
 	bs[3] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Key.Marshal(wire)
-	bs = b[:12]
+	bs = b[:16]
 	tmp32 = t.WriterID
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.CurrentTime
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
+	tmp64 := t.CurrentTime
+	bs[4] = byte(tmp64)
+	bs[5] = byte(tmp64 >> 8)
+	bs[6] = byte(tmp64 >> 16)
+	bs[7] = byte(tmp64 >> 24)
+	bs[8] = byte(tmp64 >> 32)
+	bs[9] = byte(tmp64 >> 40)
+	bs[10] = byte(tmp64 >> 48)
+	bs[11] = byte(tmp64 >> 56)
 	tmp32 = t.Sender
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *UpdateView) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
 	bs = b[:4]
 	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
@@ -89,13 +93,13 @@ func (t *UpdateView) Unmarshal(wire io.Reader) error {
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Key.Unmarshal(wire)
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.WriterID = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.CurrentTime = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Sender = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.CurrentTime = int64((uint64(bs[4]) | (uint64(bs[5]) << 8) | (uint64(bs[6]) << 16) | (uint64(bs[7]) << 24) | (uint64(bs[8]) << 32) | (uint64(bs[9]) << 40) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 56)))
+	t.Sender = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	return nil
 }
 
@@ -136,9 +140,9 @@ func (p *AckReadCache) Put(t *AckRead) {
 	p.mu.Unlock()
 }
 func (t *AckRead) Marshal(wire io.Writer) {
-	var b [16]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:16]
+	bs = b[:20]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -149,32 +153,48 @@ func (t *AckRead) Marshal(wire io.Writer) {
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.CurrentTag.Timestamp
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
+	tmp64 := t.CurrentTag.Timestamp
+	bs[8] = byte(tmp64)
+	bs[9] = byte(tmp64 >> 8)
+	bs[10] = byte(tmp64 >> 16)
+	bs[11] = byte(tmp64 >> 24)
+	bs[12] = byte(tmp64 >> 32)
+	bs[13] = byte(tmp64 >> 40)
+	bs[14] = byte(tmp64 >> 48)
+	bs[15] = byte(tmp64 >> 56)
 	tmp32 = t.CurrentTag.WriterID
-	bs[12] = byte(tmp32)
-	bs[13] = byte(tmp32 >> 8)
-	bs[14] = byte(tmp32 >> 16)
-	bs[15] = byte(tmp32 >> 24)
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Value.Marshal(wire)
+	bs = b[:4]
+	tmp32 = t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
 }
 
 func (t *AckRead) Unmarshal(wire io.Reader) error {
-	var b [16]byte
+	var b [20]byte
 	var bs []byte
-	bs = b[:16]
-	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.ReaderID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.CurrentTag.Timestamp = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.CurrentTag.WriterID = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.CurrentTag.Timestamp = int64((uint64(bs[8]) | (uint64(bs[9]) << 8) | (uint64(bs[10]) << 16) | (uint64(bs[11]) << 24) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 40) | (uint64(bs[14]) << 48) | (uint64(bs[15]) << 56)))
+	t.CurrentTag.WriterID = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
 	t.Value.Unmarshal(wire)
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	return nil
 }
 
@@ -328,7 +348,7 @@ func (t *Tag) New() fastrpc.Serializable {
 	return new(Tag)
 }
 func (t *Tag) BinarySize() (nbytes int, sizeKnown bool) {
-	return 8, true
+	return 12, true
 }
 
 type TagCache struct {
@@ -361,31 +381,35 @@ func (p *TagCache) Put(t *Tag) {
 	p.mu.Unlock()
 }
 func (t *Tag) Marshal(wire io.Writer) {
-	var b [8]byte
+	var b [12]byte
 	var bs []byte
-	bs = b[:8]
-	tmp32 := t.Timestamp
-	bs[0] = byte(tmp32)
-	bs[1] = byte(tmp32 >> 8)
-	bs[2] = byte(tmp32 >> 16)
-	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.WriterID
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
+	bs = b[:12]
+	tmp64 := t.Timestamp
+	bs[0] = byte(tmp64)
+	bs[1] = byte(tmp64 >> 8)
+	bs[2] = byte(tmp64 >> 16)
+	bs[3] = byte(tmp64 >> 24)
+	bs[4] = byte(tmp64 >> 32)
+	bs[5] = byte(tmp64 >> 40)
+	bs[6] = byte(tmp64 >> 48)
+	bs[7] = byte(tmp64 >> 56)
+	tmp32 := t.WriterID
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
 func (t *Tag) Unmarshal(wire io.Reader) error {
-	var b [8]byte
+	var b [12]byte
 	var bs []byte
-	bs = b[:8]
-	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+	bs = b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
 		return err
 	}
-	t.Timestamp = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.WriterID = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
 	return nil
 }
 
@@ -491,9 +515,9 @@ func (p *WriteCache) Put(t *Write) {
 	p.mu.Unlock()
 }
 func (t *Write) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:16]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -504,11 +528,15 @@ func (t *Write) Marshal(wire io.Writer) {
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.CurrentTime
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
+	tmp64 := t.CurrentTime
+	bs[8] = byte(tmp64)
+	bs[9] = byte(tmp64 >> 8)
+	bs[10] = byte(tmp64 >> 16)
+	bs[11] = byte(tmp64 >> 24)
+	bs[12] = byte(tmp64 >> 32)
+	bs[13] = byte(tmp64 >> 40)
+	bs[14] = byte(tmp64 >> 48)
+	bs[15] = byte(tmp64 >> 56)
 	wire.Write(bs)
 	t.Command.Marshal(wire)
 	bs = b[:1]
@@ -517,15 +545,15 @@ func (t *Write) Marshal(wire io.Writer) {
 }
 
 func (t *Write) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.CurrentTime = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.CurrentTime = int64((uint64(bs[8]) | (uint64(bs[9]) << 8) | (uint64(bs[10]) << 16) | (uint64(bs[11]) << 24) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 40) | (uint64(bs[14]) << 48) | (uint64(bs[15]) << 56)))
 	t.Command.Unmarshal(wire)
 	bs = b[:1]
 	if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
@@ -829,7 +857,7 @@ func (p *CommitWriteCache) Put(t *CommitWrite) {
 	p.mu.Unlock()
 }
 func (t *CommitWrite) Marshal(wire io.Writer) {
-	var b [9]byte
+	var b [13]byte
 	var bs []byte
 	bs = b[:4]
 	tmp32 := t.Seq
@@ -839,23 +867,27 @@ func (t *CommitWrite) Marshal(wire io.Writer) {
 	bs[3] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Key.Marshal(wire)
-	bs = b[:9]
+	bs = b[:13]
 	tmp32 = t.WriterID
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.CurrentTime
-	bs[4] = byte(tmp32)
-	bs[5] = byte(tmp32 >> 8)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 24)
-	bs[8] = byte(t.IsAsync)
+	tmp64 := t.CurrentTime
+	bs[4] = byte(tmp64)
+	bs[5] = byte(tmp64 >> 8)
+	bs[6] = byte(tmp64 >> 16)
+	bs[7] = byte(tmp64 >> 24)
+	bs[8] = byte(tmp64 >> 32)
+	bs[9] = byte(tmp64 >> 40)
+	bs[10] = byte(tmp64 >> 48)
+	bs[11] = byte(tmp64 >> 56)
+	bs[12] = byte(t.IsAsync)
 	wire.Write(bs)
 }
 
 func (t *CommitWrite) Unmarshal(wire io.Reader) error {
-	var b [9]byte
+	var b [13]byte
 	var bs []byte
 	bs = b[:4]
 	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
@@ -863,13 +895,13 @@ func (t *CommitWrite) Unmarshal(wire io.Reader) error {
 	}
 	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Key.Unmarshal(wire)
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
 	t.WriterID = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.CurrentTime = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.IsAsync = uint8(bs[8])
+	t.CurrentTime = int64((uint64(bs[4]) | (uint64(bs[5]) << 8) | (uint64(bs[6]) << 16) | (uint64(bs[7]) << 24) | (uint64(bs[8]) << 32) | (uint64(bs[9]) << 40) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 56)))
+	t.IsAsync = uint8(bs[12])
 	return nil
 }
 
@@ -1069,9 +1101,9 @@ func (p *AckWriteCache) Put(t *AckWrite) {
 	p.mu.Unlock()
 }
 func (t *AckWrite) Marshal(wire io.Writer) {
-	var b [17]byte
+	var b [21]byte
 	var bs []byte
-	bs = b[:17]
+	bs = b[:21]
 	tmp32 := t.Seq
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -1083,12 +1115,503 @@ func (t *AckWrite) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
 	bs[8] = byte(t.StaleTag)
-	tmp32 = t.OtherTag.Timestamp
-	bs[9] = byte(tmp32)
-	bs[10] = byte(tmp32 >> 8)
-	bs[11] = byte(tmp32 >> 16)
-	bs[12] = byte(tmp32 >> 24)
+	tmp64 := t.OtherTag.Timestamp
+	bs[9] = byte(tmp64)
+	bs[10] = byte(tmp64 >> 8)
+	bs[11] = byte(tmp64 >> 16)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 32)
+	bs[14] = byte(tmp64 >> 40)
+	bs[15] = byte(tmp64 >> 48)
+	bs[16] = byte(tmp64 >> 56)
 	tmp32 = t.OtherTag.WriterID
+	bs[17] = byte(tmp32)
+	bs[18] = byte(tmp32 >> 8)
+	bs[19] = byte(tmp32 >> 16)
+	bs[20] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *AckWrite) Unmarshal(wire io.Reader) error {
+	var b [21]byte
+	var bs []byte
+	bs = b[:21]
+	if _, err := io.ReadAtLeast(wire, bs, 21); err != nil {
+		return err
+	}
+	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.StaleTag = uint8(bs[8])
+	t.OtherTag.Timestamp = int64((uint64(bs[9]) | (uint64(bs[10]) << 8) | (uint64(bs[11]) << 16) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 32) | (uint64(bs[14]) << 40) | (uint64(bs[15]) << 48) | (uint64(bs[16]) << 56)))
+	t.OtherTag.WriterID = int32((uint32(bs[17]) | (uint32(bs[18]) << 8) | (uint32(bs[19]) << 16) | (uint32(bs[20]) << 24)))
+	return nil
+}
+
+func (t *Digest) New() fastrpc.Serializable {
+	return new(Digest)
+}
+func (t *Digest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type DigestCache struct {
+	mu    sync.Mutex
+	cache []*Digest
+}
+
+func NewDigestCache() *DigestCache {
+	c := &DigestCache{}
+	c.cache = make([]*Digest, 0)
+	return c
+}
+
+func (p *DigestCache) Get() *Digest {
+	var t *Digest
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Digest{}
+	}
+	return t
+}
+func (p *DigestCache) Put(t *Digest) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Digest) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Hashes))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:8]
+		tmp64 := t.Hashes[i]
+		bs[0] = byte(tmp64)
+		bs[1] = byte(tmp64 >> 8)
+		bs[2] = byte(tmp64 >> 16)
+		bs[3] = byte(tmp64 >> 24)
+		bs[4] = byte(tmp64 >> 32)
+		bs[5] = byte(tmp64 >> 40)
+		bs[6] = byte(tmp64 >> 48)
+		bs[7] = byte(tmp64 >> 56)
+		wire.Write(bs)
+	}
+}
+
+func (t *Digest) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Hashes = make([]uint64, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:8]
+		if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+			return err
+		}
+		t.Hashes[i] = uint64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	}
+	return nil
+}
+
+func (t *RepairPull) New() fastrpc.Serializable {
+	return new(RepairPull)
+}
+func (t *RepairPull) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type RepairPullCache struct {
+	mu    sync.Mutex
+	cache []*RepairPull
+}
+
+func NewRepairPullCache() *RepairPullCache {
+	c := &RepairPullCache{}
+	c.cache = make([]*RepairPull, 0)
+	return c
+}
+
+func (p *RepairPullCache) Get() *RepairPull {
+	var t *RepairPull
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &RepairPull{}
+	}
+	return t
+}
+func (p *RepairPullCache) Put(t *RepairPull) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *RepairPull) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Ranges))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		tmp32 = t.Ranges[i]
+		bs[0] = byte(tmp32)
+		bs[1] = byte(tmp32 >> 8)
+		bs[2] = byte(tmp32 >> 16)
+		bs[3] = byte(tmp32 >> 24)
+		wire.Write(bs)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.Keys))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		t.Keys[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen3 := int64(len(t.Tags))
+	if wlen := binary.PutVarint(bs, alen3); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen3; i++ {
+		t.Tags[i].Marshal(wire)
+	}
+}
+
+func (t *RepairPull) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Ranges = make([]int32, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		t.Ranges[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Keys = make([]state.Key, alen2)
+	for i := int64(0); i < alen2; i++ {
+		t.Keys[i].Unmarshal(wire)
+	}
+	alen3, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Tags = make([]Tag, alen3)
+	for i := int64(0); i < alen3; i++ {
+		t.Tags[i].Unmarshal(wire)
+	}
+	return nil
+}
+
+func (t *RepairPush) New() fastrpc.Serializable {
+	return new(RepairPush)
+}
+func (t *RepairPush) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type RepairPushCache struct {
+	mu    sync.Mutex
+	cache []*RepairPush
+}
+
+func NewRepairPushCache() *RepairPushCache {
+	c := &RepairPushCache{}
+	c.cache = make([]*RepairPush, 0)
+	return c
+}
+
+func (p *RepairPushCache) Get() *RepairPush {
+	var t *RepairPush
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &RepairPush{}
+	}
+	return t
+}
+func (p *RepairPushCache) Put(t *RepairPush) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *RepairPush) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Keys))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Keys[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen2 := int64(len(t.Tags))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen2; i++ {
+		t.Tags[i].Marshal(wire)
+	}
+	bs = b[:]
+	alen3 := int64(len(t.Values))
+	if wlen := binary.PutVarint(bs, alen3); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen3; i++ {
+		t.Values[i].Marshal(wire)
+	}
+}
+
+func (t *RepairPush) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Keys = make([]state.Key, alen1)
+	for i := int64(0); i < alen1; i++ {
+		t.Keys[i].Unmarshal(wire)
+	}
+	alen2, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Tags = make([]Tag, alen2)
+	for i := int64(0); i < alen2; i++ {
+		t.Tags[i].Unmarshal(wire)
+	}
+	alen3, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Values = make([]state.Value, alen3)
+	for i := int64(0); i < alen3; i++ {
+		t.Values[i].Unmarshal(wire)
+	}
+	return nil
+}
+
+func (t *LeaseRequest) New() fastrpc.Serializable {
+	return new(LeaseRequest)
+}
+func (t *LeaseRequest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LeaseRequestCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRequest
+}
+
+func NewLeaseRequestCache() *LeaseRequestCache {
+	c := &LeaseRequestCache{}
+	c.cache = make([]*LeaseRequest, 0)
+	return c
+}
+
+func (p *LeaseRequestCache) Get() *LeaseRequest {
+	var t *LeaseRequest
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRequest{}
+	}
+	return t
+}
+func (p *LeaseRequestCache) Put(t *LeaseRequest) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseRequest) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:4]
+	tmp32 = t.Epoch
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *LeaseRequest) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key.Unmarshal(wire)
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Epoch = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	return nil
+}
+
+func (t *LeaseGrant) New() fastrpc.Serializable {
+	return new(LeaseGrant)
+}
+func (t *LeaseGrant) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LeaseGrantCache struct {
+	mu    sync.Mutex
+	cache []*LeaseGrant
+}
+
+func NewLeaseGrantCache() *LeaseGrantCache {
+	c := &LeaseGrantCache{}
+	c.cache = make([]*LeaseGrant, 0)
+	return c
+}
+
+func (p *LeaseGrantCache) Get() *LeaseGrant {
+	var t *LeaseGrant
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseGrant{}
+	}
+	return t
+}
+func (p *LeaseGrantCache) Put(t *LeaseGrant) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseGrant) Marshal(wire io.Writer) {
+	var b [17]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+	bs = b[:17]
+	tmp32 = t.Epoch
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	bs[4] = byte(t.OK)
+	tmp64 := t.Tag.Timestamp
+	bs[5] = byte(tmp64)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64 >> 16)
+	bs[8] = byte(tmp64 >> 24)
+	bs[9] = byte(tmp64 >> 32)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 48)
+	bs[12] = byte(tmp64 >> 56)
+	tmp32 = t.Tag.WriterID
 	bs[13] = byte(tmp32)
 	bs[14] = byte(tmp32 >> 8)
 	bs[15] = byte(tmp32 >> 16)
@@ -1096,17 +1619,144 @@ func (t *AckWrite) Marshal(wire io.Writer) {
 	wire.Write(bs)
 }
 
-func (t *AckWrite) Unmarshal(wire io.Reader) error {
+func (t *LeaseGrant) Unmarshal(wire io.Reader) error {
 	var b [17]byte
 	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key.Unmarshal(wire)
 	bs = b[:17]
 	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
 		return err
 	}
-	t.Seq = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.WriterID = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.StaleTag = uint8(bs[8])
-	t.OtherTag.Timestamp = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
-	t.OtherTag.WriterID = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	t.Epoch = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.OK = uint8(bs[4])
+	t.Tag.Timestamp = int64((uint64(bs[5]) | (uint64(bs[6]) << 8) | (uint64(bs[7]) << 16) | (uint64(bs[8]) << 24) | (uint64(bs[9]) << 32) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 48) | (uint64(bs[12]) << 56)))
+	t.Tag.WriterID = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	return nil
+}
+
+func (t *LeaseRevoke) New() fastrpc.Serializable {
+	return new(LeaseRevoke)
+}
+func (t *LeaseRevoke) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LeaseRevokeCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRevoke
+}
+
+func NewLeaseRevokeCache() *LeaseRevokeCache {
+	c := &LeaseRevokeCache{}
+	c.cache = make([]*LeaseRevoke, 0)
+	return c
+}
+
+func (p *LeaseRevokeCache) Get() *LeaseRevoke {
+	var t *LeaseRevoke
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRevoke{}
+	}
+	return t
+}
+func (p *LeaseRevokeCache) Put(t *LeaseRevoke) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseRevoke) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *LeaseRevoke) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key.Unmarshal(wire)
+	return nil
+}
+
+func (t *LeaseRevokeAck) New() fastrpc.Serializable {
+	return new(LeaseRevokeAck)
+}
+func (t *LeaseRevokeAck) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type LeaseRevokeAckCache struct {
+	mu    sync.Mutex
+	cache []*LeaseRevokeAck
+}
+
+func NewLeaseRevokeAckCache() *LeaseRevokeAckCache {
+	c := &LeaseRevokeAckCache{}
+	c.cache = make([]*LeaseRevokeAck, 0)
+	return c
+}
+
+func (p *LeaseRevokeAckCache) Get() *LeaseRevokeAck {
+	var t *LeaseRevokeAck
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &LeaseRevokeAck{}
+	}
+	return t
+}
+func (p *LeaseRevokeAckCache) Put(t *LeaseRevokeAck) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *LeaseRevokeAck) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Sender
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Key.Marshal(wire)
+}
+
+func (t *LeaseRevokeAck) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Sender = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Key.Unmarshal(wire)
 	return nil
 }
@@ -0,0 +1,57 @@
+package hlc
+
+import (
+	"time"
+)
+
+// Number of low-order bits that hold the logical counter. The remaining high
+// bits hold the physical time in milliseconds since the Unix epoch.
+const LOGICAL_BITS = 16
+
+// A hybrid logical clock packed into a single int64, so that timestamps can be
+// compared as plain integers. A timestamp is always greater than every
+// timestamp the clock has produced or observed before.
+type Clock struct {
+	last int64
+	now  func() time.Time
+}
+
+func NewClock() *Clock {
+	return &Clock{0, time.Now}
+}
+
+func pack(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond) << LOGICAL_BITS
+}
+
+// Now returns a new timestamp for a local event
+func (c *Clock) Now() int64 {
+	pt := pack(c.now())
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update merges a timestamp received from another replica into the clock and
+// returns a new timestamp greater than both
+func (c *Clock) Update(remote int64) int64 {
+	if remote > c.last {
+		c.last = remote
+	}
+	return c.Now()
+}
+
+// Physical returns the wall-clock time a timestamp was taken at, up to the
+// clock skew between replicas
+func Physical(ts int64) time.Time {
+	ms := ts >> LOGICAL_BITS
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Logical returns the logical counter of a timestamp
+func Logical(ts int64) int64 {
+	return ts & (1<<LOGICAL_BITS - 1)
+}
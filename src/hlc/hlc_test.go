@@ -0,0 +1,47 @@
+package hlc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonotonic(t *testing.T) {
+	wall := time.Unix(1000, 0)
+	c := &Clock{0, func() time.Time { return wall }}
+
+	prev := c.Now()
+	for i := 0; i < 100000; i++ {
+		ts := c.Now()
+		if ts <= prev {
+			t.Fatalf("Timestamp went backwards: %d after %d", ts, prev)
+		}
+		prev = ts
+	}
+
+	// the physical part never runs behind the wall clock
+	if Physical(prev).Before(wall) {
+		t.Errorf("Expected physical time >= %v, got %v", wall, Physical(prev))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	wall := time.Unix(1000, 0)
+	c := &Clock{0, func() time.Time { return wall }}
+
+	// a replica whose clock runs ahead
+	remote := pack(wall.Add(time.Second)) + 5
+	ts := c.Update(remote)
+	if ts <= remote {
+		t.Errorf("Expected timestamp after %d, got %d", remote, ts)
+	}
+	if Logical(ts) != 6 {
+		t.Errorf("Expected logical counter 6, got %d", Logical(ts))
+	}
+
+	// once the wall clock catches up, the logical counter resets
+	wall = wall.Add(2 * time.Second)
+	ts = c.Now()
+	if Logical(ts) != 0 || !Physical(ts).Equal(wall) {
+		t.Errorf("Expected %v with logical counter 0, got %v and %d", wall, Physical(ts), Logical(ts))
+	}
+}
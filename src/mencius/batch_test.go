@@ -0,0 +1,34 @@
+package mencius
+
+import (
+	"bytes"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+func TestBatchInOneInstance(t *testing.T) {
+	net := newTestNet(t, 3, 4)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	// five proposals queued at once: a batch of four, then one
+	replies := make([]*bytes.Buffer, 5)
+	for i := range replies {
+		var propose *genericsmr.Propose
+		propose, replies[i] = smrtest.Propose(int32(i), state.Command{state.PUT, state.Key(i), state.Value(i)})
+		r0.ProposeChan <- propose
+	}
+	r0.handlePropose(<-r0.ProposeChan)
+	net.DeliverAll()
+
+	if inst := r1.instanceSpace[0]; inst == nil || inst.status != COMMITTED || len(inst.cmds) != 4 {
+		t.Fatalf("replica 1 has not committed a batch of four commands in instance 0: %+v", inst)
+	}
+	if inst := r1.instanceSpace[3]; inst == nil || len(inst.cmds) != 1 || inst.cmds[0].V != 4 {
+		t.Fatalf("the last proposal is not alone in instance 3: %+v", inst)
+	}
+	for i := 0; i < 4; i++ {
+		smrtest.CheckReply(t, replies[i], int32(i), TRUE, state.NIL)
+	}
+}
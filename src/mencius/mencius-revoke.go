@@ -0,0 +1,332 @@
+package mencius
+
+import (
+	"gus-epaxos/src/menciusproto"
+	"log"
+	"time"
+)
+
+// Revocation. When the lowest instance that blocks commits has not moved for
+// a while, any replica may take over a range of the instances of its owner:
+// it runs Phase 1 for the whole range at once, with a ballot higher than any
+// used in it, then proposes again every value or skip that the majority of
+// promises report, with the highest ballot, and skips the rest. Acceptors
+// keep their promise for the range, so that an owner that was only slow
+// cannot get a value accepted there any more; it moves its next proposals
+// past the range as soon as it hears of the revocation, and learns from the
+// commits of the revoking replica what became of the proposals it had in
+// flight there.
+//
+// A replica that was cut off catches up the same way: it takes over the
+// instances it missed the commits of, its own included, and learns the
+// values chosen there from the promises.
+
+// Instances of the owner taken over at once
+const NB_INST_TO_REVOKE = 1000
+
+// A revocation without a majority of promises in this long is given up, and
+// may be tried again with a higher ballot
+const REVOKE_TIMEOUT = 1 * time.Second
+
+// promise is a range of the instances of a replica that this replica
+// promised not to accept values for with a ballot lower than ballot
+type promise struct {
+	start  int32
+	end    int32
+	ballot int32
+}
+
+// revocation is a Revoke in progress
+type revocation struct {
+	start   int32
+	end     int32
+	ballot  int32
+	acks    []bool
+	oks     int
+	entries map[int32]menciusproto.RevokeEntry // highest ballot accepted, per instance
+	sentAt  time.Time
+}
+
+func (r *Replica) owner(instance int32) int32 {
+	return instance % int32(r.N)
+}
+
+// promisedBallot is the highest ballot this replica promised for an instance
+// in a revocation, or -1
+func (r *Replica) promisedBallot(instance int32) (int32, *promise) {
+	ballot := int32(-1)
+	var promised *promise
+	for i := range r.promises[r.owner(instance)] {
+		p := &r.promises[r.owner(instance)][i]
+		if instance >= p.start && instance <= p.end && p.ballot > ballot {
+			ballot = p.ballot
+			promised = p
+		}
+	}
+	return ballot, promised
+}
+
+// prunePromises forgets the promises for ranges that are committed, where
+// no value can be accepted any more
+func (r *Replica) prunePromises() {
+	for q := range r.promises {
+		kept := r.promises[q][:0]
+		for _, p := range r.promises[q] {
+			if !r.committedRange(p.start, p.end) {
+				kept = append(kept, p)
+			}
+		}
+		r.promises[q] = kept
+	}
+}
+
+// committedRange tells whether every instance of the owner of start, from
+// start to end, is committed. Instances below the blocking one that were
+// never filled in are inside a committed skip.
+func (r *Replica) committedRange(start int32, end int32) bool {
+	if end >= r.blockingInstance {
+		return false
+	}
+	for i := start; i <= end; i += int32(r.N) {
+		if inst := r.instanceSpace[i]; inst != nil && inst.status != COMMITTED && inst.status != EXECUTED {
+			return false
+		}
+	}
+	return true
+}
+
+// highestBallot is the highest ballot this replica knows of for the
+// instances of the owner of start, from start to end
+func (r *Replica) highestBallot(start int32, end int32) int32 {
+	ballot := int32(-1)
+	for _, p := range r.promises[r.owner(start)] {
+		if p.start <= end && p.end >= start && p.ballot > ballot {
+			ballot = p.ballot
+		}
+	}
+	for i := start; i <= end; i += int32(r.N) {
+		if inst := r.instanceSpace[i]; inst != nil && inst.ballot > ballot {
+			ballot = inst.ballot
+		}
+	}
+	return ballot
+}
+
+// revokeEntries lists the values and skips this replica has accepted for
+// the instances of the owner of start, from start to end
+func (r *Replica) revokeEntries(start int32, end int32) []menciusproto.RevokeEntry {
+	entries := make([]menciusproto.RevokeEntry, 0)
+	for i := start; i <= end; i += int32(r.N) {
+		inst := r.instanceSpace[i]
+		if inst == nil || inst.status == PREPARING || (!inst.skipped && inst.cmds == nil) {
+			continue
+		}
+		e := menciusproto.RevokeEntry{i, inst.ballot, FALSE, int32(inst.nbInstSkipped), inst.cmds}
+		if inst.skipped {
+			e.Skip = TRUE
+			e.Command = nil
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// startRevocation tries to take over the instances of the owner of start
+func (r *Replica) startRevocation(start int32) {
+	end := start + (NB_INST_TO_REVOKE-1)*int32(r.N)
+	for end >= int32(len(r.instanceSpace)) {
+		end -= int32(r.N)
+	}
+	// higher than the ballots of the owner too
+	highest := r.highestBallot(start, end)
+	if highest < r.revokeBallot {
+		highest = r.revokeBallot
+	}
+	if highest < 1<<BALLOT_ID_BITS {
+		highest = 1 << BALLOT_ID_BITS
+	}
+	ballot := r.makeBallotLargerThan(highest)
+	r.revokeBallot = ballot
+
+	rv := &revocation{start, end, ballot, make([]bool, r.N), 0, make(map[int32]menciusproto.RevokeEntry), time.Now()}
+	r.revocation = rv
+	log.Printf("Replica %d revoking the instances of replica %d from %d to %d with ballot %d\n", r.Id, r.owner(start), start, end, ballot)
+
+	// this replica promises its own ballot
+	r.promises[r.owner(start)] = append(r.promises[r.owner(start)], promise{start, end, ballot})
+	if r.owner(start) == r.Id {
+		r.skipRevoked(end)
+	}
+	r.addRevokePromise(r.Id, r.revokeEntries(start, end))
+
+	args := &menciusproto.Revoke{r.Id, start, end, ballot}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q] {
+			continue
+		}
+		r.SendMsg(q, r.revokeRPC, args)
+	}
+}
+
+func (r *Replica) addRevokePromise(acceptor int32, entries []menciusproto.RevokeEntry) {
+	rv := r.revocation
+	if rv.acks[acceptor] {
+		return
+	}
+	rv.acks[acceptor] = true
+	rv.oks++
+	for _, e := range entries {
+		if known, present := rv.entries[e.Instance]; !present || e.Ballot > known.Ballot {
+			rv.entries[e.Instance] = e
+		}
+	}
+	if rv.oks > r.N>>1 {
+		r.finishRevocation()
+	}
+}
+
+func (r *Replica) handleRevoke(revoke *menciusproto.Revoke) {
+	q := r.owner(revoke.StartInstance)
+	if b := r.highestBallot(revoke.StartInstance, revoke.EndInstance); b > revoke.Ballot {
+		r.SendMsg(revoke.LeaderId, r.revokeReplyRPC, &menciusproto.RevokeReply{r.Id, revoke.StartInstance, FALSE, b, nil})
+		return
+	}
+
+	r.promises[q] = append(r.promises[q], promise{revoke.StartInstance, revoke.EndInstance, revoke.Ballot})
+	if q == r.Id {
+		log.Printf("Replica %d was revoked from instance %d to %d by replica %d\n", r.Id, revoke.StartInstance, revoke.EndInstance, revoke.LeaderId)
+		r.skipRevoked(revoke.EndInstance)
+	}
+	r.SendMsg(revoke.LeaderId, r.revokeReplyRPC, &menciusproto.RevokeReply{r.Id, revoke.StartInstance, TRUE, revoke.Ballot, r.revokeEntries(revoke.StartInstance, revoke.EndInstance)})
+}
+
+// skipRevoked moves the next proposals of this replica past the instances
+// another replica has taken over
+func (r *Replica) skipRevoked(end int32) {
+	if r.crtInstance <= end {
+		r.crtInstance = end + int32(r.N)
+	}
+}
+
+// takenUpTo is the last instance of the owner of instance, from instance on,
+// that this replica knows to be revoked or in use
+func (r *Replica) takenUpTo(instance int32) int32 {
+	end := instance
+	if _, p := r.promisedBallot(instance); p != nil {
+		end = p.end
+	}
+	for end+int32(r.N) < int32(len(r.instanceSpace)) && r.instanceSpace[end+int32(r.N)] != nil {
+		end += int32(r.N)
+	}
+	return end
+}
+
+// requeueSkipped proposes again, in instances still its own, the client
+// proposals this replica had in instances another replica skipped
+func (r *Replica) requeueSkipped(start int32, end int32) {
+	for i := start; i <= end; i += int32(r.N) {
+		if inst := r.instanceSpace[i]; inst != nil {
+			r.requeue(inst)
+		}
+	}
+}
+
+func (r *Replica) handleRevokeReply(rreply *menciusproto.RevokeReply) {
+	rv := r.revocation
+	if rv == nil || rreply.StartInstance != rv.start {
+		// we've moved on -- these are delayed replies, so just ignore
+		return
+	}
+	if rreply.OK == FALSE {
+		if rreply.Ballot > rv.ballot {
+			// another replica is revoking these instances, or did already
+			log.Printf("Replica %d gives up the revocation from instance %d for ballot %d\n", r.Id, rv.start, rreply.Ballot)
+			r.revokeBallot = rreply.Ballot
+			r.revocation = nil
+		}
+		return
+	}
+	if rreply.Ballot != rv.ballot {
+		return
+	}
+	r.addRevokePromise(rreply.AcceptorId, rreply.Entries)
+}
+
+// finishRevocation proposes a value or a skip for every instance of the range
+// once a majority has promised its ballot
+func (r *Replica) finishRevocation() {
+	rv := r.revocation
+	r.revocation = nil
+	n := int32(r.N)
+	log.Printf("Replica %d took over instances %d to %d\n", r.Id, rv.start, rv.end)
+	r.suspected[r.owner(rv.start)] = true
+
+	for i := rv.start; i <= rv.end; {
+		e, present := rv.entries[i]
+		if !present {
+			// skip the instances up to the next one with a value
+			nb := int32(1)
+			for i+nb*n <= rv.end {
+				if _, present := rv.entries[i+nb*n]; present {
+					break
+				}
+				nb++
+			}
+			e = menciusproto.RevokeEntry{i, -1, TRUE, nb, nil}
+		} else if e.Skip == TRUE {
+			// but not over an instance that was accepted with a higher ballot
+			nb := int32(1)
+			for ; nb < e.NbInstancesToSkip; nb++ {
+				if later, present := rv.entries[i+nb*n]; present && later.Ballot > e.Ballot {
+					break
+				}
+			}
+			e.NbInstancesToSkip = nb
+		}
+
+		r.proposeRevoked(i, rv.ballot, e)
+		if e.Skip == TRUE {
+			i += e.NbInstancesToSkip * n
+		} else {
+			i += n
+		}
+	}
+	r.sync()
+}
+
+// proposeRevoked proposes again the value or skip of an instance taken over
+func (r *Replica) proposeRevoked(instance int32, ballot int32, e menciusproto.RevokeEntry) {
+	cmds := e.Command
+	inst := r.instanceSpace[instance]
+	if inst != nil && (inst.status == COMMITTED || inst.status == EXECUTED) {
+		// let the others know
+		r.bcastCommit(instance, e.Skip, e.NbInstancesToSkip, cmds)
+		return
+	}
+
+	lb := &LeaderBookkeeping{nil, 0, 0, 0}
+	if inst != nil && inst.lb != nil {
+		if e.Skip == TRUE {
+			r.requeue(inst)
+		} else {
+			// this replica is taking over its own instance, with its value
+			lb.clientProposals = inst.lb.clientProposals
+		}
+	}
+	r.instanceSpace[instance] = &Instance{e.Skip == TRUE,
+		int(e.NbInstancesToSkip),
+		cmds,
+		ballot,
+		ACCEPTED,
+		lb}
+	r.recordInstanceMetadata(r.instanceSpace[instance])
+	r.recordCommands(cmds)
+	r.bcastAccept(instance, ballot, e.Skip, e.NbInstancesToSkip, cmds)
+}
+
+// checkRevocation gives up a revocation that did not get a majority in time
+func (r *Replica) checkRevocation() {
+	if r.revocation != nil && time.Since(r.revocation.sentAt) >= REVOKE_TIMEOUT {
+		r.revocation = nil
+	}
+}
@@ -19,23 +19,28 @@ const NB_INST_TO_SKIP = 100000
 const MAX_SKIPS_WAITING = 20
 const TRUE = uint8(1)
 const FALSE = uint8(0)
+const CLOCK = 1000 * 10
+
+// Ballots are (counter << BALLOT_ID_BITS) | replica id
+const BALLOT_ID_BITS = 4
 
 type Replica struct {
 	*genericsmr.Replica      // extends a generic Paxos replica
 	skipChan                 chan fastrpc.Serializable
-	prepareChan              chan fastrpc.Serializable
 	acceptChan               chan fastrpc.Serializable
 	commitChan               chan fastrpc.Serializable
-	prepareReplyChan         chan fastrpc.Serializable
 	acceptReplyChan          chan fastrpc.Serializable
+	revokeChan               chan fastrpc.Serializable
+	revokeReplyChan          chan fastrpc.Serializable
 	delayedSkipChan          chan *DelayedSkip
 	skipRPC                  uint8
-	prepareRPC               uint8
 	acceptRPC                uint8
 	commitRPC                uint8
-	prepareReplyRPC          uint8
 	acceptReplyRPC           uint8
+	revokeRPC                uint8
+	revokeReplyRPC           uint8
 	clockChan                chan bool   // clock
+	fastClockChan            chan bool   // clock for batching
 	instanceSpace            []*Instance // the space of all instances (used and not yet used)
 	crtInstance              int32       // highest active instance number that this replica knows about
 	latestInstReady          int32       // highest instance number that is in the READY state (ready to commit)
@@ -47,6 +52,12 @@ type Replica struct {
 	skipsWaiting             int
 	counter                  int
 	skippedTo                []int32
+	promises                 [][]promise           // ranges revoked, per owner
+	revocation               *revocation           // the revocation this replica is running
+	revokeBallot             int32                 // highest ballot seen in a revocation
+	suspected                []bool                // replicas whose instances were revoked, until they are heard from
+	batcher                  *genericsmr.Batcher   // adaptive batching of client proposals
+	pending                  []*genericsmr.Propose // proposals the event loop put back, handled before ProposeChan
 }
 
 type DelayedSkip struct {
@@ -66,21 +77,26 @@ const (
 type Instance struct {
 	skipped       bool
 	nbInstSkipped int
-	command       *state.Command
+	cmds          []state.Command
 	ballot        int32
 	status        InstanceStatus
 	lb            *LeaderBookkeeping
 }
 
 type LeaderBookkeeping struct {
-	clientProposal *genericsmr.Propose
-	maxRecvBallot  int32
-	prepareOKs     int
-	acceptOKs      int
-	nacks          int
+	clientProposals []*genericsmr.Propose
+	maxRecvBallot   int32
+	acceptOKs       int
+	nacks           int
+}
+
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable, maxBatch, maxBatchDelay)
+	go r.run()
+	return r
 }
 
-func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
 	skippedTo := make([]int32, len(peerAddrList))
 	for i := 0; i < len(skippedTo); i++ {
 		skippedTo[i] = -1
@@ -95,6 +111,7 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(chan *DelayedSkip, genericsmr.CHAN_BUFFER_SIZE),
 		0, 0, 0, 0, 0, 0,
 		make(chan bool, 10),
+		make(chan bool, 1),
 		make([]*Instance, 10*1024*1024),
 		int32(id),
 		int32(-1),
@@ -105,22 +122,32 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		false,
 		0,
 		0,
-		skippedTo}
+		skippedTo,
+		make([][]promise, len(peerAddrList)),
+		nil,
+		-1,
+		make([]bool, len(peerAddrList)),
+		genericsmr.NewBatcher(maxBatch, maxBatchDelay),
+		nil}
 
 	r.Durable = durable
 
 	r.skipRPC = r.RegisterRPC(new(menciusproto.Skip), r.skipChan)
-	r.prepareRPC = r.RegisterRPC(new(menciusproto.Prepare), r.prepareChan)
 	r.acceptRPC = r.RegisterRPC(new(menciusproto.Accept), r.acceptChan)
 	r.commitRPC = r.RegisterRPC(new(menciusproto.Commit), r.commitChan)
-	r.prepareReplyRPC = r.RegisterRPC(new(menciusproto.PrepareReply), r.prepareReplyChan)
 	r.acceptReplyRPC = r.RegisterRPC(new(menciusproto.AcceptReply), r.acceptReplyChan)
-
-	go r.run()
+	r.revokeRPC = r.RegisterRPC(new(menciusproto.Revoke), r.revokeChan)
+	r.revokeReplyRPC = r.RegisterRPC(new(menciusproto.RevokeReply), r.revokeReplyChan)
 
 	return r
 }
 
+// BatchStats reports the sizes of the batches proposed by this replica
+func (r *Replica) BatchStats(args *genericsmrproto.BatchStatsArgs, reply *genericsmrproto.BatchStatsReply) error {
+	r.batcher.Stats(reply)
+	return nil
+}
+
 // append a log entry to stable storage
 func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	if !r.Durable {
@@ -140,15 +167,17 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 }
 
 // write a sequence of commands to stable storage
-func (r *Replica) recordCommand(cmd *state.Command) {
+func (r *Replica) recordCommands(cmds []state.Command) {
 	if !r.Durable {
 		return
 	}
 
-	if cmd == nil {
+	if cmds == nil {
 		return
 	}
-	cmd.Marshal(io.Writer(r.StableStore))
+	for i := 0; i < len(cmds); i++ {
+		cmds[i].Marshal(io.Writer(r.StableStore))
+	}
 }
 
 // sync with the stable store
@@ -160,10 +189,6 @@ func (r *Replica) sync() {
 	r.StableStore.Sync()
 }
 
-func (r *Replica) replyPrepare(replicaId int32, reply *menciusproto.PrepareReply) {
-	r.SendMsg(replicaId, r.prepareReplyRPC, reply)
-}
-
 func (r *Replica) replyAccept(replicaId int32, reply *menciusproto.AcceptReply) {
 	r.SendMsg(replicaId, r.acceptReplyRPC, reply)
 }
@@ -185,15 +210,34 @@ func (r *Replica) run() {
 	}
 
 	go r.clock()
+	go r.fastClock()
+
+	onOffProposeChan := r.ProposeChan
 
 	for !r.Shutdown {
 
+		// the event loop cannot wait on ProposeChan for the proposals it puts
+		// back
+		if len(r.pending) > 0 {
+			r.handlePropose(r.nextProposal())
+			continue
+		}
+
 		select {
 
-		case propose := <-r.ProposeChan:
+		case propose := <-onOffProposeChan:
 			//got a Propose from a client
 			dlog.Printf("Proposal with id %d\n", propose.CommandId)
 			r.handlePropose(propose)
+			//deactivate the new proposals channel to allow commands to accumulate for batching
+			onOffProposeChan = nil
+			break
+
+		case <-r.fastClockChan:
+			//activate the new proposals channel once enough commands are queued for a batch
+			if r.batcher.Ready(r.queued()) {
+				onOffProposeChan = r.ProposeChan
+			}
 			break
 
 		case skipS := <-r.skipChan:
@@ -202,13 +246,6 @@ func (r *Replica) run() {
 			dlog.Printf("Skip for instances %d-%d\n", skip.StartInstance, skip.EndInstance)
 			r.handleSkip(skip)
 
-		case prepareS := <-r.prepareChan:
-			prepare := prepareS.(*menciusproto.Prepare)
-			//got a Prepare message
-			dlog.Printf("Received Prepare from replica %d, for instance %d\n", prepare.LeaderId, prepare.Instance)
-			r.handlePrepare(prepare)
-			break
-
 		case acceptS := <-r.acceptChan:
 			accept := acceptS.(*menciusproto.Accept)
 			//got an Accept message
@@ -223,11 +260,18 @@ func (r *Replica) run() {
 			r.handleCommit(commit)
 			break
 
-		case prepareReplyS := <-r.prepareReplyChan:
-			prepareReply := prepareReplyS.(*menciusproto.PrepareReply)
-			//got a Prepare reply
-			dlog.Printf("Received PrepareReply for instance %d\n", prepareReply.Instance)
-			r.handlePrepareReply(prepareReply)
+		case revokeS := <-r.revokeChan:
+			revoke := revokeS.(*menciusproto.Revoke)
+			//got a Revoke message
+			dlog.Printf("Received Revoke from replica %d, for instances %d-%d\n", revoke.LeaderId, revoke.StartInstance, revoke.EndInstance)
+			r.handleRevoke(revoke)
+			break
+
+		case revokeReplyS := <-r.revokeReplyChan:
+			revokeReply := revokeReplyS.(*menciusproto.RevokeReply)
+			//got a Revoke reply
+			dlog.Printf("Received RevokeReply for instances from %d\n", revokeReply.StartInstance)
+			r.handleRevokeReply(revokeReply)
 			break
 
 		case acceptReplyS := <-r.acceptReplyChan:
@@ -247,8 +291,10 @@ func (r *Replica) run() {
 			} else {
 				r.noCommitFor = 0
 				lastSeenInstance = r.blockingInstance
+				r.prunePromises()
 			}
-			if r.noCommitFor >= 50+int(r.Id) && r.crtInstance >= r.blockingInstance+int32(r.N) {
+			r.checkRevocation()
+			if r.noCommitFor >= r.forceCommitAfter() && r.crtInstance >= r.blockingInstance+int32(r.N) {
 				r.noCommitFor = 0
 				dlog.Printf("Doing force commit\n")
 				r.forceCommit()
@@ -265,12 +311,19 @@ func (r *Replica) clock() {
 	}
 }
 
+func (r *Replica) fastClock() {
+	for !r.Shutdown {
+		time.Sleep(CLOCK)
+		r.fastClockChan <- true
+	}
+}
+
 func (r *Replica) makeUniqueBallot(ballot int32) int32 {
-	return (ballot << 4) | r.Id
+	return (ballot << BALLOT_ID_BITS) | r.Id
 }
 
 func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
-	return r.makeUniqueBallot((ballot >> 4) + 1)
+	return r.makeUniqueBallot((ballot >> BALLOT_ID_BITS) + 1)
 }
 
 var sk menciusproto.Skip
@@ -303,36 +356,9 @@ func (r *Replica) bcastSkip(startInstance int32, endInstance int32, exceptReplic
 	}
 }
 
-func (r *Replica) bcastPrepare(instance int32, ballot int32) {
-	defer func() {
-		if err := recover(); err != nil {
-			dlog.Println("Prepare bcast failed:", err)
-		}
-	}()
-	args := &menciusproto.Prepare{r.Id, instance, ballot}
-
-	n := r.N - 1
-	if r.Thrifty {
-		n = r.N >> 1
-	}
-	q := r.Id
-
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
-			break
-		}
-		if !r.Alive[q] {
-			continue
-		}
-		sent++
-		r.SendMsg(q, r.prepareRPC, args)
-	}
-}
-
 var ma menciusproto.Accept
 
-func (r *Replica) bcastAccept(instance int32, ballot int32, skip uint8, nbInstToSkip int32, command state.Command) {
+func (r *Replica) bcastAccept(instance int32, ballot int32, skip uint8, nbInstToSkip int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("Accept bcast failed:", err)
@@ -396,7 +422,7 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, skip uint8, nbInstTo
 
 var mc menciusproto.Commit
 
-func (r *Replica) bcastCommit(instance int32, skip uint8, nbInstToSkip int32, command state.Command) {
+func (r *Replica) bcastCommit(instance int32, skip uint8, nbInstToSkip int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			dlog.Println("Commit bcast failed:", err)
@@ -427,26 +453,83 @@ func (r *Replica) bcastCommit(instance int32, skip uint8, nbInstToSkip int32, co
 }
 
 func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	batchSize := r.batcher.Size(r.queued() + 1)
+
+	cmds := make([]state.Command, batchSize)
+	proposals := make([]*genericsmr.Propose, batchSize)
+	cmds[0] = propose.Command
+	proposals[0] = propose
+
+	for i := 1; i < batchSize; i++ {
+		prop := r.nextProposal()
+		cmds[i] = prop.Command
+		proposals[i] = prop
+	}
+	r.batcher.Record(batchSize, r.queued())
 
 	instNo := r.crtInstance
 	r.crtInstance += int32(r.N)
 
 	r.instanceSpace[instNo] = &Instance{false,
 		0,
-		&propose.Command,
+		cmds,
 		r.makeBallotLargerThan(0),
 		ACCEPTED,
-		&LeaderBookkeeping{propose, 0, 0, 0, 0}}
+		&LeaderBookkeeping{proposals, 0, 0, 0}}
 
 	r.recordInstanceMetadata(r.instanceSpace[instNo])
-	r.recordCommand(&propose.Command)
+	r.recordCommands(cmds)
 	r.sync()
 
-	r.bcastAccept(instNo, r.instanceSpace[instNo].ballot, FALSE, 0, propose.Command)
-	dlog.Printf("Choosing req. %d in instance %d\n", propose.CommandId, instNo)
+	r.bcastAccept(instNo, r.instanceSpace[instNo].ballot, FALSE, 0, cmds)
+	dlog.Printf("Choosing %d commands in instance %d\n", batchSize, instNo)
+}
+
+// requeue proposes again, in the next instances of this replica, the client
+// proposals of an instance where something else was chosen. They wait in a
+// local queue, as the event loop is the only reader of ProposeChan.
+func (r *Replica) requeue(inst *Instance) {
+	if inst.lb == nil {
+		return
+	}
+	r.pending = append(r.pending, inst.lb.clientProposals...)
+	inst.lb.clientProposals = nil
+}
+
+// queued counts the proposals waiting to be handled
+func (r *Replica) queued() int {
+	return len(r.pending) + len(r.ProposeChan)
+}
+
+// nextProposal takes the next waiting proposal, those put back first. There
+// must be one.
+func (r *Replica) nextProposal() *genericsmr.Propose {
+	if len(r.pending) > 0 {
+		prop := r.pending[0]
+		r.pending = r.pending[1:]
+		return prop
+	}
+	return <-r.ProposeChan
+}
+
+// replyCommitted tells the clients whose commands an instance holds that
+// they were committed
+func (r *Replica) replyCommitted(inst *Instance) {
+	for _, prop := range inst.lb.clientProposals {
+		dlog.Printf("Sending ACK for req. %d\n", prop.CommandId)
+		r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, prop.CommandId, state.NIL, prop.Timestamp}, prop.Reply)
+	}
 }
 
 func (r *Replica) handleSkip(skip *menciusproto.Skip) {
+	r.suspected[skip.LeaderId] = false
+	if inst := r.instanceSpace[skip.StartInstance]; inst != nil && (inst.status == COMMITTED || inst.status == EXECUTED) {
+		return
+	}
+	if b, _ := r.promisedBallot(skip.StartInstance); b >= 0 {
+		// too late, another replica took over these instances
+		return
+	}
 	r.instanceSpace[skip.StartInstance] = &Instance{true,
 		int(skip.EndInstance-skip.StartInstance)/r.N + 1,
 		nil,
@@ -456,45 +539,6 @@ func (r *Replica) handleSkip(skip *menciusproto.Skip) {
 	r.updateBlocking(skip.StartInstance)
 }
 
-func (r *Replica) handlePrepare(prepare *menciusproto.Prepare) {
-	inst := r.instanceSpace[prepare.Instance]
-
-	if inst == nil {
-		dlog.Println("Replying OK to null-instance Prepare")
-		r.replyPrepare(prepare.LeaderId, &menciusproto.PrepareReply{prepare.Instance,
-			TRUE,
-			-1,
-			FALSE,
-			0,
-			state.Command{state.NONE, 0, 0}})
-
-		r.instanceSpace[prepare.Instance] = &Instance{false,
-			0,
-			nil,
-			prepare.Ballot,
-			PREPARING,
-			nil}
-	} else {
-		ok := TRUE
-		if prepare.Ballot < inst.ballot {
-			ok = FALSE
-		}
-		if inst.command == nil {
-			inst.command = &state.Command{state.NONE, 0, 0}
-		}
-		skipped := FALSE
-		if inst.skipped {
-			skipped = TRUE
-		}
-		r.replyPrepare(prepare.LeaderId, &menciusproto.PrepareReply{prepare.Instance,
-			ok,
-			inst.ballot,
-			skipped,
-			int32(inst.nbInstSkipped),
-			*inst.command})
-	}
-}
-
 func (r *Replica) timerHelper(ds *DelayedSkip) {
 	time.Sleep(WAIT_BEFORE_SKIP_MS * 1000 * 1000)
 	r.delayedSkipChan <- ds
@@ -503,9 +547,25 @@ func (r *Replica) timerHelper(ds *DelayedSkip) {
 func (r *Replica) handleAccept(accept *menciusproto.Accept) {
 	flush := true
 	inst := r.instanceSpace[accept.Instance]
+	if r.owner(accept.Instance) == accept.LeaderId {
+		r.suspected[accept.LeaderId] = false
+	}
 
-	if inst != nil && inst.ballot > accept.Ballot {
-		r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, FALSE, inst.ballot, -1, -1})
+	if inst != nil && (inst.status == COMMITTED || inst.status == EXECUTED) && r.owner(accept.Instance) == accept.LeaderId && accept.Skip == FALSE {
+		if inst.skipped || inst.cmds == nil || !sameCommands(inst.cmds, accept.Command) {
+			// the owner missed that another replica took over
+			r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, FALSE, inst.ballot, accept.Instance, r.takenUpTo(accept.Instance)})
+			return
+		}
+	} else if inst == nil && accept.Instance < r.blockingInstance {
+		// inside a committed skip, whose promise may be pruned
+		r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, FALSE, -1, accept.Instance, r.takenUpTo(accept.Instance)})
+		return
+	} else if b, _ := r.promisedBallot(accept.Instance); b > accept.Ballot || (inst != nil && inst.ballot > accept.Ballot) {
+		if inst != nil && inst.ballot > b {
+			b = inst.ballot
+		}
+		r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, FALSE, b, -1, r.takenUpTo(accept.Instance)})
 		return
 	}
 
@@ -543,23 +603,24 @@ func (r *Replica) handleAccept(accept *menciusproto.Accept) {
 		}
 		r.instanceSpace[accept.Instance] = &Instance{skip,
 			int(accept.NbInstancesToSkip),
-			&accept.Command,
+			accept.Command,
 			accept.Ballot,
 			ACCEPTED,
 			nil}
 		r.recordInstanceMetadata(r.instanceSpace[accept.Instance])
-		r.recordCommand(&accept.Command)
+		r.recordCommands(accept.Command)
 		r.sync()
 
 		r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, TRUE, -1, skipStart, skipEnd})
 	} else {
 		if inst.status == COMMITTED || inst.status == EXECUTED {
-			if inst.command == nil {
-				inst.command = &accept.Command
+			if inst.cmds == nil {
+				inst.cmds = accept.Command
 			}
 			dlog.Printf("ATTENTION! Reordered Commit\n")
+			r.replyAccept(accept.LeaderId, &menciusproto.AcceptReply{accept.Instance, TRUE, accept.Ballot, skipStart, skipEnd})
 		} else {
-			inst.command = &accept.Command
+			inst.cmds = accept.Command
 			inst.ballot = accept.Ballot
 			inst.status = ACCEPTED
 			inst.skipped = false
@@ -615,84 +676,42 @@ func (r *Replica) handleCommit(commit *menciusproto.Commit) {
 			COMMITTED,
 			nil}
 	} else {
-		//inst.command = &commit.Command
+		//inst.cmds = commit.Command
 		inst.status = COMMITTED
 		inst.skipped = false
 		if commit.Skip == TRUE {
 			inst.skipped = true
 		}
 		inst.nbInstSkipped = int(commit.NbInstancesToSkip)
-		if inst.lb != nil && inst.lb.clientProposal != nil {
-			// try command in the next available instance
-			r.ProposeChan <- inst.lb.clientProposal
-			inst.lb.clientProposal = nil
+		if inst.lb != nil && !inst.skipped && !r.Dreply {
+			// another replica took over, and chose our value
+			r.replyCommitted(inst)
 		}
 	}
 
 	r.recordInstanceMetadata(r.instanceSpace[commit.Instance])
 
-	if commit.Instance%int32(r.N) == r.Id%int32(r.N) {
-		if r.crtInstance < commit.Instance+commit.NbInstancesToSkip*int32(r.N) {
-			r.crtInstance = commit.Instance + commit.NbInstancesToSkip*int32(r.N)
+	if r.owner(commit.Instance) == r.Id {
+		end := commit.Instance
+		if commit.Skip == TRUE {
+			end += (commit.NbInstancesToSkip - 1) * int32(r.N)
+			r.requeueSkipped(commit.Instance, end)
 		}
+		r.skipRevoked(end)
 	}
 
 	// Try to commit instances waiting for this one
 	r.updateBlocking(commit.Instance)
 }
 
-func (r *Replica) handlePrepareReply(preply *menciusproto.PrepareReply) {
-	dlog.Printf("PrepareReply for instance %d\n", preply.Instance)
-
-	inst := r.instanceSpace[preply.Instance]
-
-	if inst.status != PREPARING {
-		// we've moved on -- these are delayed replies, so just ignore
-		return
-	}
-
-	if preply.OK == TRUE {
-		inst.lb.prepareOKs++
-
-		if preply.Ballot > inst.lb.maxRecvBallot {
-			inst.command = &preply.Command
-			inst.skipped = false
-			if preply.Skip == TRUE {
-				inst.skipped = true
-			}
-			inst.nbInstSkipped = int(preply.NbInstancesToSkip)
-			inst.lb.maxRecvBallot = preply.Ballot
-		}
-
-		if inst.lb.prepareOKs+1 > r.N>>1 {
-			inst.status = ACCEPTED
-			inst.lb.nacks = 0
-			skip := FALSE
-			if inst.skipped {
-				skip = TRUE
-			}
-			r.bcastAccept(preply.Instance, inst.ballot, skip, int32(inst.nbInstSkipped), *inst.command)
-		}
-	} else {
-		// TODO: there is probably another active leader
-		inst.lb.nacks++
-		if preply.Ballot > inst.lb.maxRecvBallot {
-			inst.lb.maxRecvBallot = preply.Ballot
-		}
-		if inst.lb.nacks >= r.N>>1 && inst.lb != nil {
-			// TODO: better to wait a while
-			// some other replica is trying to commit skips for our instance
-			// increase ballot number and try again
-			inst.ballot = r.makeBallotLargerThan(inst.lb.maxRecvBallot)
-			r.bcastPrepare(preply.Instance, inst.ballot)
-		}
-	}
-}
-
 func (r *Replica) handleAcceptReply(areply *menciusproto.AcceptReply) {
 	dlog.Printf("AcceptReply for instance %d\n", areply.Instance)
 
 	inst := r.instanceSpace[areply.Instance]
+	if inst == nil || inst.lb == nil {
+		// delayed reply to a replica that was restarted
+		return
+	}
 
 	if areply.OK == TRUE {
 		inst.lb.acceptOKs++
@@ -722,22 +741,22 @@ func (r *Replica) handleAcceptReply(areply *menciusproto.AcceptReply) {
 			r.updateBlocking(areply.Instance)
 		}
 	} else {
-		// TODO: there is probably another active leader
 		inst.lb.nacks++
 		if areply.Ballot > inst.lb.maxRecvBallot {
 			inst.lb.maxRecvBallot = areply.Ballot
 		}
-		if (areply.Ballot&0x0F)%int32(r.N) == areply.Instance%int32(r.N) {
-			// the owner of the instance is trying to commit something, I should give up
+		if r.owner(areply.Instance) != r.Id {
+			// another replica is taking over the same instances, let it
+			return
 		}
-		if inst.lb.nacks >= r.N>>1 {
-			// TODO
-			if inst.lb.clientProposal != nil {
-				// I'm the owner of the instance, I'll try again with a higher ballot number
-				inst.ballot = r.makeBallotLargerThan(inst.lb.maxRecvBallot)
-				r.bcastPrepare(areply.Instance, inst.ballot)
-			}
+		// another replica took over this instance: propose in the next
+		// instances that are still ours
+		r.skipRevoked(areply.SkippedEndInstance)
+		if areply.SkippedStartInstance == areply.Instance && inst.status != COMMITTED && inst.status != EXECUTED {
+			// something else was chosen
+			r.requeue(inst)
 		}
+		// otherwise the Commit of the revoking replica tells what was chosen
 	}
 }
 
@@ -767,11 +786,9 @@ func (r *Replica) updateBlocking(instance int32) {
 				dlog.Printf("Am about to commit instance %d\n", r.blockingInstance)
 
 				inst.status = COMMITTED
-				if inst.lb.clientProposal != nil && !r.Dreply {
-					// give client the all clear
-					dlog.Printf("Sending ACK for req. %d\n", inst.lb.clientProposal.CommandId)
-					r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, inst.lb.clientProposal.CommandId, state.NIL, inst.lb.clientProposal.Timestamp},
-						inst.lb.clientProposal.Reply)
+				if !r.Dreply {
+					// give clients the all clear
+					r.replyCommitted(inst)
 				}
 				skip := FALSE
 				if inst.skipped {
@@ -781,7 +798,7 @@ func (r *Replica) updateBlocking(instance int32) {
 				r.recordInstanceMetadata(inst)
 				r.sync()
 
-				r.bcastCommit(r.blockingInstance, skip, int32(inst.nbInstSkipped), *inst.command)
+				r.bcastCommit(r.blockingInstance, skip, int32(inst.nbInstSkipped), inst.cmds)
 			} else if inst.status != COMMITTED && inst.status != EXECUTED {
 				return
 			}
@@ -824,12 +841,13 @@ func (r *Replica) executeCommands() {
 			}
 
 			if r.instanceSpace[i].status != COMMITTED {
-				if !r.instanceSpace[i].skipped {
-					confInst, present := conflicts[r.instanceSpace[i].command.K]
-					if present && r.instanceSpace[confInst].status != EXECUTED {
+				if !r.instanceSpace[i].skipped && r.instanceSpace[i].cmds != nil {
+					if r.waitsFor(conflicts, i, false) {
 						break
 					}
-					conflicts[r.instanceSpace[i].command.K] = i
+					for _, cmd := range r.instanceSpace[i].cmds {
+						conflicts[cmd.K] = i
+					}
 					jump = true
 					continue
 				} else {
@@ -846,20 +864,20 @@ func (r *Replica) executeCommands() {
 			}
 
 			inst := r.instanceSpace[i]
-			for inst.command == nil {
+			for inst.cmds == nil {
 				time.Sleep(1000 * 1000)
 			}
-			confInst, present := conflicts[inst.command.K]
-			if present && confInst < i && r.instanceSpace[confInst].status != EXECUTED && state.Conflict(r.instanceSpace[confInst].command, inst.command) {
+			if r.waitsFor(conflicts, i, true) {
 				break
 			}
 
-			inst.command.Execute(r.State)
-
-			if r.Dreply && inst.lb != nil && inst.lb.clientProposal != nil {
-				dlog.Printf("Sending ACK for req. %d\n", inst.lb.clientProposal.CommandId)
-				r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, inst.lb.clientProposal.CommandId, state.NIL, inst.lb.clientProposal.Timestamp},
-					inst.lb.clientProposal.Reply)
+			for j := 0; j < len(inst.cmds); j++ {
+				val := inst.cmds[j].Execute(r.State)
+				if r.Dreply && inst.lb != nil && j < len(inst.lb.clientProposals) {
+					prop := inst.lb.clientProposals[j]
+					dlog.Printf("Sending ACK for req. %d\n", prop.CommandId)
+					r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, prop.CommandId, val, prop.Timestamp}, prop.Reply)
+				}
 			}
 			inst.status = EXECUTED
 
@@ -875,23 +893,58 @@ func (r *Replica) executeCommands() {
 	}
 }
 
+// waitsFor tells whether the commands of instance i must wait for those of
+// an earlier instance that is not executed yet, among the instances the
+// executor jumped over. Committed commands only wait for conflicting ones.
+func (r *Replica) waitsFor(conflicts map[state.Key]int32, i int32, committed bool) bool {
+	cmds := r.instanceSpace[i].cmds
+	for j := range cmds {
+		confInst, present := conflicts[cmds[j].K]
+		if !present || r.instanceSpace[confInst].status == EXECUTED {
+			continue
+		}
+		if !committed || (confInst < i && state.ConflictBatch(r.instanceSpace[confInst].cmds, cmds)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameCommands tells whether two batches hold the same commands
+func sameCommands(a []state.Command, b []state.Command) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// forceCommitAfter is how many ticks without commits a replica waits before
+// it takes over the instances that block them. Replicas wait for different
+// times, so that they rarely compete, and for less time when the owner was
+// already revoked.
+func (r *Replica) forceCommitAfter() int {
+	if r.suspected[r.owner(r.blockingInstance)] {
+		return 2 + int(r.Id)
+	}
+	return 50 + int(r.Id)
+}
+
 func (r *Replica) forceCommit() {
 	//find what is the oldest un-initialized instance and try to take over
 	problemInstance := r.blockingInstance
-
-	//try to take over the problem instance
-	if int(problemInstance)%r.N == int(r.Id+1)%r.N {
-		log.Println("Replica", r.Id, "Trying to take over instance", problemInstance)
-		if r.instanceSpace[problemInstance] == nil {
-			r.instanceSpace[problemInstance] = &Instance{true,
-				NB_INST_TO_SKIP,
-				&state.Command{state.NONE, 0, 0},
-				r.makeUniqueBallot(1),
-				PREPARING,
-				&LeaderBookkeeping{nil, 0, 0, 0, 0}}
-			r.bcastPrepare(problemInstance, r.instanceSpace[problemInstance].ballot)
-		} else {
-			log.Println("Not nil")
-		}
+	if r.revocation != nil {
+		return
+	}
+	if inst := r.instanceSpace[problemInstance]; r.owner(problemInstance) == r.Id && inst != nil && (inst.lb == nil || inst.lb.nacks == 0) {
+		// still in flight; a replica takes over its own instances only
+		// after it missed how another replica took them over
+		return
 	}
+	log.Println("Replica", r.Id, "Trying to take over instance", problemInstance)
+	r.startRevocation(problemInstance)
 }
@@ -0,0 +1,245 @@
+package mencius
+
+import (
+	"bytes"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/menciusproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+// testNet runs the Mencius handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int, maxBatch int) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, false, maxBatch, 0)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.skipRPC:        new(menciusproto.Skip),
+		r.acceptRPC:      new(menciusproto.Accept),
+		r.acceptReplyRPC: new(menciusproto.AcceptReply),
+		r.commitRPC:      new(menciusproto.Commit),
+		r.revokeRPC:      new(menciusproto.Revoke),
+		r.revokeReplyRPC: new(menciusproto.RevokeReply),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *menciusproto.Skip:
+			r.handleSkip(m)
+		case *menciusproto.Accept:
+			r.handleAccept(m)
+		case *menciusproto.AcceptReply:
+			r.handleAcceptReply(m)
+		case *menciusproto.Commit:
+			r.handleCommit(m)
+		case *menciusproto.Revoke:
+			r.handleRevoke(m)
+		case *menciusproto.RevokeReply:
+			r.handleRevokeReply(m)
+		}
+	}
+	// proposes again what the replicas requeued
+	net.Step = func() bool {
+		ran := false
+		for id, r := range net.replicas {
+			for !net.Down[id] && r.queued() > 0 {
+				r.handlePropose(r.nextProposal())
+				ran = true
+			}
+		}
+		return ran
+	}
+	return net
+}
+
+// propose hands a PUT to a replica, and returns where its reply goes
+func (net *testNet) propose(id int, key state.Key, val state.Value) *bytes.Buffer {
+	propose, reply := smrtest.Propose(int32(val), state.Command{state.PUT, key, val})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+// committed tells whether a replica committed a value in some instance, and
+// which
+func committed(r *Replica, val state.Value) (int32, bool) {
+	for i := int32(0); i < r.blockingInstance; i++ {
+		inst := r.instanceSpace[i]
+		if inst != nil && inst.status == COMMITTED && !inst.skipped && inst.cmds != nil && inst.cmds[0].V == val {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func TestRevokeFailedReplica(t *testing.T) {
+	net := newTestNet(t, 3, 1)
+	r0, r1, r2 := net.replicas[0], net.replicas[1], net.replicas[2]
+
+	net.propose(0, 1, 10)
+	net.DeliverAll()
+
+	// replica 1 fails while its instance 1 blocks the commit of instance 2
+	net.Down[1] = true
+	reply := net.propose(2, 2, 20)
+	net.DeliverAll()
+	if _, ok := committed(r2, 20); ok {
+		t.Fatalf("instance 2 committed before instance 1")
+	}
+
+	r0.forceCommit()
+	net.DeliverAll()
+	for _, r := range []*Replica{r0, r2} {
+		if i, ok := committed(r, 20); !ok || i != 2 {
+			t.Fatalf("replica %d has not committed instance 2 after the revocation", r.Id)
+		}
+	}
+	smrtest.CheckReply(t, reply, 20, TRUE, state.NIL)
+
+	// the next instances of replica 1 do not block commits either
+	net.propose(2, 3, 30)
+	net.propose(0, 4, 40)
+	net.DeliverAll()
+	if _, ok := committed(r0, 40); !ok {
+		t.Fatalf("replica 0 is blocked by the revoked instances")
+	}
+
+	// replica 1 comes back: it learns its instances were taken over, and
+	// catches up on the commits it missed
+	net.Down[1] = false
+	reply = net.propose(1, 5, 50)
+	net.DeliverAll()
+	for i := 0; i < 10; i++ {
+		if _, ok := committed(r1, 50); ok {
+			break
+		}
+		r1.forceCommit()
+		net.DeliverAll()
+	}
+	for _, r := range net.replicas {
+		if i, ok := committed(r, 50); !ok || i <= r0.promises[1][0].end {
+			t.Fatalf("replica %d has not committed the proposal of replica 1 past the revoked instances", r.Id)
+		}
+	}
+	for _, val := range []state.Value{10, 20, 30, 40} {
+		if _, ok := committed(r1, val); !ok {
+			t.Fatalf("replica 1 has not caught up on the commit of %d", val)
+		}
+	}
+	smrtest.CheckReply(t, reply, 50, TRUE, state.NIL)
+}
+
+func TestStaleRevocation(t *testing.T) {
+	net := newTestNet(t, 3, 1)
+	r0, r2 := net.replicas[0], net.replicas[2]
+
+	net.propose(0, 1, 10)
+	net.DeliverAll()
+
+	// two replicas try to take over the instances of replica 1 at once
+	net.Down[1] = true
+	r0.forceCommit()
+	r2.forceCommit()
+	net.DeliverAll()
+
+	if r0.revocation != nil || r2.revocation != nil {
+		t.Fatalf("a revocation is still running")
+	}
+	// whichever won, both agree on what instance 1 is
+	for _, r := range []*Replica{r0, r2} {
+		inst := r.instanceSpace[1]
+		if inst == nil || inst.status != COMMITTED || !inst.skipped {
+			t.Fatalf("replica %d has not committed a skip in instance 1", r.Id)
+		}
+	}
+}
+
+func TestPrunePromises(t *testing.T) {
+	net := newTestNet(t, 3, 1)
+	r0, r1, r2 := net.replicas[0], net.replicas[1], net.replicas[2]
+
+	net.propose(0, 1, 10)
+	net.Down[1] = true
+	net.propose(2, 2, 20)
+	net.DeliverAll()
+	r0.forceCommit()
+	net.DeliverAll()
+	end := r0.promises[1][0].end
+
+	// the promise is kept until replica 2 proposes past the revoked range, and
+	// replica 0 skips up to there, so that the whole range is committed
+	r0.prunePromises()
+	if len(r0.promises[1]) != 1 {
+		t.Fatalf("replica 0 dropped the promise for a range still in use")
+	}
+	for r0.crtInstance <= end {
+		net.propose(2, 3, 30)
+		net.DeliverAll()
+	}
+	for _, r := range []*Replica{r0, r2} {
+		r.prunePromises()
+		if len(r.promises[1]) != 0 {
+			t.Fatalf("replica %d still keeps the promise for the committed range", r.Id)
+		}
+	}
+
+	// replica 1 comes back, and its Accepts inside the skip, past its first
+	// instance, are still refused
+	net.Down[1] = false
+	r1.crtInstance = 4
+	net.propose(1, 5, 50)
+	net.DeliverAll()
+	for _, r := range []*Replica{r0, r2} {
+		for i := int32(4); i <= end; i += 3 {
+			if r.instanceSpace[i] != nil {
+				t.Fatalf("replica %d accepted %v in the committed instance %d", r.Id, r.instanceSpace[i].cmds, i)
+			}
+		}
+		if inst := r.instanceSpace[end+3]; inst == nil || inst.cmds == nil || inst.cmds[0].V != 50 {
+			t.Fatalf("replica %d did not accept the proposal of replica 1 past the committed range", r.Id)
+		}
+	}
+}
+
+func TestRequeueWithFullProposeChan(t *testing.T) {
+	net := newTestNet(t, 3, 1)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	net.propose(0, 1, 10)
+	net.Down[1] = true
+	net.propose(2, 2, 20)
+	net.DeliverAll()
+	r0.forceCommit()
+	net.DeliverAll()
+
+	// replica 1 comes back and proposes in a revoked instance, while its
+	// clients keep ProposeChan full
+	net.Down[1] = false
+	net.propose(1, 5, 50)
+	propose, _ := smrtest.Propose(60, state.Command{state.PUT, 6, 60})
+	for len(r1.ProposeChan) < cap(r1.ProposeChan) {
+		r1.ProposeChan <- propose
+	}
+	for i := 0; i < 3 && len(r1.pending) == 0; i++ {
+		net.Deliver(1, 0)
+		net.Deliver(1, 2)
+		net.Deliver(0, 1)
+		net.Deliver(2, 1)
+	}
+	if len(r1.pending) != 1 || r1.pending[0].CommandId != 50 {
+		t.Fatalf("replica 1 did not put its proposal back")
+	}
+	if r1.nextProposal().CommandId != 50 || r1.queued() != cap(r1.ProposeChan) {
+		t.Fatalf("the proposal put back is not handled first")
+	}
+}
@@ -10,28 +10,13 @@ type Skip struct {
 	EndInstance   int32
 }
 
-type Prepare struct {
-	LeaderId int32
-	Instance int32
-	Ballot   int32
-}
-
-type PrepareReply struct {
-	Instance          int32
-	OK                uint8
-	Ballot            int32
-	Skip              uint8
-	NbInstancesToSkip int32
-	Command           state.Command
-}
-
 type Accept struct {
 	LeaderId          int32
 	Instance          int32
 	Ballot            int32
 	Skip              uint8
 	NbInstancesToSkip int32
-	Command           state.Command
+	Command           []state.Command
 }
 
 type AcceptReply struct {
@@ -49,3 +34,30 @@ type Commit struct {
 	NbInstancesToSkip int32
 	//Command state.Command
 }
+
+// A Revoke takes over the instances of a replica suspected to have failed,
+// from StartInstance to EndInstance, with a ballot higher than the owner's
+type Revoke struct {
+	LeaderId      int32
+	StartInstance int32
+	EndInstance   int32
+	Ballot        int32
+}
+
+// A promise lists the instances of the range that the acceptor has accepted
+// a value or a skip for
+type RevokeReply struct {
+	AcceptorId    int32
+	StartInstance int32
+	OK            uint8
+	Ballot        int32 // the ballot promised, or the higher one that rejects the Revoke
+	Entries       []RevokeEntry
+}
+
+type RevokeEntry struct {
+	Instance          int32
+	Ballot            int32
+	Skip              uint8
+	NbInstancesToSkip int32
+	Command           []state.Command
+}
@@ -1,11 +1,19 @@
 package menciusproto
 
 import (
+	"bufio"
+	"encoding/binary"
 	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/state"
 	"io"
 	"sync"
 )
 
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
 func (t *Skip) New() fastrpc.Serializable {
 	return new(Skip)
 }
@@ -77,26 +85,26 @@ func (t *Skip) Unmarshal(wire io.Reader) error {
 	return nil
 }
 
-func (t *Prepare) New() fastrpc.Serializable {
-	return new(Prepare)
+func (t *Accept) New() fastrpc.Serializable {
+	return new(Accept)
 }
-func (t *Prepare) BinarySize() (nbytes int, sizeKnown bool) {
-	return 12, true
+func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
 }
 
-type PrepareCache struct {
+type AcceptCache struct {
 	mu    sync.Mutex
-	cache []*Prepare
+	cache []*Accept
 }
 
-func NewPrepareCache() *PrepareCache {
-	c := &PrepareCache{}
-	c.cache = make([]*Prepare, 0)
+func NewAcceptCache() *AcceptCache {
+	c := &AcceptCache{}
+	c.cache = make([]*Accept, 0)
 	return c
 }
 
-func (p *PrepareCache) Get() *Prepare {
-	var t *Prepare
+func (p *AcceptCache) Get() *Accept {
+	var t *Accept
 	p.mu.Lock()
 	if len(p.cache) > 0 {
 		t = p.cache[len(p.cache)-1]
@@ -104,19 +112,19 @@ func (p *PrepareCache) Get() *Prepare {
 	}
 	p.mu.Unlock()
 	if t == nil {
-		t = &Prepare{}
+		t = &Accept{}
 	}
 	return t
 }
-func (p *PrepareCache) Put(t *Prepare) {
+func (p *AcceptCache) Put(t *Accept) {
 	p.mu.Lock()
 	p.cache = append(p.cache, t)
 	p.mu.Unlock()
 }
-func (t *Prepare) Marshal(wire io.Writer) {
-	var b [12]byte
+func (t *Accept) Marshal(wire io.Writer) {
+	var b [17]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:17]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -132,42 +140,71 @@ func (t *Prepare) Marshal(wire io.Writer) {
 	bs[9] = byte(tmp32 >> 8)
 	bs[10] = byte(tmp32 >> 16)
 	bs[11] = byte(tmp32 >> 24)
+	bs[12] = byte(t.Skip)
+	tmp32 = t.NbInstancesToSkip
+	bs[13] = byte(tmp32)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32 >> 16)
+	bs[16] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Command))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Marshal(wire)
+	}
 }
 
-func (t *Prepare) Unmarshal(wire io.Reader) error {
-	var b [12]byte
+func (t *Accept) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [17]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:17]
+	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
 		return err
 	}
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.Skip = uint8(bs[12])
+	t.NbInstancesToSkip = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Command = make([]state.Command, alen1)
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Unmarshal(wire)
+	}
 	return nil
 }
 
-func (t *PrepareReply) New() fastrpc.Serializable {
-	return new(PrepareReply)
+func (t *AcceptReply) New() fastrpc.Serializable {
+	return new(AcceptReply)
 }
-func (t *PrepareReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 0, false
+func (t *AcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 17, true
 }
 
-type PrepareReplyCache struct {
+type AcceptReplyCache struct {
 	mu    sync.Mutex
-	cache []*PrepareReply
+	cache []*AcceptReply
 }
 
-func NewPrepareReplyCache() *PrepareReplyCache {
-	c := &PrepareReplyCache{}
-	c.cache = make([]*PrepareReply, 0)
+func NewAcceptReplyCache() *AcceptReplyCache {
+	c := &AcceptReplyCache{}
+	c.cache = make([]*AcceptReply, 0)
 	return c
 }
 
-func (p *PrepareReplyCache) Get() *PrepareReply {
-	var t *PrepareReply
+func (p *AcceptReplyCache) Get() *AcceptReply {
+	var t *AcceptReply
 	p.mu.Lock()
 	if len(p.cache) > 0 {
 		t = p.cache[len(p.cache)-1]
@@ -175,19 +212,19 @@ func (p *PrepareReplyCache) Get() *PrepareReply {
 	}
 	p.mu.Unlock()
 	if t == nil {
-		t = &PrepareReply{}
+		t = &AcceptReply{}
 	}
 	return t
 }
-func (p *PrepareReplyCache) Put(t *PrepareReply) {
+func (p *AcceptReplyCache) Put(t *AcceptReply) {
 	p.mu.Lock()
 	p.cache = append(p.cache, t)
 	p.mu.Unlock()
 }
-func (t *PrepareReply) Marshal(wire io.Writer) {
-	var b [14]byte
+func (t *AcceptReply) Marshal(wire io.Writer) {
+	var b [17]byte
 	var bs []byte
-	bs = b[:14]
+	bs = b[:17]
 	tmp32 := t.Instance
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -199,52 +236,54 @@ func (t *PrepareReply) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp32 >> 8)
 	bs[7] = byte(tmp32 >> 16)
 	bs[8] = byte(tmp32 >> 24)
-	bs[9] = byte(t.Skip)
-	tmp32 = t.NbInstancesToSkip
-	bs[10] = byte(tmp32)
-	bs[11] = byte(tmp32 >> 8)
-	bs[12] = byte(tmp32 >> 16)
-	bs[13] = byte(tmp32 >> 24)
+	tmp32 = t.SkippedStartInstance
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	tmp32 = t.SkippedEndInstance
+	bs[13] = byte(tmp32)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32 >> 16)
+	bs[16] = byte(tmp32 >> 24)
 	wire.Write(bs)
-	t.Command.Marshal(wire)
 }
 
-func (t *PrepareReply) Unmarshal(wire io.Reader) error {
-	var b [14]byte
+func (t *AcceptReply) Unmarshal(wire io.Reader) error {
+	var b [17]byte
 	var bs []byte
-	bs = b[:14]
-	if _, err := io.ReadAtLeast(wire, bs, 14); err != nil {
+	bs = b[:17]
+	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
 		return err
 	}
 	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.OK = uint8(bs[4])
 	t.Ballot = int32((uint32(bs[5]) | (uint32(bs[6]) << 8) | (uint32(bs[7]) << 16) | (uint32(bs[8]) << 24)))
-	t.Skip = uint8(bs[9])
-	t.NbInstancesToSkip = int32((uint32(bs[10]) | (uint32(bs[11]) << 8) | (uint32(bs[12]) << 16) | (uint32(bs[13]) << 24)))
-	t.Command.Unmarshal(wire)
+	t.SkippedStartInstance = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	t.SkippedEndInstance = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
 	return nil
 }
 
-func (t *Accept) New() fastrpc.Serializable {
-	return new(Accept)
+func (t *Commit) New() fastrpc.Serializable {
+	return new(Commit)
 }
-func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
-	return 0, false
+func (t *Commit) BinarySize() (nbytes int, sizeKnown bool) {
+	return 13, true
 }
 
-type AcceptCache struct {
+type CommitCache struct {
 	mu    sync.Mutex
-	cache []*Accept
+	cache []*Commit
 }
 
-func NewAcceptCache() *AcceptCache {
-	c := &AcceptCache{}
-	c.cache = make([]*Accept, 0)
+func NewCommitCache() *CommitCache {
+	c := &CommitCache{}
+	c.cache = make([]*Commit, 0)
 	return c
 }
 
-func (p *AcceptCache) Get() *Accept {
-	var t *Accept
+func (p *CommitCache) Get() *Commit {
+	var t *Commit
 	p.mu.Lock()
 	if len(p.cache) > 0 {
 		t = p.cache[len(p.cache)-1]
@@ -252,19 +291,19 @@ func (p *AcceptCache) Get() *Accept {
 	}
 	p.mu.Unlock()
 	if t == nil {
-		t = &Accept{}
+		t = &Commit{}
 	}
 	return t
 }
-func (p *AcceptCache) Put(t *Accept) {
+func (p *CommitCache) Put(t *Commit) {
 	p.mu.Lock()
 	p.cache = append(p.cache, t)
 	p.mu.Unlock()
 }
-func (t *Accept) Marshal(wire io.Writer) {
-	var b [17]byte
+func (t *Commit) Marshal(wire io.Writer) {
+	var b [13]byte
 	var bs []byte
-	bs = b[:17]
+	bs = b[:13]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
@@ -275,57 +314,49 @@ func (t *Accept) Marshal(wire io.Writer) {
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
 	bs[7] = byte(tmp32 >> 24)
-	tmp32 = t.Ballot
-	bs[8] = byte(tmp32)
-	bs[9] = byte(tmp32 >> 8)
-	bs[10] = byte(tmp32 >> 16)
-	bs[11] = byte(tmp32 >> 24)
-	bs[12] = byte(t.Skip)
+	bs[8] = byte(t.Skip)
 	tmp32 = t.NbInstancesToSkip
-	bs[13] = byte(tmp32)
-	bs[14] = byte(tmp32 >> 8)
-	bs[15] = byte(tmp32 >> 16)
-	bs[16] = byte(tmp32 >> 24)
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
 	wire.Write(bs)
-	t.Command.Marshal(wire)
 }
 
-func (t *Accept) Unmarshal(wire io.Reader) error {
-	var b [17]byte
+func (t *Commit) Unmarshal(wire io.Reader) error {
+	var b [13]byte
 	var bs []byte
-	bs = b[:17]
-	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	t.Skip = uint8(bs[12])
-	t.NbInstancesToSkip = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
-	t.Command.Unmarshal(wire)
+	t.Skip = uint8(bs[8])
+	t.NbInstancesToSkip = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
 	return nil
 }
 
-func (t *AcceptReply) New() fastrpc.Serializable {
-	return new(AcceptReply)
+func (t *Revoke) New() fastrpc.Serializable {
+	return new(Revoke)
 }
-func (t *AcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 17, true
+func (t *Revoke) BinarySize() (nbytes int, sizeKnown bool) {
+	return 16, true
 }
 
-type AcceptReplyCache struct {
+type RevokeCache struct {
 	mu    sync.Mutex
-	cache []*AcceptReply
+	cache []*Revoke
 }
 
-func NewAcceptReplyCache() *AcceptReplyCache {
-	c := &AcceptReplyCache{}
-	c.cache = make([]*AcceptReply, 0)
+func NewRevokeCache() *RevokeCache {
+	c := &RevokeCache{}
+	c.cache = make([]*Revoke, 0)
 	return c
 }
 
-func (p *AcceptReplyCache) Get() *AcceptReply {
-	var t *AcceptReply
+func (p *RevokeCache) Get() *Revoke {
+	var t *Revoke
 	p.mu.Lock()
 	if len(p.cache) > 0 {
 		t = p.cache[len(p.cache)-1]
@@ -333,78 +364,76 @@ func (p *AcceptReplyCache) Get() *AcceptReply {
 	}
 	p.mu.Unlock()
 	if t == nil {
-		t = &AcceptReply{}
+		t = &Revoke{}
 	}
 	return t
 }
-func (p *AcceptReplyCache) Put(t *AcceptReply) {
+func (p *RevokeCache) Put(t *Revoke) {
 	p.mu.Lock()
 	p.cache = append(p.cache, t)
 	p.mu.Unlock()
 }
-func (t *AcceptReply) Marshal(wire io.Writer) {
-	var b [17]byte
+func (t *Revoke) Marshal(wire io.Writer) {
+	var b [16]byte
 	var bs []byte
-	bs = b[:17]
-	tmp32 := t.Instance
+	bs = b[:16]
+	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	bs[4] = byte(t.OK)
+	tmp32 = t.StartInstance
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.EndInstance
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
 	tmp32 = t.Ballot
-	bs[5] = byte(tmp32)
-	bs[6] = byte(tmp32 >> 8)
-	bs[7] = byte(tmp32 >> 16)
-	bs[8] = byte(tmp32 >> 24)
-	tmp32 = t.SkippedStartInstance
-	bs[9] = byte(tmp32)
-	bs[10] = byte(tmp32 >> 8)
-	bs[11] = byte(tmp32 >> 16)
-	bs[12] = byte(tmp32 >> 24)
-	tmp32 = t.SkippedEndInstance
-	bs[13] = byte(tmp32)
-	bs[14] = byte(tmp32 >> 8)
-	bs[15] = byte(tmp32 >> 16)
-	bs[16] = byte(tmp32 >> 24)
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
 	wire.Write(bs)
 }
 
-func (t *AcceptReply) Unmarshal(wire io.Reader) error {
-	var b [17]byte
+func (t *Revoke) Unmarshal(wire io.Reader) error {
+	var b [16]byte
 	var bs []byte
-	bs = b[:17]
-	if _, err := io.ReadAtLeast(wire, bs, 17); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
-	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.OK = uint8(bs[4])
-	t.Ballot = int32((uint32(bs[5]) | (uint32(bs[6]) << 8) | (uint32(bs[7]) << 16) | (uint32(bs[8]) << 24)))
-	t.SkippedStartInstance = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
-	t.SkippedEndInstance = int32((uint32(bs[13]) | (uint32(bs[14]) << 8) | (uint32(bs[15]) << 16) | (uint32(bs[16]) << 24)))
+	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.StartInstance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.EndInstance = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.Ballot = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	return nil
 }
 
-func (t *Commit) New() fastrpc.Serializable {
-	return new(Commit)
+func (t *RevokeReply) New() fastrpc.Serializable {
+	return new(RevokeReply)
 }
-func (t *Commit) BinarySize() (nbytes int, sizeKnown bool) {
-	return 13, true
+func (t *RevokeReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
 }
 
-type CommitCache struct {
+type RevokeReplyCache struct {
 	mu    sync.Mutex
-	cache []*Commit
+	cache []*RevokeReply
 }
 
-func NewCommitCache() *CommitCache {
-	c := &CommitCache{}
-	c.cache = make([]*Commit, 0)
+func NewRevokeReplyCache() *RevokeReplyCache {
+	c := &RevokeReplyCache{}
+	c.cache = make([]*RevokeReply, 0)
 	return c
 }
 
-func (p *CommitCache) Get() *Commit {
-	var t *Commit
+func (p *RevokeReplyCache) Get() *RevokeReply {
+	var t *RevokeReply
 	p.mu.Lock()
 	if len(p.cache) > 0 {
 		t = p.cache[len(p.cache)-1]
@@ -412,25 +441,85 @@ func (p *CommitCache) Get() *Commit {
 	}
 	p.mu.Unlock()
 	if t == nil {
-		t = &Commit{}
+		t = &RevokeReply{}
 	}
 	return t
 }
-func (p *CommitCache) Put(t *Commit) {
+func (p *RevokeReplyCache) Put(t *RevokeReply) {
 	p.mu.Lock()
 	p.cache = append(p.cache, t)
 	p.mu.Unlock()
 }
-func (t *Commit) Marshal(wire io.Writer) {
+func (t *RevokeReply) Marshal(wire io.Writer) {
 	var b [13]byte
 	var bs []byte
 	bs = b[:13]
-	tmp32 := t.LeaderId
+	tmp32 := t.AcceptorId
 	bs[0] = byte(tmp32)
 	bs[1] = byte(tmp32 >> 8)
 	bs[2] = byte(tmp32 >> 16)
 	bs[3] = byte(tmp32 >> 24)
-	tmp32 = t.Instance
+	tmp32 = t.StartInstance
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Entries))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Entries[i].Marshal(wire)
+	}
+}
+
+func (t *RevokeReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.AcceptorId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.StartInstance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]RevokeEntry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Entries[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *RevokeEntry) Marshal(wire io.Writer) {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	tmp32 := t.Instance
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.Ballot
 	bs[4] = byte(tmp32)
 	bs[5] = byte(tmp32 >> 8)
 	bs[6] = byte(tmp32 >> 16)
@@ -442,18 +531,39 @@ func (t *Commit) Marshal(wire io.Writer) {
 	bs[11] = byte(tmp32 >> 16)
 	bs[12] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Command))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Marshal(wire)
+	}
 }
 
-func (t *Commit) Unmarshal(wire io.Reader) error {
+func (t *RevokeEntry) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
 	var b [13]byte
 	var bs []byte
 	bs = b[:13]
 	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
-	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.Ballot = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Skip = uint8(bs[8])
 	t.NbInstancesToSkip = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Command = make([]state.Command, alen1)
+	for i := int64(0); i < alen1; i++ {
+		t.Command[i].Unmarshal(wire)
+	}
 	return nil
 }
@@ -0,0 +1,332 @@
+package paxos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+// testNet runs the Paxos handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	t        *testing.T
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int, leases bool) *testNet {
+	net := &testNet{nil, t, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, false, false, false, leases, false, 1, 0, 0)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.prepareRPC:      new(paxosproto.Prepare),
+		r.prepareReplyRPC: new(paxosproto.PrepareReply),
+		r.acceptRPC:       new(paxosproto.Accept),
+		r.acceptReplyRPC:  new(paxosproto.AcceptReply),
+		r.commitRPC:       new(paxosproto.Commit),
+		r.commitShortRPC:  new(paxosproto.CommitShort),
+		r.readRPC:         new(paxosproto.Read),
+		r.readReplyRPC:    new(paxosproto.ReadReply),
+		r.forwardRPC:      new(paxosproto.Forward),
+		r.forwardReplyRPC: new(paxosproto.ForwardReply),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *paxosproto.Prepare:
+			r.handlePrepare(m)
+		case *paxosproto.PrepareReply:
+			r.handlePrepareReply(m)
+		case *paxosproto.Accept:
+			r.handleAccept(m)
+		case *paxosproto.AcceptReply:
+			r.handleAcceptReply(m)
+		case *paxosproto.Commit:
+			r.handleCommit(m)
+		case *paxosproto.CommitShort:
+			r.handleCommitShort(m)
+		case *paxosproto.Read:
+			r.handleRead(m)
+		case *paxosproto.ReadReply:
+			r.handleReadReply(m)
+		case *paxosproto.Forward:
+			r.handleForward(m)
+		case *paxosproto.ForwardReply:
+			r.handleForwardReply(m)
+		}
+	}
+	net.Step = net.runQueues
+	return net
+}
+
+// runQueues does what the event loops do with the proposals queued at each
+// live replica, and the replies it has to send to forwarded proposals
+func (net *testNet) runQueues() bool {
+	ran := false
+	for id, r := range net.replicas {
+		for !net.Down[id] && (r.queued() > 0 || len(r.forwardedReplyChan) > 0) {
+			ran = true
+			if r.queued() > 0 {
+				r.handlePropose(r.nextProposal())
+			} else {
+				<-r.forwardedReplyChan
+				r.sendForwardedReplies()
+			}
+		}
+	}
+	return ran
+}
+
+// propose hands a PUT to a replica, and returns where its reply goes
+func (net *testNet) propose(id int, key state.Key, val state.Value) *bytes.Buffer {
+	propose, reply := smrtest.Propose(int32(val), state.Command{state.PUT, key, val})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+// get hands a GET to a replica, and returns where its reply goes
+func (net *testNet) get(id int, key state.Key) *bytes.Buffer {
+	propose, reply := smrtest.Propose(0, state.Command{state.GET, key, 0})
+	net.replicas[id].handlePropose(propose)
+	return reply
+}
+
+// checkCommitted fails unless every live replica has committed the instance
+// with the given commands
+func (net *testNet) checkCommitted(instance int32, vals ...state.Value) {
+	for id, r := range net.replicas {
+		if net.Down[id] {
+			continue
+		}
+		inst := r.instanceSpace.get(instance)
+		if inst == nil || inst.status != COMMITTED || inst.cmds == nil {
+			net.t.Fatalf("replica %d has not committed instance %d", id, instance)
+		}
+		if len(inst.cmds) != len(vals) {
+			net.t.Fatalf("replica %d committed %v in instance %d, want values %v", id, inst.cmds, instance, vals)
+		}
+		for i, cmd := range inst.cmds {
+			if cmd.V != vals[i] {
+				net.t.Fatalf("replica %d committed %v in instance %d, want values %v", id, inst.cmds, instance, vals)
+			}
+		}
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0, r1, r2 := net.replicas[0], net.replicas[1], net.replicas[2]
+
+	r0.startCampaign()
+	net.DeliverAll()
+	if !r0.IsLeader || r1.leader() != 0 || r2.leader() != 0 {
+		t.Fatalf("replica 0 did not become the leader")
+	}
+	net.propose(0, 1, 10)
+	net.DeliverAll()
+	net.checkCommitted(0, 10)
+
+	// instance 1 is lost, instance 2 is only accepted by replica 1
+	net.propose(0, 1, 11)
+	net.Drop(0, 1)
+	net.Drop(0, 2)
+	net.propose(0, 1, 12)
+	net.Deliver(0, 1)
+	net.Crash(0)
+
+	// followers redirect clients to the leader they know of
+	reply := net.propose(1, 1, 13)
+	var preply genericsmrproto.ProposeReplyTS
+	if err := preply.Unmarshal(reply); err != nil {
+		t.Fatal(err)
+	}
+	if preply.OK != FALSE || preply.Value != 0 {
+		t.Fatalf("replica 1 answered a proposal with %+v, want a redirection to 0", preply)
+	}
+
+	r2.startCampaign()
+	net.DeliverAll()
+	if !r2.IsLeader || r1.leader() != 2 {
+		t.Fatalf("replica 2 did not take over")
+	}
+	net.checkCommitted(1)
+	net.checkCommitted(2, 12)
+
+	net.propose(2, 1, 14)
+	net.DeliverAll()
+	net.checkCommitted(3, 14)
+
+	// the old leader steps down when its Accepts are refused
+	net.Down[0] = false
+	net.propose(0, 1, 15)
+	net.DeliverAll()
+	if r0.IsLeader || r0.leader() != 2 {
+		t.Fatalf("replica 0 did not step down")
+	}
+	reply = net.propose(0, 1, 16)
+	if err := preply.Unmarshal(reply); err != nil {
+		t.Fatal(err)
+	}
+	if preply.OK != FALSE || preply.Value != 2 {
+		t.Fatalf("replica 0 answered a proposal with %+v, want a redirection to 2", preply)
+	}
+}
+
+func TestStepDownAfterAccepted(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	for _, r := range net.replicas {
+		r.forwarding = true
+	}
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	r0.startCampaign()
+	net.DeliverAll()
+
+	// a majority accepts the proposal, but the leader does not hear of it
+	reply := net.propose(0, 1, 10)
+	net.Deliver(0, 1)
+	net.Deliver(0, 2)
+	net.Drop(1, 0)
+	net.Drop(2, 0)
+
+	// the new leader chooses the same commands, so the old one must neither
+	// forward the proposal nor try it again
+	r1.startCampaign()
+	net.DeliverAll()
+	if r0.IsLeader || !r1.IsLeader {
+		t.Fatalf("replica 1 did not take over")
+	}
+	net.checkCommitted(0, 10)
+	for id, r := range net.replicas {
+		if inst := r.instanceSpace.get(1); inst != nil {
+			t.Fatalf("replica %d has %v in instance 1, the proposal was committed twice", id, inst.cmds)
+		}
+	}
+	smrtest.CheckReply(t, reply, 10, TRUE, state.NIL)
+	if reply.Len() > 0 {
+		t.Fatalf("the proposal was answered twice")
+	}
+}
+
+func TestReelectedLeaderKeepsItsProposals(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	r0.startCampaign()
+	net.DeliverAll()
+
+	// only replica 1 accepts the proposal
+	reply := net.propose(0, 1, 10)
+	net.Deliver(0, 1)
+	net.Drop(0, 2)
+	net.Drop(1, 0)
+
+	// replica 1 takes over while replica 0 is cut off, and has the proposal
+	// chosen with its own ballot
+	net.Down[0] = true
+	r1.startCampaign()
+	net.DeliverAll()
+	net.Down[0] = false
+
+	// replica 0 takes over again, after a first ballot too low, and still
+	// answers its client
+	r0.startCampaign()
+	net.DeliverAll()
+	r0.startCampaign()
+	net.DeliverAll()
+	if !r0.IsLeader || r1.IsLeader {
+		t.Fatalf("replica 0 did not take over again")
+	}
+	net.checkCommitted(0, 10)
+	smrtest.CheckReply(t, reply, 10, TRUE, state.NIL)
+}
+
+func TestEqualCommandsOfAnotherClient(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	r0.startCampaign()
+	net.DeliverAll()
+
+	// replica 0's proposal is lost, and replica 1 takes over while replica 0
+	// is cut off, to commit the same command of another client in the same
+	// instance
+	reply := net.propose(0, 1, 10)
+	net.Drop(0, 1)
+	net.Drop(0, 2)
+	net.Down[0] = true
+	r1.startCampaign()
+	net.DeliverAll()
+	net.propose(1, 1, 10)
+	net.DeliverAll()
+	net.Down[0] = false
+
+	// replica 0 takes over again, and proposes its command once more rather
+	// than answer it as if it were the other one
+	r0.startCampaign()
+	net.DeliverAll()
+	r0.startCampaign()
+	net.DeliverAll()
+	if !r0.IsLeader {
+		t.Fatalf("replica 0 did not take over again")
+	}
+	net.checkCommitted(0, 10)
+	net.checkCommitted(1, 10)
+	smrtest.CheckReply(t, reply, 10, TRUE, state.NIL)
+}
+
+func TestPromiseIsDurable(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r1 := net.replicas[1]
+	r1.Durable = true
+
+	// the promise is on disk by the time the reply leaves
+	net.replicas[0].startCampaign()
+	net.Deliver(0, 1)
+	if net.Links[1][0].Len() == 0 {
+		t.Fatalf("replica 1 did not answer the Prepare")
+	}
+	info, err := r1.StableStore.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make([]byte, info.Size())
+	r1.StableStore.ReadAt(stored, 0)
+	if len(stored) != 4 || int32(binary.LittleEndian.Uint32(stored)) != r1.defaultBallot {
+		t.Fatalf("replica 1 stored %v for the promise of ballot %d", stored, r1.defaultBallot)
+	}
+}
+
+func TestStaleCampaign(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0, r1, r2 := net.replicas[0], net.replicas[1], net.replicas[2]
+
+	// replica 1 promises replica 0's ballot, but its reply is lost, and
+	// replica 0's Prepare to replica 2 is late
+	r0.startCampaign()
+	late := append([]byte(nil), net.Links[0][2].Bytes()...)
+	net.Drop(0, 2)
+	net.Deliver(0, 1)
+	net.Drop(1, 0)
+
+	r1.startCampaign()
+	net.DeliverAll()
+	if !r1.IsLeader || r0.leader() != 1 || r2.leader() != 1 {
+		t.Fatalf("replica 1 did not become the leader")
+	}
+
+	net.Links[0][2].Write(late)
+	net.DeliverAll()
+	if r0.IsLeader || r0.campaign != nil || !r1.IsLeader || r2.leader() != 1 {
+		t.Fatalf("a stale campaign changed the leader")
+	}
+}
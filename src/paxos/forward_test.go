@@ -0,0 +1,109 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+func TestFollowerForwards(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	for _, r := range net.replicas {
+		r.forwarding = true
+	}
+	r1 := net.replicas[1]
+
+	net.replicas[0].startCampaign()
+	net.DeliverAll()
+
+	// the reply comes back on the follower's client connection
+	reply := net.propose(1, 1, 10)
+	net.DeliverAll()
+	net.checkCommitted(0, 10)
+	if preply := smrtest.ReadReply(t, reply); preply.OK != TRUE || preply.CommandId != 10 {
+		t.Fatalf("the forwarded proposal was answered with %+v", preply)
+	}
+	if len(r1.forwards) != 0 {
+		t.Fatalf("replica 1 still waits for %d forwarded proposals", len(r1.forwards))
+	}
+
+	// proposals forwarded to a leader that was replaced are redirected
+	net.Crash(0)
+	reply = net.propose(1, 1, 11)
+	net.DeliverAll()
+	if reply.Len() > 0 || len(r1.forwards) != 1 {
+		t.Fatalf("the proposal forwarded to a crashed leader was answered")
+	}
+	net.replicas[2].startCampaign()
+	net.DeliverAll()
+	if preply := smrtest.ReadReply(t, reply); preply.OK != FALSE || preply.CommandId != 11 || preply.Value != 2 {
+		t.Fatalf("the proposal forwarded to the old leader was answered with %+v", preply)
+	}
+
+	// and later ones go to the new leader
+	reply = net.propose(1, 1, 12)
+	net.DeliverAll()
+	net.checkCommitted(1, 12)
+	if preply := smrtest.ReadReply(t, reply); preply.OK != TRUE || preply.CommandId != 12 {
+		t.Fatalf("the forwarded proposal was answered with %+v", preply)
+	}
+}
+
+func TestForwardRepliesFromTwoGoroutines(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0 := net.replicas[0]
+	const n = 100
+
+	// a replica that is not the leader redirects the proposals forwarded to it
+	r0.handleForward(&paxosproto.Forward{1, -1, state.Command{state.PUT, 1, 10}, 0})
+	w := r0.forwardWriters[1]
+
+	// while the executor answers on the same writer
+	done := make(chan bool)
+	go func() {
+		for i := int32(0); i < n; i++ {
+			r0.replyReads([]*genericsmr.Propose{{&genericsmrproto.Propose{i, state.Command{state.GET, 1, 0}, 0}, w}})
+		}
+		done <- true
+	}()
+	for i := int32(n); i < 2*n; i++ {
+		r0.redirect(&genericsmr.Propose{&genericsmrproto.Propose{i, state.Command{state.PUT, 1, 10}, 0}, w})
+	}
+	<-done
+
+	answered := make(map[int32]bool)
+	for _, fr := range r0.forwardedReplies {
+		if fr.to != 1 || answered[fr.reply.ForwardId] {
+			t.Fatalf("replica 0 sent %+v to replica %d", fr.reply, fr.to)
+		}
+		answered[fr.reply.ForwardId] = true
+	}
+	if len(answered) != 2*n+1 {
+		t.Fatalf("replica 0 sent %d replies, want %d", len(answered), 2*n+1)
+	}
+}
+
+func TestForwardWithFullWindow(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0 := net.replicas[0]
+	r0.window = 1
+
+	r0.startCampaign()
+	net.DeliverAll()
+
+	// the window is full, and the clients keep ProposeChan full
+	net.propose(0, 1, 10)
+	propose, _ := smrtest.Propose(20, state.Command{state.PUT, 2, 20})
+	for len(r0.ProposeChan) < cap(r0.ProposeChan) {
+		r0.ProposeChan <- propose
+	}
+
+	// a forwarded proposal waits without holding up the event loop
+	r0.handleForward(&paxosproto.Forward{1, 0, state.Command{state.PUT, 3, 30}, 0})
+	if r0.windowOpen() || len(r0.pending) != 1 || r0.pending[0].Command.V != 30 {
+		t.Fatalf("replica 0 did not queue the forwarded proposal")
+	}
+}
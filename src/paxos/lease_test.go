@@ -0,0 +1,152 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"testing"
+	"time"
+)
+
+// pendingReads lists the GETs a replica has handed to its executor
+func pendingReads(r *Replica, instance int32) []*genericsmr.Propose {
+	r.readsMutex.Lock()
+	defer r.readsMutex.Unlock()
+	if instance <= r.executedUpTo {
+		return r.readsReady
+	}
+	return r.readsPending[instance]
+}
+
+func TestLeaderReadsUnderLease(t *testing.T) {
+	net := newTestNet(t, 3, true)
+	r0, r1, r2 := net.replicas[0], net.replicas[1], net.replicas[2]
+	for _, r := range net.replicas {
+		r.Exec = true
+	}
+
+	r0.startCampaign()
+	net.DeliverAll()
+	if !r0.IsLeader || r0.readLocally(nil) {
+		t.Fatalf("replica 0 holds a lease before any Accept")
+	}
+	net.propose(0, 1, 10)
+	net.DeliverAll()
+	net.checkCommitted(0, 10)
+	if !time.Now().Before(r0.leaseExpiry) {
+		t.Fatalf("replica 0 did not get a lease from the commit")
+	}
+
+	// the leader reads locally, once instance 0 is executed
+	net.get(0, 1)
+	for from := range net.Links {
+		for to := range net.Links[from] {
+			if net.Links[from][to].Len() > 0 {
+				t.Fatalf("a read under a lease sent messages")
+			}
+		}
+	}
+	if len(pendingReads(r0, 0)) != 1 {
+		t.Fatalf("the read does not wait for instance 0")
+	}
+
+	// followers do not help another replica take over during the lease
+	defaultBallot := r1.defaultBallot
+	r2.startCampaign()
+	if r2.campaign == nil || r2.campaign.ballot != -1 || net.Links[2][1].Len() > 0 {
+		t.Fatalf("replica 2 campaigned during the lease of replica 0")
+	}
+	r1.handlePrepare(&paxosproto.Prepare{2, 1, r2.makeUniqueBallot(100), TRUE})
+	net.DeliverAll()
+	if r1.defaultBallot != defaultBallot || !r0.IsLeader {
+		t.Fatalf("replica 1 promised a ballot during the lease of replica 0")
+	}
+
+	// once the promises run out, replica 2 takes over
+	r0.leaseExpiry = time.Time{}
+	r1.promisedUntil = time.Time{}
+	r2.promisedUntil = time.Time{}
+	r2.campaign.sentAt = time.Now().Add(-PREPARE_TIMEOUT)
+	r2.checkCampaign()
+	net.DeliverAll()
+	if !r2.IsLeader || r1.leader() != 2 {
+		t.Fatalf("replica 2 did not take over after the lease")
+	}
+}
+
+func TestQuorumReadReturnsKey(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0, r1 := net.replicas[0], net.replicas[1]
+
+	r0.startCampaign()
+	net.DeliverAll()
+	net.propose(0, 1, 10)
+	net.propose(0, 2, 20)
+	net.DeliverAll()
+
+	// a follower waits for the highest instance a majority has accepted
+	reply := net.get(1, 1)
+	net.DeliverAll()
+	reads := pendingReads(r1, 1)
+	if len(reads) != 1 {
+		t.Fatalf("the quorum read does not wait for instance 1")
+	}
+
+	// and then reads the key, not the last command executed
+	r1.State.Store[1] = 10
+	r1.State.Store[2] = 20
+	r1.replyReads(reads)
+	preply := smrtest.ReadReply(t, reply)
+	if preply.OK != TRUE || preply.Value != 10 {
+		t.Fatalf("the quorum read returned %+v, want value 10", preply)
+	}
+}
+
+func TestReplyReadsMissingKey(t *testing.T) {
+	net := newTestNet(t, 1, false)
+	propose, reply := smrtest.Propose(0, state.Command{state.GET, 7, 0})
+	net.replicas[0].replyReads([]*genericsmr.Propose{propose})
+	preply := smrtest.ReadReply(t, reply)
+	if preply.Value != state.NIL {
+		t.Fatalf("a read of a missing key returned %d", preply.Value)
+	}
+}
+
+func TestFollowerReadsAfterWrite(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0 := net.replicas[0]
+	r1 := net.replicas[1]
+
+	r0.startCampaign()
+	net.DeliverAll()
+
+	// the PUT completes without replica 1
+	reply := net.propose(0, 1, 10)
+	net.Drop(0, 1)
+	net.Deliver(0, 2)
+	net.Deliver(2, 0)
+	net.Drop(0, 1)
+	smrtest.CheckReply(t, reply, 10, TRUE, state.NIL)
+
+	// a read at replica 1 that only the leader answers waits for it
+	net.get(1, 1)
+	net.Drop(1, 2)
+	net.DeliverAll()
+	if len(pendingReads(r1, 0)) != 1 {
+		t.Fatalf("the read at replica 1 does not wait for instance 0")
+	}
+
+	// a PUT that replica 1 accepted counts too, if only replica 2 answers
+	net.propose(0, 1, 20)
+	net.Drop(0, 2)
+	net.Deliver(0, 1)
+	net.Deliver(1, 0)
+	net.Drop(0, 2)
+	net.get(1, 1)
+	net.Drop(1, 0)
+	net.DeliverAll()
+	if len(pendingReads(r1, 1)) != 1 {
+		t.Fatalf("the read at replica 1 does not wait for instance 1")
+	}
+}
@@ -0,0 +1,279 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"log"
+	"time"
+)
+
+// Leader changes. A replica that is told to lead runs Phase 1 once for every
+// instance it does not know to be committed: a Prepare "to infinity" with a
+// ballot higher than any it has seen. Acceptors that promise the ballot
+// report the values they have accepted from that instance on. With a
+// majority of promises, the new leader re-proposes the value with the highest
+// ballot in every instance, fills the holes with no-ops, and from then on
+// runs Phase 2 alone for new instances under the same ballot.
+//
+// A leader steps down as soon as it hears of a higher ballot, from a Prepare,
+// an Accept, a Commit or a NACK. Replicas that are not the leader answer
+// client proposals with a redirection to the leader they know of.
+
+// How long a replica waits for a majority of promises before it tries again
+// with a higher ballot
+const PREPARE_TIMEOUT = 500 * time.Millisecond
+
+// Ballots are (counter << BALLOT_ID_BITS) | replica id
+const BALLOT_ID_BITS = 8
+const BALLOT_ID_MASK = (1 << BALLOT_ID_BITS) - 1
+
+// campaign is a Prepare to infinity in progress
+type campaign struct {
+	ballot  int32
+	from    int32 // first instance the Prepare covers
+	acks    []bool
+	oks     int
+	entries map[int32]paxosproto.PrepareEntry // highest ballot accepted, per instance
+	top     int32                             // highest instance reported
+	sentAt  time.Time
+}
+
+func (r *Replica) makeUniqueBallot(ballot int32) int32 {
+	return (ballot << BALLOT_ID_BITS) | r.Id
+}
+
+// leader is the replica that owns the highest ballot this replica has
+// promised, or -1 if it knows of none
+func (r *Replica) leader() int32 {
+	if r.defaultBallot < 0 {
+		return -1
+	}
+	return r.defaultBallot & BALLOT_ID_MASK
+}
+
+// startCampaign sends a Prepare to infinity with a ballot higher than any
+// this replica has promised
+func (r *Replica) startCampaign() {
+	r.leaseExpiry = time.Time{}
+	if r.leasePromised(r.Id) {
+		// the leader may still read locally, try again once its lease is over
+		log.Printf("Replica %d waits for the lease of replica %d to expire\n", r.Id, r.leaseHolder)
+		r.IsLeader = false
+		r.campaign = &campaign{-1, -1, nil, 0, nil, -1, r.promisedUntil.Add(-PREPARE_TIMEOUT)}
+		return
+	}
+
+	ballot := r.makeUniqueBallot((r.defaultBallot >> BALLOT_ID_BITS) + 1)
+	r.defaultBallot = ballot
+	r.recordBallot(ballot)
+	r.sync()
+	r.IsLeader = false
+	r.dropForwards()
+
+	c := &campaign{ballot, r.committedUpTo + 1, make([]bool, r.N), 0, make(map[int32]paxosproto.PrepareEntry), r.committedUpTo, time.Now()}
+	r.campaign = c
+	log.Printf("Replica %d campaigning with ballot %d from instance %d\n", r.Id, ballot, c.from)
+
+	// this replica promises its own ballot
+	r.addPromise(r.Id, r.entriesFrom(c.from))
+	if c.oks > r.N>>1 {
+		r.finishCampaign()
+		return
+	}
+	r.bcastPrepare(c.from, ballot, true)
+}
+
+// entriesFrom lists the values this replica knows of from instance from on
+func (r *Replica) entriesFrom(from int32) []paxosproto.PrepareEntry {
+	last := r.acceptedUpTo
+	if r.crtInstance-1 > last {
+		last = r.crtInstance - 1
+	}
+	entries := make([]paxosproto.PrepareEntry, 0)
+	for i := from; i <= last; i++ {
+		inst := r.instanceSpace.get(i)
+		if inst == nil || inst.cmds == nil {
+			continue
+		}
+		committed := FALSE
+		if inst.status == COMMITTED {
+			committed = TRUE
+		}
+		entries = append(entries, paxosproto.PrepareEntry{i, inst.ballot, inst.vballot, committed, inst.cmds})
+	}
+	return entries
+}
+
+func (r *Replica) addPromise(acceptor int32, entries []paxosproto.PrepareEntry) {
+	c := r.campaign
+	if c.acks[acceptor] {
+		return
+	}
+	c.acks[acceptor] = true
+	c.oks++
+	for _, e := range entries {
+		if e.Instance < c.from {
+			continue
+		}
+		if e.Instance > c.top {
+			c.top = e.Instance
+		}
+		known, present := c.entries[e.Instance]
+		if !present || known.Committed == FALSE && (e.Committed == TRUE || e.Ballot > known.Ballot) {
+			c.entries[e.Instance] = e
+		}
+	}
+}
+
+func (r *Replica) handlePrepare(prepare *paxosproto.Prepare) {
+	if prepare.Ballot < r.defaultBallot || r.leasePromised(prepare.LeaderId) {
+		r.replyPrepare(prepare.LeaderId, &paxosproto.PrepareReply{r.Id, prepare.Instance, FALSE, r.defaultBallot, nil})
+		return
+	}
+
+	var entries []paxosproto.PrepareEntry
+	if prepare.ToInfinity == TRUE {
+		// the promise must survive a crash before it is made
+		r.observeBallot(prepare.Ballot)
+		r.recordBallot(r.defaultBallot)
+		r.sync()
+		entries = r.entriesFrom(prepare.Instance)
+	} else {
+		entries = make([]paxosproto.PrepareEntry, 0)
+		if inst := r.instanceSpace.get(prepare.Instance); inst != nil && inst.cmds != nil {
+			committed := FALSE
+			if inst.status == COMMITTED {
+				committed = TRUE
+			}
+			entries = append(entries, paxosproto.PrepareEntry{prepare.Instance, inst.ballot, inst.vballot, committed, inst.cmds})
+		}
+	}
+	r.replyPrepare(prepare.LeaderId, &paxosproto.PrepareReply{r.Id, prepare.Instance, TRUE, prepare.Ballot, entries})
+}
+
+func (r *Replica) handlePrepareReply(preply *paxosproto.PrepareReply) {
+	c := r.campaign
+	if c == nil {
+		// we've moved on -- these are delayed replies, so just ignore
+		return
+	}
+
+	if preply.OK == FALSE {
+		if preply.Ballot > c.ballot {
+			// another replica has taken over
+			log.Printf("Replica %d lost its campaign to ballot %d\n", r.Id, preply.Ballot)
+			r.observeBallot(preply.Ballot)
+		}
+		return
+	}
+	if preply.Ballot != c.ballot || preply.Instance != c.from {
+		// a reply to an earlier campaign
+		return
+	}
+
+	r.addPromise(preply.AcceptorId, preply.Entries)
+	if c.oks > r.N>>1 {
+		r.finishCampaign()
+	}
+}
+
+// finishCampaign takes over every instance the campaign covers, once a
+// majority has promised its ballot
+func (r *Replica) finishCampaign() {
+	c := r.campaign
+	r.campaign = nil
+	r.IsLeader = true
+	log.Printf("Replica %d is the leader with ballot %d\n", r.Id, c.ballot)
+
+	for i := c.from; i <= c.top; i++ {
+		inst := r.instanceSpace.get(i)
+		if inst != nil && inst.status == COMMITTED && inst.cmds != nil {
+			continue
+		}
+
+		// a chosen value is proposed again too, so that replicas that only
+		// heard a CommitShort for it learn the commands
+		e, present := c.entries[i]
+		if inst != nil && inst.status == COMMITTED {
+			if present {
+				inst.cmds = e.Command
+				inst.vballot = e.VBallot
+				r.recordCommands(e.Command)
+				r.sendAccept(i, c.ballot, e.VBallot, e.Command)
+			}
+			continue
+		}
+
+		// a hole gets a no-op, first proposed now
+		cmds := make([]state.Command, 0)
+		vballot := c.ballot
+		if present {
+			cmds = e.Command
+			vballot = e.VBallot
+		}
+		// our own proposals stay if their commands are proposed again,
+		// whoever proposed them since
+		proposals := r.requeueProposals(inst, vballot)
+
+		r.instanceSpace.set(i, &Instance{cmds, c.ballot, vballot, PREPARED, &LeaderBookkeeping{proposals, 0, 0, 0, 0, time.Now()}})
+		r.recordInstanceMetadata(r.instanceSpace.get(i))
+		r.recordCommands(cmds)
+		r.sendAccept(i, c.ballot, vballot, cmds)
+	}
+	r.sync()
+	r.updateCommittedUpTo()
+	r.advanceAccepted(c.top)
+
+	if c.top+1 > r.crtInstance {
+		r.crtInstance = c.top + 1
+	}
+}
+
+// observeBallot promises a higher ballot, and steps down if it belongs to
+// another replica
+func (r *Replica) observeBallot(ballot int32) {
+	if ballot <= r.defaultBallot {
+		return
+	}
+	replaced := ballot&BALLOT_ID_MASK != r.leader()
+	r.defaultBallot = ballot
+	if replaced {
+		r.dropForwards()
+	}
+	if ballot&BALLOT_ID_MASK == r.Id {
+		return
+	}
+	if r.IsLeader || r.campaign != nil {
+		log.Printf("Replica %d steps down for ballot %d\n", r.Id, ballot)
+	}
+	r.IsLeader = false
+	r.campaign = nil
+	r.leaseExpiry = time.Time{}
+}
+
+// checkCampaign tries again with a higher ballot if a majority did not
+// answer in time
+func (r *Replica) checkCampaign() {
+	if r.campaign != nil && time.Since(r.campaign.sentAt) >= PREPARE_TIMEOUT {
+		r.startCampaign()
+	}
+}
+
+// requeueProposals puts the client proposals of an instance back in the
+// queue if the instance was given commands first proposed with another ballot
+// than theirs, to be tried in another instance, or redirected to the new
+// leader. It returns the proposals that stay, to be answered when the
+// instance commits. A leader proposes one value per instance and ballot, so
+// the ballot tells the proposals apart from equal commands of other clients.
+func (r *Replica) requeueProposals(inst *Instance, vballot int32) []*genericsmr.Propose {
+	if inst == nil || inst.lb == nil || inst.lb.clientProposals == nil {
+		return nil
+	}
+	if inst.vballot == vballot {
+		return inst.lb.clientProposals
+	}
+	r.pending = append(r.pending, inst.lb.clientProposals...)
+	inst.lb.clientProposals = nil
+	return nil
+}
@@ -0,0 +1,118 @@
+package paxos
+
+import (
+	"bufio"
+	"bytes"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"log"
+)
+
+// Forwarding. A follower sends the writes of its clients to the leader it
+// knows of, and relays the replies on the client connection, so that clients
+// can connect to any replica. Reads are served where they arrive. If the
+// follower knows of no leader, or forwarding is off, it answers with a
+// redirection to the leader instead.
+//
+// At the leader, a forwarded proposal waits with the proposals the event loop
+// put back, and is proposed like any other. Its reply goes to a writer that
+// turns it into a ForwardReply. The executor may reply too, so replies are
+// written under clientMutex, and the ForwardReplies are queued for the event
+// loop to send.
+
+// forwardedReply is a ForwardReply waiting to be sent to a follower
+type forwardedReply struct {
+	to    int32
+	reply *paxosproto.ForwardReply
+}
+
+// forwarder is where the leader writes the replies to the proposals that a
+// follower forwarded. It is written under clientMutex.
+type forwarder struct {
+	to int32
+	r  *Replica
+}
+
+func (f *forwarder) Write(p []byte) (int, error) {
+	rd := bytes.NewReader(p)
+	for rd.Len() > 0 {
+		var preply genericsmrproto.ProposeReplyTS
+		if err := preply.Unmarshal(rd); err != nil {
+			return len(p) - rd.Len(), err
+		}
+		f.r.forwardedReplies = append(f.r.forwardedReplies, &forwardedReply{f.to, &paxosproto.ForwardReply{preply.CommandId, preply.OK, preply.Value, preply.Timestamp}})
+	}
+	select {
+	case f.r.forwardedReplyChan <- true:
+	default:
+	}
+	return len(p), nil
+}
+
+// sendForwardedReplies sends the ForwardReplies the forwarders queued
+func (r *Replica) sendForwardedReplies() {
+	r.clientMutex.Lock()
+	replies := r.forwardedReplies
+	r.forwardedReplies = nil
+	r.clientMutex.Unlock()
+	for _, fr := range replies {
+		r.SendMsg(fr.to, r.forwardReplyRPC, fr.reply)
+	}
+}
+
+// forward sends a client proposal to the leader, and tells whether it could
+func (r *Replica) forward(propose *genericsmr.Propose) bool {
+	leader := r.leader()
+	if !r.forwarding || leader < 0 || leader == r.Id || !r.Alive[leader] {
+		return false
+	}
+	id := r.crtForward
+	r.crtForward++
+	r.forwards[id] = propose
+	r.SendMsg(leader, r.forwardRPC, &paxosproto.Forward{r.Id, id, propose.Command, propose.Timestamp})
+	return true
+}
+
+func (r *Replica) handleForward(fwd *paxosproto.Forward) {
+	if r.forwardWriters[fwd.ReplicaId] == nil {
+		r.forwardWriters[fwd.ReplicaId] = bufio.NewWriter(&forwarder{fwd.ReplicaId, r})
+	}
+	propose := &genericsmr.Propose{
+		&genericsmrproto.Propose{fwd.ForwardId, fwd.Command, fwd.Timestamp},
+		r.forwardWriters[fwd.ReplicaId]}
+	if !r.IsLeader {
+		r.redirect(propose)
+		return
+	}
+	r.pending = append(r.pending, propose)
+}
+
+func (r *Replica) handleForwardReply(freply *paxosproto.ForwardReply) {
+	propose, present := r.forwards[freply.ForwardId]
+	if !present {
+		return
+	}
+	delete(r.forwards, freply.ForwardId)
+	r.replyClient(&genericsmrproto.ProposeReplyTS{freply.OK, propose.CommandId, freply.Value, propose.Timestamp}, propose.Reply)
+}
+
+// dropForwards redirects the proposals forwarded to a leader that was
+// replaced, as they may never be answered
+func (r *Replica) dropForwards() {
+	if len(r.forwards) == 0 {
+		return
+	}
+	log.Printf("Replica %d redirects %d forwarded proposals\n", r.Id, len(r.forwards))
+	for id, propose := range r.forwards {
+		delete(r.forwards, id)
+		r.redirect(propose)
+	}
+}
+
+// redirect tells a client that this replica is not the leader. The reply
+// carries the leader this replica knows of in place of a value, or -1.
+func (r *Replica) redirect(propose *genericsmr.Propose) {
+	r.replyClient(&genericsmrproto.ProposeReplyTS{FALSE, propose.CommandId, state.Value(r.leader()), propose.Timestamp}, propose.Reply)
+}
@@ -0,0 +1,102 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/state"
+	"time"
+)
+
+// Leader leases. An acceptor that accepts a value from the leader promises
+// not to join the Phase 1 of any other replica for LEASE_DURATION, plus a
+// guard against clock drift. Once a majority has accepted an Accept that was
+// sent at time t, no other leader can be elected before t + LEASE_DURATION,
+// so until then every write that completes goes through this replica. The
+// leader serves GETs from its state once it has executed every instance it
+// has proposed, and sends a no-op to renew an idle lease.
+//
+// Without a lease, GETs ask a majority for the highest instance it has
+// accepted, and are answered once that instance is executed.
+
+// How long a lease lasts, counted from the moment the Accept was sent
+const LEASE_DURATION = 1 * time.Second
+
+// Acceptors keep their promise for longer than the leader, to absorb clock
+// drift
+const LEASE_GUARD = 100 * time.Millisecond
+
+// An idle lease is renewed when it is this close to expiring
+const LEASE_RENEW = LEASE_DURATION / 2
+
+// promiseLease records that this replica accepted a value from leader
+func (r *Replica) promiseLease(leader int32) {
+	if !r.leases {
+		return
+	}
+	r.leaseHolder = leader
+	r.promisedUntil = time.Now().Add(LEASE_DURATION + LEASE_GUARD)
+}
+
+// leasePromised tells whether this replica may not promise a ballot from
+// replica q, because it promised a lease to another leader
+func (r *Replica) leasePromised(q int32) bool {
+	return r.leases && q != r.leaseHolder && time.Now().Before(r.promisedUntil)
+}
+
+// extendLease renews the lease of the leader once a majority has accepted
+// an Accept sent at sentAt
+func (r *Replica) extendLease(sentAt time.Time) {
+	if !r.leases || !r.IsLeader {
+		return
+	}
+	if expiry := sentAt.Add(LEASE_DURATION); expiry.After(r.leaseExpiry) {
+		r.leaseExpiry = expiry
+	}
+}
+
+// renewLease proposes a no-op if the lease is close to expiring and no
+// Accept has been sent lately
+func (r *Replica) renewLease() {
+	if !r.leases || !r.IsLeader || r.campaign != nil {
+		return
+	}
+	now := time.Now()
+	if r.leaseExpiry.Sub(now) >= LEASE_RENEW || now.Sub(r.lastAccept) < LEASE_RENEW {
+		return
+	}
+	r.startInstance(make([]state.Command, 0), nil)
+}
+
+// readLocally serves a GET at the leader while it holds a lease
+func (r *Replica) readLocally(propose *genericsmr.Propose) bool {
+	if !r.leases || !r.Exec || !r.IsLeader || !time.Now().Before(r.leaseExpiry) {
+		return false
+	}
+	// every write that may have completed is in an instance proposed by
+	// this replica, or re-proposed when it became the leader
+	r.readAfter(r.crtInstance-1, propose)
+	return true
+}
+
+// readAfter has the executor answer a GET once it has executed the instance
+func (r *Replica) readAfter(instance int32, propose *genericsmr.Propose) {
+	r.readsMutex.Lock()
+	defer r.readsMutex.Unlock()
+	if instance <= r.executedUpTo {
+		r.readsReady = append(r.readsReady, propose)
+		return
+	}
+	r.readsPending[instance] = append(r.readsPending[instance], propose)
+}
+
+// replyReads answers GETs from the state. Only the executor calls it.
+func (r *Replica) replyReads(proposals []*genericsmr.Propose) {
+	for _, prop := range proposals {
+		propreply := &genericsmrproto.ProposeReplyTS{
+			TRUE,
+			prop.CommandId,
+			prop.Command.Execute(r.State),
+			prop.Timestamp}
+		r.replyClient(propreply, prop.Reply)
+	}
+}
@@ -0,0 +1,125 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"sync"
+)
+
+// Pipelining. The leader keeps at most window instances uncommitted, counted
+// from the first instance it has not committed yet. Proposals that arrive
+// while the window is full wait in ProposeChan, and once it fills up, the
+// client connections stop being read, which pushes back on the clients.
+// Proposals that the event loop itself puts back wait in a local queue
+// instead, as it is the only reader of ProposeChan.
+
+// Instances are allocated this many at a time
+const LOG_SEGMENT_SIZE = 64 * 1024
+
+// instanceLog is the instance space. It grows one segment at a time, as
+// instances are used.
+type instanceLog struct {
+	mutex    sync.RWMutex // the executor reads the log too
+	segments [][]*Instance
+}
+
+func (l *instanceLog) get(i int32) *Instance {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	s := int(i / LOG_SEGMENT_SIZE)
+	if i < 0 || s >= len(l.segments) || l.segments[s] == nil {
+		return nil
+	}
+	return l.segments[s][i%LOG_SEGMENT_SIZE]
+}
+
+func (l *instanceLog) set(i int32, inst *Instance) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := int(i / LOG_SEGMENT_SIZE)
+	for s >= len(l.segments) {
+		l.segments = append(l.segments, nil)
+	}
+	if l.segments[s] == nil {
+		l.segments[s] = make([]*Instance, LOG_SEGMENT_SIZE)
+	}
+	l.segments[s][i%LOG_SEGMENT_SIZE] = inst
+}
+
+// size is the number of instances allocated
+func (l *instanceLog) size() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	n := 0
+	for _, s := range l.segments {
+		if s != nil {
+			n += LOG_SEGMENT_SIZE
+		}
+	}
+	return n
+}
+
+// inFlight is the number of instances the leader started and has not
+// committed yet, counting those committed behind an uncommitted one
+func (r *Replica) inFlight() int32 {
+	if n := r.crtInstance - 1 - r.committedUpTo; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// queued is the number of proposals waiting to be handled
+func (r *Replica) queued() int {
+	return len(r.pending) + len(r.ProposeChan)
+}
+
+// nextProposal takes the next waiting proposal, those put back first. There
+// must be one.
+func (r *Replica) nextProposal() *genericsmr.Propose {
+	if len(r.pending) > 0 {
+		prop := r.pending[0]
+		r.pending = r.pending[1:]
+		return prop
+	}
+	return <-r.ProposeChan
+}
+
+// windowOpen tells whether the leader may start another instance
+func (r *Replica) windowOpen() bool {
+	return !r.IsLeader || r.window <= 0 || r.inFlight() < int32(r.window)
+}
+
+// recordWindow samples the window and the proposal queue, on every tick of
+// the clock and every time the leader starts an instance
+func (r *Replica) recordWindow(started bool, stalled bool) {
+	inFlight := r.inFlight()
+	queued := int32(r.queued())
+
+	r.windowMutex.Lock()
+	defer r.windowMutex.Unlock()
+	s := &r.windowStats
+	s.InFlight = inFlight
+	if inFlight > s.MaxInFlight {
+		s.MaxInFlight = inFlight
+	}
+	s.Queued = queued
+	if queued > s.MaxQueued {
+		s.MaxQueued = queued
+	}
+	if started {
+		s.Started++
+	}
+	if stalled {
+		s.Stalls++
+	}
+}
+
+// WindowStats reports how full the pipeline window and the proposal queue are
+func (r *Replica) WindowStats(args *genericsmrproto.WindowStatsArgs, reply *genericsmrproto.WindowStatsReply) error {
+	r.windowMutex.Lock()
+	*reply = r.windowStats
+	r.windowMutex.Unlock()
+	reply.Window = int32(r.window)
+	reply.LogSize = int32(r.instanceSpace.size())
+	return nil
+}
@@ -1,6 +1,7 @@
 package paxos
 
 import (
+	"bufio"
 	"encoding/binary"
 	"gus-epaxos/src/dlog"
 	"gus-epaxos/src/fastrpc"
@@ -10,6 +11,7 @@ import (
 	"gus-epaxos/src/state"
 	"io"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -17,7 +19,6 @@ const CHAN_BUFFER_SIZE = 200000
 const TRUE = uint8(1)
 const FALSE = uint8(0)
 
-const MAX_BATCH = 1
 const CLOCK = 1000 * 10
 
 type Replica struct {
@@ -30,6 +31,8 @@ type Replica struct {
 	prepareReplyChan    chan fastrpc.Serializable
 	acceptReplyChan     chan fastrpc.Serializable
 	readReplyChan       chan fastrpc.Serializable
+	forwardChan         chan fastrpc.Serializable
+	forwardReplyChan    chan fastrpc.Serializable
 	prepareRPC          uint8
 	acceptRPC           uint8
 	commitRPC           uint8
@@ -38,10 +41,12 @@ type Replica struct {
 	prepareReplyRPC     uint8
 	acceptReplyRPC      uint8
 	readReplyRPC        uint8
-	IsLeader            bool        // does this replica think it is the leader
-	instanceSpace       []*Instance // the space of all instances (used and not yet used)
-	crtInstance         int32       // highest active instance number that this replica knows about
-	defaultBallot       int32       // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
+	forwardRPC          uint8
+	forwardReplyRPC     uint8
+	IsLeader            bool         // does this replica think it is the leader
+	instanceSpace       *instanceLog // the space of all instances (used and not yet used)
+	crtInstance         int32        // highest active instance number that this replica knows about
+	defaultBallot       int32        // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
 	Shutdown            bool
 	counter             int
 	flush               bool
@@ -52,7 +57,28 @@ type Replica struct {
 	readOKs             map[int32]int
 	readData            map[int32][]int32
 	readProposal        map[int32]*genericsmr.Propose
-	readsPending        [][]*genericsmr.Propose
+	readsPending        map[int32][]*genericsmr.Propose
+	batcher             *genericsmr.Batcher // adaptive batching of client proposals
+	campaign            *campaign           // Prepare to infinity in progress, if any
+	beTheLeaderChan     chan bool
+	leases              bool        // serve reads locally at the leader under a lease?
+	leaseExpiry         time.Time   // end of the lease of this replica, as the leader
+	lastAccept          time.Time   // when this replica last sent an Accept, as the leader
+	leaseHolder         int32       // leader this replica last promised a lease to
+	promisedUntil       time.Time   // end of that promise
+	readsMutex          *sync.Mutex // guards executedUpTo, readsPending and readsReady
+	readsReady          []*genericsmr.Propose
+	window              int // most uncommitted instances at the leader, 0 if unlimited
+	windowMutex         *sync.Mutex
+	windowStats         genericsmrproto.WindowStatsReply
+	forwarding          bool                          // forward proposals to the leader?
+	crtForward          int32                         // next id for a forwarded proposal
+	forwards            map[int32]*genericsmr.Propose // proposals forwarded to the leader, by id
+	forwardWriters      []*bufio.Writer               // replies to the proposals forwarded by each follower
+	forwardedReplyChan  chan bool                     // signals forwardedReplies
+	forwardedReplies    []*forwardedReply             // ForwardReplies to send, guarded by clientMutex
+	clientMutex         *sync.Mutex                   // for synchronizing when sending replies to clients from multiple go-routines
+	pending             []*genericsmr.Propose         // proposals the event loop put back, handled before ProposeChan
 }
 
 type InstanceStatus int
@@ -65,10 +91,11 @@ const (
 )
 
 type Instance struct {
-	cmds   []state.Command
-	ballot int32
-	status InstanceStatus
-	lb     *LeaderBookkeeping
+	cmds    []state.Command
+	ballot  int32
+	vballot int32 // ballot the commands were first proposed with, -1 if unknown
+	status  InstanceStatus
+	lb      *LeaderBookkeeping
 }
 
 type LeaderBookkeeping struct {
@@ -77,9 +104,22 @@ type LeaderBookkeeping struct {
 	prepareOKs      int
 	acceptOKs       int
 	nacks           int
+	sentAt          time.Time // when the Accept was sent
 }
 
-func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, leases bool, forwarding bool, maxBatch int, maxBatchDelay time.Duration, window int) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable, leases, forwarding, maxBatch, maxBatchDelay, window)
+
+	go r.run()
+
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, leases bool, forwarding bool, maxBatch int, maxBatchDelay time.Duration, window int) *Replica {
+	if len(peerAddrList) > BALLOT_ID_MASK+1 {
+		log.Fatalf("Paxos supports at most %d replicas\n", BALLOT_ID_MASK+1)
+	}
+
 	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
@@ -89,9 +129,11 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, 3*genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		0, 0, 0, 0, 0, 0, 0, 0,
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 		false,
-		make([]*Instance, 15*1024*1024),
+		new(instanceLog),
 		0,
 		-1,
 		false,
@@ -104,7 +146,28 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		map[int32]int{},
 		map[int32][]int32{},
 		map[int32]*genericsmr.Propose{},
-		make([][]*genericsmr.Propose, 150*1024*1024),
+		map[int32][]*genericsmr.Propose{},
+		genericsmr.NewBatcher(maxBatch, maxBatchDelay),
+		nil,
+		make(chan bool, 1),
+		leases,
+		time.Time{},
+		time.Time{},
+		-1,
+		time.Time{},
+		new(sync.Mutex),
+		nil,
+		window,
+		new(sync.Mutex),
+		genericsmrproto.WindowStatsReply{},
+		forwarding,
+		0,
+		map[int32]*genericsmr.Propose{},
+		make([]*bufio.Writer, len(peerAddrList)),
+		make(chan bool, 1),
+		nil,
+		new(sync.Mutex),
+		nil,
 	}
 
 	r.Durable = durable
@@ -117,8 +180,8 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 	r.prepareReplyRPC = r.RegisterRPC(new(paxosproto.PrepareReply), r.prepareReplyChan)
 	r.acceptReplyRPC = r.RegisterRPC(new(paxosproto.AcceptReply), r.acceptReplyChan)
 	r.readReplyRPC = r.RegisterRPC(new(paxosproto.ReadReply), r.readReplyChan)
-
-	go r.run()
+	r.forwardRPC = r.RegisterRPC(new(paxosproto.Forward), r.forwardChan)
+	r.forwardReplyRPC = r.RegisterRPC(new(paxosproto.ForwardReply), r.forwardReplyChan)
 
 	return r
 }
@@ -135,6 +198,17 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	r.StableStore.Write(b[:])
 }
 
+// record the ballot promised for all instances to stable storage
+func (r *Replica) recordBallot(ballot int32) {
+	if !r.Durable {
+		return
+	}
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(ballot))
+	r.StableStore.Write(b[:])
+}
+
 // write a sequence of commands to stable storage
 func (r *Replica) recordCommands(cmds []state.Command) {
 	if !r.Durable {
@@ -161,7 +235,17 @@ func (r *Replica) sync() {
 /* RPC to be called by master */
 
 func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
-	r.IsLeader = true
+	// the event loop runs the campaign
+	select {
+	case r.beTheLeaderChan <- true:
+	default:
+	}
+	return nil
+}
+
+// BatchStats reports the sizes of the batches proposed by this replica
+func (r *Replica) BatchStats(args *genericsmrproto.BatchStatsArgs, reply *genericsmrproto.BatchStatsReply) error {
+	r.batcher.Stats(reply)
 	return nil
 }
 
@@ -202,7 +286,7 @@ func (r *Replica) run() {
 	}
 
 	if r.Id == 0 {
-		r.IsLeader = true
+		r.startCampaign()
 	}
 
 	clockChan = make(chan bool, 1)
@@ -212,11 +296,31 @@ func (r *Replica) run() {
 
 	for !r.Shutdown {
 
+		// the event loop cannot wait on ProposeChan for the proposals it puts
+		// back, or those forwarded to it
+		if len(r.pending) > 0 && r.campaign == nil && r.windowOpen() {
+			r.handlePropose(r.nextProposal())
+			continue
+		}
+
 		select {
 
 		case <-clockChan:
-			//activate the new proposals channel
-			onOffProposeChan = r.ProposeChan
+			//activate the new proposals channel once enough commands are queued for a batch,
+			//unless a campaign for leadership is in progress or the pipeline window is full
+			r.checkCampaign()
+			r.renewLease()
+			open := r.windowOpen()
+			if r.campaign == nil && open && r.batcher.Ready(r.queued()) {
+				onOffProposeChan = r.ProposeChan
+			}
+			r.recordWindow(false, !open && r.queued() > 0)
+			break
+
+		case <-r.beTheLeaderChan:
+			if !r.IsLeader && r.campaign == nil {
+				r.startCampaign()
+			}
 			break
 
 		case propose := <-onOffProposeChan:
@@ -282,17 +386,31 @@ func (r *Replica) run() {
 			dlog.Printf("Received ReadReply with instance %d\n", readReply.Instance)
 			r.handleReadReply(readReply)
 			break
+
+		case forwardS := <-r.forwardChan:
+			forward := forwardS.(*paxosproto.Forward)
+			//got a proposal forwarded by a follower
+			dlog.Printf("Received Forward from replica %d\n", forward.ReplicaId)
+			r.handleForward(forward)
+			break
+
+		case forwardReplyS := <-r.forwardReplyChan:
+			forwardReply := forwardReplyS.(*paxosproto.ForwardReply)
+			//got the reply to a forwarded proposal
+			dlog.Printf("Received ForwardReply for %d\n", forwardReply.ForwardId)
+			r.handleForwardReply(forwardReply)
+			break
+
+		case <-r.forwardedReplyChan:
+			r.sendForwardedReplies()
+			break
 		}
 	}
 }
 
-func (r *Replica) makeUniqueBallot(ballot int32) int32 {
-	return (ballot << 4) | r.Id
-}
-
 func (r *Replica) updateCommittedUpTo() {
-	for r.instanceSpace[r.committedUpTo+1] != nil &&
-		r.instanceSpace[r.committedUpTo+1].status == COMMITTED {
+	for r.instanceSpace.get(r.committedUpTo+1) != nil &&
+		r.instanceSpace.get(r.committedUpTo+1).status == COMMITTED {
 		r.committedUpTo++
 	}
 }
@@ -330,7 +448,14 @@ func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity bool) {
 
 var pa paxosproto.Accept
 
-func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Command) {
+// sendAccept broadcasts an Accept from the leader, which also accepts it
+func (r *Replica) sendAccept(instance int32, ballot int32, vballot int32, command []state.Command) {
+	r.lastAccept = time.Now()
+	r.promiseLease(r.Id)
+	r.bcastAccept(instance, ballot, vballot, command)
+}
+
+func (r *Replica) bcastAccept(instance int32, ballot int32, vballot int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
@@ -339,6 +464,7 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Comm
 	pa.LeaderId = r.Id
 	pa.Instance = instance
 	pa.Ballot = ballot
+	pa.VBallot = vballot
 	pa.Command = command
 	args := &pa
 	//args := &paxosproto.Accept{r.Id, instance, ballot, command}
@@ -365,7 +491,7 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Comm
 var pc paxosproto.Commit
 var pcs paxosproto.CommitShort
 
-func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Command) {
+func (r *Replica) bcastCommit(instance int32, ballot int32, vballot int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Commit bcast failed:", err)
@@ -375,6 +501,7 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 	pc.LeaderId = r.Id
 	pc.Instance = instance
 	pc.Ballot = ballot
+	pc.VBallot = vballot
 	pc.Command = command
 	args := &pc
 	pcs.LeaderId = r.Id
@@ -421,281 +548,227 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 	// got read command
 	if propose.Command.Op == state.GET {
+		if r.readLocally(propose) {
+			return
+		}
 		readId := r.crtRead
 		r.crtRead++
 		r.readProposal[readId] = propose
+		// this replica is part of the majority
+		r.readData[readId] = []int32{r.acceptedUpTo}
 		r.bcastRead(readId)
-	} else {
-		for r.instanceSpace[r.crtInstance] != nil {
-			r.crtInstance++
-		}
-
-		instNo := r.crtInstance
-		r.crtInstance++
-
-		batchSize := len(r.ProposeChan) + 1
+		return
+	}
 
-		if batchSize > MAX_BATCH {
-			batchSize = MAX_BATCH
+	if !r.IsLeader {
+		if !r.forward(propose) {
+			r.redirect(propose)
 		}
+		return
+	}
 
-		cmds := make([]state.Command, batchSize)
-		proposals := make([]*genericsmr.Propose, batchSize)
-		cmds[0] = propose.Command
-		proposals[0] = propose
+	batchSize := r.batcher.Size(r.queued() + 1)
 
-		for i := 1; i < batchSize; i++ {
-			prop := <-r.ProposeChan
-			cmds[i] = prop.Command
-			proposals[i] = prop
-		}
+	cmds := make([]state.Command, batchSize)
+	proposals := make([]*genericsmr.Propose, batchSize)
+	cmds[0] = propose.Command
+	proposals[0] = propose
 
-		if r.defaultBallot == -1 {
-			r.instanceSpace[instNo] = &Instance{
-				cmds,
-				r.makeUniqueBallot(0),
-				PREPARING,
-				&LeaderBookkeeping{proposals, 0, 0, 0, 0}}
-			r.bcastPrepare(instNo, r.makeUniqueBallot(0), true)
-			dlog.Printf("Classic round for instance %d\n", instNo)
-		} else {
-			r.instanceSpace[instNo] = &Instance{
-				cmds,
-				r.defaultBallot,
-				PREPARED,
-				&LeaderBookkeeping{proposals, 0, 0, 0, 0}}
-
-			r.recordInstanceMetadata(r.instanceSpace[instNo])
-			r.recordCommands(cmds)
-			r.sync()
-
-			r.bcastAccept(instNo, r.defaultBallot, cmds)
-			dlog.Printf("Fast round for instance %d\n", instNo)
-		}
+	for i := 1; i < batchSize; i++ {
+		prop := r.nextProposal()
+		cmds[i] = prop.Command
+		proposals[i] = prop
 	}
-}
+	r.batcher.Record(batchSize, r.queued())
 
-func (r *Replica) handlePrepare(prepare *paxosproto.Prepare) {
-	inst := r.instanceSpace[prepare.Instance]
-	var preply *paxosproto.PrepareReply
+	r.startInstance(cmds, proposals)
+}
 
-	if inst == nil {
-		ok := TRUE
-		if r.defaultBallot > prepare.Ballot {
-			ok = FALSE
-		}
-		preply = &paxosproto.PrepareReply{prepare.Instance, ok, r.defaultBallot, make([]state.Command, 0)}
-	} else {
-		ok := TRUE
-		if prepare.Ballot < inst.ballot {
-			ok = FALSE
-		}
-		preply = &paxosproto.PrepareReply{prepare.Instance, ok, inst.ballot, inst.cmds}
+// startInstance proposes commands in the next free instance. Phase 1 was run
+// for every instance when this replica became the leader.
+func (r *Replica) startInstance(cmds []state.Command, proposals []*genericsmr.Propose) {
+	for r.instanceSpace.get(r.crtInstance) != nil {
+		r.crtInstance++
 	}
 
-	r.replyPrepare(prepare.LeaderId, preply)
+	instNo := r.crtInstance
+	r.crtInstance++
 
-	if prepare.ToInfinity == TRUE && prepare.Ballot > r.defaultBallot {
-		r.defaultBallot = prepare.Ballot
-	}
+	r.instanceSpace.set(instNo, &Instance{
+		cmds,
+		r.defaultBallot,
+		r.defaultBallot,
+		PREPARED,
+		&LeaderBookkeeping{proposals, 0, 0, 0, 0, time.Now()}})
+
+	r.recordInstanceMetadata(r.instanceSpace.get(instNo))
+	r.recordCommands(cmds)
+	r.sync()
+
+	r.advanceAccepted(instNo)
+	r.sendAccept(instNo, r.defaultBallot, r.defaultBallot, cmds)
+	r.recordWindow(true, false)
+	dlog.Printf("Fast round for instance %d\n", instNo)
 }
 
 func (r *Replica) handleAccept(accept *paxosproto.Accept) {
-	inst := r.instanceSpace[accept.Instance]
+	inst := r.instanceSpace.get(accept.Instance)
 	var areply *paxosproto.AcceptReply
 
-	if inst == nil {
-		if accept.Ballot < r.defaultBallot {
-			areply = &paxosproto.AcceptReply{accept.Instance, FALSE, r.defaultBallot}
-		} else {
-			r.instanceSpace[accept.Instance] = &Instance{
+	if accept.Ballot < r.defaultBallot {
+		areply = &paxosproto.AcceptReply{accept.Instance, FALSE, r.defaultBallot}
+	} else if inst != nil && inst.ballot > accept.Ballot {
+		areply = &paxosproto.AcceptReply{accept.Instance, FALSE, inst.ballot}
+	} else {
+		// only a leader that a majority promised its ballot sends Accepts
+		r.observeBallot(accept.Ballot)
+		if inst == nil {
+			r.instanceSpace.set(accept.Instance, &Instance{
 				accept.Command,
 				accept.Ballot,
+				accept.VBallot,
 				ACCEPTED,
-				nil}
-			areply = &paxosproto.AcceptReply{accept.Instance, TRUE, r.defaultBallot}
-		}
-	} else if inst.ballot > accept.Ballot {
-		areply = &paxosproto.AcceptReply{accept.Instance, FALSE, inst.ballot}
-	} else if inst.ballot < accept.Ballot {
-		inst.cmds = accept.Command
-		inst.ballot = accept.Ballot
-		inst.status = ACCEPTED
-		areply = &paxosproto.AcceptReply{accept.Instance, TRUE, inst.ballot}
-		if inst.lb != nil && inst.lb.clientProposals != nil {
-			//TODO: is this correct?
-			// try the proposal in a different instance
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ProposeChan <- inst.lb.clientProposals[i]
+				nil})
+		} else if inst.status == COMMITTED {
+			// a reordered ACCEPT: the value is chosen, but we may not know it
+			if inst.cmds == nil {
+				inst.cmds = accept.Command
+				inst.vballot = accept.VBallot
 			}
-			inst.lb.clientProposals = nil
-		}
-	} else {
-		// reordered ACCEPT
-		r.instanceSpace[accept.Instance].cmds = accept.Command
-		if r.instanceSpace[accept.Instance].status != COMMITTED {
-			r.instanceSpace[accept.Instance].status = ACCEPTED
+		} else {
+			r.requeueProposals(inst, accept.VBallot)
+			inst.cmds = accept.Command
+			inst.ballot = accept.Ballot
+			inst.vballot = accept.VBallot
+			inst.status = ACCEPTED
 		}
-		areply = &paxosproto.AcceptReply{accept.Instance, TRUE, r.defaultBallot}
+		areply = &paxosproto.AcceptReply{accept.Instance, TRUE, accept.Ballot}
+		r.promiseLease(accept.LeaderId)
 	}
 
 	if areply.OK == TRUE {
-		r.recordInstanceMetadata(r.instanceSpace[accept.Instance])
+		r.recordInstanceMetadata(r.instanceSpace.get(accept.Instance))
 		r.recordCommands(accept.Command)
 		r.sync()
+		r.advanceAccepted(accept.Instance)
 	}
 
-	if accept.Instance > r.acceptedUpTo {
-		r.acceptedUpTo = accept.Instance
-	}
 	r.replyAccept(accept.LeaderId, areply)
 }
 
 func (r *Replica) handleCommit(commit *paxosproto.Commit) {
-	inst := r.instanceSpace[commit.Instance]
+	inst := r.instanceSpace.get(commit.Instance)
 
 	dlog.Printf("Committing instance %d\n", commit.Instance)
+	r.observeBallot(commit.Ballot)
 	if inst == nil {
-		r.instanceSpace[commit.Instance] = &Instance{
+		r.instanceSpace.set(commit.Instance, &Instance{
 			commit.Command,
 			commit.Ballot,
+			commit.VBallot,
 			COMMITTED,
-			nil}
+			nil})
 	} else {
-		r.instanceSpace[commit.Instance].cmds = commit.Command
-		r.instanceSpace[commit.Instance].status = COMMITTED
-		r.instanceSpace[commit.Instance].ballot = commit.Ballot
-		if inst.lb != nil && inst.lb.clientProposals != nil {
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ProposeChan <- inst.lb.clientProposals[i]
-			}
-			inst.lb.clientProposals = nil
+		if inst.status != COMMITTED {
+			r.requeueProposals(inst, commit.VBallot)
+			r.replyCommitted(inst)
 		}
+		inst.cmds = commit.Command
+		inst.vballot = commit.VBallot
+		inst.status = COMMITTED
+		inst.ballot = commit.Ballot
 	}
+	r.advanceAccepted(commit.Instance)
 
 	r.updateCommittedUpTo()
 
-	r.recordInstanceMetadata(r.instanceSpace[commit.Instance])
+	r.recordInstanceMetadata(r.instanceSpace.get(commit.Instance))
 	r.recordCommands(commit.Command)
 }
 
 func (r *Replica) handleCommitShort(commit *paxosproto.CommitShort) {
-	inst := r.instanceSpace[commit.Instance]
+	inst := r.instanceSpace.get(commit.Instance)
 
 	dlog.Printf("Committing instance %d\n", commit.Instance)
+	r.observeBallot(commit.Ballot)
 
 	if inst == nil {
-		r.instanceSpace[commit.Instance] = &Instance{nil,
+		r.instanceSpace.set(commit.Instance, &Instance{nil,
 			commit.Ballot,
+			-1,
 			COMMITTED,
-			nil}
+			nil})
 	} else {
-		r.instanceSpace[commit.Instance].status = COMMITTED
-		r.instanceSpace[commit.Instance].ballot = commit.Ballot
-		if inst.lb != nil && inst.lb.clientProposals != nil {
-			for i := 0; i < len(inst.lb.clientProposals); i++ {
-				r.ProposeChan <- inst.lb.clientProposals[i]
-			}
-			inst.lb.clientProposals = nil
+		// we accepted the commands in this ballot
+		if inst.status != COMMITTED {
+			r.replyCommitted(inst)
 		}
+		inst.status = COMMITTED
+		inst.ballot = commit.Ballot
 	}
+	r.advanceAccepted(commit.Instance)
 
 	r.updateCommittedUpTo()
 
-	r.recordInstanceMetadata(r.instanceSpace[commit.Instance])
-}
-
-func (r *Replica) handlePrepareReply(preply *paxosproto.PrepareReply) {
-	inst := r.instanceSpace[preply.Instance]
-
-	if inst.status != PREPARING {
-		// TODO: should replies for non-current ballots be ignored?
-		// we've moved on -- these are delayed replies, so just ignore
-		return
-	}
-
-	if preply.OK == TRUE {
-		inst.lb.prepareOKs++
-
-		if preply.Ballot > inst.lb.maxRecvBallot {
-			inst.cmds = preply.Command
-			inst.lb.maxRecvBallot = preply.Ballot
-			if inst.lb.clientProposals != nil {
-				// there is already a competing command for this instance,
-				// so we put the client proposal back in the queue so that
-				// we know to try it in another instance
-				for i := 0; i < len(inst.lb.clientProposals); i++ {
-					r.ProposeChan <- inst.lb.clientProposals[i]
-				}
-				inst.lb.clientProposals = nil
-			}
-		}
-
-		if inst.lb.prepareOKs+1 > r.N>>1 {
-			inst.status = PREPARED
-			inst.lb.nacks = 0
-			if inst.ballot > r.defaultBallot {
-				r.defaultBallot = inst.ballot
-			}
-			r.recordInstanceMetadata(r.instanceSpace[preply.Instance])
-			r.sync()
-			r.bcastAccept(preply.Instance, inst.ballot, inst.cmds)
-		}
-	} else {
-		// TODO: there is probably another active leader
-		inst.lb.nacks++
-		if preply.Ballot > inst.lb.maxRecvBallot {
-			inst.lb.maxRecvBallot = preply.Ballot
-		}
-		if inst.lb.nacks >= r.N>>1 {
-			if inst.lb.clientProposals != nil {
-				// try the proposals in another instance
-				for i := 0; i < len(inst.lb.clientProposals); i++ {
-					r.ProposeChan <- inst.lb.clientProposals[i]
-				}
-				inst.lb.clientProposals = nil
-			}
-		}
-	}
+	r.recordInstanceMetadata(r.instanceSpace.get(commit.Instance))
 }
 
 func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
-	inst := r.instanceSpace[areply.Instance]
-	if inst.status != PREPARED && inst.status != ACCEPTED {
+	inst := r.instanceSpace.get(areply.Instance)
+	if inst == nil || inst.lb == nil || inst.status != PREPARED && inst.status != ACCEPTED {
 		// we've move on, these are delayed replies, so just ignore
 		return
 	}
 	if areply.OK == TRUE {
+		if areply.Ballot != inst.ballot {
+			// a reply to an earlier ballot
+			return
+		}
 		inst.lb.acceptOKs++
 		if inst.lb.acceptOKs+1 > r.N>>1 {
-			inst = r.instanceSpace[areply.Instance]
+			inst = r.instanceSpace.get(areply.Instance)
 			inst.status = COMMITTED
-			if inst.lb.clientProposals != nil && !r.Dreply {
-				// give client the all clear
-				for i := 0; i < len(inst.cmds); i++ {
-					propreply := &genericsmrproto.ProposeReplyTS{
-						TRUE,
-						inst.lb.clientProposals[i].CommandId,
-						state.NIL,
-						inst.lb.clientProposals[i].Timestamp}
-					r.ReplyProposeTS(propreply, inst.lb.clientProposals[i].Reply)
-				}
-			}
+			r.replyCommitted(inst)
 
-			r.recordInstanceMetadata(r.instanceSpace[areply.Instance])
+			r.recordInstanceMetadata(r.instanceSpace.get(areply.Instance))
 			r.sync() //is this necessary?
 			r.updateCommittedUpTo()
-			r.bcastCommit(areply.Instance, inst.ballot, inst.cmds)
+			r.extendLease(inst.lb.sentAt)
+			r.bcastCommit(areply.Instance, inst.ballot, inst.vballot, inst.cmds)
 		}
 	} else {
-		// TODO: there is probably another active leader
+		// an acceptor promised a higher ballot to another leader
 		inst.lb.nacks++
 		if areply.Ballot > inst.lb.maxRecvBallot {
 			inst.lb.maxRecvBallot = areply.Ballot
 		}
-		if inst.lb.nacks >= r.N>>1 {
-			// TODO
-		}
+		// the new leader decides the instance, and may choose the proposals
+		// if enough acceptors took them: they wait for its Accept or Commit
+		r.observeBallot(areply.Ballot)
+	}
+}
+
+// replyClient sends a reply on a client connection, or on the writer of a
+// follower's forwarded proposals. The event loop and the executor both reply.
+func (r *Replica) replyClient(reply *genericsmrproto.ProposeReplyTS, w *bufio.Writer) {
+	r.clientMutex.Lock()
+	r.ReplyProposeTS(reply, w)
+	r.clientMutex.Unlock()
+}
+
+// replyCommitted gives the clients of a committed instance the all clear,
+// unless they wait for execution
+func (r *Replica) replyCommitted(inst *Instance) {
+	if inst.lb == nil || inst.lb.clientProposals == nil || r.Dreply {
+		return
+	}
+	for i := 0; i < len(inst.cmds); i++ {
+		propreply := &genericsmrproto.ProposeReplyTS{
+			TRUE,
+			inst.lb.clientProposals[i].CommandId,
+			state.NIL,
+			inst.lb.clientProposals[i].Timestamp}
+		r.replyClient(propreply, inst.lb.clientProposals[i].Reply)
 	}
 }
 
@@ -704,38 +777,37 @@ func (r *Replica) executeCommands() {
 	for !r.Shutdown {
 		executed := false
 
+		r.readsMutex.Lock()
+		ready := r.readsReady
+		r.readsReady = nil
+		r.readsMutex.Unlock()
+		r.replyReads(ready)
+
 		for i <= r.committedUpTo {
-			if r.instanceSpace[i].cmds != nil {
-				inst := r.instanceSpace[i]
+			if r.instanceSpace.get(i).cmds != nil {
+				inst := r.instanceSpace.get(i)
 				var val state.Value
 				for j := 0; j < len(inst.cmds); j++ {
 					//log.Println("length of cmds: ", len(inst.cmds))
 					val = inst.cmds[j].Execute(r.State)
-					if r.IsLeader && r.Dreply && inst.lb != nil && inst.lb.clientProposals != nil {
+					if r.Dreply && inst.lb != nil && inst.lb.clientProposals != nil {
 						propreply := &genericsmrproto.ProposeReplyTS{
 							TRUE,
 							inst.lb.clientProposals[j].CommandId,
 							val,
 							inst.lb.clientProposals[j].Timestamp}
-						r.ReplyProposeTS(propreply, inst.lb.clientProposals[j].Reply)
+						r.replyClient(propreply, inst.lb.clientProposals[j].Reply)
 					}
 				}
+				r.readsMutex.Lock()
 				r.executedUpTo++
+				proposals := r.readsPending[i]
+				delete(r.readsPending, i)
+				r.readsMutex.Unlock()
 				executed = true
 
 				// reply to pending read request after execution
-				proposals := r.readsPending[i]
-				r.readsPending[i] = nil
-				if proposals != nil {
-					for _, prop := range proposals {
-						propreply := &genericsmrproto.ProposeReplyTS{
-							TRUE,
-							prop.CommandId,
-							val,
-							prop.Timestamp}
-						r.ReplyProposeTS(propreply, prop.Reply)
-					}
-				}
+				r.replyReads(proposals)
 
 				i++
 			} else {
@@ -783,6 +855,14 @@ func (r *Replica) bcastRead(readId int32) {
 	}
 }
 
+// advanceAccepted records that this replica accepted an instance. The leader
+// accepts the instances it proposes.
+func (r *Replica) advanceAccepted(instance int32) {
+	if instance > r.acceptedUpTo {
+		r.acceptedUpTo = instance
+	}
+}
+
 // replica responds with highest slot accepted
 func (r *Replica) handleRead(read *paxosproto.Read) {
 	var readReply *paxosproto.ReadReply
@@ -793,10 +873,10 @@ func (r *Replica) handleRead(read *paxosproto.Read) {
 	r.replyRead(read.RequesterId, readReply)
 }
 
-// pick the highest accepted slot, respond to client
+// pick the highest accepted slot, respond to client once it is executed
 func (r *Replica) handleReadReply(readReply *paxosproto.ReadReply) {
 	// if quorom has already been received, return
-	if r.readOKs[readReply.ReadId] == r.N>>1 {
+	if r.readProposal[readReply.ReadId] == nil {
 		return
 	}
 
@@ -813,31 +893,9 @@ func (r *Replica) handleReadReply(readReply *paxosproto.ReadReply) {
 			}
 		}
 
-		r.readData[readReply.ReadId] = nil
-		if largestSlot == -1 {
-			propreply := &genericsmrproto.ProposeReplyTS{
-				TRUE,
-				r.readProposal[readReply.ReadId].CommandId,
-				0,
-				r.readProposal[readReply.ReadId].Timestamp}
-			r.ReplyProposeTS(propreply, r.readProposal[readReply.ReadId].Reply)
-			r.readProposal[readReply.ReadId] = nil
-			return
-		}
-
-		if largestSlot <= r.executedUpTo {
-			propreply := &genericsmrproto.ProposeReplyTS{
-				TRUE,
-				r.readProposal[readReply.ReadId].CommandId,
-				r.instanceSpace[largestSlot].cmds[0].V,
-				r.readProposal[readReply.ReadId].Timestamp}
-			r.ReplyProposeTS(propreply, r.readProposal[readReply.ReadId].Reply)
-
-			r.readProposal[readReply.ReadId] = nil
-		} else {
-			r.readsPending[largestSlot] = append(
-				r.readsPending[largestSlot],
-				r.readProposal[readReply.ReadId])
-		}
+		r.readAfter(largestSlot, r.readProposal[readReply.ReadId])
+		delete(r.readProposal, readReply.ReadId)
+		delete(r.readOKs, readReply.ReadId)
+		delete(r.readData, readReply.ReadId)
 	}
 }
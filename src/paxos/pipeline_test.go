@@ -0,0 +1,75 @@
+package paxos
+
+import (
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/paxosproto"
+	"gus-epaxos/src/state"
+	"testing"
+)
+
+func TestInstanceLogGrows(t *testing.T) {
+	l := new(instanceLog)
+	if l.get(0) != nil || l.get(-1) != nil || l.size() != 0 {
+		t.Fatalf("an empty log has instances")
+	}
+	far := int32(3*LOG_SEGMENT_SIZE + 5)
+	inst := &Instance{}
+	l.set(far, inst)
+	if l.get(far) != inst || l.get(far-1) != nil || l.get(far+LOG_SEGMENT_SIZE) != nil {
+		t.Fatalf("the log lost instance %d", far)
+	}
+	if l.size() != LOG_SEGMENT_SIZE {
+		t.Fatalf("the log allocated %d instances for one segment", l.size())
+	}
+}
+
+func TestWindowLimitsInFlight(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0 := net.replicas[0]
+	r0.window = 2
+
+	r0.startCampaign()
+	net.DeliverAll()
+	net.propose(0, 1, 10)
+	net.propose(0, 2, 20)
+	if r0.windowOpen() || r0.inFlight() != 2 {
+		t.Fatalf("the window is open with %d instances in flight", r0.inFlight())
+	}
+
+	net.DeliverAll()
+	if !r0.windowOpen() || r0.inFlight() != 0 {
+		t.Fatalf("the window is closed with %d instances in flight", r0.inFlight())
+	}
+
+	var stats genericsmrproto.WindowStatsReply
+	r0.WindowStats(nil, &stats)
+	if stats.Window != 2 || stats.Started != 2 || stats.MaxInFlight != 2 {
+		t.Fatalf("wrong window stats %+v", stats)
+	}
+}
+
+func TestRequeueWithFullProposeChan(t *testing.T) {
+	net := newTestNet(t, 3, false)
+	r0 := net.replicas[0]
+
+	r0.startCampaign()
+	net.DeliverAll()
+	net.propose(0, 1, 10)
+	net.Drop(0, 1)
+	net.Drop(0, 2)
+
+	// replica 1 takes over the instance while the clients keep ProposeChan full
+	propose, _ := smrtest.Propose(20, state.Command{state.PUT, 2, 20})
+	for len(r0.ProposeChan) < cap(r0.ProposeChan) {
+		r0.ProposeChan <- propose
+	}
+	ballot := r0.defaultBallot + 1
+	r0.handleAccept(&paxosproto.Accept{1, 0, ballot, ballot, []state.Command{{state.PUT, 3, 30}}})
+	if len(r0.pending) != 1 || r0.pending[0].CommandId != 10 {
+		t.Fatalf("replica 0 did not put its proposal back")
+	}
+	if r0.nextProposal().CommandId != 10 || r0.queued() != cap(r0.ProposeChan) {
+		t.Fatalf("the proposal put back is not handled first")
+	}
+}
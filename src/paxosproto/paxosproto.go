@@ -20,17 +20,29 @@ type Prepare struct {
 	ToInfinity uint8
 }
 
+// A Prepare to infinity is answered with every instance from Instance on that
+// the acceptor knows a value for
 type PrepareReply struct {
-	Instance int32
-	OK       uint8
-	Ballot   int32
-	Command  []state.Command
+	AcceptorId int32
+	Instance   int32
+	OK         uint8
+	Ballot     int32 // the ballot promised, or the higher one that rejects the Prepare
+	Entries    []PrepareEntry
+}
+
+type PrepareEntry struct {
+	Instance  int32
+	Ballot    int32
+	VBallot   int32 // ballot the commands were first proposed with
+	Committed uint8
+	Command   []state.Command
 }
 
 type Accept struct {
 	LeaderId int32
 	Instance int32
 	Ballot   int32
+	VBallot  int32 // ballot the commands were first proposed with
 	Command  []state.Command
 }
 
@@ -44,6 +56,7 @@ type Commit struct {
 	LeaderId int32
 	Instance int32
 	Ballot   int32
+	VBallot  int32 // ballot the commands were first proposed with
 	Command  []state.Command
 }
 
@@ -63,3 +76,18 @@ type ReadReply struct {
 	Instance int32
 	ReadId   int32
 }
+
+// A follower forwards a client proposal to the leader, and relays the reply
+type Forward struct {
+	ReplicaId int32
+	ForwardId int32
+	Command   state.Command
+	Timestamp int64
+}
+
+type ForwardReply struct {
+	ForwardId int32
+	OK        uint8
+	Value     state.Value // the leader to redirect to, if not OK
+	Timestamp int64
+}
@@ -124,20 +124,85 @@ func (p *PrepareReplyCache) Put(t *PrepareReply) {
 	p.mu.Unlock()
 }
 func (t *PrepareReply) Marshal(wire io.Writer) {
-	var b [10]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
+	bs = b[:13]
+	tmp32 := t.AcceptorId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Entries))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Entries[i].Marshal(wire)
+	}
+}
+
+func (t *PrepareReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.AcceptorId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]PrepareEntry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Entries[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *PrepareEntry) Marshal(wire io.Writer) {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
 	tmp32 := t.Instance
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	bs[4] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[5] = byte(tmp32 >> 24)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 8)
-	bs[8] = byte(tmp32)
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	tmp32 = t.VBallot
+	bs[8] = byte(tmp32 >> 24)
+	bs[9] = byte(tmp32 >> 16)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32)
+	bs[12] = byte(t.Committed)
 	wire.Write(bs)
 	bs = b[:]
 	alen1 := int64(len(t.Command))
@@ -149,21 +214,22 @@ func (t *PrepareReply) Marshal(wire io.Writer) {
 	}
 }
 
-func (t *PrepareReply) Unmarshal(rr io.Reader) error {
+func (t *PrepareEntry) Unmarshal(rr io.Reader) error {
 	var wire byteReader
 	var ok bool
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [10]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
 	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.OK = uint8(bs[4])
-	t.Ballot = int32(((uint32(bs[5]) << 24) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 8) | uint32(bs[8])))
+	t.Ballot = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.VBallot = int32(((uint32(bs[8]) << 24) | (uint32(bs[9]) << 16) | (uint32(bs[10]) << 8) | uint32(bs[11])))
+	t.Committed = uint8(bs[12])
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
@@ -212,9 +278,9 @@ func (p *AcceptCache) Put(t *Accept) {
 	p.mu.Unlock()
 }
 func (t *Accept) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:16]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -230,6 +296,11 @@ func (t *Accept) Marshal(wire io.Writer) {
 	bs[9] = byte(tmp32 >> 16)
 	bs[10] = byte(tmp32 >> 8)
 	bs[11] = byte(tmp32)
+	tmp32 = t.VBallot
+	bs[12] = byte(tmp32 >> 24)
+	bs[13] = byte(tmp32 >> 16)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32)
 	wire.Write(bs)
 	bs = b[:]
 	alen1 := int64(len(t.Command))
@@ -247,15 +318,16 @@ func (t *Accept) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.Ballot = int32(((uint32(bs[8]) << 24) | (uint32(bs[9]) << 16) | (uint32(bs[10]) << 8) | uint32(bs[11])))
+	t.VBallot = int32(((uint32(bs[12]) << 24) | (uint32(bs[13]) << 16) | (uint32(bs[14]) << 8) | uint32(bs[15])))
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
@@ -371,9 +443,9 @@ func (p *CommitCache) Put(t *Commit) {
 	p.mu.Unlock()
 }
 func (t *Commit) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
+	bs = b[:16]
 	tmp32 := t.LeaderId
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -389,6 +461,11 @@ func (t *Commit) Marshal(wire io.Writer) {
 	bs[9] = byte(tmp32 >> 16)
 	bs[10] = byte(tmp32 >> 8)
 	bs[11] = byte(tmp32)
+	tmp32 = t.VBallot
+	bs[12] = byte(tmp32 >> 24)
+	bs[13] = byte(tmp32 >> 16)
+	bs[14] = byte(tmp32 >> 8)
+	bs[15] = byte(tmp32)
 	wire.Write(bs)
 	bs = b[:]
 	alen1 := int64(len(t.Command))
@@ -406,15 +483,16 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [12]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:12]
-	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
 		return err
 	}
 	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
 	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	t.Ballot = int32(((uint32(bs[8]) << 24) | (uint32(bs[9]) << 16) | (uint32(bs[10]) << 8) | uint32(bs[11])))
+	t.VBallot = int32(((uint32(bs[12]) << 24) | (uint32(bs[13]) << 16) | (uint32(bs[14]) << 8) | uint32(bs[15])))
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
@@ -632,3 +710,169 @@ func (t *ReadReply) Unmarshal(wire io.Reader) error {
 	t.ReadId = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
+
+func (t *Forward) New() fastrpc.Serializable {
+	return new(Forward)
+}
+func (t *Forward) BinarySize() (nbytes int, sizeKnown bool) {
+	return 33, true
+}
+
+type ForwardCache struct {
+	mu    sync.Mutex
+	cache []*Forward
+}
+
+func NewForwardCache() *ForwardCache {
+	c := &ForwardCache{}
+	c.cache = make([]*Forward, 0)
+	return c
+}
+
+func (p *ForwardCache) Get() *Forward {
+	var t *Forward
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Forward{}
+	}
+	return t
+}
+func (p *ForwardCache) Put(t *Forward) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Forward) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.ForwardId
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	t.Command.Marshal(wire)
+	bs = b[:8]
+	tmp64 := t.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *Forward) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.ForwardId = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Timestamp = int64(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	return nil
+}
+
+func (t *ForwardReply) New() fastrpc.Serializable {
+	return new(ForwardReply)
+}
+func (t *ForwardReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 21, true
+}
+
+type ForwardReplyCache struct {
+	mu    sync.Mutex
+	cache []*ForwardReply
+}
+
+func NewForwardReplyCache() *ForwardReplyCache {
+	c := &ForwardReplyCache{}
+	c.cache = make([]*ForwardReply, 0)
+	return c
+}
+
+func (p *ForwardReplyCache) Get() *ForwardReply {
+	var t *ForwardReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &ForwardReply{}
+	}
+	return t
+}
+func (p *ForwardReplyCache) Put(t *ForwardReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *ForwardReply) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:5]
+	tmp32 := t.ForwardId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	bs[4] = byte(t.OK)
+	wire.Write(bs)
+	t.Value.Marshal(wire)
+	bs = b[:8]
+	tmp64 := t.Timestamp
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	wire.Write(bs)
+}
+
+func (t *ForwardReply) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:5]
+	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
+		return err
+	}
+	t.ForwardId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.OK = uint8(bs[4])
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Timestamp = int64(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	return nil
+}
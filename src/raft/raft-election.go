@@ -0,0 +1,146 @@
+package raft
+
+import (
+	"gus-epaxos/src/raftproto"
+	"gus-epaxos/src/state"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Leader election. A follower that hears nothing from a leader for its
+// election timeout starts a new term and asks the others for their votes.
+// Replicas vote once per term, for candidates whose log is at least as
+// up-to-date as theirs, so that the leader of a term has every committed
+// entry. Timeouts are randomized, so that candidates rarely split the votes.
+// A new leader appends an empty entry of its term, through which it commits
+// the entries of the terms before.
+
+// How often the leader sends an AppendEntries to a follower with nothing new
+const HEARTBEAT = 50 * time.Millisecond
+
+// Shortest election timeout; each one is drawn up to twice as long
+const ELECTION_TIMEOUT = 300 * time.Millisecond
+
+// campaign is an election in progress
+type campaign struct {
+	term  int32
+	votes []bool
+	oks   int
+}
+
+func (r *Replica) resetElectionTimer() {
+	r.electionDeadline = time.Now().Add(ELECTION_TIMEOUT + time.Duration(rand.Int63n(int64(ELECTION_TIMEOUT))))
+}
+
+// startElection runs for leader in the next term
+func (r *Replica) startElection() {
+	r.currentTerm++
+	r.votedFor = r.Id
+	r.leaderId = -1
+	r.IsLeader = false
+	r.recordTerm()
+	r.sync()
+	r.resetElectionTimer()
+
+	r.campaign = &campaign{r.currentTerm, make([]bool, r.N), 0}
+	log.Printf("Replica %d campaigning in term %d\n", r.Id, r.currentTerm)
+
+	r.addVote(r.Id)
+	if r.campaign == nil {
+		return
+	}
+	rv := &raftproto.RequestVote{r.currentTerm, r.Id, r.lastLogIndex(), r.log[r.lastLogIndex()].Term}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			r.SendMsg(q, r.requestVoteRPC, rv)
+		}
+	}
+}
+
+func (r *Replica) addVote(voter int32) {
+	c := r.campaign
+	if c.votes[voter] {
+		return
+	}
+	c.votes[voter] = true
+	c.oks++
+	if c.oks > r.N>>1 {
+		r.becomeLeader()
+	}
+}
+
+func (r *Replica) handleRequestVote(rv *raftproto.RequestVote) {
+	r.observeTerm(rv.Term)
+	rreply := &raftproto.RequestVoteReply{r.currentTerm, r.Id, FALSE}
+
+	lastTerm := r.log[r.lastLogIndex()].Term
+	upToDate := rv.LastLogTerm > lastTerm || (rv.LastLogTerm == lastTerm && rv.LastLogIndex >= r.lastLogIndex())
+	if rv.Term == r.currentTerm && (r.votedFor < 0 || r.votedFor == rv.CandidateId) && upToDate {
+		r.votedFor = rv.CandidateId
+		r.recordTerm()
+		r.sync()
+		r.resetElectionTimer()
+		rreply.VoteGranted = TRUE
+	}
+	r.SendMsg(rv.CandidateId, r.requestVoteReplyRPC, rreply)
+}
+
+func (r *Replica) handleRequestVoteReply(rreply *raftproto.RequestVoteReply) {
+	r.observeTerm(rreply.Term)
+	if r.campaign == nil || rreply.Term != r.campaign.term || rreply.VoteGranted == FALSE {
+		// we've moved on, or lost this vote
+		return
+	}
+	r.addVote(rreply.VoterId)
+}
+
+func (r *Replica) becomeLeader() {
+	r.campaign = nil
+	r.IsLeader = true
+	r.leaderId = r.Id
+	log.Printf("Replica %d is the leader in term %d\n", r.Id, r.currentTerm)
+
+	for q := range r.nextIndex {
+		r.nextIndex[q] = r.lastLogIndex() + 1
+		r.matchIndex[q] = 0
+	}
+	r.appendEntries([]raftproto.Entry{{r.currentTerm, state.Command{state.NONE, 0, 0}}})
+}
+
+// observeTerm moves on to a higher term, and steps down
+func (r *Replica) observeTerm(term int32) {
+	if term <= r.currentTerm {
+		return
+	}
+	if r.IsLeader || r.campaign != nil {
+		log.Printf("Replica %d steps down for term %d\n", r.Id, term)
+	}
+	r.currentTerm = term
+	r.votedFor = -1
+	r.leaderId = -1
+	r.IsLeader = false
+	r.campaign = nil
+	r.recordTerm()
+	r.sync()
+}
+
+// checkElection sends the heartbeats of the leader, and runs for leader when
+// the election timeout expires
+func (r *Replica) checkElection(now time.Time) {
+	if r.IsLeader {
+		for q := int32(0); q < int32(r.N); q++ {
+			if q != r.Id && now.Sub(r.lastSent[q]) >= HEARTBEAT {
+				r.sendAppendEntries(q)
+			}
+		}
+		return
+	}
+
+	if now.After(r.electionDeadline) {
+		if r.campaign == nil {
+			log.Printf("Replica %d has not heard from leader %d\n", r.Id, r.leaderId)
+		}
+		r.startElection()
+	}
+}
@@ -0,0 +1,451 @@
+package raft
+
+import (
+	"encoding/binary"
+	"gus-epaxos/src/dlog"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/raftproto"
+	"gus-epaxos/src/state"
+	"io"
+	"log"
+	"time"
+)
+
+const TRUE = uint8(1)
+const FALSE = uint8(0)
+
+const CLOCK = 1000 * 10
+
+// Most entries in an AppendEntries, for followers that lag behind
+const MAX_APPEND_ENTRIES = 1024
+
+type Replica struct {
+	*genericsmr.Replica    // extends a generic Paxos replica
+	requestVoteChan        chan fastrpc.Serializable
+	requestVoteReplyChan   chan fastrpc.Serializable
+	appendEntriesChan      chan fastrpc.Serializable
+	appendEntriesReplyChan chan fastrpc.Serializable
+	requestVoteRPC         uint8
+	requestVoteReplyRPC    uint8
+	appendEntriesRPC       uint8
+	appendEntriesReplyRPC  uint8
+	IsLeader               bool
+	currentTerm            int32
+	votedFor               int32 // in the current term, -1 if none
+	leaderId               int32 // of the current term, -1 if unknown
+	log                    []raftproto.Entry
+	proposals              map[int32]*genericsmr.Propose // client proposals, by log index
+	commitIndex            int32
+	lastApplied            int32
+	nextIndex              []int32 // next entry to send to each follower, as the leader
+	matchIndex             []int32 // last entry known to be replicated on each follower, as the leader
+	lastSent               []time.Time
+	campaign               *campaign           // election in progress, if any
+	electionDeadline       time.Time           // when a follower runs for leader if it has not heard from one
+	batcher                *genericsmr.Batcher // adaptive batching of client proposals
+	beTheLeaderChan        chan bool
+}
+
+func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
+	r := newReplica(id, peerAddrList, thrifty, exec, dreply, durable, maxBatch, maxBatchDelay)
+
+	go r.run()
+
+	return r
+}
+
+func newReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, maxBatch int, maxBatchDelay time.Duration) *Replica {
+	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, 3*genericsmr.CHAN_BUFFER_SIZE),
+		0, 0, 0, 0,
+		false,
+		0,
+		-1,
+		-1,
+		// the log starts with an empty entry, so that every entry has one before it
+		[]raftproto.Entry{{0, state.Command{state.NONE, 0, 0}}},
+		make(map[int32]*genericsmr.Propose),
+		0,
+		0,
+		make([]int32, len(peerAddrList)),
+		make([]int32, len(peerAddrList)),
+		make([]time.Time, len(peerAddrList)),
+		nil,
+		time.Time{},
+		genericsmr.NewBatcher(maxBatch, maxBatchDelay),
+		make(chan bool, 1),
+	}
+
+	r.Durable = durable
+	r.resetElectionTimer()
+
+	r.requestVoteRPC = r.RegisterRPC(new(raftproto.RequestVote), r.requestVoteChan)
+	r.requestVoteReplyRPC = r.RegisterRPC(new(raftproto.RequestVoteReply), r.requestVoteReplyChan)
+	r.appendEntriesRPC = r.RegisterRPC(new(raftproto.AppendEntries), r.appendEntriesChan)
+	r.appendEntriesReplyRPC = r.RegisterRPC(new(raftproto.AppendEntriesReply), r.appendEntriesReplyChan)
+
+	return r
+}
+
+// write the current term and vote to stable storage
+func (r *Replica) recordTerm() {
+	if !r.Durable {
+		return
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(r.currentTerm))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(r.votedFor))
+	r.StableStore.Write(b[:])
+}
+
+// write log entries to stable storage
+func (r *Replica) recordEntries(entries []raftproto.Entry) {
+	if !r.Durable {
+		return
+	}
+
+	var b [4]byte
+	for i := range entries {
+		binary.LittleEndian.PutUint32(b[:], uint32(entries[i].Term))
+		r.StableStore.Write(b[:])
+		entries[i].Command.Marshal(io.Writer(r.StableStore))
+	}
+}
+
+// sync with the stable store
+func (r *Replica) sync() {
+	if !r.Durable {
+		return
+	}
+
+	r.StableStore.Sync()
+}
+
+/* RPC to be called by master */
+
+func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
+	// the event loop runs the election
+	select {
+	case r.beTheLeaderChan <- true:
+	default:
+	}
+	return nil
+}
+
+// BatchStats reports the sizes of the batches appended by this replica
+func (r *Replica) BatchStats(args *genericsmrproto.BatchStatsArgs, reply *genericsmrproto.BatchStatsReply) error {
+	r.batcher.Stats(reply)
+	return nil
+}
+
+/* ============= */
+
+var clockChan chan bool
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(CLOCK)
+		clockChan <- true
+	}
+}
+
+/* Main event processing loop */
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+
+	dlog.Println("Waiting for client connections")
+
+	go r.WaitForClientConnections()
+
+	if r.Id == 0 {
+		r.startElection()
+	}
+
+	clockChan = make(chan bool, 1)
+	go r.clock()
+
+	onOffProposeChan := r.ProposeChan
+
+	for !r.Shutdown {
+
+		select {
+
+		case <-clockChan:
+			//activate the new proposals channel once enough commands are queued for a batch,
+			//unless an election is in progress
+			r.checkElection(time.Now())
+			if r.campaign == nil && r.batcher.Ready(len(r.ProposeChan)) {
+				onOffProposeChan = r.ProposeChan
+			}
+			break
+
+		case <-r.beTheLeaderChan:
+			if !r.IsLeader && r.campaign == nil {
+				r.startElection()
+			}
+			break
+
+		case propose := <-onOffProposeChan:
+			//got a Propose from a client
+			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
+			r.handlePropose(propose)
+			//deactivate the new proposals channel to prioritize the handling of protocol messages
+			onOffProposeChan = nil
+			break
+
+		case requestVoteS := <-r.requestVoteChan:
+			requestVote := requestVoteS.(*raftproto.RequestVote)
+			//got a RequestVote message
+			dlog.Printf("Received RequestVote from replica %d, for term %d\n", requestVote.CandidateId, requestVote.Term)
+			r.handleRequestVote(requestVote)
+			break
+
+		case requestVoteReplyS := <-r.requestVoteReplyChan:
+			requestVoteReply := requestVoteReplyS.(*raftproto.RequestVoteReply)
+			//got a RequestVote reply
+			dlog.Printf("Received RequestVoteReply from replica %d, for term %d\n", requestVoteReply.VoterId, requestVoteReply.Term)
+			r.handleRequestVoteReply(requestVoteReply)
+			break
+
+		case appendEntriesS := <-r.appendEntriesChan:
+			appendEntries := appendEntriesS.(*raftproto.AppendEntries)
+			//got an AppendEntries message
+			dlog.Printf("Received AppendEntries from replica %d, after index %d\n", appendEntries.LeaderId, appendEntries.PrevLogIndex)
+			r.handleAppendEntries(appendEntries)
+			break
+
+		case appendEntriesReplyS := <-r.appendEntriesReplyChan:
+			appendEntriesReply := appendEntriesReplyS.(*raftproto.AppendEntriesReply)
+			//got an AppendEntries reply
+			dlog.Printf("Received AppendEntriesReply from replica %d, up to index %d\n", appendEntriesReply.FollowerId, appendEntriesReply.MatchIndex)
+			r.handleAppendEntriesReply(appendEntriesReply)
+			break
+		}
+	}
+}
+
+func (r *Replica) lastLogIndex() int32 {
+	return int32(len(r.log) - 1)
+}
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	if !r.IsLeader {
+		r.redirect(propose)
+		return
+	}
+
+	batchSize := r.batcher.Size(len(r.ProposeChan) + 1)
+
+	entries := make([]raftproto.Entry, batchSize)
+	entries[0] = raftproto.Entry{r.currentTerm, propose.Command}
+	r.proposals[r.lastLogIndex()+1] = propose
+
+	for i := 1; i < batchSize; i++ {
+		prop := <-r.ProposeChan
+		entries[i] = raftproto.Entry{r.currentTerm, prop.Command}
+		r.proposals[r.lastLogIndex()+1+int32(i)] = prop
+	}
+	r.batcher.Record(batchSize, len(r.ProposeChan))
+
+	r.appendEntries(entries)
+}
+
+// appendEntries adds entries to the log of the leader, and sends them to the
+// followers
+func (r *Replica) appendEntries(entries []raftproto.Entry) {
+	r.log = append(r.log, entries...)
+	r.recordEntries(entries)
+	r.sync()
+	r.matchIndex[r.Id] = r.lastLogIndex()
+	dlog.Printf("Appended entries up to %d in term %d\n", r.lastLogIndex(), r.currentTerm)
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			r.sendAppendEntries(q)
+		}
+	}
+	r.advanceCommitIndex()
+}
+
+// sendAppendEntries sends a follower the entries that follow the last one it
+// was sent. Entries are assumed to arrive: if they do not, the follower
+// rejects the next AppendEntries and the leader goes back.
+func (r *Replica) sendAppendEntries(q int32) {
+	next := r.nextIndex[q]
+	last := r.lastLogIndex()
+	if last-next+1 > MAX_APPEND_ENTRIES {
+		last = next + MAX_APPEND_ENTRIES - 1
+	}
+	r.nextIndex[q] = last + 1
+	r.lastSent[q] = time.Now()
+	r.SendMsg(q, r.appendEntriesRPC, &raftproto.AppendEntries{
+		r.currentTerm,
+		r.Id,
+		next - 1,
+		r.log[next-1].Term,
+		r.commitIndex,
+		r.log[next : last+1]})
+}
+
+func (r *Replica) handleAppendEntries(ae *raftproto.AppendEntries) {
+	areply := &raftproto.AppendEntriesReply{r.currentTerm, r.Id, FALSE, r.lastLogIndex()}
+	if ae.Term < r.currentTerm {
+		r.SendMsg(ae.LeaderId, r.appendEntriesReplyRPC, areply)
+		return
+	}
+
+	r.observeTerm(ae.Term)
+	if r.campaign != nil {
+		// another replica won the election of this term
+		r.campaign = nil
+	}
+	r.leaderId = ae.LeaderId
+	r.resetElectionTimer()
+	areply.Term = r.currentTerm
+
+	if ae.PrevLogIndex > r.lastLogIndex() {
+		r.SendMsg(ae.LeaderId, r.appendEntriesReplyRPC, areply)
+		return
+	}
+	if term := r.log[ae.PrevLogIndex].Term; term != ae.PrevLogTerm {
+		// skip the whole term that does not match
+		i := ae.PrevLogIndex
+		for i > r.commitIndex && r.log[i-1].Term == term {
+			i--
+		}
+		areply.MatchIndex = i - 1
+		r.SendMsg(ae.LeaderId, r.appendEntriesReplyRPC, areply)
+		return
+	}
+
+	for i, e := range ae.Entries {
+		index := ae.PrevLogIndex + 1 + int32(i)
+		if index <= r.lastLogIndex() {
+			if r.log[index].Term == e.Term {
+				continue
+			}
+			r.truncateLog(index)
+		}
+		r.log = append(r.log, ae.Entries[i:]...)
+		r.recordEntries(ae.Entries[i:])
+		r.sync()
+		break
+	}
+
+	lastNew := ae.PrevLogIndex + int32(len(ae.Entries))
+	if ae.LeaderCommit > r.commitIndex {
+		r.commitIndex = ae.LeaderCommit
+		if lastNew < r.commitIndex {
+			r.commitIndex = lastNew
+		}
+		r.applyCommitted()
+	}
+
+	areply.Success = TRUE
+	areply.MatchIndex = lastNew
+	r.SendMsg(ae.LeaderId, r.appendEntriesReplyRPC, areply)
+}
+
+// truncateLog drops the entries from index on, which a new leader replaced,
+// and redirects their clients
+func (r *Replica) truncateLog(index int32) {
+	log.Printf("Replica %d drops entries %d to %d\n", r.Id, index, r.lastLogIndex())
+	for i := index; i <= r.lastLogIndex(); i++ {
+		if propose, present := r.proposals[i]; present {
+			delete(r.proposals, i)
+			r.redirect(propose)
+		}
+	}
+	r.log = r.log[:index]
+}
+
+func (r *Replica) handleAppendEntriesReply(areply *raftproto.AppendEntriesReply) {
+	r.observeTerm(areply.Term)
+	if !r.IsLeader || areply.Term != r.currentTerm {
+		// we've moved on, these are delayed replies, so just ignore
+		return
+	}
+
+	q := areply.FollowerId
+	if areply.Success == FALSE {
+		// go back to where the logs may match
+		if areply.MatchIndex+1 < r.nextIndex[q] {
+			r.nextIndex[q] = areply.MatchIndex + 1
+		}
+		if r.nextIndex[q] <= r.matchIndex[q] {
+			r.nextIndex[q] = r.matchIndex[q] + 1
+		}
+		r.sendAppendEntries(q)
+		return
+	}
+
+	if areply.MatchIndex <= r.matchIndex[q] {
+		return
+	}
+	r.matchIndex[q] = areply.MatchIndex
+	if r.nextIndex[q] <= areply.MatchIndex {
+		r.nextIndex[q] = areply.MatchIndex + 1
+	}
+	r.advanceCommitIndex()
+	if r.nextIndex[q] <= r.lastLogIndex() && r.nextIndex[q] == areply.MatchIndex+1 {
+		// the follower catches up
+		r.sendAppendEntries(q)
+	}
+}
+
+// advanceCommitIndex commits the entries of the current term that a majority
+// has, and every entry before them
+func (r *Replica) advanceCommitIndex() {
+	for index := r.lastLogIndex(); index > r.commitIndex && r.log[index].Term == r.currentTerm; index-- {
+		count := 0
+		for _, match := range r.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count > r.N>>1 {
+			dlog.Printf("Committed entries up to %d\n", index)
+			r.commitIndex = index
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies the committed entries in log order, and replies to
+// their clients: when they commit, or once executed if Dreply is set
+func (r *Replica) applyCommitted() {
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		e := &r.log[r.lastApplied]
+		val := state.NIL
+		if r.Exec {
+			val = e.Command.Execute(r.State)
+		}
+
+		propose, present := r.proposals[r.lastApplied]
+		if !present {
+			continue
+		}
+		delete(r.proposals, r.lastApplied)
+		if !r.Dreply {
+			val = state.NIL
+		} else if !r.Exec {
+			continue
+		}
+		r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{TRUE, propose.CommandId, val, propose.Timestamp}, propose.Reply)
+	}
+}
+
+// redirect tells a client that this replica is not the leader. The reply
+// carries the leader this replica knows of in place of a value, or -1.
+func (r *Replica) redirect(propose *genericsmr.Propose) {
+	r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{FALSE, propose.CommandId, state.Value(r.leaderId), propose.Timestamp}, propose.Reply)
+}
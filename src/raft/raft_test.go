@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"gus-epaxos/src/fastrpc"
+	"gus-epaxos/src/genericsmr"
+	"gus-epaxos/src/genericsmr/smrtest"
+	"gus-epaxos/src/genericsmrproto"
+	"gus-epaxos/src/raftproto"
+	"gus-epaxos/src/state"
+	"testing"
+	"time"
+)
+
+// testNet runs the Raft handlers over an smrtest.Net
+type testNet struct {
+	*smrtest.Net
+	replicas []*Replica
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+	net := &testNet{nil, make([]*Replica, n)}
+	net.Net = smrtest.NewNet(t, n, func(id int, peers []string) *genericsmr.Replica {
+		net.replicas[id] = newReplica(id, peers, false, true, true, true, 4, time.Millisecond)
+		return net.replicas[id].Replica
+	})
+
+	r := net.replicas[0]
+	net.Messages = map[uint8]fastrpc.Serializable{
+		r.requestVoteRPC:        new(raftproto.RequestVote),
+		r.requestVoteReplyRPC:   new(raftproto.RequestVoteReply),
+		r.appendEntriesRPC:      new(raftproto.AppendEntries),
+		r.appendEntriesReplyRPC: new(raftproto.AppendEntriesReply),
+	}
+	net.Handle = func(to int, msg fastrpc.Serializable) {
+		r := net.replicas[to]
+		switch m := msg.(type) {
+		case *raftproto.RequestVote:
+			r.handleRequestVote(m)
+		case *raftproto.RequestVoteReply:
+			r.handleRequestVoteReply(m)
+		case *raftproto.AppendEntries:
+			r.handleAppendEntries(m)
+		case *raftproto.AppendEntriesReply:
+			r.handleAppendEntriesReply(m)
+		}
+	}
+	return net
+}
+
+// propose hands a batch of PUTs to a replica, and returns where their
+// replies go
+func (net *testNet) propose(id int, key state.Key, vals ...state.Value) *bytes.Buffer {
+	reply := new(bytes.Buffer)
+	w := bufio.NewWriter(reply)
+	r := net.replicas[id]
+	for _, val := range vals[1:] {
+		r.ProposeChan <- &genericsmr.Propose{&genericsmrproto.Propose{int32(val), state.Command{state.PUT, key, val}, 0}, w}
+	}
+	r.handlePropose(&genericsmr.Propose{&genericsmrproto.Propose{int32(vals[0]), state.Command{state.PUT, key, vals[0]}, 0}, w})
+	return reply
+}
+
+func TestReplication(t *testing.T) {
+	net := newTestNet(t, 3)
+	leader := net.replicas[0]
+	leader.startElection()
+	net.DeliverAll()
+	if !leader.IsLeader {
+		t.Fatalf("replica 0 has not become the leader")
+	}
+
+	// the three commands go in a single AppendEntries
+	reply := net.propose(0, 7, 10, 20, 30)
+	net.DeliverAll()
+	if leader.commitIndex != 4 {
+		t.Fatalf("the leader committed up to %d, want 4", leader.commitIndex)
+	}
+	for _, val := range []state.Value{10, 20, 30} {
+		smrtest.CheckReply(t, reply, int32(val), TRUE, val)
+	}
+
+	// followers learn of the commit with the next heartbeat
+	leader.checkElection(time.Now().Add(HEARTBEAT))
+	net.DeliverAll()
+	for _, r := range net.replicas {
+		if r.lastApplied != 4 || r.State.Store[7] != 30 {
+			t.Fatalf("replica %d applied up to %d, with key 7 at %d", r.Id, r.lastApplied, r.State.Store[7])
+		}
+	}
+}
+
+func TestLeaderChange(t *testing.T) {
+	net := newTestNet(t, 3)
+	net.replicas[0].startElection()
+	net.DeliverAll()
+
+	// the leader is cut off, and its entry does not commit
+	net.Down[0] = true
+	lost := net.propose(0, 7, 10)
+	net.DeliverAll()
+
+	r1 := net.replicas[1]
+	r1.checkElection(r1.electionDeadline.Add(time.Millisecond))
+	net.DeliverAll()
+	if !r1.IsLeader || r1.currentTerm != 2 {
+		t.Fatalf("replica 1 has not become the leader of term 2")
+	}
+	reply := net.propose(1, 7, 20)
+	net.DeliverAll()
+	smrtest.CheckReply(t, reply, 20, TRUE, 20)
+
+	// the old leader comes back, and its entry is replaced
+	net.Down[0] = false
+	r1.checkElection(time.Now().Add(HEARTBEAT))
+	net.DeliverAll()
+	r1.checkElection(time.Now().Add(2 * HEARTBEAT))
+	net.DeliverAll()
+	r0 := net.replicas[0]
+	if r0.IsLeader || r0.currentTerm != 2 || r0.lastApplied != 3 || r0.State.Store[7] != 20 {
+		t.Fatalf("replica 0 in term %d applied up to %d, with key 7 at %d", r0.currentTerm, r0.lastApplied, r0.State.Store[7])
+	}
+	smrtest.CheckReply(t, lost, 10, FALSE, 1)
+}
@@ -0,0 +1,41 @@
+package raftproto
+
+import (
+	"gus-epaxos/src/state"
+)
+
+type RequestVote struct {
+	Term         int32
+	CandidateId  int32
+	LastLogIndex int32
+	LastLogTerm  int32
+}
+
+type RequestVoteReply struct {
+	Term        int32
+	VoterId     int32
+	VoteGranted uint8
+}
+
+// AppendEntries replicates the entries of the leader that follow
+// PrevLogIndex, or is a heartbeat when there are none
+type AppendEntries struct {
+	Term         int32
+	LeaderId     int32
+	PrevLogIndex int32
+	PrevLogTerm  int32
+	LeaderCommit int32
+	Entries      []Entry
+}
+
+type Entry struct {
+	Term    int32
+	Command state.Command
+}
+
+type AppendEntriesReply struct {
+	Term       int32
+	FollowerId int32
+	Success    uint8
+	MatchIndex int32 // last index in the log of the follower that matches the leader, or where to try next
+}
@@ -0,0 +1,364 @@
+package raftproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"gus-epaxos/src/fastrpc"
+	"io"
+	"sync"
+)
+
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
+func (t *RequestVote) New() fastrpc.Serializable {
+	return new(RequestVote)
+}
+func (t *RequestVote) BinarySize() (nbytes int, sizeKnown bool) {
+	return 16, true
+}
+
+type RequestVoteCache struct {
+	mu    sync.Mutex
+	cache []*RequestVote
+}
+
+func NewRequestVoteCache() *RequestVoteCache {
+	c := &RequestVoteCache{}
+	c.cache = make([]*RequestVote, 0)
+	return c
+}
+
+func (p *RequestVoteCache) Get() *RequestVote {
+	var t *RequestVote
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &RequestVote{}
+	}
+	return t
+}
+func (p *RequestVoteCache) Put(t *RequestVote) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *RequestVote) Marshal(wire io.Writer) {
+	var b [16]byte
+	var bs []byte
+	bs = b[:16]
+	tmp32 := t.Term
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.CandidateId
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.LastLogIndex
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.LastLogTerm
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *RequestVote) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	var bs []byte
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.Term = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.CandidateId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.LastLogIndex = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.LastLogTerm = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	return nil
+}
+
+func (t *RequestVoteReply) New() fastrpc.Serializable {
+	return new(RequestVoteReply)
+}
+func (t *RequestVoteReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 9, true
+}
+
+type RequestVoteReplyCache struct {
+	mu    sync.Mutex
+	cache []*RequestVoteReply
+}
+
+func NewRequestVoteReplyCache() *RequestVoteReplyCache {
+	c := &RequestVoteReplyCache{}
+	c.cache = make([]*RequestVoteReply, 0)
+	return c
+}
+
+func (p *RequestVoteReplyCache) Get() *RequestVoteReply {
+	var t *RequestVoteReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &RequestVoteReply{}
+	}
+	return t
+}
+func (p *RequestVoteReplyCache) Put(t *RequestVoteReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *RequestVoteReply) Marshal(wire io.Writer) {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	tmp32 := t.Term
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.VoterId
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.VoteGranted)
+	wire.Write(bs)
+}
+
+func (t *RequestVoteReply) Unmarshal(wire io.Reader) error {
+	var b [9]byte
+	var bs []byte
+	bs = b[:9]
+	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+		return err
+	}
+	t.Term = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.VoterId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.VoteGranted = uint8(bs[8])
+	return nil
+}
+
+func (t *AppendEntries) New() fastrpc.Serializable {
+	return new(AppendEntries)
+}
+func (t *AppendEntries) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AppendEntriesCache struct {
+	mu    sync.Mutex
+	cache []*AppendEntries
+}
+
+func NewAppendEntriesCache() *AppendEntriesCache {
+	c := &AppendEntriesCache{}
+	c.cache = make([]*AppendEntries, 0)
+	return c
+}
+
+func (p *AppendEntriesCache) Get() *AppendEntries {
+	var t *AppendEntries
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AppendEntries{}
+	}
+	return t
+}
+func (p *AppendEntriesCache) Put(t *AppendEntries) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AppendEntries) Marshal(wire io.Writer) {
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	tmp32 := t.Term
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.LeaderId
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	tmp32 = t.PrevLogIndex
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.PrevLogTerm
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	tmp32 = t.LeaderCommit
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.Entries))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.Entries[i].Marshal(wire)
+	}
+}
+
+func (t *AppendEntries) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [20]byte
+	var bs []byte
+	bs = b[:20]
+	if _, err := io.ReadAtLeast(wire, bs, 20); err != nil {
+		return err
+	}
+	t.Term = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.LeaderId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.PrevLogIndex = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.PrevLogTerm = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
+	t.LeaderCommit = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]Entry, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.Entries[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Entry) Marshal(wire io.Writer) {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	tmp32 := t.Term
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	t.Command.Marshal(wire)
+}
+
+func (t *Entry) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	var bs []byte
+	bs = b[:4]
+	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+		return err
+	}
+	t.Term = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *AppendEntriesReply) New() fastrpc.Serializable {
+	return new(AppendEntriesReply)
+}
+func (t *AppendEntriesReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 13, true
+}
+
+type AppendEntriesReplyCache struct {
+	mu    sync.Mutex
+	cache []*AppendEntriesReply
+}
+
+func NewAppendEntriesReplyCache() *AppendEntriesReplyCache {
+	c := &AppendEntriesReplyCache{}
+	c.cache = make([]*AppendEntriesReply, 0)
+	return c
+}
+
+func (p *AppendEntriesReplyCache) Get() *AppendEntriesReply {
+	var t *AppendEntriesReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AppendEntriesReply{}
+	}
+	return t
+}
+func (p *AppendEntriesReplyCache) Put(t *AppendEntriesReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AppendEntriesReply) Marshal(wire io.Writer) {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	tmp32 := t.Term
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.FollowerId
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	bs[8] = byte(t.Success)
+	tmp32 = t.MatchIndex
+	bs[9] = byte(tmp32)
+	bs[10] = byte(tmp32 >> 8)
+	bs[11] = byte(tmp32 >> 16)
+	bs[12] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *AppendEntriesReply) Unmarshal(wire io.Reader) error {
+	var b [13]byte
+	var bs []byte
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.Term = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.FollowerId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	t.Success = uint8(bs[8])
+	t.MatchIndex = int32((uint32(bs[9]) | (uint32(bs[10]) << 8) | (uint32(bs[11]) << 16) | (uint32(bs[12]) << 24)))
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"gus-epaxos/src/abd"
 	"gus-epaxos/src/epaxos"
 	"gus-epaxos/src/fastpaxos"
 	"gus-epaxos/src/gpaxos"
@@ -10,6 +11,7 @@ import (
 	"gus-epaxos/src/masterproto"
 	"gus-epaxos/src/mencius"
 	"gus-epaxos/src/paxos"
+	"gus-epaxos/src/raft"
 	"log"
 	"net"
 	"net/http"
@@ -31,13 +33,21 @@ var doMencius *bool = flag.Bool("m", false, "Use Mencius as the replication prot
 var doGpaxos *bool = flag.Bool("g", false, "Use Generalized Paxos as the replication protocol. Defaults to false.")
 var doEpaxos *bool = flag.Bool("e", false, "Use EPaxos as the replication protocol. Defaults to false.")
 var doFastpaxos *bool = flag.Bool("f", false, "Use Fast Paxos as the replication protocol. Defaults to false.")
+var doRaft *bool = flag.Bool("raft", false, "Use Raft as the replication protocol. Defaults to false.")
+var doAbd *bool = flag.Bool("abd", false, "Use multi-writer ABD as the replication protocol. Defaults to false.")
 var procs *int = flag.Int("p", 2, "GOMAXPROCS. Defaults to 2")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var thrifty = flag.Bool("thrifty", false, "Use only as many messages as strictly required for inter-replica communication.")
 var exec = flag.Bool("exec", false, "Execute commands.")
 var dreply = flag.Bool("dreply", true, "Reply to client only after command has been executed.")
-var beacon = flag.Bool("beacon", false, "Send beacons to other replicas to compare their relative speeds.")
+var beacon = flag.Bool("beacon", false, "Send beacons to other replicas to compare their relative speeds. EPaxos always does in thrifty mode.")
 var durable = flag.Bool("durable", false, "Log to a stable store (i.e., a file in the current dir).")
+var antiEntropy = flag.Bool("antientropy", false, "Gus only: exchange digests with the other replicas in the background, and repair the keys they lack.")
+var leases = flag.Bool("leases", false, "Gus, EPaxos and Paxos only: serve reads locally at replicas holding a lease (EPaxos and Paxos also need -exec).")
+var batch = flag.Int("batch", 1, "EPaxos, Paxos, Mencius and Raft only: maximum number of commands per instance. Defaults to 1 (no batching).")
+var batchDelay = flag.Duration("batchdelay", time.Millisecond, "EPaxos, Paxos, Mencius and Raft only: longest a command waits for its batch to fill up.")
+var window = flag.Int("window", 0, "Paxos only: maximum number of uncommitted instances at the leader. Defaults to 0 (no limit).")
+var forward = flag.Bool("forward", true, "Paxos only: followers forward client proposals to the leader, instead of redirecting the clients.")
 
 func main() {
 	flag.Parse()
@@ -62,7 +72,7 @@ func main() {
 
 	if *doGus {
 		log.Println("Starting Gus replica...")
-		rep := gus.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable)
+		rep := gus.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *beacon, *durable, *leases, *antiEntropy)
 		rpc.Register(rep)
 	} else if *doFastpaxos {
 		log.Println("Starting Fast Paxos replica...")
@@ -70,19 +80,27 @@ func main() {
 		rpc.Register(rep)
 	} else if *doEpaxos {
 		log.Println("Starting Egalitarian Paxos replica...")
-		rep := epaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *beacon, *durable)
+		rep := epaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *beacon, *durable, *leases, *batch, *batchDelay)
 		rpc.Register(rep)
 	} else if *doMencius {
 		log.Println("Starting Mencius replica...")
-		rep := mencius.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable)
+		rep := mencius.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable, *batch, *batchDelay)
 		rpc.Register(rep)
 	} else if *doGpaxos {
 		log.Println("Starting Generalized Paxos replica...")
-		rep := gpaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply)
+		rep := gpaxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable)
+		rpc.Register(rep)
+	} else if *doRaft {
+		log.Println("Starting Raft replica...")
+		rep := raft.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable, *batch, *batchDelay)
+		rpc.Register(rep)
+	} else if *doAbd {
+		log.Println("Starting ABD replica...")
+		rep := abd.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable)
 		rpc.Register(rep)
 	} else {
 		log.Println("Starting classic Paxos replica...")
-		rep := paxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable)
+		rep := paxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable, *leases, *forward, *batch, *batchDelay, *window)
 		rpc.Register(rep)
 	}
 